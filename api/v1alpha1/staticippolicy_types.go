@@ -0,0 +1,126 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// SelectionStrategy is the strategy to select an IPPool among the ones matching a pool selector
+// +kubebuilder:validation:Enum=FirstFit;MostFree;RoundRobin;Spread
+type SelectionStrategy string
+
+const (
+	// FirstFitStrategy selects the first matching IPPool with a free address
+	FirstFitStrategy SelectionStrategy = "FirstFit"
+
+	// MostFreeStrategy selects the matching IPPool with the most free addresses
+	MostFreeStrategy SelectionStrategy = "MostFree"
+
+	// RoundRobinStrategy selects the matching IPPools with a free address in turn
+	RoundRobinStrategy SelectionStrategy = "RoundRobin"
+
+	// SpreadStrategy selects the matching IPPool with a free address and the fewest addresses allocated to the
+	// MachineDeployment, or to the control plane, of the machine, or to the Cluster for the other consumers
+	SpreadStrategy SelectionStrategy = "Spread"
+)
+
+// PoolSelector selects the IPPools by name, or by labels
+type PoolSelector struct {
+	// Name of the IPPool, in the IPPool namespace of the Cluster, or in the global IPPool namespace
+	// +optional
+	Name string `json:"name,omitempty"`
+
+	// Selector of the labels of the IPPools
+	// +optional
+	Selector *metav1.LabelSelector `json:"selector,omitempty"`
+}
+
+// RolePolicy overrides the IPPool selection of the policy for the machines of a role
+type RolePolicy struct {
+	// PoolSelectors are the ordered selectors of the IPPools, the IPPools of a selector are used once the IPPools of
+	// the previous selectors have no free address
+	// +optional
+	PoolSelectors []PoolSelector `json:"poolSelectors,omitempty"`
+
+	// Strategy to select an IPPool among the ones matching a pool selector, defaults to the strategy of the policy
+	// +optional
+	Strategy SelectionStrategy `json:"strategy,omitempty"`
+}
+
+// StaticIPPolicySpec defines the IPPools the static IPs of the selected machines are allocated from
+type StaticIPPolicySpec struct {
+	// NamespaceSelector selects the namespaces of the Clusters the policy applies to. It is only used for the
+	// policies in the global IPPool namespace, the other policies apply to the Clusters of their namespace.
+	// +optional
+	NamespaceSelector *metav1.LabelSelector `json:"namespaceSelector,omitempty"`
+
+	// ClusterSelector selects the Clusters the policy applies to, all the Clusters if not set
+	// +optional
+	ClusterSelector *metav1.LabelSelector `json:"clusterSelector,omitempty"`
+
+	// TemplateSelector selects the VSphereMachineTemplates the machines are cloned from, all the machines if not set
+	// +optional
+	TemplateSelector *metav1.LabelSelector `json:"templateSelector,omitempty"`
+
+	// Priority of the policy, the policy with the highest priority applies when several policies select a machine
+	// +optional
+	Priority int32 `json:"priority,omitempty"`
+
+	// PoolSelectors are the ordered selectors of the IPPools, the IPPools of a selector are used once the IPPools of
+	// the previous selectors have no free address
+	PoolSelectors []PoolSelector `json:"poolSelectors"`
+
+	// Strategy to select an IPPool among the ones matching a pool selector
+	// +kubebuilder:default=FirstFit
+	// +optional
+	Strategy SelectionStrategy `json:"strategy,omitempty"`
+
+	// ControlPlane overrides the IPPool selection for the control plane machines
+	// +optional
+	ControlPlane *RolePolicy `json:"controlPlane,omitempty"`
+
+	// Workers overrides the IPPool selection for the worker machines
+	// +optional
+	Workers *RolePolicy `json:"workers,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:printcolumn:name="Strategy",type="string",JSONPath=".spec.strategy"
+// +kubebuilder:printcolumn:name="Priority",type="integer",JSONPath=".spec.priority"
+// +kubebuilder:printcolumn:name="Age",type="date",JSONPath=".metadata.creationTimestamp"
+
+// StaticIPPolicy is the Schema for the staticippolicies API
+type StaticIPPolicy struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec StaticIPPolicySpec `json:"spec,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// StaticIPPolicyList contains a list of StaticIPPolicy
+type StaticIPPolicyList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []StaticIPPolicy `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&StaticIPPolicy{}, &StaticIPPolicyList{})
+}
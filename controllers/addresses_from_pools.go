@@ -0,0 +1,177 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+	"github.com/spectrocloud/cluster-api-provider-vsphere-static-ip/pkg/ipam"
+	"github.com/spectrocloud/cluster-api-provider-vsphere-static-ip/pkg/util"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/sets"
+	infrav1 "sigs.k8s.io/cluster-api-provider-vsphere/api/v1beta1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	addressesFromPoolsField = "addressesFromPools"
+
+	// vSphereMachineCRDName is the name of the capv VSphereMachine CustomResourceDefinition
+	vSphereMachineCRDName = "vspheremachines.infrastructure.cluster.x-k8s.io"
+)
+
+// networkDevicesPath is the path of the network devices in the VSphereMachine
+var networkDevicesPath = []string{"spec", "network", "devices"}
+
+// SupportsAddressesFromPools checks if the installed capv VSphereMachine CRD has the 'addressesFromPools' field in the
+// network devices of the vendored capv api version, which is unknown to the vendored capv and pruned by older versions
+func SupportsAddressesFromPools(ctx context.Context, cli client.Reader) (bool, error) {
+	crd := &unstructured.Unstructured{}
+	crd.SetGroupVersionKind(schema.GroupVersionKind{Group: "apiextensions.k8s.io", Version: "v1", Kind: "CustomResourceDefinition"})
+	if err := cli.Get(ctx, client.ObjectKey{Name: vSphereMachineCRDName}, crd); err != nil {
+		return false, errors.Wrapf(err, "failed to get CustomResourceDefinition %s", vSphereMachineCRDName)
+	}
+
+	versions, _, err := unstructured.NestedSlice(crd.Object, "spec", "versions")
+	if err != nil {
+		return false, errors.Wrapf(err, "failed to get the versions of CustomResourceDefinition %s", vSphereMachineCRDName)
+	}
+	for _, v := range versions {
+		version, ok := v.(map[string]interface{})
+		if !ok || version["name"] != infrav1.GroupVersion.Version {
+			continue
+		}
+		_, found, err := unstructured.NestedMap(version, "schema", "openAPIV3Schema", "properties", "spec", "properties",
+			"network", "properties", "devices", "items", "properties", addressesFromPoolsField)
+		return found && err == nil, nil
+	}
+
+	return false, nil
+}
+
+// getUnstructuredObject gets the object as unstructured, to keep the fields unknown to the vendored capv api, such as
+// the 'addressesFromPools' of the network devices in the newer capv versions
+func getUnstructuredObject(cli client.Client, obj client.Object) (*unstructured.Unstructured, error) {
+	u := &unstructured.Unstructured{}
+	u.SetGroupVersionKind(obj.GetObjectKind().GroupVersionKind())
+	if err := cli.Get(context.Background(), client.ObjectKeyFromObject(obj), u); err != nil {
+		return nil, err
+	}
+
+	return u, nil
+}
+
+// getAddressesFromPoolsDevices gets the indexes of the network devices which delegate the ip allocation to capv, by
+// referencing the pools in 'addressesFromPools'
+func getAddressesFromPoolsDevices(u *unstructured.Unstructured) (sets.Int, error) {
+	devices, _, err := unstructured.NestedSlice(u.Object, networkDevicesPath...)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get network devices of %s", u.GetName())
+	}
+
+	delegated := sets.NewInt()
+	for i := range devices {
+		device, ok := devices[i].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if pools, ok := device[addressesFromPoolsField].([]interface{}); ok && len(pools) > 0 {
+			delegated.Insert(i)
+		}
+	}
+
+	return delegated, nil
+}
+
+// isNetworkDevicesIPAllocated checks if all the non-DHCP network devices are assigned an IP or delegated to capv
+func isNetworkDevicesIPAllocated(devices []infrav1.NetworkDeviceSpec, delegated sets.Int) bool {
+	for i := range devices {
+		if util.IsDeviceIPAllocationDHCP(devices[i]) || delegated.Has(i) {
+			continue
+		}
+		if len(devices[i].IPAddrs) == 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// setAddressesFromPools references the pool of the capi ipam contract, of the kind, with the name of the IPPool, in the
+// 'addressesFromPools' of the unassigned non-DHCP network devices, which are not yet delegated to capv
+func setAddressesFromPools(u *unstructured.Unstructured, devices []infrav1.NetworkDeviceSpec, delegated sets.Int,
+	ipPool ipam.IPPool, poolKind schema.GroupKind) error {
+	if ipPool.GetNamespace() != u.GetNamespace() {
+		return errors.Errorf("IPPool %s/%s must be in the namespace of %s to be referenced in addressesFromPools",
+			ipPool.GetNamespace(), ipPool.GetName(), u.GetName())
+	}
+
+	poolRef := corev1.TypedLocalObjectReference{APIGroup: &poolKind.Group, Kind: poolKind.Kind, Name: ipPool.GetName()}
+	ref, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&poolRef)
+	if err != nil {
+		return errors.Wrapf(err, "failed to convert the reference to %s %s", poolKind.Kind, ipPool.GetName())
+	}
+
+	rawDevices, _, err := unstructured.NestedSlice(u.Object, networkDevicesPath...)
+	if err != nil {
+		return errors.Wrapf(err, "failed to get network devices of %s", u.GetName())
+	}
+
+	for i := range devices {
+		if i >= len(rawDevices) || util.IsDeviceIPAllocationDHCP(devices[i]) || delegated.Has(i) || len(devices[i].IPAddrs) > 0 {
+			continue
+		}
+		if device, ok := rawDevices[i].(map[string]interface{}); ok {
+			device[addressesFromPoolsField] = []interface{}{ref}
+		}
+	}
+
+	return unstructured.SetNestedSlice(u.Object, rawDevices, networkDevicesPath...)
+}
+
+// mergeNetworkDevices sets the fields of the assigned network devices in the unstructured object, keeping the fields
+// unknown to the vendored capv api
+func mergeNetworkDevices(u *unstructured.Unstructured, devices []infrav1.NetworkDeviceSpec, delegated sets.Int) error {
+	rawDevices, _, err := unstructured.NestedSlice(u.Object, networkDevicesPath...)
+	if err != nil {
+		return errors.Wrapf(err, "failed to get network devices of %s", u.GetName())
+	}
+
+	for i := range devices {
+		if i >= len(rawDevices) || delegated.Has(i) {
+			continue
+		}
+		device, ok := rawDevices[i].(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		fields, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&devices[i])
+		if err != nil {
+			return errors.Wrapf(err, "failed to convert network device of %s", u.GetName())
+		}
+		for k, v := range fields {
+			device[k] = v
+		}
+	}
+
+	return unstructured.SetNestedSlice(u.Object, rawDevices, networkDevicesPath...)
+}
@@ -0,0 +1,113 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	ipamv1 "github.com/metal3-io/ip-address-manager/api/v1alpha1"
+	"github.com/spectrocloud/cluster-api-provider-vsphere-static-ip/pkg/ipam/metal3io"
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	infrav1 "sigs.k8s.io/cluster-api-provider-vsphere/api/v1beta1"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func newUnstructuredVSphereMachine(devices ...interface{}) *unstructured.Unstructured {
+	u := &unstructured.Unstructured{Object: map[string]interface{}{
+		"spec": map[string]interface{}{
+			"network": map[string]interface{}{"devices": devices},
+		},
+	}}
+	u.SetName("vm")
+	u.SetNamespace("default")
+	return u
+}
+
+func TestAddressesFromPools(t *testing.T) {
+	poolRef := []interface{}{map[string]interface{}{"apiGroup": "ipam.cluster.x-k8s.io", "kind": "InClusterIPPool", "name": "pool"}}
+	poolKind := schema.GroupKind{Group: "ipam.cluster.x-k8s.io", Kind: "InClusterIPPool"}
+	devices := []infrav1.NetworkDeviceSpec{{NetworkName: "delegated"}, {NetworkName: "static"}, {NetworkName: "dhcp", DHCP4: true}}
+	newRaw := func() *unstructured.Unstructured {
+		return newUnstructuredVSphereMachine(
+			map[string]interface{}{"networkName": "delegated", addressesFromPoolsField: poolRef},
+			map[string]interface{}{"networkName": "static"},
+			map[string]interface{}{"networkName": "dhcp", "dhcp4": true},
+		)
+	}
+
+	delegated, err := getAddressesFromPoolsDevices(newRaw())
+	assert.NoError(t, err)
+	assert.Equal(t, []int{0}, delegated.List())
+	assert.False(t, isNetworkDevicesIPAllocated(devices, delegated))
+
+	t.Run("merge assigned devices and keep addressesFromPools", func(t *testing.T) {
+		assigned := make([]infrav1.NetworkDeviceSpec, len(devices))
+		copy(assigned, devices)
+		assigned[1].IPAddrs = []string{"10.10.100.20/18"}
+		assigned[1].Gateway4 = "10.10.100.1"
+		assert.True(t, isNetworkDevicesIPAllocated(assigned, delegated))
+
+		raw := newRaw()
+		assert.NoError(t, mergeNetworkDevices(raw, assigned, delegated))
+		rawDevices, _, _ := unstructured.NestedSlice(raw.Object, networkDevicesPath...)
+		assert.Equal(t, poolRef, rawDevices[0].(map[string]interface{})[addressesFromPoolsField])
+		assert.Equal(t, []interface{}{"10.10.100.20/18"}, rawDevices[1].(map[string]interface{})["ipAddrs"])
+		assert.Equal(t, "10.10.100.1", rawDevices[1].(map[string]interface{})["gateway4"])
+	})
+
+	t.Run("reference the IPPool in the unassigned devices", func(t *testing.T) {
+		raw := newRaw()
+		pool := metal3io.NewIPPool(ipamv1.IPPool{ObjectMeta: metav1.ObjectMeta{Name: "ip-pool", Namespace: "default"}}, nil)
+		assert.NoError(t, setAddressesFromPools(raw, devices, delegated, pool, poolKind))
+		rawDevices, _, _ := unstructured.NestedSlice(raw.Object, networkDevicesPath...)
+		assert.Equal(t, poolRef, rawDevices[0].(map[string]interface{})[addressesFromPoolsField])
+		//the pool of the capi ipam contract with the name of the IPPool is referenced
+		assert.Equal(t, []interface{}{map[string]interface{}{"apiGroup": "ipam.cluster.x-k8s.io", "kind": "InClusterIPPool", "name": "ip-pool"}},
+			rawDevices[1].(map[string]interface{})[addressesFromPoolsField])
+		assert.NotContains(t, rawDevices[2].(map[string]interface{}), addressesFromPoolsField)
+	})
+
+	t.Run("IPPool in another namespace can not be referenced", func(t *testing.T) {
+		pool := metal3io.NewIPPool(ipamv1.IPPool{ObjectMeta: metav1.ObjectMeta{Name: "ip-pool", Namespace: "pools"}}, nil)
+		assert.Error(t, setAddressesFromPools(newRaw(), devices, delegated, pool, poolKind))
+	})
+}
+
+func TestSupportsAddressesFromPools(t *testing.T) {
+	newCRD := func(deviceProperties map[string]interface{}) *unstructured.Unstructured {
+		version := func(name string, deviceProperties map[string]interface{}) interface{} {
+			return map[string]interface{}{"name": name, "schema": map[string]interface{}{"openAPIV3Schema": map[string]interface{}{
+				"properties": map[string]interface{}{"spec": map[string]interface{}{"properties": map[string]interface{}{
+					"network": map[string]interface{}{"properties": map[string]interface{}{
+						"devices": map[string]interface{}{"items": map[string]interface{}{"properties": deviceProperties}}}}}}}}}}
+		}
+		crd := &unstructured.Unstructured{Object: map[string]interface{}{"spec": map[string]interface{}{"versions": []interface{}{
+			version("v1alpha3", map[string]interface{}{addressesFromPoolsField: map[string]interface{}{"type": "array"}}),
+			version(infrav1.GroupVersion.Version, deviceProperties),
+		}}}}
+		crd.SetAPIVersion("apiextensions.k8s.io/v1")
+		crd.SetKind("CustomResourceDefinition")
+		crd.SetName(vSphereMachineCRDName)
+		return crd
+	}
+
+	//capv v1.0 has no addressesFromPools in the vendored api version
+	cli := fake.NewClientBuilder().WithScheme(runtime.NewScheme()).WithObjects(
+		newCRD(map[string]interface{}{"networkName": map[string]interface{}{"type": "string"}})).Build()
+	supported, err := SupportsAddressesFromPools(context.Background(), cli)
+	assert.NoError(t, err)
+	assert.False(t, supported)
+
+	cli = fake.NewClientBuilder().WithScheme(runtime.NewScheme()).WithObjects(
+		newCRD(map[string]interface{}{addressesFromPoolsField: map[string]interface{}{"type": "array"}})).Build()
+	supported, err = SupportsAddressesFromPools(context.Background(), cli)
+	assert.NoError(t, err)
+	assert.True(t, supported)
+
+	//the CRD is required
+	_, err = SupportsAddressesFromPools(context.Background(), fake.NewClientBuilder().WithScheme(runtime.NewScheme()).Build())
+	assert.Error(t, err)
+}
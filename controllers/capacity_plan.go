@@ -0,0 +1,338 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+
+	"github.com/go-logr/logr"
+	"github.com/pkg/errors"
+	"github.com/spectrocloud/cluster-api-provider-vsphere-static-ip/pkg/ipam"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/serializer"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	utilyaml "k8s.io/apimachinery/pkg/util/yaml"
+	infrav1alpha3 "sigs.k8s.io/cluster-api-provider-vsphere/api/v1alpha3"
+	infrav1 "sigs.k8s.io/cluster-api-provider-vsphere/api/v1beta1"
+	capi "sigs.k8s.io/cluster-api/api/v1beta1"
+	kubeadmcontrolplane "sigs.k8s.io/cluster-api/controlplane/kubeadm/api/v1beta1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// CapacityPlanPath is the path of the capacity plan endpoint, served along with the metrics
+const CapacityPlanPath = "/ipam/plan"
+
+// maxManifestsSize is the maximum size of the manifests posted to the capacity plan endpoint
+const maxManifestsSize = 10 << 20
+
+// CapacityPlanHandler plans the addresses of a cluster before it is created: the manifests of the cluster posted to it
+// are resolved to the IPPools their addresses would be allocated from, as by the reconcilers, and the demand for the
+// addresses of each IPPool is reported against its free addresses. No address is allocated.
+type CapacityPlanHandler struct {
+	client.Client
+	Log    logr.Logger
+	Scheme *runtime.Scheme
+	// IPAM allocates the static IPs, it is shared by the reconcilers for the allocations from an IPPool to be serialized
+	IPAM ipam.IPAddressManager
+}
+
+// clusterManifests are the objects of a cluster involved in the allocation of its addresses
+type clusterManifests struct {
+	cluster              *capi.Cluster
+	vSphereClusters      []*infrav1.VSphereCluster
+	controlPlanes        []*kubeadmcontrolplane.KubeadmControlPlane
+	machineDeployments   []*capi.MachineDeployment
+	templates            map[types.NamespacedName]*infrav1.VSphereMachineTemplate
+	haproxyLoadBalancers []*infrav1alpha3.HAProxyLoadBalancer
+}
+
+func (h *CapacityPlanHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "the manifests of the cluster must be posted", http.StatusMethodNotAllowed)
+		return
+	}
+
+	//the objects without a namespace are planned in the namespace of the request, as by kubectl apply
+	namespace := req.URL.Query().Get("namespace")
+	if namespace == "" {
+		namespace = metav1.NamespaceDefault
+	}
+	manifests, err := decodeClusterManifests(h.Scheme, http.MaxBytesReader(w, req.Body, maxManifestsSize), namespace)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	log := h.Log.WithValues("cluster", manifests.cluster.Name, "namespace", manifests.cluster.Namespace)
+	plan, err := h.planCapacity(manifests)
+	if err != nil {
+		log.Error(err, "failed to plan the capacity of the IPPools")
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(plan); err != nil {
+		log.Error(err, "failed to write the capacity plan")
+	}
+}
+
+// planCapacity gets the demand for addresses of the control plane endpoint and of the machines of the cluster, and plans
+// it in the IPPools
+func (h *CapacityPlanHandler) planCapacity(manifests *clusterManifests) (*ipam.CapacityPlan, error) {
+	demands, err := h.getAddressDemands(manifests)
+	if err != nil {
+		return nil, err
+	}
+
+	return ipam.PlanCapacity(h.IPAM, demands, manifests.cluster.ObjectMeta)
+}
+
+// getAddressDemands gets the demand for addresses of the control plane endpoint, of the KubeadmControlPlane and of the
+// MachineDeployments of the cluster, with the IPPool match labels of their reconcilers
+func (h *CapacityPlanHandler) getAddressDemands(manifests *clusterManifests) ([]ipam.AddressDemand, error) {
+	cluster := manifests.cluster
+	demands := []ipam.AddressDemand{}
+
+	//the control plane endpoint is allocated to the VSphereCluster without a host, unless load balanced by HAProxy
+	if vSphereCluster := manifests.getVSphereCluster(); vSphereCluster != nil && vSphereCluster.Spec.ControlPlaneEndpoint.Host == "" &&
+		!manifests.hasHAProxyLoadBalancer() {
+		poolMatchLabels, selection, err := getVIPIPPoolSelection(h.Client, h.IPAM.GetOptions().GlobalIPPoolNamespace, cluster.ObjectMeta,
+			machineRoleControlPlane, vSphereCluster.Labels, ipam.SelectionOptions{})
+		if err != nil {
+			return nil, err
+		}
+		demands = append(demands, ipam.AddressDemand{
+			Consumer:        "VSphereCluster " + vSphereCluster.Name,
+			Addresses:       1,
+			PoolMatchLabels: poolMatchLabels,
+			Selection:       selection,
+		})
+	}
+
+	if kcp := manifests.getControlPlane(); kcp != nil {
+		template, err := h.getTemplate(manifests, kcp.Namespace, kcp.Spec.MachineTemplate.InfrastructureRef)
+		if err != nil {
+			return nil, err
+		}
+		if template != nil {
+			addresses, err := getControlPlaneAddressCount(kcp, template)
+			if err != nil {
+				return nil, err
+			}
+			poolMatchLabels, selection, err := getMachineGroupIPPoolMatchLabels(h.Client, h.IPAM.GetOptions().GlobalIPPoolNamespace, cluster, kcp, template, machineRoleControlPlane, "")
+			if err != nil {
+				return nil, err
+			}
+			demands = append(demands, ipam.AddressDemand{
+				Consumer:        "KubeadmControlPlane " + kcp.Name,
+				Addresses:       addresses,
+				PoolMatchLabels: poolMatchLabels,
+				Selection:       selection,
+			})
+		}
+	}
+
+	for _, md := range manifests.machineDeployments {
+		if md.Spec.ClusterName != cluster.Name {
+			continue
+		}
+		template, err := h.getTemplate(manifests, md.Namespace, md.Spec.Template.Spec.InfrastructureRef)
+		if err != nil {
+			return nil, err
+		}
+		if template == nil {
+			continue
+		}
+		addresses, err := getIPBlockSize(md, template)
+		if err != nil {
+			return nil, err
+		}
+		failureDomain := ""
+		if md.Spec.Template.Spec.FailureDomain != nil {
+			failureDomain = *md.Spec.Template.Spec.FailureDomain
+		}
+		poolMatchLabels, selection, err := getMachineGroupIPPoolMatchLabels(h.Client, h.IPAM.GetOptions().GlobalIPPoolNamespace, cluster, md, template, machineRoleWorker, failureDomain)
+		if err != nil {
+			return nil, err
+		}
+		demands = append(demands, ipam.AddressDemand{
+			Consumer:        "MachineDeployment " + md.Name,
+			Addresses:       addresses,
+			PoolMatchLabels: poolMatchLabels,
+			Selection:       selection,
+		})
+	}
+
+	return demands, nil
+}
+
+// getTemplate gets the VSphereMachineTemplate referenced by the machines of a group, from the manifests or else from
+// the API server, nil if the machines are not VSphereMachines
+func (h *CapacityPlanHandler) getTemplate(manifests *clusterManifests, ownerNamespace string,
+	ref corev1.ObjectReference) (*infrav1.VSphereMachineTemplate, error) {
+	if ref.Kind != "VSphereMachineTemplate" {
+		return nil, nil
+	}
+	namespace := ref.Namespace
+	if namespace == "" {
+		namespace = ownerNamespace
+	}
+
+	key := types.NamespacedName{Namespace: namespace, Name: ref.Name}
+	if template, ok := manifests.templates[key]; ok {
+		return template, nil
+	}
+	template := &infrav1.VSphereMachineTemplate{}
+	if err := h.Get(context.TODO(), key, template); err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil, errors.Errorf("VSphereMachineTemplate %s not found in the manifests nor in namespace %s", ref.Name, namespace)
+		}
+		return nil, errors.Wrapf(err, "failed to get VSphereMachineTemplate %s", ref.Name)
+	}
+
+	return template, nil
+}
+
+// getVSphereCluster gets the VSphereCluster referenced by the cluster, nil if not in the manifests
+func (m *clusterManifests) getVSphereCluster() *infrav1.VSphereCluster {
+	ref := m.cluster.Spec.InfrastructureRef
+	if ref == nil || ref.Kind != "VSphereCluster" {
+		return nil
+	}
+	for _, vSphereCluster := range m.vSphereClusters {
+		if vSphereCluster.Name == ref.Name && vSphereCluster.Namespace == m.cluster.Namespace {
+			return vSphereCluster
+		}
+	}
+	return nil
+}
+
+// getControlPlane gets the KubeadmControlPlane referenced by the cluster, nil if not in the manifests
+func (m *clusterManifests) getControlPlane() *kubeadmcontrolplane.KubeadmControlPlane {
+	ref := m.cluster.Spec.ControlPlaneRef
+	if ref == nil || ref.Kind != "KubeadmControlPlane" {
+		return nil
+	}
+	for _, kcp := range m.controlPlanes {
+		if kcp.Name == ref.Name && kcp.Namespace == m.cluster.Namespace {
+			return kcp
+		}
+	}
+	return nil
+}
+
+// hasHAProxyLoadBalancer checks if the manifests have an HAProxyLoadBalancer for the cluster
+func (m *clusterManifests) hasHAProxyLoadBalancer() bool {
+	for _, lb := range m.haproxyLoadBalancers {
+		if lb.Namespace == m.cluster.Namespace && lb.Labels[capi.ClusterLabelName] == m.cluster.Name {
+			return true
+		}
+	}
+	return false
+}
+
+// decodeClusterManifests decodes the multi-document yaml manifests of a cluster, skipping the objects of the kinds not
+// involved in the allocation of its addresses
+func decodeClusterManifests(scheme *runtime.Scheme, r io.Reader, namespace string) (*clusterManifests, error) {
+	manifests := &clusterManifests{templates: map[types.NamespacedName]*infrav1.VSphereMachineTemplate{}}
+	decoder := serializer.NewCodecFactory(scheme).UniversalDeserializer()
+
+	reader := utilyaml.NewYAMLReader(bufio.NewReader(r))
+	for {
+		doc, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read the manifests")
+		}
+		if len(bytes.TrimSpace(doc)) == 0 {
+			continue
+		}
+
+		obj, _, err := decoder.Decode(doc, nil, nil)
+		if runtime.IsNotRegisteredError(err) {
+			continue
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to decode the manifests")
+		}
+		if o, ok := obj.(client.Object); ok && o.GetNamespace() == "" {
+			o.SetNamespace(namespace)
+		}
+
+		switch o := obj.(type) {
+		case *capi.Cluster:
+			if manifests.cluster != nil {
+				return nil, errors.New("the manifests must contain a single Cluster")
+			}
+			manifests.cluster = o
+		case *infrav1.VSphereCluster:
+			manifests.vSphereClusters = append(manifests.vSphereClusters, o)
+		case *kubeadmcontrolplane.KubeadmControlPlane:
+			manifests.controlPlanes = append(manifests.controlPlanes, o)
+		case *capi.MachineDeployment:
+			manifests.machineDeployments = append(manifests.machineDeployments, o)
+		case *infrav1.VSphereMachineTemplate:
+			manifests.templates[client.ObjectKeyFromObject(o)] = o
+		case *infrav1alpha3.HAProxyLoadBalancer:
+			manifests.haproxyLoadBalancers = append(manifests.haproxyLoadBalancers, o)
+		}
+	}
+
+	if manifests.cluster == nil {
+		return nil, errors.New("the manifests must contain a Cluster")
+	}
+
+	return manifests, nil
+}
+
+// getControlPlaneAddressCount gets the number of static addresses of the machines of the KubeadmControlPlane, for its
+// replicas and the surge of its rolling update, of one machine by default
+func getControlPlaneAddressCount(kcp *kubeadmcontrolplane.KubeadmControlPlane, template *infrav1.VSphereMachineTemplate) (int, error) {
+	addresses, err := getMachineAddressCount(template)
+	if err != nil {
+		return 0, err
+	}
+
+	replicas := 1
+	if kcp.Spec.Replicas != nil {
+		replicas = int(*kcp.Spec.Replicas)
+	}
+
+	maxSurge := intstr.FromInt(1)
+	if strategy := kcp.Spec.RolloutStrategy; strategy != nil && strategy.RollingUpdate != nil && strategy.RollingUpdate.MaxSurge != nil {
+		maxSurge = *strategy.RollingUpdate.MaxSurge
+	}
+	surge, err := intstr.GetScaledValueFromIntOrPercent(&maxSurge, replicas, true)
+	if err != nil {
+		return 0, errors.Wrapf(err, "invalid maxSurge of KubeadmControlPlane %s", kcp.Name)
+	}
+
+	return (replicas + surge) * addresses, nil
+}
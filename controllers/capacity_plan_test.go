@@ -0,0 +1,173 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	ipamv1 "github.com/metal3-io/ip-address-manager/api/v1alpha1"
+	"github.com/spectrocloud/cluster-api-provider-vsphere-static-ip/pkg/ipam"
+	"github.com/spectrocloud/cluster-api-provider-vsphere-static-ip/pkg/ipam/metal3io"
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	infrav1 "sigs.k8s.io/cluster-api-provider-vsphere/api/v1beta1"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const capacityPlanManifests = `
+apiVersion: cluster.x-k8s.io/v1beta1
+kind: Cluster
+metadata:
+  name: cluster
+spec:
+  controlPlaneRef:
+    apiVersion: controlplane.cluster.x-k8s.io/v1beta1
+    kind: KubeadmControlPlane
+    name: cluster
+  infrastructureRef:
+    apiVersion: infrastructure.cluster.x-k8s.io/v1beta1
+    kind: VSphereCluster
+    name: cluster
+---
+apiVersion: infrastructure.cluster.x-k8s.io/v1beta1
+kind: VSphereCluster
+metadata:
+  name: cluster
+  labels:
+    cluster.x-k8s.io/ip-pool-group: control-plane
+spec:
+  server: vcenter
+---
+apiVersion: controlplane.cluster.x-k8s.io/v1beta1
+kind: KubeadmControlPlane
+metadata:
+  name: cluster
+spec:
+  replicas: 3
+  version: v1.22.4
+  machineTemplate:
+    infrastructureRef:
+      apiVersion: infrastructure.cluster.x-k8s.io/v1beta1
+      kind: VSphereMachineTemplate
+      name: control-plane
+  kubeadmConfigSpec: {}
+---
+apiVersion: infrastructure.cluster.x-k8s.io/v1beta1
+kind: VSphereMachineTemplate
+metadata:
+  name: control-plane
+  labels:
+    cluster.x-k8s.io/ip-pool-group: control-plane
+spec:
+  template:
+    spec:
+      network:
+        devices:
+        - networkName: static
+---
+apiVersion: bootstrap.cluster.x-k8s.io/v1beta1
+kind: KubeadmConfigTemplate
+metadata:
+  name: md-0
+spec:
+  template:
+    spec: {}
+---
+apiVersion: cluster.x-k8s.io/v1beta1
+kind: MachineDeployment
+metadata:
+  name: md-0
+spec:
+  clusterName: cluster
+  replicas: 2
+  selector: {}
+  template:
+    spec:
+      clusterName: cluster
+      bootstrap:
+        configRef:
+          kind: KubeadmConfigTemplate
+          name: md-0
+      infrastructureRef:
+        apiVersion: infrastructure.cluster.x-k8s.io/v1beta1
+        kind: VSphereMachineTemplate
+        name: worker
+`
+
+func TestCapacityPlanHandler(t *testing.T) {
+	s := newTestScheme(t)
+	assert.NoError(t, ipamv1.AddToScheme(s))
+
+	newPool := func(name, group string, end ipamv1.IPAddressStr) *ipamv1.IPPool {
+		start := ipamv1.IPAddressStr("10.10.100.20")
+		return &ipamv1.IPPool{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "tenant", Labels: map[string]string{ipam.ClusterIPPoolGroupKey: group}},
+			Spec:       ipamv1.IPPoolSpec{Pools: []ipamv1.Pool{{Start: &start, End: &end}}, Prefix: 24},
+		}
+	}
+	//the template of the workers is already created, outside the manifests
+	worker := &infrav1.VSphereMachineTemplate{ObjectMeta: metav1.ObjectMeta{Name: "worker", Namespace: "tenant",
+		Labels: map[string]string{ipam.ClusterIPPoolGroupKey: "workers"}}}
+	worker.Spec.Template.Spec.Network.Devices = []infrav1.NetworkDeviceSpec{{NetworkName: "static"}, {NetworkName: "dhcp", DHCP4: true}}
+	cli := fake.NewClientBuilder().WithScheme(s).WithObjects(
+		newPool("control-plane", "control-plane", "10.10.100.22"),
+		newPool("workers", "workers", "10.10.100.29"),
+		worker,
+	).Build()
+	handler := &CapacityPlanHandler{Client: cli, Log: log.NullLogger{}, Scheme: s, IPAM: metal3io.NewIpam(cli, cli, log.NullLogger{}, ipam.Options{})}
+
+	post := func(method, manifests string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, CapacityPlanPath+"?namespace=tenant", strings.NewReader(manifests))
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	//the control plane endpoint and the control plane machines with their surge exceed the control plane IPPool
+	rec := post(http.MethodPost, capacityPlanManifests)
+	assert.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	plan := &ipam.CapacityPlan{}
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), plan))
+	assert.False(t, plan.Fits)
+	assert.Empty(t, plan.Unresolved)
+	assert.Equal(t, []ipam.PoolCapacity{
+		{Namespace: "tenant", Name: "control-plane", Demand: 5, Free: 3, Fits: false, Consumers: []string{"VSphereCluster cluster", "KubeadmControlPlane cluster"}},
+		{Namespace: "tenant", Name: "workers", Demand: 3, Free: 10, Fits: true, Consumers: []string{"MachineDeployment md-0"}},
+	}, plan.Pools)
+
+	//nothing is allocated by the plan
+	claims := &ipamv1.IPClaimList{}
+	assert.NoError(t, cli.List(context.Background(), claims))
+	assert.Empty(t, claims.Items)
+
+	//the control plane fits without the surge and with the control plane endpoint set
+	manifests := strings.Replace(capacityPlanManifests, "  kubeadmConfigSpec: {}", `  kubeadmConfigSpec: {}
+  rolloutStrategy:
+    rollingUpdate:
+      maxSurge: 0`, 1)
+	manifests = strings.Replace(manifests, "  server: vcenter", `  server: vcenter
+  controlPlaneEndpoint:
+    host: 10.10.10.10
+    port: 6443`, 1)
+	rec = post(http.MethodPost, manifests)
+	assert.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	plan = &ipam.CapacityPlan{}
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), plan))
+	assert.True(t, plan.Fits)
+	assert.Equal(t, 3, plan.Pools[0].Demand)
+
+	//a template missing from the manifests and the namespace cannot be planned
+	rec = post(http.MethodPost, strings.Replace(capacityPlanManifests, "name: worker", "name: missing", 1))
+	assert.Equal(t, http.StatusUnprocessableEntity, rec.Code)
+
+	//the manifests must contain a Cluster
+	rec = post(http.MethodPost, "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: cm\n")
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	rec = post(http.MethodGet, "")
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+}
@@ -0,0 +1,149 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	"github.com/go-logr/logr"
+	"github.com/pkg/errors"
+	"github.com/spectrocloud/cluster-api-provider-vsphere-static-ip/pkg/ipam"
+	"github.com/spectrocloud/cluster-api-provider-vsphere-static-ip/pkg/ipam/prober"
+	"github.com/spectrocloud/cluster-api-provider-vsphere-static-ip/pkg/util"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
+	infrav1alpha3 "sigs.k8s.io/cluster-api-provider-vsphere/api/v1alpha3"
+	infrav1 "sigs.k8s.io/cluster-api-provider-vsphere/api/v1beta1"
+	capi "sigs.k8s.io/cluster-api/api/v1beta1"
+	clusterutilv1 "sigs.k8s.io/cluster-api/util"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// HAProxyLoadBalancerReconciler reconciles a HAProxyLoadBalancer object
+type HAProxyLoadBalancerReconciler struct {
+	client.Client
+	Log    logr.Logger
+	Scheme *runtime.Scheme
+	// IPAM allocates the static IPs, it is shared by the reconcilers for the allocations from an IPPool to be serialized
+	IPAM     ipam.IPAddressManager
+	Prober   prober.AddressProber
+	Recorder record.EventRecorder
+}
+
+// +kubebuilder:rbac:groups=infrastructure.cluster.x-k8s.io,resources=haproxyloadbalancers,verbs=get;list;watch;update;patch
+
+func (r *HAProxyLoadBalancerReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	log := r.Log.WithValues("haproxyloadbalancer", req.NamespacedName)
+	var res *ctrl.Result
+	var err error
+
+	haProxyLB := &infrav1alpha3.HAProxyLoadBalancer{}
+	if err := r.Get(ctx, req.NamespacedName, haProxyLB); err != nil {
+		return ctrl.Result{}, util.IgnoreNotFound(err)
+	}
+
+	//handle the case where gvk is empty
+	if haProxyLB.GroupVersionKind().Empty() {
+		log.V(0).Info("setting the missing gvk for HAProxyLoadBalancer")
+		haProxyLB.Kind = "HAProxyLoadBalancer"
+		haProxyLB.APIVersion = infrav1alpha3.GroupVersion.String()
+	}
+
+	// fetch the capi cluster
+	cluster, err := clusterutilv1.GetClusterFromMetadata(ctx, r.Client, haProxyLB.ObjectMeta)
+	if err != nil {
+		log.V(0).Info("HAProxyLoadBalancer is missing cluster label or cluster does not exist")
+		return ctrl.Result{}, nil
+	}
+
+	res, err = r.reconcileHAProxyLoadBalancerIPAddress(cluster, haProxyLB)
+	if err != nil {
+		log.Error(err, "failed to reconcile HAProxyLoadBalancer IP")
+	}
+
+	if res == nil {
+		res = &ctrl.Result{}
+	}
+
+	return *res, err
+}
+
+func (r *HAProxyLoadBalancerReconciler) reconcileHAProxyLoadBalancerIPAddress(cluster *capi.Cluster, haProxyLB *infrav1alpha3.HAProxyLoadBalancer) (*ctrl.Result, error) {
+	log := r.Log.WithValues("haProxyLoadBalancer", haProxyLB.Name, "namespace", haProxyLB.Namespace)
+	log.V(0).Info("reconcile IP address for HAProxyLoadBalancer")
+
+	//the device assignment is shared with the VSphereMachine, which uses the v1beta1 network devices
+	lbDevices := haProxyLB.Spec.VirtualMachineConfiguration.Network.Devices
+	devices := make([]infrav1.NetworkDeviceSpec, len(lbDevices))
+	for i := range lbDevices {
+		if err := infrav1alpha3.Convert_v1alpha3_NetworkDeviceSpec_To_v1beta1_NetworkDeviceSpec(&lbDevices[i], &devices[i], nil); err != nil {
+			return &ctrl.Result{}, errors.Wrapf(err, "failed to convert network device for HAProxyLoadBalancer %s", haProxyLB.Name)
+		}
+	}
+
+	if len(devices) == 0 {
+		log.V(0).Info("no network device found for HAProxyLoadBalancer")
+		return &ctrl.Result{}, nil
+	}
+
+	if util.IsMachineIPAllocationDHCP(devices) {
+		log.V(0).Info("HAProxyLoadBalancer has allocation type DHCP")
+		return &ctrl.Result{}, nil
+	}
+
+	if util.IsMachineIPAllocated(devices) {
+		log.V(0).Info("IP address is already allocated for HAProxyLoadBalancer")
+		return &ctrl.Result{}, nil
+	}
+
+	dataPatch := client.MergeFrom(haProxyLB.DeepCopy())
+	//the nameservers and search domains merge policy of the IPPool can be overridden on the HAProxyLoadBalancer
+	opts := networkDeviceOptions{dnsMergePolicy: ipam.DNSMergePolicy(haProxyLB.GetAnnotations()[ipam.DNSMergePolicyKey]), prober: r.Prober}
+
+	//match labels for the IPPool are retrieved from the StaticIPPolicy selecting the Cluster, or from the
+	//HAProxyLoadBalancer
+	poolMatchLabels, selection, err := getVIPIPPoolSelection(r.Client, r.IPAM.GetOptions().GlobalIPPoolNamespace, cluster.ObjectMeta,
+		machineRoleNone, util.GetIPPoolMatchLabels(haProxyLB), util.GetIPPoolSelectionOptions(haProxyLB))
+	if err != nil {
+		return &ctrl.Result{}, err
+	}
+	res, err := reconcileNetworkDevicesIPAddress(r.IPAM, log, poolMatchLabels, selection, cluster.ObjectMeta, haProxyLB, devices, opts)
+	if res, err := reconcileIPAllocationConditions(r.Client, r.Recorder, haProxyLB, res, err); res != nil || err != nil {
+		return res, err
+	}
+
+	for i := range devices {
+		if err := infrav1alpha3.Convert_v1beta1_NetworkDeviceSpec_To_v1alpha3_NetworkDeviceSpec(&devices[i], &lbDevices[i], nil); err != nil {
+			return &ctrl.Result{}, errors.Wrapf(err, "failed to convert network device for HAProxyLoadBalancer %s", haProxyLB.Name)
+		}
+	}
+
+	if err := r.Patch(context.TODO(), haProxyLB, dataPatch); err != nil {
+		return &ctrl.Result{}, errors.Wrapf(err, "failed to patch HAProxyLoadBalancer %s", haProxyLB.Name)
+	}
+
+	log.V(0).Info("successfully reconciled IP address for HAProxyLoadBalancer")
+
+	return &ctrl.Result{}, nil
+}
+
+func (r *HAProxyLoadBalancerReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&infrav1alpha3.HAProxyLoadBalancer{}).
+		Complete(r)
+}
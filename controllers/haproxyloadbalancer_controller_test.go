@@ -0,0 +1,99 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	ipamv1 "github.com/metal3-io/ip-address-manager/api/v1alpha1"
+	"github.com/spectrocloud/cluster-api-provider-vsphere-static-ip/pkg/ipam"
+	"github.com/spectrocloud/cluster-api-provider-vsphere-static-ip/pkg/ipam/metal3io"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	infrav1alpha3 "sigs.k8s.io/cluster-api-provider-vsphere/api/v1alpha3"
+	capi "sigs.k8s.io/cluster-api/api/v1beta1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+func TestReconcileHAProxyLoadBalancer(t *testing.T) {
+	s := newTestScheme(t)
+	assert.NoError(t, ipamv1.AddToScheme(s))
+	assert.NoError(t, infrav1alpha3.AddToScheme(s))
+
+	ctx := context.Background()
+	start, end, gateway := ipamv1.IPAddressStr("10.10.100.20"), ipamv1.IPAddressStr("10.10.100.30"), ipamv1.IPAddressStr("10.10.100.1")
+	pool := &ipamv1.IPPool{
+		ObjectMeta: metav1.ObjectMeta{Name: "pool1", Namespace: "default"},
+		Spec:       ipamv1.IPPoolSpec{Pools: []ipamv1.Pool{{Start: &start, End: &end}}, Prefix: 24},
+	}
+	cluster := &capi.Cluster{ObjectMeta: metav1.ObjectMeta{Name: "cluster", Namespace: "default", UID: "cluster-uid"}}
+	newHAProxyLB := func(name string, devices ...infrav1alpha3.NetworkDeviceSpec) *infrav1alpha3.HAProxyLoadBalancer {
+		lb := &infrav1alpha3.HAProxyLoadBalancer{
+			TypeMeta: metav1.TypeMeta{Kind: "HAProxyLoadBalancer", APIVersion: infrav1alpha3.GroupVersion.String()},
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", UID: types.UID("uid-" + name),
+				Labels: map[string]string{capi.ClusterLabelName: "cluster", ipam.ClusterIPPoolNameKey: "pool1"}},
+		}
+		lb.Spec.VirtualMachineConfiguration.Network.Devices = devices
+		return lb
+	}
+	//the second device of the load balancer was switched to DHCP after its address was allocated
+	lb := newHAProxyLB("lb", infrav1alpha3.NetworkDeviceSpec{NetworkName: "net0"}, infrav1alpha3.NetworkDeviceSpec{NetworkName: "net1", DHCP4: true})
+	dhcpLB := newHAProxyLB("dhcp-lb", infrav1alpha3.NetworkDeviceSpec{NetworkName: "net0", DHCP4: true})
+
+	cli := fake.NewClientBuilder().WithScheme(s).WithObjects(pool, cluster, lb, dhcpLB).Build()
+	ipamFunc := metal3io.NewIpam(cli, cli, log.NullLogger{}, ipam.Options{})
+	ipPool, err := ipamFunc.GetAvailableIPPool(map[string]string{ipam.ClusterIPPoolNameKey: "pool1"}, cluster.ObjectMeta, ipam.SelectionOptions{})
+	assert.NoError(t, err)
+	_, err = ipamFunc.AllocateIP("lb-1", ipPool, lb, nil)
+	assert.NoError(t, err)
+
+	r := &HAProxyLoadBalancerReconciler{Client: cli, Log: log.NullLogger{}, Scheme: s, IPAM: metal3io.NewIpam(cli, cli, log.NullLogger{}, ipam.Options{}), Recorder: record.NewFakeRecorder(10)}
+	reconcile := func(name string) ctrl.Result {
+		res, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKey{Namespace: "default", Name: name}})
+		assert.NoError(t, err)
+		return res
+	}
+	getClaim := func(name string) error {
+		return cli.Get(ctx, client.ObjectKey{Namespace: "default", Name: name}, &ipamv1.IPClaim{})
+	}
+
+	//the load balancer with only DHCP devices is skipped
+	assert.Zero(t, reconcile("dhcp-lb"))
+	assert.True(t, apierrors.IsNotFound(getClaim("dhcp-lb-0")))
+
+	//the address of the static device is claimed, and waited for
+	assert.NotZero(t, reconcile("lb"))
+	assert.NoError(t, getClaim("lb-0"))
+
+	ic := &ipamv1.IPClaim{}
+	assert.NoError(t, cli.Get(ctx, client.ObjectKey{Namespace: "default", Name: "lb-0"}, ic))
+	ic.Status.Address = &corev1.ObjectReference{Name: "ip-lb-0", Namespace: "default"}
+	assert.NoError(t, cli.Update(ctx, ic))
+	assert.NoError(t, cli.Create(ctx, &ipamv1.IPAddress{
+		ObjectMeta: metav1.ObjectMeta{Name: "ip-lb-0", Namespace: "default"},
+		Spec:       ipamv1.IPAddressSpec{Address: "10.10.100.20", Prefix: 24, Gateway: &gateway},
+	}))
+
+	//the allocated address is assigned to the static device, and the claim of the DHCP device is released
+	assert.Zero(t, reconcile("lb"))
+	assert.NoError(t, cli.Get(ctx, client.ObjectKeyFromObject(lb), lb))
+	devices := lb.Spec.VirtualMachineConfiguration.Network.Devices
+	assert.Equal(t, []string{"10.10.100.20/24"}, devices[0].IPAddrs)
+	assert.Equal(t, "10.10.100.1", devices[0].Gateway4)
+	assert.Empty(t, devices[1].IPAddrs)
+	assert.True(t, apierrors.IsNotFound(getClaim("lb-1")))
+	assert.NoError(t, getClaim("lb-0"))
+
+	//the load balancer without a Cluster is skipped
+	orphan := newHAProxyLB("orphan", infrav1alpha3.NetworkDeviceSpec{NetworkName: "net0"})
+	orphan.Labels[capi.ClusterLabelName] = "missing"
+	assert.NoError(t, cli.Create(ctx, orphan))
+	assert.Zero(t, reconcile("orphan"))
+	assert.True(t, apierrors.IsNotFound(getClaim("orphan-0")))
+}
@@ -0,0 +1,132 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spectrocloud/cluster-api-provider-vsphere-static-ip/pkg/ipam"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/retry"
+	capi "sigs.k8s.io/cluster-api/api/v1beta1"
+	"sigs.k8s.io/cluster-api/util/conditions"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// IPAddressQuotaCondition reports if the IP addresses of the object are within the quotas of the IPPool
+	IPAddressQuotaCondition capi.ConditionType = "IPAddressQuotaSatisfied"
+
+	// IPAddressQuotaExceededReason is used when the namespace or the Cluster of the object exceeds its quota
+	IPAddressQuotaExceededReason = "QuotaExceeded"
+
+	// IPPoolAccessCondition reports if the object is allowed to use the IPPools of the namespace it references
+	IPPoolAccessCondition capi.ConditionType = "IPPoolAccessGranted"
+
+	// IPPoolAccessDeniedReason is used when the access policies of the IPPool namespace deny the object namespace
+	IPPoolAccessDeniedReason = "AccessDenied"
+
+	// IPAddressBlockCondition reports if the block of addresses of the MachineDeployment is reserved in its IPPool
+	IPAddressBlockCondition capi.ConditionType = "IPAddressBlockReserved"
+
+	// IPAddressBlockExhaustedReason is used when the IPPool has not enough free addresses for the block
+	IPAddressBlockExhaustedReason = "BlockExhausted"
+)
+
+// ipAllocationConditions are the conditions reporting the IP allocation failures, which are not solved by retrying
+var ipAllocationConditions = []struct {
+	condition capi.ConditionType
+	reason    string
+	matches   func(error) bool
+}{
+	{IPAddressQuotaCondition, IPAddressQuotaExceededReason, ipam.IsQuotaExceeded},
+	{IPPoolAccessCondition, IPPoolAccessDeniedReason, ipam.IsAccessDenied},
+	{IPAddressBlockCondition, IPAddressBlockExhaustedReason, ipam.IsIPBlockExhausted},
+}
+
+// reconcileIPAllocationConditions reports the quota exceeded, or the access denied to the IPPool, in the conditions and
+// the events of the owner object, in the events only for the objects without conditions, as the HAProxyLoadBalancer.
+// The owner object is requeued, instead of failing, until the quota or the access policy is changed.
+func reconcileIPAllocationConditions(cli client.Client, recorder record.EventRecorder, owner client.Object,
+	res *ctrl.Result, err error) (*ctrl.Result, error) {
+	failed := false
+	for _, c := range ipAllocationConditions {
+		if err != nil && c.matches(err) {
+			if recorder != nil {
+				recorder.Event(owner, corev1.EventTypeWarning, c.reason, errors.Cause(err).Error())
+			}
+			failed = true
+		}
+	}
+
+	//the status is patched from a copy, to keep the changes of the owner object to be patched by the caller
+	obj, ok := owner.DeepCopyObject().(conditions.Setter)
+	if !ok {
+		if failed {
+			return &ctrl.Result{RequeueAfter: time.Minute}, nil
+		}
+		return res, err
+	}
+
+	//the conditions are owned by capv and capi, which set them concurrently, so the status is patched with an
+	//optimistic lock and the conditions are set again on the latest object on conflict
+	refresh := false
+	if patchErr := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		if refresh {
+			if err := cli.Get(context.TODO(), client.ObjectKeyFromObject(obj), obj); err != nil {
+				return err
+			}
+		}
+		refresh = true
+		statusPatch := client.MergeFromWithOptions(obj.DeepCopyObject().(client.Object), client.MergeFromWithOptimisticLock{})
+		if !setIPAllocationConditions(obj, err) {
+			return nil
+		}
+		return cli.Status().Patch(context.TODO(), obj, statusPatch)
+	}); patchErr != nil {
+		return &ctrl.Result{}, errors.Wrapf(patchErr, "failed to patch the status of %s", owner.GetName())
+	}
+
+	if failed {
+		return &ctrl.Result{RequeueAfter: time.Minute}, nil
+	}
+
+	return res, err
+}
+
+// setIPAllocationConditions sets the conditions of the IP allocation failures matching the error, and sets back the
+// failed conditions without an error. It returns whether the conditions changed.
+func setIPAllocationConditions(obj conditions.Setter, err error) bool {
+	changed := false
+	for _, c := range ipAllocationConditions {
+		switch {
+		case err != nil && c.matches(err):
+			conditions.MarkFalse(obj, c.condition, c.reason, capi.ConditionSeverityWarning, "%s", errors.Cause(err).Error())
+			changed = true
+		case err == nil && conditions.IsFalse(obj, c.condition):
+			//the conditions are only set once the allocation failed
+			conditions.MarkTrue(obj, c.condition)
+			changed = true
+		}
+	}
+
+	return changed
+}
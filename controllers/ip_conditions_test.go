@@ -0,0 +1,96 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spectrocloud/cluster-api-provider-vsphere-static-ip/pkg/ipam"
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+	infrav1alpha3 "sigs.k8s.io/cluster-api-provider-vsphere/api/v1alpha3"
+	infrav1 "sigs.k8s.io/cluster-api-provider-vsphere/api/v1beta1"
+	"sigs.k8s.io/cluster-api/util/conditions"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestReconcileIPAllocationConditions(t *testing.T) {
+	s := newTestScheme(t)
+	vSphereVM := &infrav1.VSphereVM{ObjectMeta: metav1.ObjectMeta{Name: "vm", Namespace: "default"}}
+	cli := fake.NewClientBuilder().WithScheme(s).WithObjects(vSphereVM).Build()
+	getVSphereVM := func() *infrav1.VSphereVM {
+		vm := &infrav1.VSphereVM{}
+		assert.NoError(t, cli.Get(context.Background(), client.ObjectKeyFromObject(vSphereVM), vm))
+		return vm
+	}
+
+	//the exceeded quota is reported, and the VSphereVM is requeued
+	quotaErr := errors.Wrap(&ipam.QuotaExceededError{Pool: "pool1", Scope: ipam.QuotaScopeNamespace, Consumer: "default", Quota: 1}, "failed to allocate")
+	res, err := reconcileIPAllocationConditions(cli, nil, getVSphereVM(), &ctrl.Result{}, quotaErr)
+	assert.NoError(t, err)
+	assert.Equal(t, time.Minute, res.RequeueAfter)
+	assert.True(t, conditions.IsFalse(getVSphereVM(), IPAddressQuotaCondition))
+	assert.Equal(t, IPAddressQuotaExceededReason, conditions.GetReason(getVSphereVM(), IPAddressQuotaCondition))
+
+	//other errors are returned as is
+	_, err = reconcileIPAllocationConditions(cli, nil, getVSphereVM(), &ctrl.Result{}, errors.New("failed"))
+	assert.EqualError(t, err, "failed")
+
+	//the condition is set back once the address is allocated
+	res, err = reconcileIPAllocationConditions(cli, nil, getVSphereVM(), nil, nil)
+	assert.NoError(t, err)
+	assert.Nil(t, res)
+	assert.True(t, conditions.IsTrue(getVSphereVM(), IPAddressQuotaCondition))
+
+	//the access denied to the IPPool is reported in an event
+	recorder := record.NewFakeRecorder(1)
+	accessErr := &ipam.AccessDeniedError{PoolNamespace: "pools", Consumer: "default"}
+	res, err = reconcileIPAllocationConditions(cli, recorder, getVSphereVM(), nil, accessErr)
+	assert.NoError(t, err)
+	assert.Equal(t, time.Minute, res.RequeueAfter)
+	assert.True(t, conditions.IsFalse(getVSphereVM(), IPPoolAccessCondition))
+	assert.True(t, conditions.IsTrue(getVSphereVM(), IPAddressQuotaCondition))
+	assert.Equal(t, "Warning AccessDenied namespace default is not allowed to use the ip-pools of namespace pools", <-recorder.Events)
+
+	//the conditions set concurrently by capv are kept
+	stale := getVSphereVM()
+	latest := getVSphereVM()
+	conditions.MarkTrue(latest, infrav1.VMProvisionedCondition)
+	assert.NoError(t, cli.Status().Update(context.Background(), latest))
+	_, err = reconcileIPAllocationConditions(cli, nil, stale, nil, quotaErr)
+	assert.NoError(t, err)
+	assert.True(t, conditions.IsTrue(getVSphereVM(), infrav1.VMProvisionedCondition))
+	assert.True(t, conditions.IsFalse(getVSphereVM(), IPAddressQuotaCondition))
+	assert.True(t, conditions.IsFalse(getVSphereVM(), IPPoolAccessCondition))
+
+	//the condition is not set without an exceeded quota
+	other := &infrav1.VSphereVM{ObjectMeta: metav1.ObjectMeta{Name: "other", Namespace: "default"}}
+	assert.NoError(t, cli.Create(context.Background(), other))
+	_, err = reconcileIPAllocationConditions(cli, nil, other, nil, nil)
+	assert.NoError(t, err)
+	assert.False(t, conditions.Has(other, IPAddressQuotaCondition))
+}
+
+func TestReconcileIPAllocationConditionsWithoutConditions(t *testing.T) {
+	s := newTestScheme(t)
+	assert.NoError(t, infrav1alpha3.AddToScheme(s))
+	haProxyLB := &infrav1alpha3.HAProxyLoadBalancer{ObjectMeta: metav1.ObjectMeta{Name: "lb", Namespace: "default"}}
+	cli := fake.NewClientBuilder().WithScheme(s).WithObjects(haProxyLB).Build()
+
+	//the exceeded quota of the HAProxyLoadBalancer, without conditions, is reported in an event, and it is requeued
+	recorder := record.NewFakeRecorder(1)
+	quotaErr := &ipam.QuotaExceededError{Pool: "pool1", Scope: ipam.QuotaScopeNamespace, Consumer: "default", Quota: 1}
+	res, err := reconcileIPAllocationConditions(cli, recorder, haProxyLB, nil, quotaErr)
+	assert.NoError(t, err)
+	assert.Equal(t, time.Minute, res.RequeueAfter)
+	assert.Contains(t, <-recorder.Events, "Warning QuotaExceeded")
+
+	//other errors are returned as is
+	_, err = reconcileIPAllocationConditions(cli, recorder, haProxyLB, &ctrl.Result{}, errors.New("failed"))
+	assert.EqualError(t, err, "failed")
+	assert.Empty(t, recorder.Events)
+}
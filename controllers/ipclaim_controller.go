@@ -0,0 +1,190 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/go-logr/logr"
+	ipamv1 "github.com/metal3-io/ip-address-manager/api/v1alpha1"
+	"github.com/pkg/errors"
+	"github.com/spectrocloud/cluster-api-provider-vsphere-static-ip/pkg/ipam"
+	"github.com/spectrocloud/cluster-api-provider-vsphere-static-ip/pkg/ipam/metal3io"
+	"github.com/spectrocloud/cluster-api-provider-vsphere-static-ip/pkg/util"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+)
+
+// IPClaimReconciler quarantines the addresses released by the IPClaims, for the quarantine period of their IPPool, returns
+// the addresses taken from the block of a MachineDeployment to the block, and releases the IPClaims of the deleted
+// owners in another namespace
+type IPClaimReconciler struct {
+	client.Client
+	Log    logr.Logger
+	Scheme *runtime.Scheme
+	// APIReader reads the owners in another namespace from the api server, the cache may lag behind on them, or not
+	// watch their kind at all
+	APIReader client.Reader
+}
+
+func (r *IPClaimReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	log := r.Log.WithValues("ipclaim", req.NamespacedName)
+
+	ipClaim := &ipamv1.IPClaim{}
+	if err := r.Get(ctx, req.NamespacedName, ipClaim); err != nil {
+		return ctrl.Result{}, util.IgnoreNotFound(err)
+	}
+
+	ipPool := &ipamv1.IPPool{}
+	if err := r.Get(ctx, getIPClaimPoolKey(ipClaim), ipPool); err != nil {
+		if util.IgnoreNotFound(err) != nil {
+			return ctrl.Result{}, errors.Wrapf(err, "failed to get IPPool %s", ipClaim.Spec.Pool.Name)
+		}
+		//nothing to quarantine the address in, once the IPPool is deleted
+		ipPool = nil
+	}
+
+	if !ipClaim.DeletionTimestamp.IsZero() {
+		return ctrl.Result{}, r.reconcileDelete(log, ipClaim, ipPool)
+	}
+
+	//the owners in another namespace, for eg., of the IPClaims of the global IPPools, are checked on every resync
+	if released, err := r.releaseOrphanedIPClaim(log, ipClaim); released || err != nil {
+		return ctrl.Result{}, err
+	}
+
+	return ctrl.Result{}, r.reconcileNormal(log, ipClaim, ipPool)
+}
+
+// releaseOrphanedIPClaim deletes the IPClaim whose owner in another namespace is deleted, as it is not garbage
+// collected by kubernetes. The owner is read from the api server, and only the owner which is not found, or which is
+// recreated with another uid, is deleted.
+func (r *IPClaimReconciler) releaseOrphanedIPClaim(log logr.Logger, ipClaim *ipamv1.IPClaim) (bool, error) {
+	ownerRef, err := metal3io.GetIPClaimOwner(ipClaim)
+	if err != nil || ownerRef == nil {
+		return false, err
+	}
+
+	owner := &unstructured.Unstructured{}
+	owner.SetGroupVersionKind(schema.FromAPIVersionAndKind(ownerRef.APIVersion, ownerRef.Kind))
+	err = r.APIReader.Get(context.TODO(), types.NamespacedName{Namespace: ownerRef.Namespace, Name: ownerRef.Name}, owner)
+	if err = util.IgnoreNotFound(err); err != nil {
+		return false, errors.Wrapf(err, "failed to get the owner %s %s/%s of IPClaim %s", ownerRef.Kind, ownerRef.Namespace, ownerRef.Name, ipClaim.Name)
+	}
+	if owner.GetUID() != "" && (ownerRef.UID == "" || owner.GetUID() == ownerRef.UID) {
+		return false, nil
+	}
+
+	log.V(0).Info(fmt.Sprintf("releasing IPClaim of the deleted %s %s/%s", ownerRef.Kind, ownerRef.Namespace, ownerRef.Name))
+	if err := r.Delete(context.TODO(), ipClaim); err != nil {
+		return false, errors.Wrapf(err, "failed to delete IPClaim %s", ipClaim.Name)
+	}
+
+	return true, nil
+}
+
+// reconcileNormal records the allocated address of the IPClaim, if the IPPool has a quarantine period
+func (r *IPClaimReconciler) reconcileNormal(log logr.Logger, ipClaim *ipamv1.IPClaim, ipPool *ipamv1.IPPool) error {
+	if ipPool == nil || ipClaim.Status.Address == nil || controllerutil.ContainsFinalizer(ipClaim, ipam.QuarantineFinalizer) {
+		return nil
+	}
+
+	period, err := metal3io.GetQuarantinePeriod(ipPool)
+	if err != nil {
+		return err
+	}
+	if period == 0 {
+		return nil
+	}
+
+	ip := &ipamv1.IPAddress{}
+	ipKey := types.NamespacedName{Namespace: ipClaim.Namespace, Name: ipClaim.Status.Address.Name}
+	if err := r.Get(context.TODO(), ipKey, ip); err != nil {
+		return errors.Wrapf(err, "failed to get IPAddress %s", ipClaim.Status.Address.Name)
+	}
+
+	dataPatch := client.MergeFrom(ipClaim.DeepCopy())
+	annotations := ipClaim.GetAnnotations()
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	annotations[ipam.IPClaimAddressKey] = string(ip.Spec.Address)
+	ipClaim.SetAnnotations(annotations)
+	controllerutil.AddFinalizer(ipClaim, ipam.QuarantineFinalizer)
+
+	log.V(0).Info("recording IP address of IPClaim for quarantine", "IPAddress", ip.Spec.Address)
+	if err := r.Patch(context.TODO(), ipClaim, dataPatch); err != nil {
+		return errors.Wrapf(err, "failed to patch IPClaim %s", ipClaim.Name)
+	}
+
+	return nil
+}
+
+// reconcileDelete quarantines the address of the released IPClaim, and returns the address taken from the block of its
+// MachineDeployment to the block, before removing the finalizers
+func (r *IPClaimReconciler) reconcileDelete(log logr.Logger, ipClaim *ipamv1.IPClaim, ipPool *ipamv1.IPPool) error {
+	quarantine := controllerutil.ContainsFinalizer(ipClaim, ipam.QuarantineFinalizer)
+	block := controllerutil.ContainsFinalizer(ipClaim, ipam.IPBlockFinalizer)
+	if !quarantine && !block {
+		return nil
+	}
+
+	if address := ipClaim.GetAnnotations()[ipam.IPClaimAddressKey]; quarantine && ipPool != nil && address != "" {
+		log.V(0).Info("quarantining IP address released by IPClaim", "IPAddress", address)
+		if err := metal3io.QuarantineReleasedAddress(r.Client, ipPool, address, fmt.Sprintf("released by IPClaim %s", ipClaim.Name)); err != nil {
+			return errors.Wrapf(err, "failed to quarantine IP address %s of IPClaim %s", address, ipClaim.Name)
+		}
+	}
+
+	//the quarantined address is dropped from the block instead
+	if block && ipPool != nil {
+		log.V(0).Info("returning IP address released by IPClaim to its block", "MachineDeployment", ipClaim.Labels[ipam.IPBlockKey])
+		if err := metal3io.ReturnIPBlockAddress(r.Client, client.ObjectKeyFromObject(ipPool), ipClaim); err != nil {
+			return err
+		}
+	}
+
+	dataPatch := client.MergeFrom(ipClaim.DeepCopy())
+	controllerutil.RemoveFinalizer(ipClaim, ipam.QuarantineFinalizer)
+	controllerutil.RemoveFinalizer(ipClaim, ipam.IPBlockFinalizer)
+	if err := r.Patch(context.TODO(), ipClaim, dataPatch); err != nil {
+		return errors.Wrapf(err, "failed to patch IPClaim %s", ipClaim.Name)
+	}
+
+	return nil
+}
+
+func getIPClaimPoolKey(ipClaim *ipamv1.IPClaim) types.NamespacedName {
+	namespace := ipClaim.Spec.Pool.Namespace
+	if namespace == "" {
+		namespace = ipClaim.Namespace
+	}
+
+	return types.NamespacedName{Namespace: namespace, Name: ipClaim.Spec.Pool.Name}
+}
+
+func (r *IPClaimReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&ipamv1.IPClaim{}).
+		Complete(r)
+}
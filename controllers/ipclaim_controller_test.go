@@ -0,0 +1,170 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	ipamv1 "github.com/metal3-io/ip-address-manager/api/v1alpha1"
+	"github.com/spectrocloud/cluster-api-provider-vsphere-static-ip/pkg/ipam"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	infrav1 "sigs.k8s.io/cluster-api-provider-vsphere/api/v1beta1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+func TestIPClaimQuarantine(t *testing.T) {
+	s := newTestScheme(t)
+	assert.NoError(t, ipamv1.AddToScheme(s))
+
+	pool := &ipamv1.IPPool{ObjectMeta: metav1.ObjectMeta{
+		Name:        "pool1",
+		Namespace:   "default",
+		Annotations: map[string]string{ipam.QuarantinePeriodKey: "10m"},
+	}}
+	claim := &ipamv1.IPClaim{
+		ObjectMeta: metav1.ObjectMeta{Name: "vm-0", Namespace: "default"},
+		Spec:       ipamv1.IPClaimSpec{Pool: corev1.ObjectReference{Name: "pool1", Namespace: "default"}},
+		Status:     ipamv1.IPClaimStatus{Address: &corev1.ObjectReference{Name: "ip-vm-0", Namespace: "default"}},
+	}
+	address := &ipamv1.IPAddress{
+		ObjectMeta: metav1.ObjectMeta{Name: "ip-vm-0", Namespace: "default"},
+		Spec:       ipamv1.IPAddressSpec{Address: "10.10.100.20"},
+	}
+
+	cli := fake.NewClientBuilder().WithScheme(s).WithObjects(pool, claim, address).Build()
+	r := &IPClaimReconciler{Client: cli, Log: log.NullLogger{}, Scheme: s, APIReader: cli}
+	req := ctrl.Request{NamespacedName: client.ObjectKeyFromObject(claim)}
+
+	//the address of the allocated IPClaim is recorded
+	_, err := r.Reconcile(context.Background(), req)
+	assert.NoError(t, err)
+	assert.NoError(t, cli.Get(context.Background(), req.NamespacedName, claim))
+	assert.Equal(t, "10.10.100.20", claim.Annotations[ipam.IPClaimAddressKey])
+	assert.True(t, controllerutil.ContainsFinalizer(claim, ipam.QuarantineFinalizer))
+
+	//the address is quarantined in the IPPool once the IPClaim is released
+	assert.NoError(t, cli.Delete(context.Background(), claim))
+	_, err = r.Reconcile(context.Background(), req)
+	assert.NoError(t, err)
+	assert.NoError(t, cli.Get(context.Background(), client.ObjectKeyFromObject(pool), pool))
+	assert.Equal(t, ipamv1.IPAddressStr("10.10.100.20"), pool.Spec.PreAllocations["quarantine-10-10-100-20"])
+	assert.Contains(t, pool.Annotations[ipam.QuarantinedAddressesKey], "released by IPClaim vm-0")
+}
+
+func TestIPClaimOwnerInAnotherNamespace(t *testing.T) {
+	s := newTestScheme(t)
+	assert.NoError(t, ipamv1.AddToScheme(s))
+
+	pool := &ipamv1.IPPool{ObjectMeta: metav1.ObjectMeta{Name: "pool1", Namespace: "global"}}
+	vSphereMachine := &infrav1.VSphereMachine{ObjectMeta: metav1.ObjectMeta{Name: "vm", Namespace: "tenant1", UID: "vm-uid"}}
+	newClaim := func(name string, uid types.UID) *ipamv1.IPClaim {
+		ownerRef := `{"kind":"VSphereMachine","namespace":"tenant1","name":"vm","uid":"` + string(uid) + `","apiVersion":"` + infrav1.GroupVersion.String() + `"}`
+		return &ipamv1.IPClaim{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "global", Annotations: map[string]string{ipam.IPClaimOwnerKey: ownerRef}},
+			Spec:       ipamv1.IPClaimSpec{Pool: corev1.ObjectReference{Name: "pool1", Namespace: "global"}},
+		}
+	}
+
+	//the owner is read from the api server, the cache has not seen it yet
+	cli := fake.NewClientBuilder().WithScheme(s).WithObjects(pool, newClaim("tenant1.vm-0", "vm-uid"), newClaim("tenant1.vm-1", "old-uid")).Build()
+	apiReader := fake.NewClientBuilder().WithScheme(s).WithObjects(vSphereMachine).Build()
+	r := &IPClaimReconciler{Client: cli, Log: log.NullLogger{}, Scheme: s, APIReader: apiReader}
+
+	//the IPClaim of the existing owner is kept
+	_, err := r.Reconcile(context.Background(), ctrl.Request{NamespacedName: client.ObjectKey{Namespace: "global", Name: "tenant1.vm-0"}})
+	assert.NoError(t, err)
+	assert.NoError(t, cli.Get(context.Background(), client.ObjectKey{Namespace: "global", Name: "tenant1.vm-0"}, &ipamv1.IPClaim{}))
+
+	//the IPClaim of a deleted owner, recreated with the same name, is released
+	_, err = r.Reconcile(context.Background(), ctrl.Request{NamespacedName: client.ObjectKey{Namespace: "global", Name: "tenant1.vm-1"}})
+	assert.NoError(t, err)
+	err = cli.Get(context.Background(), client.ObjectKey{Namespace: "global", Name: "tenant1.vm-1"}, &ipamv1.IPClaim{})
+	assert.True(t, apierrors.IsNotFound(err))
+
+	//the IPClaim is kept when its owner can not be read
+	r.APIReader = unavailableReader{apiReader}
+	_, err = r.Reconcile(context.Background(), ctrl.Request{NamespacedName: client.ObjectKey{Namespace: "global", Name: "tenant1.vm-0"}})
+	assert.Error(t, err)
+	assert.NoError(t, cli.Get(context.Background(), client.ObjectKey{Namespace: "global", Name: "tenant1.vm-0"}, &ipamv1.IPClaim{}))
+
+	//the IPClaim of a deleted owner is released
+	assert.NoError(t, apiReader.Delete(context.Background(), vSphereMachine))
+	r.APIReader = apiReader
+	_, err = r.Reconcile(context.Background(), ctrl.Request{NamespacedName: client.ObjectKey{Namespace: "global", Name: "tenant1.vm-0"}})
+	assert.NoError(t, err)
+	err = cli.Get(context.Background(), client.ObjectKey{Namespace: "global", Name: "tenant1.vm-0"}, &ipamv1.IPClaim{})
+	assert.True(t, apierrors.IsNotFound(err))
+}
+
+func TestIPClaimIPBlock(t *testing.T) {
+	s := newTestScheme(t)
+	assert.NoError(t, ipamv1.AddToScheme(s))
+
+	pool := &ipamv1.IPPool{
+		ObjectMeta: metav1.ObjectMeta{Name: "pool1", Namespace: "default"},
+		Spec: ipamv1.IPPoolSpec{PreAllocations: map[string]ipamv1.IPAddressStr{
+			"vm-0": "10.10.100.20",
+			"vm-1": "10.10.100.21",
+		}},
+	}
+	newClaim := func(name string) *ipamv1.IPClaim {
+		return &ipamv1.IPClaim{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:       name,
+				Namespace:  "default",
+				Labels:     map[string]string{ipam.ClusterNamespaceKey: "default", ipam.IPBlockKey: "md1"},
+				Finalizers: []string{ipam.IPBlockFinalizer},
+			},
+			Spec: ipamv1.IPClaimSpec{Pool: corev1.ObjectReference{Name: "pool1", Namespace: "default"}},
+		}
+	}
+	claim := newClaim("vm-0")
+
+	cli := fake.NewClientBuilder().WithScheme(s).WithObjects(pool, claim).Build()
+	r := &IPClaimReconciler{Client: cli, Log: log.NullLogger{}, Scheme: s, APIReader: cli}
+	req := ctrl.Request{NamespacedName: client.ObjectKeyFromObject(claim)}
+
+	//the address is returned to the block of the MachineDeployment once the IPClaim is released
+	assert.NoError(t, cli.Delete(context.Background(), claim))
+	_, err := r.Reconcile(context.Background(), req)
+	assert.NoError(t, err)
+	assert.NoError(t, cli.Get(context.Background(), client.ObjectKeyFromObject(pool), pool))
+	assert.Equal(t, map[string]ipamv1.IPAddressStr{
+		"ipblock/default/md1/10.10.100.20": "10.10.100.20",
+		"vm-1":                             "10.10.100.21",
+	}, pool.Spec.PreAllocations)
+	err = cli.Get(context.Background(), req.NamespacedName, claim)
+	assert.True(t, apierrors.IsNotFound(err))
+
+	//the address quarantined by the IPPool is dropped from the block
+	pool.Annotations = map[string]string{ipam.QuarantinePeriodKey: "10m"}
+	assert.NoError(t, cli.Update(context.Background(), pool))
+	claim = newClaim("vm-1")
+	claim.Annotations = map[string]string{ipam.IPClaimAddressKey: "10.10.100.21"}
+	claim.Finalizers = append(claim.Finalizers, ipam.QuarantineFinalizer)
+	assert.NoError(t, cli.Create(context.Background(), claim))
+	assert.NoError(t, cli.Delete(context.Background(), claim))
+	_, err = r.Reconcile(context.Background(), ctrl.Request{NamespacedName: client.ObjectKeyFromObject(claim)})
+	assert.NoError(t, err)
+	assert.NoError(t, cli.Get(context.Background(), client.ObjectKeyFromObject(pool), pool))
+	assert.Equal(t, map[string]ipamv1.IPAddressStr{
+		"ipblock/default/md1/10.10.100.20": "10.10.100.20",
+		"quarantine-10-10-100-21":          "10.10.100.21",
+	}, pool.Spec.PreAllocations)
+}
+
+// unavailableReader fails to get any object, as the api server is unavailable
+type unavailableReader struct {
+	client.Reader
+}
+
+func (unavailableReader) Get(ctx context.Context, key client.ObjectKey, obj client.Object) error {
+	return apierrors.NewServiceUnavailable("unavailable")
+}
@@ -0,0 +1,90 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"strings"
+
+	"github.com/go-logr/logr"
+	ipamv1 "github.com/metal3-io/ip-address-manager/api/v1alpha1"
+	"github.com/spectrocloud/cluster-api-provider-vsphere-static-ip/pkg/ipam/metal3io"
+	"github.com/spectrocloud/cluster-api-provider-vsphere-static-ip/pkg/util"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// IPPoolReconciler reserves the excluded and the quarantined addresses of an IPPool, releases its quarantined addresses
+// once their quarantine period is over, and the blocks of addresses of the deleted MachineDeployments
+type IPPoolReconciler struct {
+	client.Client
+	Log      logr.Logger
+	Scheme   *runtime.Scheme
+	Recorder record.EventRecorder
+}
+
+// ExcludedAddressesAllocatedReason is used when some excluded addresses of the IPPool are already allocated, and are
+// not reserved until released
+const ExcludedAddressesAllocatedReason = "ExcludedAddressesAllocated"
+
+func (r *IPPoolReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	log := r.Log.WithValues("ippool", req.NamespacedName)
+
+	ipPool := &ipamv1.IPPool{}
+	if err := r.Get(ctx, req.NamespacedName, ipPool); err != nil {
+		return ctrl.Result{}, util.IgnoreNotFound(err)
+	}
+
+	//the excluded addresses are reserved for metal3io not to allocate them, the allocated ones once released
+	conflicts, err := metal3io.SyncExcludedAddresses(r.Client, ipPool)
+	if err != nil {
+		log.Error(err, "failed to reserve excluded IP addresses")
+		return ctrl.Result{}, err
+	}
+	if len(conflicts) > 0 {
+		message := "excluded addresses are already allocated: " + strings.Join(conflicts, ", ")
+		log.V(0).Info(message)
+		if r.Recorder != nil {
+			r.Recorder.Event(ipPool, corev1.EventTypeWarning, ExcludedAddressesAllocatedReason, message)
+		}
+	}
+
+	//the blocks are released here, as the MachineDeployments are deleted without a finalizer
+	if err := metal3io.ReleaseOrphanedIPBlocks(r.Client, ipPool); err != nil {
+		log.Error(err, "failed to release the blocks of IP addresses of the deleted MachineDeployments")
+		return ctrl.Result{}, err
+	}
+
+	//the quarantine is kept in the IPPool, so the expiry is requeued again after a restart of the manager, and the
+	//reservations stripped from the spec are restored from the annotation
+	next, err := metal3io.SyncQuarantinedAddresses(r.Client, ipPool)
+	if err != nil {
+		log.Error(err, "failed to release quarantined IP addresses")
+		return ctrl.Result{}, err
+	}
+
+	return ctrl.Result{RequeueAfter: next}, nil
+}
+
+func (r *IPPoolReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&ipamv1.IPPool{}).
+		Complete(r)
+}
@@ -0,0 +1,263 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/go-logr/logr"
+	ipamv1 "github.com/metal3-io/ip-address-manager/api/v1alpha1"
+	"github.com/pkg/errors"
+	"github.com/spectrocloud/cluster-api-provider-vsphere-static-ip/pkg/ipam"
+	"github.com/spectrocloud/cluster-api-provider-vsphere-static-ip/pkg/ipam/metal3io"
+	"github.com/spectrocloud/cluster-api-provider-vsphere-static-ip/pkg/util"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/tools/record"
+	infrav1 "sigs.k8s.io/cluster-api-provider-vsphere/api/v1beta1"
+	capi "sigs.k8s.io/cluster-api/api/v1beta1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// MachineDeploymentReconciler reserves a block of addresses for the MachineDeployments with the reserve-ip-block
+// annotation, sized for their replicas and their maximum surge, for the addresses of their new machines to be allocated
+// right away, and for a scale-out not fitting in the IPPool to be reported ahead
+type MachineDeploymentReconciler struct {
+	client.Client
+	Log    logr.Logger
+	Scheme *runtime.Scheme
+	// IPAM allocates the static IPs, it is shared by the reconcilers for the allocations from an IPPool to be serialized
+	IPAM     ipam.IPAddressManager
+	Recorder record.EventRecorder
+}
+
+// +kubebuilder:rbac:groups=cluster.x-k8s.io,resources=machinedeployments,verbs=get;list;watch
+// +kubebuilder:rbac:groups=cluster.x-k8s.io,resources=machinedeployments/status,verbs=get;update;patch
+
+func (r *MachineDeploymentReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	log := r.Log.WithValues("machinedeployment", req.NamespacedName)
+
+	//the block of a deleted MachineDeployment is released by the IPPool reconciler
+	md := &capi.MachineDeployment{}
+	if err := r.Get(ctx, req.NamespacedName, md); err != nil {
+		return ctrl.Result{}, util.IgnoreNotFound(err)
+	}
+	if !md.DeletionTimestamp.IsZero() {
+		return ctrl.Result{}, nil
+	}
+
+	cluster := &capi.Cluster{}
+	if err := r.Get(ctx, types.NamespacedName{Namespace: md.Namespace, Name: md.Spec.ClusterName}, cluster); err != nil {
+		log.V(0).Info("MachineDeployment is missing cluster or cluster does not exist")
+		return ctrl.Result{}, util.IgnoreNotFound(err)
+	}
+
+	var res *ctrl.Result
+	var err error
+	if md.GetAnnotations()[ipam.ReserveIPBlockKey] == "true" {
+		res, err = r.reconcileIPBlock(log, cluster, md)
+	} else {
+		err = metal3io.ReleaseIPBlock(r.Client, client.ObjectKeyFromObject(md), cluster.ObjectMeta, r.IPAM.GetOptions().GlobalIPPoolNamespace, nil)
+	}
+
+	res, err = reconcileIPAllocationConditions(r.Client, r.Recorder, md, res, err)
+	if err != nil {
+		log.Error(err, "failed to reconcile the IP block of MachineDeployment")
+	}
+
+	if res == nil {
+		res = &ctrl.Result{}
+	}
+
+	return *res, err
+}
+
+// reconcileIPBlock reserves the block of addresses of the MachineDeployment in the IPPool its machines are assigned from
+func (r *MachineDeploymentReconciler) reconcileIPBlock(log logr.Logger, cluster *capi.Cluster, md *capi.MachineDeployment) (*ctrl.Result, error) {
+	template, err := getMachineDeploymentTemplate(r.Client, md)
+	if err != nil {
+		return &ctrl.Result{}, err
+	}
+	if template == nil {
+		log.V(0).Info("no VSphereMachineTemplate found for MachineDeployment, skipping IP block")
+		return &ctrl.Result{}, nil
+	}
+
+	size, err := getIPBlockSize(md, template)
+	if err != nil {
+		return &ctrl.Result{}, err
+	}
+	if size == 0 {
+		return nil, metal3io.ReleaseIPBlock(r.Client, client.ObjectKeyFromObject(md), cluster.ObjectMeta, r.IPAM.GetOptions().GlobalIPPoolNamespace, nil)
+	}
+
+	poolMatchLabels, selection, err := r.getIPPoolMatchLabels(cluster, md, template)
+	if err != nil {
+		return &ctrl.Result{}, err
+	}
+	pool, err := r.IPAM.GetAvailableIPPool(poolMatchLabels, cluster.ObjectMeta, selection)
+	if err != nil {
+		return &ctrl.Result{}, errors.Wrapf(err, "failed to get an available IPPool for MachineDeployment %s", md.Name)
+	}
+	if pool == nil {
+		log.V(0).Info("waiting for IPPool to be available")
+		return &ctrl.Result{RequeueAfter: time.Minute}, nil
+	}
+
+	ipPool := &ipamv1.IPPool{}
+	if err := r.Get(context.TODO(), types.NamespacedName{Namespace: pool.GetNamespace(), Name: pool.GetName()}, ipPool); err != nil {
+		return &ctrl.Result{}, errors.Wrapf(err, "failed to get IPPool %s", pool.GetName())
+	}
+
+	log.V(0).Info(fmt.Sprintf("reserving a block of %d IP addresses for MachineDeployment", size), "IPPool", ipPool.Name)
+	if err := metal3io.ReserveIPBlock(r.Client, ipPool, client.ObjectKeyFromObject(md), size, cluster.ObjectMeta, r.IPAM.GetOptions().GlobalIPPoolNamespace); err != nil {
+		return &ctrl.Result{}, errors.Wrapf(err, "failed to reserve the IP block of MachineDeployment %s", md.Name)
+	}
+
+	return nil, nil
+}
+
+// getIPPoolMatchLabels gets the IPPool match labels, and the selection options, of the machines of the
+// MachineDeployment, as for the VSphereMachines. The MachineDeployment is set as the owner, for the IPPool of its block
+// to keep being selected.
+func (r *MachineDeploymentReconciler) getIPPoolMatchLabels(cluster *capi.Cluster, md *capi.MachineDeployment,
+	template *infrav1.VSphereMachineTemplate) (map[string]string, ipam.SelectionOptions, error) {
+	failureDomain := ""
+	if md.Spec.Template.Spec.FailureDomain != nil {
+		failureDomain = *md.Spec.Template.Spec.FailureDomain
+	}
+	poolMatchLabels, selection, err := getMachineGroupIPPoolMatchLabels(r.Client, r.IPAM.GetOptions().GlobalIPPoolNamespace, cluster, md, template, machineRoleWorker, failureDomain)
+	if err != nil {
+		return nil, selection, err
+	}
+
+	selection.Owner = md
+
+	return poolMatchLabels, selection, nil
+}
+
+// getMachineGroupIPPoolMatchLabels gets the IPPool match labels, and the selection options, of the machines of a
+// MachineDeployment or of a control plane, as for their VSphereMachines: from the StaticIPPolicy selecting them, or else
+// from the first of the VSphereMachineTemplate, the owner and the Cluster with the IPPool labels, along with their
+// placement
+func getMachineGroupIPPoolMatchLabels(cli client.Client, globalNamespace string, cluster *capi.Cluster, owner client.Object,
+	template *infrav1.VSphereMachineTemplate, role machineRole, failureDomain string) (map[string]string, ipam.SelectionOptions, error) {
+	policySelection, err := getStaticIPPolicySelection(cli, globalNamespace, cluster.ObjectMeta, template, role)
+	if err != nil {
+		return nil, ipam.SelectionOptions{}, err
+	}
+	poolMatchLabels := map[string]string{}
+	var selection ipam.SelectionOptions
+	if policySelection != nil {
+		selection = *policySelection
+	} else {
+		poolMatchLabels, selection = util.GetIPPoolMatchLabels(cluster), util.GetIPPoolSelectionOptions(cluster)
+		for _, obj := range []client.Object{template, owner} {
+			if labels := util.GetIPPoolMatchLabels(obj); util.HasIPPoolMatchLabels(labels) {
+				poolMatchLabels, selection = labels, util.GetIPPoolSelectionOptions(obj)
+				break
+			}
+		}
+		if !util.HasIPPoolMatchLabels(poolMatchLabels) && getRoleIPPoolSelector(cluster, role) == "" {
+			return nil, selection, fmt.Errorf("no IPPool match labels found for the machines of %s", owner.GetName())
+		}
+		poolMatchLabels = withRoleIPPoolSelector(poolMatchLabels, cluster, role)
+	}
+
+	poolMatchLabels, err = withTopology(cli, poolMatchLabels, template.Spec.Template.Spec.VirtualMachineCloneSpec, failureDomain)
+	return poolMatchLabels, selection, err
+}
+
+// getMachineDeploymentTemplate gets the VSphereMachineTemplate of the machines of the MachineDeployment, nil if none
+func getMachineDeploymentTemplate(cli client.Client, md *capi.MachineDeployment) (*infrav1.VSphereMachineTemplate, error) {
+	ref := md.Spec.Template.Spec.InfrastructureRef
+	if ref.Kind != "VSphereMachineTemplate" {
+		return nil, nil
+	}
+	namespace := ref.Namespace
+	if namespace == "" {
+		namespace = md.Namespace
+	}
+
+	template := &infrav1.VSphereMachineTemplate{}
+	if err := cli.Get(context.Background(), types.NamespacedName{Namespace: namespace, Name: ref.Name}, template); err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, errors.Wrapf(err, "failed to get VSphereMachineTemplate %s", ref.Name)
+	}
+
+	return template, nil
+}
+
+// getIPBlockSize gets the number of static addresses of the machines of the MachineDeployment, for its replicas and
+// the maximum surge of its rolling update
+func getIPBlockSize(md *capi.MachineDeployment, template *infrav1.VSphereMachineTemplate) (int, error) {
+	addresses, err := getMachineAddressCount(template)
+	if err != nil {
+		return 0, err
+	}
+
+	replicas := 1
+	if md.Spec.Replicas != nil {
+		replicas = int(*md.Spec.Replicas)
+	}
+
+	//the machines are replaced without a surge by the OnDelete strategy, the surge defaults to one machine
+	surge := 0
+	if strategy := md.Spec.Strategy; strategy == nil || strategy.Type != capi.OnDeleteMachineDeploymentStrategyType {
+		maxSurge := intstr.FromInt(1)
+		if strategy != nil && strategy.RollingUpdate != nil && strategy.RollingUpdate.MaxSurge != nil {
+			maxSurge = *strategy.RollingUpdate.MaxSurge
+		}
+		if surge, err = intstr.GetScaledValueFromIntOrPercent(&maxSurge, replicas, true); err != nil {
+			return 0, errors.Wrapf(err, "invalid maxSurge of MachineDeployment %s", md.Name)
+		}
+	}
+
+	return (replicas + surge) * addresses, nil
+}
+
+// getMachineAddressCount gets the number of static addresses allocated to each machine of the VSphereMachineTemplate, for
+// its network devices neither using DHCP nor with static addresses set
+func getMachineAddressCount(template *infrav1.VSphereMachineTemplate) (int, error) {
+	devices := template.Spec.Template.Spec.Network.Devices
+	addressCounts, err := util.GetDeviceAddressCounts(template.GetAnnotations(), len(devices))
+	if err != nil {
+		return 0, err
+	}
+	addresses := 0
+	for i := range devices {
+		if util.IsDeviceIPAllocationDHCP(devices[i]) || len(devices[i].IPAddrs) > 0 {
+			continue
+		}
+		addresses += addressCounts[i]
+	}
+
+	return addresses, nil
+}
+
+func (r *MachineDeploymentReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&capi.MachineDeployment{}).
+		Complete(r)
+}
@@ -0,0 +1,135 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	ipamv1 "github.com/metal3-io/ip-address-manager/api/v1alpha1"
+	"github.com/spectrocloud/cluster-api-provider-vsphere-static-ip/pkg/ipam"
+	"github.com/spectrocloud/cluster-api-provider-vsphere-static-ip/pkg/ipam/metal3io"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/tools/record"
+	infrav1 "sigs.k8s.io/cluster-api-provider-vsphere/api/v1beta1"
+	capi "sigs.k8s.io/cluster-api/api/v1beta1"
+	"sigs.k8s.io/cluster-api/util/conditions"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+func TestGetIPBlockSize(t *testing.T) {
+	newTemplate := func(annotations map[string]string, devices ...infrav1.NetworkDeviceSpec) *infrav1.VSphereMachineTemplate {
+		template := &infrav1.VSphereMachineTemplate{ObjectMeta: metav1.ObjectMeta{Name: "template", Annotations: annotations}}
+		template.Spec.Template.Spec.Network.Devices = devices
+		return template
+	}
+	newMachineDeployment := func(replicas int32, strategy *capi.MachineDeploymentStrategy) *capi.MachineDeployment {
+		md := &capi.MachineDeployment{ObjectMeta: metav1.ObjectMeta{Name: "md"}}
+		md.Spec.Replicas = &replicas
+		md.Spec.Strategy = strategy
+		return md
+	}
+	rollingUpdate := func(maxSurge intstr.IntOrString) *capi.MachineDeploymentStrategy {
+		return &capi.MachineDeploymentStrategy{
+			Type:          capi.RollingUpdateMachineDeploymentStrategyType,
+			RollingUpdate: &capi.MachineRollingUpdateDeployment{MaxSurge: &maxSurge},
+		}
+	}
+	static := infrav1.NetworkDeviceSpec{NetworkName: "static"}
+	dhcp := infrav1.NetworkDeviceSpec{NetworkName: "dhcp", DHCP4: true}
+
+	tests := []struct {
+		name     string
+		md       *capi.MachineDeployment
+		template *infrav1.VSphereMachineTemplate
+		expected int
+	}{
+		{name: "default surge", md: newMachineDeployment(3, nil), template: newTemplate(nil, static), expected: 4},
+		{name: "surge", md: newMachineDeployment(3, rollingUpdate(intstr.FromInt(2))), template: newTemplate(nil, static), expected: 5},
+		{name: "percent surge rounded up", md: newMachineDeployment(3, rollingUpdate(intstr.FromString("50%"))), template: newTemplate(nil, static), expected: 5},
+		{name: "on delete", md: newMachineDeployment(3, &capi.MachineDeploymentStrategy{Type: capi.OnDeleteMachineDeploymentStrategyType}), template: newTemplate(nil, static), expected: 3},
+		{name: "dhcp devices skipped", md: newMachineDeployment(2, nil), template: newTemplate(nil, static, dhcp, static), expected: 6},
+		{name: "addresses per device", md: newMachineDeployment(2, nil), template: newTemplate(map[string]string{ipam.AddressesPerDeviceKey: "2"}, static, dhcp), expected: 6},
+		{name: "dhcp only", md: newMachineDeployment(2, nil), template: newTemplate(nil, dhcp), expected: 0},
+	}
+	for _, tt := range tests {
+		size, err := getIPBlockSize(tt.md, tt.template)
+		assert.NoError(t, err, tt.name)
+		assert.Equal(t, tt.expected, size, tt.name)
+	}
+}
+
+func TestReconcileMachineDeploymentIPBlock(t *testing.T) {
+	s := newTestScheme(t)
+	assert.NoError(t, ipamv1.AddToScheme(s))
+
+	start, end := ipamv1.IPAddressStr("10.10.100.20"), ipamv1.IPAddressStr("10.10.100.23")
+	ipPool := &ipamv1.IPPool{
+		ObjectMeta: metav1.ObjectMeta{Name: "md-pool", Namespace: "default"},
+		Spec:       ipamv1.IPPoolSpec{Pools: []ipamv1.Pool{{Start: &start, End: &end}}, Prefix: 24},
+	}
+	cluster := &capi.Cluster{ObjectMeta: metav1.ObjectMeta{Name: "cluster", Namespace: "default"}}
+	template := &infrav1.VSphereMachineTemplate{ObjectMeta: metav1.ObjectMeta{Name: "template", Namespace: "default",
+		Labels: map[string]string{ipam.ClusterIPPoolNameKey: "md-pool"}}}
+	template.Spec.Template.Spec.Network.Devices = []infrav1.NetworkDeviceSpec{{NetworkName: "static"}}
+	replicas := int32(2)
+	md := &capi.MachineDeployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "md", Namespace: "default", Annotations: map[string]string{ipam.ReserveIPBlockKey: "true"}},
+		Spec: capi.MachineDeploymentSpec{
+			ClusterName: "cluster",
+			Replicas:    &replicas,
+			Template: capi.MachineTemplateSpec{Spec: capi.MachineSpec{
+				ClusterName:       "cluster",
+				InfrastructureRef: corev1.ObjectReference{Kind: "VSphereMachineTemplate", Name: "template"},
+			}},
+		},
+	}
+	cli := fake.NewClientBuilder().WithScheme(s).WithObjects(ipPool, cluster, template, md).Build()
+	r := &MachineDeploymentReconciler{Client: cli, Log: log.NullLogger{}, IPAM: metal3io.NewIpam(cli, cli, log.NullLogger{}, ipam.Options{}), Recorder: record.NewFakeRecorder(10)}
+	req := ctrl.Request{NamespacedName: client.ObjectKeyFromObject(md)}
+	poolKey := client.ObjectKeyFromObject(ipPool)
+
+	//the block is sized for the replicas and the default surge of one machine
+	_, err := r.Reconcile(context.Background(), req)
+	assert.NoError(t, err)
+	assert.NoError(t, cli.Get(context.Background(), poolKey, ipPool))
+	assert.Len(t, ipPool.Spec.PreAllocations, 3)
+	assert.Contains(t, ipPool.Spec.PreAllocations, "ipblock/default/md/10.10.100.20")
+
+	//the scale-out not fitting in the IPPool is reported
+	assert.NoError(t, cli.Get(context.Background(), req.NamespacedName, md))
+	replicas = 4
+	md.Spec.Replicas = &replicas
+	assert.NoError(t, cli.Update(context.Background(), md))
+	res, err := r.Reconcile(context.Background(), req)
+	assert.NoError(t, err)
+	assert.NotZero(t, res.RequeueAfter)
+	assert.NoError(t, cli.Get(context.Background(), poolKey, ipPool))
+	assert.Len(t, ipPool.Spec.PreAllocations, 4)
+	assert.NoError(t, cli.Get(context.Background(), req.NamespacedName, md))
+	assert.True(t, conditions.IsFalse(md, IPAddressBlockCondition))
+	assert.Equal(t, IPAddressBlockExhaustedReason, conditions.GetReason(md, IPAddressBlockCondition))
+
+	//the block fits once scaled in
+	replicas = 1
+	md.Spec.Replicas = &replicas
+	assert.NoError(t, cli.Update(context.Background(), md))
+	_, err = r.Reconcile(context.Background(), req)
+	assert.NoError(t, err)
+	assert.NoError(t, cli.Get(context.Background(), poolKey, ipPool))
+	assert.Len(t, ipPool.Spec.PreAllocations, 2)
+	assert.NoError(t, cli.Get(context.Background(), req.NamespacedName, md))
+	assert.True(t, conditions.IsTrue(md, IPAddressBlockCondition))
+
+	//the block is released once the annotation is removed
+	md.Annotations = nil
+	assert.NoError(t, cli.Update(context.Background(), md))
+	_, err = r.Reconcile(context.Background(), req)
+	assert.NoError(t, err)
+	assert.NoError(t, cli.Get(context.Background(), poolKey, ipPool))
+	assert.Empty(t, ipPool.Spec.PreAllocations)
+}
@@ -0,0 +1,258 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/pkg/errors"
+	"github.com/spectrocloud/cluster-api-provider-vsphere-static-ip/pkg/ipam"
+	"github.com/spectrocloud/cluster-api-provider-vsphere-static-ip/pkg/ipam/prober"
+	"github.com/spectrocloud/cluster-api-provider-vsphere-static-ip/pkg/util"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+	infrav1 "sigs.k8s.io/cluster-api-provider-vsphere/api/v1beta1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// networkDeviceOptions are the owner specific options to assign the network devices
+type networkDeviceOptions struct {
+	// skipDevices are the indexes of the devices not assigned by the controller
+	skipDevices sets.Int
+	// addressCounts are the number of addresses of each device, defaulting to one
+	addressCounts []int
+	// dnsMergePolicy overrides the nameservers and search domains merge policy of the IPPool, if set
+	dnsMergePolicy ipam.DNSMergePolicy
+	// prober checks the addresses are not in use before they are assigned, if set
+	prober prober.AddressProber
+}
+
+// reconcileNetworkDevicesIPAddress assigns static IPs from the IPPool selected with the match labels and the selection
+// options to the non-DHCP network devices of the owner object. A nil result is returned once all the devices are
+// assigned and the owner object can be patched.
+func reconcileNetworkDevicesIPAddress(ipamFunc ipam.IPAddressManager, log logr.Logger, poolMatchLabels map[string]string,
+	selection ipam.SelectionOptions, clusterMeta metav1.ObjectMeta, owner client.Object, devices []infrav1.NetworkDeviceSpec,
+	opts networkDeviceOptions) (*ctrl.Result, error) {
+	kind := owner.GetObjectKind().GroupVersionKind().Kind
+	//the IPPools of the devices assigned in this reconcile
+	devicePools := map[int]ipam.IPPool{}
+
+	//the IPPool of the addresses already allocated to the owner keeps being selected, for eg., while waiting for them
+	selection.Owner = owner
+
+	for i := range devices {
+		if util.IsDeviceIPAllocationDHCP(devices[i]) || len(devices[i].IPAddrs) > 0 || opts.skipDevices.Has(i) {
+			continue
+		}
+
+		ipPool, err := ipamFunc.GetAvailableIPPool(poolMatchLabels, clusterMeta, selection)
+		if ipam.IsAccessDenied(err) {
+			return &ctrl.Result{}, errors.Wrapf(err, "failed to get an available IPPool for %s: %s", kind, owner.GetName())
+		}
+		if err != nil {
+			log.Error(err, "failed to get an available IPPool")
+			return &ctrl.Result{}, nil
+		}
+		if ipPool == nil {
+			log.V(0).Info("waiting for IPPool to be available")
+			return &ctrl.Result{}, nil
+		}
+		devicePools[i] = ipPool
+
+		ipAddrs := []string{}
+		var gateway string
+		var nameservers []string
+		for j := 0; j < getAddressCount(opts.addressCounts, i); j++ {
+			ipName := util.GetFormattedDeviceClaimName(util.GetClaimOwnerName(owner, ipPool.GetNamespace()), i, j)
+			ip, err := ipamFunc.GetIP(ipName, ipPool)
+			if err != nil {
+				return &ctrl.Result{}, errors.Wrapf(err, "failed to get allocated IP address for %s %s", kind, owner.GetName())
+			}
+
+			if ip == nil {
+				if _, err := ipamFunc.AllocateIP(ipName, ipPool, owner, nil); err != nil {
+					return &ctrl.Result{}, errors.Wrapf(err, "failed to allocate IP address for %s: %s", kind, owner.GetName())
+				}
+
+				log.V(0).Info(fmt.Sprintf("waiting for IP address to be available for the %s", kind))
+				return &ctrl.Result{RequeueAfter: 30 * time.Second}, nil
+			}
+
+			if err := util.ValidateIP(ip); err != nil {
+				return &ctrl.Result{}, errors.Wrapf(err, "invalid IP address retrieved for %s: %s", kind, owner.GetName())
+			}
+
+			if opts.prober != nil {
+				if res, err := probeIPAddress(ipamFunc, log, opts.prober, ipName, ipPool, ip, owner); res != nil || err != nil {
+					return res, err
+				}
+			}
+
+			log.V(0).Info(fmt.Sprintf("static IP selected for %s", kind), "IPAddressName", ip.GetName())
+
+			//the device configuration comes from the range of the IPPool the address falls in, if set
+			mask, ipGateway, ipNameservers := util.GetIPConfig(ipPool, ip)
+
+			//capv expects static-ip in the CIDR format
+			ipAddrs = append(ipAddrs, fmt.Sprintf("%s/%d", util.GetAddress(ip), mask))
+			if j == 0 {
+				gateway, nameservers = ipGateway, ipNameservers
+			}
+		}
+
+		log.V(0).Info(fmt.Sprintf("assigning IP address to %s", kind), "IPAddress", ipAddrs)
+
+		devices[i].IPAddrs = ipAddrs
+		//TODO: handle ipv6
+		//gateway4 is required if DHCP4 is disabled, gateway6 is required if DHCP6 is disabled
+		devices[i].Gateway4 = gateway
+
+		//the values of nameservers and searchDomains from the IPPool are merged with the default values set from
+		//the VSphereMachineTemplate, by default the IPPool values override the template values
+		dnsMergePolicy := opts.dnsMergePolicy
+		if dnsMergePolicy == "" {
+			if dnsMergePolicy, err = ipPool.GetDNSMergePolicy(); err != nil {
+				return &ctrl.Result{}, errors.Wrapf(err, "failed to get DNS merge policy of IPPool %s", ipPool.GetName())
+			}
+		}
+		if devices[i].Nameservers, err = util.MergeDNSValues(dnsMergePolicy, nameservers, devices[i].Nameservers); err != nil {
+			return &ctrl.Result{}, errors.Wrapf(err, "failed to merge nameservers for %s: %s", kind, owner.GetName())
+		}
+		if devices[i].SearchDomains, err = util.MergeDNSValues(dnsMergePolicy, util.GetSearchDomains(ipPool), devices[i].SearchDomains); err != nil {
+			return &ctrl.Result{}, errors.Wrapf(err, "failed to merge search domains for %s: %s", kind, owner.GetName())
+		}
+
+		//the routes and mtu from the IPPool, if configured, override the values of the device as well
+		poolRoutes, err := ipPool.GetRoutes()
+		if err != nil {
+			return &ctrl.Result{}, errors.Wrapf(err, "failed to get routes of IPPool %s", ipPool.GetName())
+		}
+		if routes := util.GetRoutes(poolRoutes); len(routes) > 0 {
+			if err := util.ValidateRoutes(ipAddrs[0], routes); err != nil {
+				return &ctrl.Result{}, errors.Wrapf(err, "invalid routes in IPPool %s for %s: %s", ipPool.GetName(), kind, owner.GetName())
+			}
+			devices[i].Routes = routes
+		}
+		mtu, err := ipPool.GetMTU()
+		if err != nil {
+			return &ctrl.Result{}, errors.Wrapf(err, "failed to get MTU of IPPool %s", ipPool.GetName())
+		}
+		if mtu != nil {
+			devices[i].MTU = mtu
+		}
+	}
+
+	if len(devicePools) > 0 {
+		if err := releaseUnusedDeviceIPs(ipamFunc, owner, devices, devicePools, opts); err != nil {
+			return &ctrl.Result{}, err
+		}
+	}
+
+	return nil, nil
+}
+
+// releaseUnusedDeviceIPs releases the IPs allocated for the owner object, in any of the IPPools, which are no longer
+// used by its network devices, for eg., when the number of addresses of a device is decreased, or when the IPPool of a
+// device is changed during the allocation. The IPs of the devices assigned earlier are kept in their IPPool.
+func releaseUnusedDeviceIPs(ipamFunc ipam.IPAddressManager, owner client.Object, devices []infrav1.NetworkDeviceSpec,
+	devicePools map[int]ipam.IPPool, opts networkDeviceOptions) error {
+	ownedPools, err := ipamFunc.GetOwnedIPPools(owner, nil)
+	if err != nil {
+		return errors.Wrapf(err, "failed to get IPPools of the IP addresses allocated for %s", owner.GetName())
+	}
+
+	for _, ipPool := range ownedPools {
+		ipNames := sets.NewString()
+		for i := range devices {
+			if util.IsDeviceIPAllocationDHCP(devices[i]) || opts.skipDevices.Has(i) {
+				continue
+			}
+			if pool, ok := devicePools[i]; ok && !isSameIPPool(pool, ipPool) {
+				continue
+			}
+			for j := 0; j < getAddressCount(opts.addressCounts, i); j++ {
+				ipNames.Insert(util.GetFormattedDeviceClaimName(util.GetClaimOwnerName(owner, ipPool.GetNamespace()), i, j))
+			}
+		}
+
+		ownedIPNames, err := ipamFunc.GetOwnedIPNames(ipPool, owner, nil)
+		if err != nil {
+			return errors.Wrapf(err, "failed to get IP addresses allocated for %s", owner.GetName())
+		}
+		for _, ipName := range ownedIPNames {
+			if ipNames.Has(ipName) {
+				continue
+			}
+			if err := ipamFunc.DeallocateIP(ipName, ipPool, owner); err != nil {
+				return errors.Wrapf(err, "failed to release IP address %s for %s", ipName, owner.GetName())
+			}
+		}
+	}
+
+	return nil
+}
+
+func isSameIPPool(a, b ipam.IPPool) bool {
+	return a.GetNamespace() == b.GetNamespace() && a.GetName() == b.GetName()
+}
+
+// probeIPAddress probes the allocated address once, before it is first assigned. The probed address is recorded on
+// the IPClaim, so that the assigned address is not probed again on every reconcile, as each probe blocks the worker.
+func probeIPAddress(ipamFunc ipam.IPAddressManager, log logr.Logger, addressProber prober.AddressProber, ipName string,
+	ipPool ipam.IPPool, ip ipam.IPAddress, owner client.Object) (*ctrl.Result, error) {
+	kind := owner.GetObjectKind().GroupVersionKind().Kind
+	address := util.GetAddress(ip)
+
+	probed, err := ipamFunc.GetProbedAddress(ipName, ipPool)
+	if err != nil {
+		return &ctrl.Result{}, errors.Wrapf(err, "failed to get probed IP address for %s: %s", kind, owner.GetName())
+	}
+	if probed == address {
+		return nil, nil
+	}
+
+	inUse, err := addressProber.Probe(context.TODO(), address)
+	if err != nil {
+		return &ctrl.Result{}, errors.Wrapf(err, "failed to probe IP address %s for %s: %s", address, kind, owner.GetName())
+	}
+
+	//the address is quarantined and a new one is allocated on the next reconcile, once the IPClaim is deleted
+	if inUse {
+		log.V(0).Info(fmt.Sprintf("IP address is already in use, quarantining it for the %s", kind), "IPAddress", address)
+		if err := ipamFunc.QuarantineIP(ipName, ipPool, fmt.Sprintf("in use when assigned to %s %s", kind, owner.GetName())); err != nil {
+			return &ctrl.Result{}, errors.Wrapf(err, "failed to quarantine IP address for %s: %s", kind, owner.GetName())
+		}
+		return &ctrl.Result{RequeueAfter: 30 * time.Second}, nil
+	}
+
+	if err := ipamFunc.SetProbedAddress(ipName, ipPool, address); err != nil {
+		return &ctrl.Result{}, errors.Wrapf(err, "failed to record probed IP address for %s: %s", kind, owner.GetName())
+	}
+
+	return nil, nil
+}
+
+func getAddressCount(addressCounts []int, device int) int {
+	if device < len(addressCounts) && addressCounts[device] > 0 {
+		return addressCounts[device]
+	}
+	return 1
+}
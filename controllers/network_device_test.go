@@ -0,0 +1,234 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	ipamv1 "github.com/metal3-io/ip-address-manager/api/v1alpha1"
+	"github.com/spectrocloud/cluster-api-provider-vsphere-static-ip/pkg/ipam"
+	"github.com/spectrocloud/cluster-api-provider-vsphere-static-ip/pkg/ipam/metal3io"
+	"github.com/spectrocloud/cluster-api-provider-vsphere-static-ip/pkg/ipam/prober"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	infrav1 "sigs.k8s.io/cluster-api-provider-vsphere/api/v1beta1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+func TestReconcileNetworkDevicesMultipleAddresses(t *testing.T) {
+	s := newTestScheme(t)
+	assert.NoError(t, ipamv1.AddToScheme(s))
+
+	gateway := ipamv1.IPAddressStr("10.10.100.1")
+	pool := &ipamv1.IPPool{ObjectMeta: metav1.ObjectMeta{Name: "pool1", Namespace: "default"}}
+	vSphereMachine := &infrav1.VSphereMachine{
+		TypeMeta:   metav1.TypeMeta{Kind: "VSphereMachine", APIVersion: infrav1.GroupVersion.String()},
+		ObjectMeta: metav1.ObjectMeta{Name: "vm", Namespace: "default", UID: "vm-uid"},
+	}
+	owner := metav1.OwnerReference{Kind: "VSphereMachine", APIVersion: infrav1.GroupVersion.String(), Name: "vm", UID: "vm-uid"}
+
+	objs := []client.Object{pool}
+	//allocated claims, including a stale one for a third address of the device
+	for name, address := range map[string]string{"vm-0": "10.10.100.20", "vm-0.1": "10.10.100.21", "vm-0.2": "10.10.100.22"} {
+		objs = append(objs,
+			&ipamv1.IPClaim{
+				ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", OwnerReferences: []metav1.OwnerReference{owner}},
+				Spec:       ipamv1.IPClaimSpec{Pool: corev1.ObjectReference{Name: "pool1", Namespace: "default"}},
+				Status:     ipamv1.IPClaimStatus{Address: &corev1.ObjectReference{Name: "ip-" + name, Namespace: "default"}},
+			},
+			&ipamv1.IPAddress{
+				ObjectMeta: metav1.ObjectMeta{Name: "ip-" + name, Namespace: "default"},
+				Spec:       ipamv1.IPAddressSpec{Address: ipamv1.IPAddressStr(address), Prefix: 24, Gateway: &gateway},
+			})
+	}
+
+	cli := fake.NewClientBuilder().WithScheme(s).WithObjects(objs...).Build()
+	ipamFunc := metal3io.NewIpam(cli, cli, log.NullLogger{}, ipam.Options{})
+	devices := []infrav1.NetworkDeviceSpec{{NetworkName: "vm-network"}}
+	poolMatchLabels := map[string]string{ipam.ClusterIPPoolNameKey: "pool1"}
+
+	res, err := reconcileNetworkDevicesIPAddress(ipamFunc, log.NullLogger{}, poolMatchLabels, ipam.SelectionOptions{},
+		metav1.ObjectMeta{Namespace: "default"}, vSphereMachine, devices, networkDeviceOptions{addressCounts: []int{2}})
+	assert.NoError(t, err)
+	assert.Nil(t, res)
+	assert.Equal(t, []string{"10.10.100.20/24", "10.10.100.21/24"}, devices[0].IPAddrs)
+	assert.Equal(t, "10.10.100.1", devices[0].Gateway4)
+
+	//the claim of the address no longer used by the device is released
+	err = cli.Get(context.Background(), client.ObjectKey{Namespace: "default", Name: "vm-0.2"}, &ipamv1.IPClaim{})
+	assert.True(t, apierrors.IsNotFound(err))
+	assert.NoError(t, cli.Get(context.Background(), client.ObjectKey{Namespace: "default", Name: "vm-0.1"}, &ipamv1.IPClaim{}))
+}
+
+func TestReconcileNetworkDevicesPoolRange(t *testing.T) {
+	s := newTestScheme(t)
+	assert.NoError(t, ipamv1.AddToScheme(s))
+
+	addr := func(s string) *ipamv1.IPAddressStr {
+		a := ipamv1.IPAddressStr(s)
+		return &a
+	}
+	subnet := ipamv1.IPSubnetStr("10.10.200.0/24")
+	pool := &ipamv1.IPPool{
+		ObjectMeta: metav1.ObjectMeta{Name: "pool1", Namespace: "default"},
+		Spec: ipamv1.IPPoolSpec{
+			Pools: []ipamv1.Pool{
+				{Start: addr("10.10.100.20"), End: addr("10.10.100.30"), Prefix: 24, Gateway: addr("10.10.100.1")},
+				{Subnet: &subnet, Prefix: 25, Gateway: addr("10.10.200.1"), DNSServers: []ipamv1.IPAddressStr{"10.10.200.53"}},
+			},
+			Prefix:     16,
+			Gateway:    addr("10.10.0.1"),
+			DNSServers: []ipamv1.IPAddressStr{"8.8.8.8"},
+		},
+	}
+	vSphereMachine := &infrav1.VSphereMachine{
+		TypeMeta:   metav1.TypeMeta{Kind: "VSphereMachine", APIVersion: infrav1.GroupVersion.String()},
+		ObjectMeta: metav1.ObjectMeta{Name: "vm", Namespace: "default", UID: "vm-uid"},
+	}
+
+	objs := []client.Object{pool}
+	//the IPAddresses are rendered with the top-level values of the IPPool
+	for name, address := range map[string]string{"vm-0": "10.10.100.20", "vm-1": "10.10.200.10", "vm-2": "10.10.250.10"} {
+		objs = append(objs,
+			&ipamv1.IPClaim{
+				ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+				Spec:       ipamv1.IPClaimSpec{Pool: corev1.ObjectReference{Name: "pool1", Namespace: "default"}},
+				Status:     ipamv1.IPClaimStatus{Address: &corev1.ObjectReference{Name: "ip-" + name, Namespace: "default"}},
+			},
+			&ipamv1.IPAddress{
+				ObjectMeta: metav1.ObjectMeta{Name: "ip-" + name, Namespace: "default"},
+				Spec:       ipamv1.IPAddressSpec{Address: ipamv1.IPAddressStr(address), Prefix: 16, Gateway: addr("10.10.0.1")},
+			})
+	}
+
+	cli := fake.NewClientBuilder().WithScheme(s).WithObjects(objs...).Build()
+	devices := []infrav1.NetworkDeviceSpec{{NetworkName: "net-1"}, {NetworkName: "net-2"}, {NetworkName: "net-3"}}
+	res, err := reconcileNetworkDevicesIPAddress(metal3io.NewIpam(cli, cli, log.NullLogger{}, ipam.Options{}), log.NullLogger{},
+		map[string]string{ipam.ClusterIPPoolNameKey: "pool1"}, ipam.SelectionOptions{}, metav1.ObjectMeta{Namespace: "default"}, vSphereMachine,
+		devices, networkDeviceOptions{})
+	assert.NoError(t, err)
+	assert.Nil(t, res)
+
+	//range with start and end, without DNS servers
+	assert.Equal(t, []string{"10.10.100.20/24"}, devices[0].IPAddrs)
+	assert.Equal(t, "10.10.100.1", devices[0].Gateway4)
+	assert.Equal(t, []string{"8.8.8.8"}, devices[0].Nameservers)
+
+	//range with subnet and DNS servers
+	assert.Equal(t, []string{"10.10.200.10/25"}, devices[1].IPAddrs)
+	assert.Equal(t, "10.10.200.1", devices[1].Gateway4)
+	assert.Equal(t, []string{"10.10.200.53"}, devices[1].Nameservers)
+
+	//address outside of the ranges keeps the values of the IPAddress
+	assert.Equal(t, []string{"10.10.250.10/16"}, devices[2].IPAddrs)
+	assert.Equal(t, "10.10.0.1", devices[2].Gateway4)
+	assert.Equal(t, []string{"8.8.8.8"}, devices[2].Nameservers)
+}
+
+func TestReconcileNetworkDevicesAddressInUse(t *testing.T) {
+	s := newTestScheme(t)
+	assert.NoError(t, ipamv1.AddToScheme(s))
+
+	gateway := ipamv1.IPAddressStr("10.10.100.1")
+	pool := &ipamv1.IPPool{ObjectMeta: metav1.ObjectMeta{Name: "pool1", Namespace: "default"}}
+	vSphereMachine := &infrav1.VSphereMachine{
+		TypeMeta:   metav1.TypeMeta{Kind: "VSphereMachine", APIVersion: infrav1.GroupVersion.String()},
+		ObjectMeta: metav1.ObjectMeta{Name: "vm", Namespace: "default", UID: "vm-uid"},
+	}
+	claim := &ipamv1.IPClaim{
+		ObjectMeta: metav1.ObjectMeta{Name: "vm-0", Namespace: "default"},
+		Spec:       ipamv1.IPClaimSpec{Pool: corev1.ObjectReference{Name: "pool1", Namespace: "default"}},
+		Status:     ipamv1.IPClaimStatus{Address: &corev1.ObjectReference{Name: "ip-vm-0", Namespace: "default"}},
+	}
+	address := &ipamv1.IPAddress{
+		ObjectMeta: metav1.ObjectMeta{Name: "ip-vm-0", Namespace: "default"},
+		Spec:       ipamv1.IPAddressSpec{Address: "10.10.100.20", Prefix: 24, Gateway: &gateway},
+	}
+
+	cli := fake.NewClientBuilder().WithScheme(s).WithObjects(pool, claim, address).Build()
+	ipProber := &prober.FakeProber{InUse: map[string]bool{"10.10.100.20": true}}
+	devices := []infrav1.NetworkDeviceSpec{{NetworkName: "vm-network"}}
+
+	res, err := reconcileNetworkDevicesIPAddress(metal3io.NewIpam(cli, cli, log.NullLogger{}, ipam.Options{}), log.NullLogger{},
+		map[string]string{ipam.ClusterIPPoolNameKey: "pool1"}, ipam.SelectionOptions{}, metav1.ObjectMeta{Namespace: "default"}, vSphereMachine,
+		devices, networkDeviceOptions{prober: ipProber})
+	assert.NoError(t, err)
+	assert.NotZero(t, res.RequeueAfter)
+	assert.Empty(t, devices[0].IPAddrs)
+	assert.Equal(t, []string{"10.10.100.20"}, ipProber.Probed())
+
+	//the address in use is reserved in the IPPool, and the IPClaim is deleted for a new address to be allocated
+	err = cli.Get(context.Background(), client.ObjectKey{Namespace: "default", Name: "vm-0"}, &ipamv1.IPClaim{})
+	assert.True(t, apierrors.IsNotFound(err))
+	updatedPool := &ipamv1.IPPool{}
+	assert.NoError(t, cli.Get(context.Background(), client.ObjectKey{Namespace: "default", Name: "pool1"}, updatedPool))
+	assert.Contains(t, updatedPool.Spec.PreAllocations, "quarantine-10-10-100-20")
+
+	//the address not in use is probed once, before it is first assigned
+	claim.ResourceVersion, address.ResourceVersion = "", ""
+	cli = fake.NewClientBuilder().WithScheme(s).WithObjects(pool, claim, address).Build()
+	ipProber = &prober.FakeProber{}
+	for i := 0; i < 2; i++ {
+		res, err = reconcileNetworkDevicesIPAddress(metal3io.NewIpam(cli, cli, log.NullLogger{}, ipam.Options{}), log.NullLogger{},
+			map[string]string{ipam.ClusterIPPoolNameKey: "pool1"}, ipam.SelectionOptions{}, metav1.ObjectMeta{Namespace: "default"}, vSphereMachine,
+			devices, networkDeviceOptions{prober: ipProber})
+		assert.NoError(t, err)
+		assert.Nil(t, res)
+		assert.Equal(t, []string{"10.10.100.20/24"}, devices[0].IPAddrs)
+	}
+	assert.Equal(t, []string{"10.10.100.20"}, ipProber.Probed())
+	probedClaim := &ipamv1.IPClaim{}
+	assert.NoError(t, cli.Get(context.Background(), client.ObjectKey{Namespace: "default", Name: "vm-0"}, probedClaim))
+	assert.Equal(t, "10.10.100.20", probedClaim.Annotations[ipam.IPClaimProbedAddressKey])
+}
+
+func TestReconcileNetworkDevicesIPPoolChange(t *testing.T) {
+	s := newTestScheme(t)
+	assert.NoError(t, ipamv1.AddToScheme(s))
+
+	ctx := context.Background()
+	gateway := ipamv1.IPAddressStr("10.10.100.1")
+	oldPool := &ipamv1.IPPool{ObjectMeta: metav1.ObjectMeta{Name: "shared", Namespace: "global"}}
+	pool := &ipamv1.IPPool{ObjectMeta: metav1.ObjectMeta{Name: "pool1", Namespace: "default"}}
+	vSphereMachine := &infrav1.VSphereMachine{
+		TypeMeta:   metav1.TypeMeta{Kind: "VSphereMachine", APIVersion: infrav1.GroupVersion.String()},
+		ObjectMeta: metav1.ObjectMeta{Name: "vm", Namespace: "default", UID: "vm-uid"},
+	}
+	cli := fake.NewClientBuilder().WithScheme(s).WithObjects(oldPool, pool).Build()
+	ipamFunc := metal3io.NewIpam(cli, cli, log.NullLogger{}, ipam.Options{})
+
+	//the addresses of the devices were allocated from the previous IPPool of the machine, in another namespace
+	for _, ipName := range []string{"default.vm-0", "default.vm-1"} {
+		_, err := ipamFunc.AllocateIP(ipName, metal3io.NewIPPool(*oldPool, nil), vSphereMachine, nil)
+		assert.NoError(t, err)
+	}
+
+	//the first device is assigned from the new IPPool, the second device was assigned earlier
+	claim := &ipamv1.IPClaim{
+		ObjectMeta: metav1.ObjectMeta{Name: "vm-0", Namespace: "default"},
+		Spec:       ipamv1.IPClaimSpec{Pool: corev1.ObjectReference{Name: "pool1", Namespace: "default"}},
+		Status:     ipamv1.IPClaimStatus{Address: &corev1.ObjectReference{Name: "ip-vm-0", Namespace: "default"}},
+	}
+	claim.SetOwnerReferences([]metav1.OwnerReference{{APIVersion: infrav1.GroupVersion.String(), Kind: "VSphereMachine", Name: "vm", UID: "vm-uid"}})
+	assert.NoError(t, cli.Create(ctx, claim))
+	assert.NoError(t, cli.Create(ctx, &ipamv1.IPAddress{
+		ObjectMeta: metav1.ObjectMeta{Name: "ip-vm-0", Namespace: "default"},
+		Spec:       ipamv1.IPAddressSpec{Address: "10.10.100.20", Prefix: 24, Gateway: &gateway},
+	}))
+	devices := []infrav1.NetworkDeviceSpec{{NetworkName: "vm-network"}, {NetworkName: "vm-network-2", IPAddrs: []string{"10.10.200.20/24"}}}
+
+	res, err := reconcileNetworkDevicesIPAddress(ipamFunc, log.NullLogger{}, map[string]string{ipam.ClusterIPPoolNameKey: "pool1"}, ipam.SelectionOptions{},
+		metav1.ObjectMeta{Namespace: "default"}, vSphereMachine, devices, networkDeviceOptions{})
+	assert.NoError(t, err)
+	assert.Nil(t, res)
+	assert.Equal(t, []string{"10.10.100.20/24"}, devices[0].IPAddrs)
+
+	//the address of the first device left in the previous IPPool is released, the one of the second device is kept
+	err = cli.Get(ctx, client.ObjectKey{Namespace: "global", Name: "default.vm-0"}, &ipamv1.IPClaim{})
+	assert.True(t, apierrors.IsNotFound(err))
+	assert.NoError(t, cli.Get(ctx, client.ObjectKey{Namespace: "global", Name: "default.vm-1"}, &ipamv1.IPClaim{}))
+	assert.NoError(t, cli.Get(ctx, client.ObjectKey{Namespace: "default", Name: "vm-0"}, &ipamv1.IPClaim{}))
+}
@@ -0,0 +1,259 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/pkg/errors"
+	"github.com/spectrocloud/cluster-api-provider-vsphere-static-ip/pkg/ipam"
+	"github.com/spectrocloud/cluster-api-provider-vsphere-static-ip/pkg/util"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/sets"
+	capi "sigs.k8s.io/cluster-api/api/v1beta1"
+	"sigs.k8s.io/cluster-api/controllers/remote"
+	"sigs.k8s.io/cluster-api/util/conditions"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// serviceClaimLabels tell the IPClaims of the LoadBalancer Services apart from the other IPClaims owned by the Cluster
+var serviceClaimLabels = map[string]string{ipam.ServiceLoadBalancerKey: "true"}
+
+// ServiceLoadBalancerReconciler allocates the ingress IPs for the LoadBalancer Services in a workload cluster
+type ServiceLoadBalancerReconciler struct {
+	client.Client
+	Log    logr.Logger
+	Scheme *runtime.Scheme
+	// IPAM allocates the static IPs, it is shared by the reconcilers for the allocations from an IPPool to be serialized
+	IPAM    ipam.IPAddressManager
+	Tracker *remote.ClusterCacheTracker
+	// LoadBalancerClass is the loadBalancerClass of the Services handled besides the ones without a class, which are
+	// handled by the default load balancer implementation
+	LoadBalancerClass string
+
+	controller controller.Controller
+}
+
+// +kubebuilder:rbac:groups="",resources=secrets,verbs=get;list;watch
+
+func (r *ServiceLoadBalancerReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	log := r.Log.WithValues("cluster", req.NamespacedName)
+	var res *ctrl.Result
+	var err error
+
+	cluster := &capi.Cluster{}
+	if err := r.Get(ctx, req.NamespacedName, cluster); err != nil {
+		return ctrl.Result{}, util.IgnoreNotFound(err)
+	}
+
+	//handle the case where gvk is empty
+	if cluster.GroupVersionKind().Empty() {
+		log.V(0).Info("setting the missing gvk for cluster")
+		cluster.Kind = "Cluster"
+		cluster.APIVersion = capi.GroupVersion.String()
+	}
+
+	if !cluster.DeletionTimestamp.IsZero() {
+		log.V(0).Info("cluster is being deleted, skipping reconcile LoadBalancer Services")
+		return ctrl.Result{}, nil
+	}
+
+	if !conditions.IsTrue(cluster, capi.ControlPlaneInitializedCondition) {
+		log.V(0).Info("waiting for the control plane to be initialized")
+		return ctrl.Result{}, nil
+	}
+
+	res, err = r.reconcileServiceLoadBalancerIPAddress(ctx, cluster)
+	if err != nil {
+		log.Error(err, "failed to reconcile LoadBalancer Service IP")
+	}
+
+	if res == nil {
+		res = &ctrl.Result{}
+	}
+
+	return *res, err
+}
+
+func (r *ServiceLoadBalancerReconciler) reconcileServiceLoadBalancerIPAddress(ctx context.Context, cluster *capi.Cluster) (*ctrl.Result, error) {
+	log := r.Log.WithValues("cluster", cluster.Name, "namespace", cluster.Namespace)
+
+	//only the clusters labelled with a LoadBalancer ip-pool are handled
+	poolMatchLabels := util.GetLoadBalancerIPPoolMatchLabels(cluster.GetLabels())
+	if len(poolMatchLabels) == 0 {
+		return &ctrl.Result{}, nil
+	}
+
+	log.V(0).Info("reconcile IP addresses for the workload cluster LoadBalancer Services")
+
+	//the StaticIPPolicy selecting the Cluster takes precedence over the LoadBalancer ip-pool labels
+	poolMatchLabels, selection, err := getVIPIPPoolSelection(r.Client, r.IPAM.GetOptions().GlobalIPPoolNamespace, cluster.ObjectMeta,
+		machineRoleNone, poolMatchLabels, ipam.SelectionOptions{})
+	if err != nil {
+		return &ctrl.Result{}, err
+	}
+	ipPool, err := r.IPAM.GetAvailableIPPool(poolMatchLabels, cluster.ObjectMeta, selection)
+	if err != nil {
+		log.Error(err, "failed to get an available IPPool")
+		return &ctrl.Result{}, nil
+	}
+	if ipPool == nil {
+		log.V(0).Info("waiting for IPPool to be available")
+		return &ctrl.Result{}, nil
+	}
+
+	clusterKey := client.ObjectKeyFromObject(cluster)
+	if err := r.Tracker.Watch(ctx, remote.WatchInput{
+		Name:         "watchServices",
+		Cluster:      clusterKey,
+		Watcher:      r.controller,
+		Kind:         &corev1.Service{},
+		EventHandler: handler.EnqueueRequestsFromMapFunc(r.serviceToCluster(clusterKey)),
+	}); err != nil {
+		return &ctrl.Result{}, errors.Wrapf(err, "failed to watch Services in cluster %s", cluster.Name)
+	}
+
+	remoteClient, err := r.Tracker.GetClient(ctx, clusterKey)
+	if err != nil {
+		return &ctrl.Result{}, errors.Wrapf(err, "failed to get client for cluster %s", cluster.Name)
+	}
+
+	return r.reconcileServices(ctx, cluster, r.IPAM, ipPool, remoteClient)
+}
+
+func (r *ServiceLoadBalancerReconciler) reconcileServices(ctx context.Context, cluster *capi.Cluster, ipamFunc ipam.IPAddressManager,
+	ipPool ipam.IPPool, remoteClient client.Client) (*ctrl.Result, error) {
+	log := r.Log.WithValues("cluster", cluster.Name, "namespace", cluster.Namespace)
+
+	services := &corev1.ServiceList{}
+	if err := remoteClient.List(ctx, services); err != nil {
+		return &ctrl.Result{}, errors.Wrapf(err, "failed to list Services in cluster %s", cluster.Name)
+	}
+
+	requeue := false
+	ipNames := sets.NewString()
+	for i := range services.Items {
+		svc := &services.Items[i]
+		if !r.isLoadBalancerService(svc) {
+			continue
+		}
+
+		ipName := util.GetFormattedServiceClaimName(cluster, ipPool.GetName(), svc.Namespace, svc.Name)
+		ipNames.Insert(ipName)
+
+		ip, err := ipamFunc.GetIP(ipName, ipPool)
+		if err != nil {
+			return &ctrl.Result{}, errors.Wrapf(err, "failed to get allocated IP address for Service %s/%s", svc.Namespace, svc.Name)
+		}
+
+		if ip == nil {
+			if _, err := ipamFunc.AllocateIP(ipName, ipPool, cluster, serviceClaimLabels); err != nil {
+				return &ctrl.Result{}, errors.Wrapf(err, "failed to allocate IP address for Service %s/%s", svc.Namespace, svc.Name)
+			}
+
+			log.V(0).Info("waiting for IP address to be available for the Service", "service", svc.Namespace+"/"+svc.Name)
+			requeue = true
+			continue
+		}
+
+		ipAddr := util.GetAddress(ip)
+		if ipAddr == "" {
+			return &ctrl.Result{}, errors.Errorf("invalid IP address retrieved for Service %s/%s", svc.Namespace, svc.Name)
+		}
+
+		if util.HasLoadBalancerIngressIP(svc, ipAddr) {
+			continue
+		}
+
+		log.V(0).Info("assigning IP address to Service", "service", svc.Namespace+"/"+svc.Name, "IPAddress", ipAddr)
+		dataPatch := client.MergeFrom(svc.DeepCopy())
+		svc.Status.LoadBalancer.Ingress = []corev1.LoadBalancerIngress{{IP: ipAddr}}
+		if err := remoteClient.Status().Patch(ctx, svc, dataPatch); err != nil {
+			return &ctrl.Result{}, errors.Wrapf(err, "failed to patch Service %s/%s", svc.Namespace, svc.Name)
+		}
+	}
+
+	//release the IP addresses of the deleted Services, or the ones no longer handled, and the IP addresses left in the
+	//previously selected IPPools, once the Services are assigned the IP addresses of the current IPPool. The other
+	//IPClaims owned by the Cluster are left as is.
+	ownedPools, err := ipamFunc.GetOwnedIPPools(cluster, serviceClaimLabels)
+	if err != nil {
+		return &ctrl.Result{}, errors.Wrapf(err, "failed to get IPPools allocated from for cluster %s", cluster.Name)
+	}
+	for _, pool := range ownedPools {
+		isCurrentPool := pool.GetNamespace() == ipPool.GetNamespace() && pool.GetName() == ipPool.GetName()
+		if !isCurrentPool && requeue {
+			continue
+		}
+
+		ownedIPNames, err := ipamFunc.GetOwnedIPNames(pool, cluster, serviceClaimLabels)
+		if err != nil {
+			return &ctrl.Result{}, errors.Wrapf(err, "failed to get IP addresses allocated for cluster %s", cluster.Name)
+		}
+		for _, ipName := range ownedIPNames {
+			if isCurrentPool && ipNames.Has(ipName) {
+				continue
+			}
+			if err := ipamFunc.DeallocateIP(ipName, pool, cluster); err != nil {
+				return &ctrl.Result{}, errors.Wrapf(err, "failed to release IP address %s for cluster %s", ipName, cluster.Name)
+			}
+		}
+	}
+
+	if requeue {
+		return &ctrl.Result{RequeueAfter: 30 * time.Second}, nil
+	}
+
+	log.V(0).Info("successfully reconciled IP addresses for the workload cluster LoadBalancer Services")
+
+	return &ctrl.Result{}, nil
+}
+
+// isLoadBalancerService checks if the Service is a LoadBalancer handled by the controller, either without a
+// loadBalancerClass, or with the configured one. The Services of the other classes are left to their implementation.
+func (r *ServiceLoadBalancerReconciler) isLoadBalancerService(svc *corev1.Service) bool {
+	if svc.Spec.Type != corev1.ServiceTypeLoadBalancer || !svc.DeletionTimestamp.IsZero() {
+		return false
+	}
+
+	return svc.Spec.LoadBalancerClass == nil || (r.LoadBalancerClass != "" && *svc.Spec.LoadBalancerClass == r.LoadBalancerClass)
+}
+
+func (r *ServiceLoadBalancerReconciler) serviceToCluster(clusterKey client.ObjectKey) handler.MapFunc {
+	return func(o client.Object) []reconcile.Request {
+		return []reconcile.Request{{NamespacedName: clusterKey}}
+	}
+}
+
+func (r *ServiceLoadBalancerReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	c, err := ctrl.NewControllerManagedBy(mgr).
+		For(&capi.Cluster{}).
+		Build(r)
+	if err != nil {
+		return err
+	}
+
+	r.controller = c
+	return nil
+}
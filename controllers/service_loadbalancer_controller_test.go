@@ -0,0 +1,124 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	ipamv1 "github.com/metal3-io/ip-address-manager/api/v1alpha1"
+	"github.com/spectrocloud/cluster-api-provider-vsphere-static-ip/pkg/ipam"
+	"github.com/spectrocloud/cluster-api-provider-vsphere-static-ip/pkg/ipam/metal3io"
+	"github.com/spectrocloud/cluster-api-provider-vsphere-static-ip/pkg/util"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	capi "sigs.k8s.io/cluster-api/api/v1beta1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+func TestReconcileServiceLoadBalancers(t *testing.T) {
+	s := newTestScheme(t)
+	assert.NoError(t, ipamv1.AddToScheme(s))
+	remoteScheme := runtime.NewScheme()
+	assert.NoError(t, corev1.AddToScheme(remoteScheme))
+
+	ctx := context.Background()
+	gateway := ipamv1.IPAddressStr("10.10.100.1")
+	newPool := func(name string) *ipamv1.IPPool {
+		return &ipamv1.IPPool{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"}}
+	}
+	cluster := &capi.Cluster{
+		TypeMeta:   metav1.TypeMeta{Kind: "Cluster", APIVersion: capi.GroupVersion.String()},
+		ObjectMeta: metav1.ObjectMeta{Name: "cluster", Namespace: "default", UID: "cluster-uid"},
+	}
+	newService := func(name string, svcType corev1.ServiceType, class *string) *corev1.Service {
+		return &corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+			Spec:       corev1.ServiceSpec{Type: svcType, LoadBalancerClass: class},
+		}
+	}
+	kubeVip, other := "kube-vip", "other"
+
+	//the address of the web Service was allocated from the previously selected IPPool
+	oldClaimName := util.GetFormattedServiceClaimName(cluster, "pool1", "default", "web")
+	owner := metav1.OwnerReference{Kind: "Cluster", APIVersion: capi.GroupVersion.String(), Name: "cluster", UID: "cluster-uid"}
+	oldClaim := &ipamv1.IPClaim{
+		ObjectMeta: metav1.ObjectMeta{Name: oldClaimName, Namespace: "default", OwnerReferences: []metav1.OwnerReference{owner},
+			Labels: map[string]string{ipam.ServiceLoadBalancerKey: "true"}},
+		Spec: ipamv1.IPClaimSpec{Pool: corev1.ObjectReference{Name: "pool1", Namespace: "default"}},
+	}
+	//another IPClaim owned by the Cluster, not by a Service, in the selected IPPool
+	otherClaim := &ipamv1.IPClaim{
+		ObjectMeta: metav1.ObjectMeta{Name: "cluster-other", Namespace: "default", OwnerReferences: []metav1.OwnerReference{owner}},
+		Spec:       ipamv1.IPClaimSpec{Pool: corev1.ObjectReference{Name: "pool2", Namespace: "default"}},
+	}
+
+	cli := fake.NewClientBuilder().WithScheme(s).WithObjects(newPool("pool1"), newPool("pool2"), cluster, oldClaim, otherClaim).Build()
+	remoteClient := fake.NewClientBuilder().WithScheme(remoteScheme).WithObjects(
+		newService("web", corev1.ServiceTypeLoadBalancer, nil),
+		newService("kube-vip", corev1.ServiceTypeLoadBalancer, &kubeVip),
+		newService("other", corev1.ServiceTypeLoadBalancer, &other),
+		newService("internal", corev1.ServiceTypeClusterIP, nil),
+	).Build()
+
+	ipamFunc := metal3io.NewIpam(cli, cli, log.NullLogger{}, ipam.Options{})
+	r := &ServiceLoadBalancerReconciler{Client: cli, Log: log.NullLogger{}, Scheme: s, IPAM: ipamFunc, LoadBalancerClass: kubeVip}
+	ipPool, err := ipamFunc.GetAvailableIPPool(map[string]string{ipam.ClusterIPPoolNameKey: "pool2"}, cluster.ObjectMeta, ipam.SelectionOptions{})
+	assert.NoError(t, err)
+
+	getClaim := func(name string) error {
+		return cli.Get(ctx, client.ObjectKey{Namespace: "default", Name: name}, &ipamv1.IPClaim{})
+	}
+	claimName := func(svc string) string {
+		return util.GetFormattedServiceClaimName(cluster, "pool2", "default", svc)
+	}
+
+	//the Services without a class and with the configured class are claimed from the selected IPPool, the claim of
+	//the previous IPPool is kept until the Services are assigned their new addresses
+	res, err := r.reconcileServices(ctx, cluster, ipamFunc, ipPool, remoteClient)
+	assert.NoError(t, err)
+	assert.NotZero(t, res.RequeueAfter)
+	assert.NoError(t, getClaim(claimName("web")))
+	assert.NoError(t, getClaim(claimName("kube-vip")))
+	assert.True(t, apierrors.IsNotFound(getClaim(claimName("other"))))
+	assert.True(t, apierrors.IsNotFound(getClaim(claimName("internal"))))
+	assert.NoError(t, getClaim(oldClaimName))
+
+	//the addresses are allocated by the metal3io ipam
+	for svc, address := range map[string]string{"web": "10.10.100.20", "kube-vip": "10.10.100.21"} {
+		ic := &ipamv1.IPClaim{}
+		assert.NoError(t, cli.Get(ctx, client.ObjectKey{Namespace: "default", Name: claimName(svc)}, ic))
+		ic.Status.Address = &corev1.ObjectReference{Name: "ip-" + svc, Namespace: "default"}
+		assert.NoError(t, cli.Update(ctx, ic))
+		assert.NoError(t, cli.Create(ctx, &ipamv1.IPAddress{
+			ObjectMeta: metav1.ObjectMeta{Name: "ip-" + svc, Namespace: "default"},
+			Spec:       ipamv1.IPAddressSpec{Address: ipamv1.IPAddressStr(address), Prefix: 24, Gateway: &gateway},
+		}))
+	}
+
+	res, err = r.reconcileServices(ctx, cluster, ipamFunc, ipPool, remoteClient)
+	assert.NoError(t, err)
+	assert.Zero(t, res.RequeueAfter)
+	for svc, address := range map[string]string{"web": "10.10.100.20", "kube-vip": "10.10.100.21"} {
+		service := &corev1.Service{}
+		assert.NoError(t, remoteClient.Get(ctx, client.ObjectKey{Namespace: "default", Name: svc}, service))
+		assert.Equal(t, []corev1.LoadBalancerIngress{{IP: address}}, service.Status.LoadBalancer.Ingress)
+	}
+	service := &corev1.Service{}
+	assert.NoError(t, remoteClient.Get(ctx, client.ObjectKey{Namespace: "default", Name: "other"}, service))
+	assert.Empty(t, service.Status.LoadBalancer.Ingress)
+
+	//the claim of the previous IPPool is released, the claim not owned by a Service is kept
+	assert.True(t, apierrors.IsNotFound(getClaim(oldClaimName)))
+	assert.NoError(t, getClaim(otherClaim.Name))
+
+	//the claim of a deleted Service is released
+	assert.NoError(t, remoteClient.Delete(ctx, newService("kube-vip", corev1.ServiceTypeLoadBalancer, &kubeVip)))
+	_, err = r.reconcileServices(ctx, cluster, ipamFunc, ipPool, remoteClient)
+	assert.NoError(t, err)
+	assert.True(t, apierrors.IsNotFound(getClaim(claimName("kube-vip"))))
+	assert.NoError(t, getClaim(claimName("web")))
+}
@@ -0,0 +1,236 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"sort"
+
+	"github.com/pkg/errors"
+	staticipv1 "github.com/spectrocloud/cluster-api-provider-vsphere-static-ip/api/v1alpha1"
+	"github.com/spectrocloud/cluster-api-provider-vsphere-static-ip/pkg/ipam"
+	"github.com/spectrocloud/cluster-api-provider-vsphere-static-ip/pkg/util"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	infrav1 "sigs.k8s.io/cluster-api-provider-vsphere/api/v1beta1"
+	capi "sigs.k8s.io/cluster-api/api/v1beta1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// machineRole is the role of the machine the StaticIPPolicy overrides the IPPool selection for
+type machineRole string
+
+const (
+	// the standalone VSphereVMs have no role
+	machineRoleNone         machineRole = ""
+	machineRoleControlPlane machineRole = "control-plane"
+	machineRoleWorker       machineRole = "worker"
+)
+
+// +kubebuilder:rbac:groups=ipam.spectrocloud.com,resources=staticippolicies,verbs=get;list;watch
+
+// getMachineRole gets the role of the machine from its control plane label, or its KubeadmControlPlane owner
+func getMachineRole(machine *capi.Machine) machineRole {
+	if machine == nil {
+		return machineRoleNone
+	}
+	if _, ok := machine.GetLabels()[capi.MachineControlPlaneLabelName]; ok {
+		return machineRoleControlPlane
+	}
+	if util.IsOwnedByKind(machine.ObjectMeta, "KubeadmControlPlane") {
+		return machineRoleControlPlane
+	}
+	return machineRoleWorker
+}
+
+// getRoleIPPoolSelector gets the IPPool selector of the role of the machine, set on the Cluster
+func getRoleIPPoolSelector(cluster *capi.Cluster, role machineRole) string {
+	switch role {
+	case machineRoleControlPlane:
+		return cluster.GetAnnotations()[ipam.ControlPlaneIPPoolSelectorKey]
+	case machineRoleWorker:
+		return cluster.GetAnnotations()[ipam.WorkerIPPoolSelectorKey]
+	}
+	return ""
+}
+
+// withRoleIPPoolSelector copies the IPPool match labels, and replaces the IPPool name, labels and selector with the
+// IPPool selector of the role of the machine, if set on the Cluster, so that the machines of the roles sharing a
+// template can be sent to different IPPools
+func withRoleIPPoolSelector(poolMatchLabels map[string]string, cluster *capi.Cluster, role machineRole) map[string]string {
+	roleSelector := getRoleIPPoolSelector(cluster, role)
+	if roleSelector == "" {
+		return poolMatchLabels
+	}
+
+	labels := map[string]string{ipam.RoleIPPoolSelectorKey: roleSelector}
+	for k, v := range poolMatchLabels {
+		labels[k] = v
+	}
+	for _, k := range ipam.IPPoolMatchLabelKeys {
+		delete(labels, k)
+	}
+
+	return labels
+}
+
+// getStaticIPPolicySelection gets the IPPool selection options from the StaticIPPolicy selecting the machine, nil if no
+// policy selects it. The policies of the Cluster namespace, and the ones of the global IPPool namespace selecting the
+// namespace, apply to the Cluster. The policy with the highest priority is used, then the one of the Cluster
+// namespace, then the first by name.
+func getStaticIPPolicySelection(cli client.Client, globalNamespace string, clusterMeta metav1.ObjectMeta,
+	template *infrav1.VSphereMachineTemplate, role machineRole) (*ipam.SelectionOptions, error) {
+	policies, err := listStaticIPPolicies(cli, clusterMeta.Namespace, globalNamespace)
+	if err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(policies, func(i, j int) bool {
+		if policies[i].Spec.Priority != policies[j].Spec.Priority {
+			return policies[i].Spec.Priority > policies[j].Spec.Priority
+		}
+		if policies[i].Namespace != policies[j].Namespace {
+			return policies[i].Namespace == clusterMeta.Namespace
+		}
+		return policies[i].Name < policies[j].Name
+	})
+
+	var namespaceLabels labels.Set
+	for i := range policies {
+		policy := &policies[i]
+		if policy.Namespace != clusterMeta.Namespace && policy.Spec.NamespaceSelector != nil && namespaceLabels == nil {
+			if namespaceLabels, err = util.GetNamespaceLabels(cli, clusterMeta.Namespace); err != nil {
+				return nil, err
+			}
+		}
+
+		ok, err := policySelects(policy, clusterMeta, namespaceLabels, template)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			return getPolicySelection(policy, role)
+		}
+	}
+
+	return nil, nil
+}
+
+// getVIPIPPoolSelection gets the IPPool match labels and selection options of a virtual IP of the Cluster, the control
+// plane endpoint or a load balancer address, from the StaticIPPolicy selecting the Cluster without a template, or else
+// the ones given from the labels of the object
+func getVIPIPPoolSelection(cli client.Client, globalNamespace string, clusterMeta metav1.ObjectMeta, role machineRole,
+	poolMatchLabels map[string]string, selection ipam.SelectionOptions) (map[string]string, ipam.SelectionOptions, error) {
+	policySelection, err := getStaticIPPolicySelection(cli, globalNamespace, clusterMeta, nil, role)
+	if err != nil {
+		return nil, ipam.SelectionOptions{}, err
+	}
+	if policySelection != nil {
+		return map[string]string{}, *policySelection, nil
+	}
+	return poolMatchLabels, selection, nil
+}
+
+// policySelects checks if the policy selects the machine of the Cluster, cloned from the VSphereMachineTemplate. The
+// standalone VSphereVMs, without a Cluster or a VSphereMachineTemplate, are not selected by the policies with a
+// selector for these.
+func policySelects(policy *staticipv1.StaticIPPolicy, clusterMeta metav1.ObjectMeta, namespaceLabels labels.Set,
+	template *infrav1.VSphereMachineTemplate) (bool, error) {
+	//the namespace selector of the policies in the global IPPool namespace selects the namespace of the Cluster
+	if policy.Namespace != clusterMeta.Namespace && policy.Spec.NamespaceSelector != nil {
+		if ok, err := matchesSelector(policy, policy.Spec.NamespaceSelector, namespaceLabels); !ok {
+			return false, err
+		}
+	}
+
+	if policy.Spec.ClusterSelector != nil {
+		if clusterMeta.Name == "" {
+			return false, nil
+		}
+		if ok, err := matchesSelector(policy, policy.Spec.ClusterSelector, clusterMeta.Labels); !ok {
+			return false, err
+		}
+	}
+
+	if policy.Spec.TemplateSelector != nil {
+		if template == nil {
+			return false, nil
+		}
+		if ok, err := matchesSelector(policy, policy.Spec.TemplateSelector, template.Labels); !ok {
+			return false, err
+		}
+	}
+
+	return true, nil
+}
+
+// getPolicySelection gets the IPPool selection options with the pool selectors and the strategy of the policy,
+// overridden for the role of the machine
+func getPolicySelection(policy *staticipv1.StaticIPPolicy, role machineRole) (*ipam.SelectionOptions, error) {
+	poolSelectors := policy.Spec.PoolSelectors
+	strategy := policy.Spec.Strategy
+
+	var rolePolicy *staticipv1.RolePolicy
+	switch role {
+	case machineRoleControlPlane:
+		rolePolicy = policy.Spec.ControlPlane
+	case machineRoleWorker:
+		rolePolicy = policy.Spec.Workers
+	}
+	if rolePolicy != nil {
+		if len(rolePolicy.PoolSelectors) > 0 {
+			poolSelectors = rolePolicy.PoolSelectors
+		}
+		if rolePolicy.Strategy != "" {
+			strategy = rolePolicy.Strategy
+		}
+	}
+
+	if len(poolSelectors) == 0 {
+		return nil, errors.Errorf("StaticIPPolicy %s/%s has no pool selectors", policy.Namespace, policy.Name)
+	}
+
+	return &ipam.SelectionOptions{PoolSelectors: poolSelectors, Strategy: strategy}, nil
+}
+
+// listStaticIPPolicies lists the StaticIPPolicies of the namespace, and of the global IPPool namespace, if set
+func listStaticIPPolicies(cli client.Client, namespace, globalNamespace string) ([]staticipv1.StaticIPPolicy, error) {
+	namespaces := []string{namespace}
+	if globalNamespace != "" && globalNamespace != namespace {
+		namespaces = append(namespaces, globalNamespace)
+	}
+
+	policies := []staticipv1.StaticIPPolicy{}
+	for _, ns := range namespaces {
+		list := &staticipv1.StaticIPPolicyList{}
+		if err := cli.List(context.Background(), list, client.InNamespace(ns)); err != nil {
+			return nil, errors.Wrapf(err, "failed to list StaticIPPolicies in namespace %s", ns)
+		}
+		policies = append(policies, list.Items...)
+	}
+
+	return policies, nil
+}
+
+func matchesSelector(policy *staticipv1.StaticIPPolicy, labelSelector *metav1.LabelSelector, objLabels map[string]string) (bool, error) {
+	selector, err := metav1.LabelSelectorAsSelector(labelSelector)
+	if err != nil {
+		return false, errors.Wrapf(err, "invalid selector in StaticIPPolicy %s/%s", policy.Namespace, policy.Name)
+	}
+
+	return selector.Matches(labels.Set(objLabels)), nil
+}
@@ -0,0 +1,110 @@
+package controllers
+
+import (
+	"testing"
+
+	staticipv1 "github.com/spectrocloud/cluster-api-provider-vsphere-static-ip/api/v1alpha1"
+	"github.com/spectrocloud/cluster-api-provider-vsphere-static-ip/pkg/ipam"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	infrav1 "sigs.k8s.io/cluster-api-provider-vsphere/api/v1beta1"
+	capi "sigs.k8s.io/cluster-api/api/v1beta1"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestGetStaticIPPolicyMatchLabels(t *testing.T) {
+	s := newTestScheme(t)
+	assert.NoError(t, corev1.AddToScheme(s))
+
+	poolSelectors := func(names ...string) []staticipv1.PoolSelector {
+		selectors := []staticipv1.PoolSelector{}
+		for _, name := range names {
+			selectors = append(selectors, staticipv1.PoolSelector{Name: name})
+		}
+		return selectors
+	}
+	selector := func(key, value string) *metav1.LabelSelector {
+		return &metav1.LabelSelector{MatchLabels: map[string]string{key: value}}
+	}
+	newPolicy := func(name, namespace string, priority int32, spec staticipv1.StaticIPPolicySpec) *staticipv1.StaticIPPolicy {
+		spec.Priority = priority
+		return &staticipv1.StaticIPPolicy{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace}, Spec: spec}
+	}
+
+	cli := fake.NewClientBuilder().WithScheme(s).WithObjects(
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "tenant1", Labels: map[string]string{"env": "prod"}}},
+		newPolicy("default", "tenant1", 0, staticipv1.StaticIPPolicySpec{PoolSelectors: poolSelectors("default")}),
+		newPolicy("gpu", "tenant1", 10, staticipv1.StaticIPPolicySpec{
+			TemplateSelector: selector("gpu", "true"),
+			PoolSelectors:    poolSelectors("gpu"),
+			Strategy:         staticipv1.MostFreeStrategy,
+			ControlPlane:     &staticipv1.RolePolicy{PoolSelectors: poolSelectors("gpu-cp")},
+			Workers:          &staticipv1.RolePolicy{Strategy: staticipv1.SpreadStrategy},
+		}),
+		newPolicy("prod", "global", 5, staticipv1.StaticIPPolicySpec{
+			NamespaceSelector: selector("env", "prod"),
+			ClusterSelector:   selector("tier", "edge"),
+			PoolSelectors:     poolSelectors("edge"),
+		}),
+		newPolicy("dev", "global", 20, staticipv1.StaticIPPolicySpec{
+			NamespaceSelector: selector("env", "dev"),
+			PoolSelectors:     poolSelectors("dev"),
+		}),
+	).Build()
+
+	cluster := metav1.ObjectMeta{Name: "cluster1", Namespace: "tenant1"}
+	edgeCluster := metav1.ObjectMeta{Name: "cluster2", Namespace: "tenant1", Labels: map[string]string{"tier": "edge"}}
+	gpuTemplate := &infrav1.VSphereMachineTemplate{ObjectMeta: metav1.ObjectMeta{Name: "gpu", Labels: map[string]string{"gpu": "true"}}}
+
+	tests := []struct {
+		clusterMeta metav1.ObjectMeta
+		template    *infrav1.VSphereMachineTemplate
+		role        machineRole
+		pools       []string
+		strategy    staticipv1.SelectionStrategy
+	}{
+		{clusterMeta: cluster, role: machineRoleWorker, pools: []string{"default"}},
+		{clusterMeta: edgeCluster, role: machineRoleWorker, pools: []string{"edge"}},
+		{clusterMeta: metav1.ObjectMeta{Namespace: "tenant1"}, role: machineRoleNone, pools: []string{"default"}},
+		{clusterMeta: edgeCluster, template: gpuTemplate, role: machineRoleNone, pools: []string{"gpu"}, strategy: staticipv1.MostFreeStrategy},
+		{clusterMeta: cluster, template: gpuTemplate, role: machineRoleControlPlane, pools: []string{"gpu-cp"}, strategy: staticipv1.MostFreeStrategy},
+		{clusterMeta: cluster, template: gpuTemplate, role: machineRoleWorker, pools: []string{"gpu"}, strategy: staticipv1.SpreadStrategy},
+	}
+	for _, tt := range tests {
+		selection, err := getStaticIPPolicySelection(cli, "global", tt.clusterMeta, tt.template, tt.role)
+		assert.NoError(t, err)
+		assert.Equal(t, &ipam.SelectionOptions{PoolSelectors: poolSelectors(tt.pools...), Strategy: tt.strategy}, selection, tt.pools)
+	}
+
+	//no policy applies to the namespaces without one
+	selection, err := getStaticIPPolicySelection(cli, "global", metav1.ObjectMeta{Name: "cluster1", Namespace: "tenant2"}, nil, machineRoleWorker)
+	assert.NoError(t, err)
+	assert.Nil(t, selection)
+}
+
+func TestGetMachineRole(t *testing.T) {
+	assert.Equal(t, machineRoleNone, getMachineRole(nil))
+	assert.Equal(t, machineRoleWorker, getMachineRole(&capi.Machine{}))
+	assert.Equal(t, machineRoleControlPlane, getMachineRole(&capi.Machine{ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{capi.MachineControlPlaneLabelName: ""}}}))
+	assert.Equal(t, machineRoleControlPlane, getMachineRole(&capi.Machine{ObjectMeta: metav1.ObjectMeta{
+		OwnerReferences: []metav1.OwnerReference{{Kind: "KubeadmControlPlane", Name: "kcp"}}}}))
+}
+
+func TestWithRoleIPPoolSelector(t *testing.T) {
+	cluster := &capi.Cluster{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{
+		ipam.ControlPlaneIPPoolSelectorKey: "tier=control-plane",
+		ipam.WorkerIPPoolSelectorKey:       "tier in (worker, shared)",
+	}}}
+	poolMatchLabels := map[string]string{ipam.ClusterIPPoolGroupKey: "prod", ipam.ClusterIPPoolNameKey: "pool1",
+		ipam.IPPoolSelectorKey: "tier", "app": "web"}
+
+	//the role selector replaces the IPPool name, labels and selector of the template shared by the roles
+	labels := withRoleIPPoolSelector(poolMatchLabels, cluster, machineRoleControlPlane)
+	assert.Equal(t, map[string]string{ipam.RoleIPPoolSelectorKey: "tier=control-plane", "app": "web"}, labels)
+	labels = withRoleIPPoolSelector(poolMatchLabels, cluster, machineRoleWorker)
+	assert.Equal(t, map[string]string{ipam.RoleIPPoolSelectorKey: "tier in (worker, shared)", "app": "web"}, labels)
+	assert.Equal(t, poolMatchLabels, withRoleIPPoolSelector(poolMatchLabels, cluster, machineRoleNone))
+	assert.Equal(t, poolMatchLabels, withRoleIPPoolSelector(poolMatchLabels, &capi.Cluster{}, machineRoleWorker))
+	assert.Len(t, poolMatchLabels, 4)
+}
@@ -0,0 +1,80 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+	"github.com/spectrocloud/cluster-api-provider-vsphere-static-ip/pkg/ipam"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	infrav1 "sigs.k8s.io/cluster-api-provider-vsphere/api/v1beta1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// withTopology adds the placement of the VM to a copy of the IPPool match labels, for the IPPools of the datacenter,
+// the vCenter server, the resource pool and the failure domain to be selected
+func withTopology(cli client.Client, poolMatchLabels map[string]string, cloneSpec infrav1.VirtualMachineCloneSpec,
+	failureDomain string) (map[string]string, error) {
+	topology := map[string]string{
+		ipam.DatacenterKey:    cloneSpec.Datacenter,
+		ipam.VCenterServerKey: cloneSpec.Server,
+		ipam.ResourcePoolKey:  cloneSpec.ResourcePool,
+		ipam.FailureDomainKey: failureDomain,
+	}
+
+	//the placement of the failure domain, set by capv from the VSphereDeploymentZone, overrides the clone spec
+	if failureDomain != "" {
+		zone := &infrav1.VSphereDeploymentZone{}
+		if err := cli.Get(context.Background(), types.NamespacedName{Name: failureDomain}, zone); err != nil {
+			if !apierrors.IsNotFound(err) {
+				return nil, errors.Wrapf(err, "failed to get VSphereDeploymentZone %s", failureDomain)
+			}
+		} else {
+			setIfNotEmpty(topology, ipam.VCenterServerKey, zone.Spec.Server)
+			setIfNotEmpty(topology, ipam.ResourcePoolKey, zone.Spec.PlacementConstraint.ResourcePool)
+
+			vSphereFailureDomain := &infrav1.VSphereFailureDomain{}
+			if err := cli.Get(context.Background(), types.NamespacedName{Name: zone.Spec.FailureDomain}, vSphereFailureDomain); err != nil {
+				if !apierrors.IsNotFound(err) {
+					return nil, errors.Wrapf(err, "failed to get VSphereFailureDomain %s", zone.Spec.FailureDomain)
+				}
+			} else {
+				setIfNotEmpty(topology, ipam.DatacenterKey, vSphereFailureDomain.Spec.Topology.Datacenter)
+			}
+		}
+	}
+
+	labels := map[string]string{}
+	for k, v := range poolMatchLabels {
+		labels[k] = v
+	}
+	for k, v := range topology {
+		if v != "" {
+			labels[k] = v
+		}
+	}
+
+	return labels, nil
+}
+
+func setIfNotEmpty(m map[string]string, key, value string) {
+	if value != "" {
+		m[key] = value
+	}
+}
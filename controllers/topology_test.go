@@ -0,0 +1,47 @@
+package controllers
+
+import (
+	"testing"
+
+	"github.com/spectrocloud/cluster-api-provider-vsphere-static-ip/pkg/ipam"
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	infrav1 "sigs.k8s.io/cluster-api-provider-vsphere/api/v1beta1"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestWithTopology(t *testing.T) {
+	s := newTestScheme(t)
+	zone := &infrav1.VSphereDeploymentZone{
+		ObjectMeta: metav1.ObjectMeta{Name: "zone-b"},
+		Spec: infrav1.VSphereDeploymentZoneSpec{
+			Server:              "vcenter-b",
+			FailureDomain:       "fd-b",
+			PlacementConstraint: infrav1.PlacementConstraint{ResourcePool: "/dc2/host/cluster/Resources/rp"},
+		},
+	}
+	failureDomain := &infrav1.VSphereFailureDomain{
+		ObjectMeta: metav1.ObjectMeta{Name: "fd-b"},
+		Spec:       infrav1.VSphereFailureDomainSpec{Topology: infrav1.Topology{Datacenter: "dc2"}},
+	}
+	cli := fake.NewClientBuilder().WithScheme(s).WithObjects(zone, failureDomain).Build()
+
+	poolMatchLabels := map[string]string{ipam.ClusterIPPoolGroupKey: "dev"}
+	cloneSpec := infrav1.VirtualMachineCloneSpec{Datacenter: "dc1", Server: "vcenter-a"}
+
+	labels, err := withTopology(cli, poolMatchLabels, cloneSpec, "")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{ipam.ClusterIPPoolGroupKey: "dev", ipam.DatacenterKey: "dc1", ipam.VCenterServerKey: "vcenter-a"}, labels)
+
+	//the placement of the deployment zone overrides the clone spec
+	labels, err = withTopology(cli, poolMatchLabels, cloneSpec, "zone-b")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		ipam.ClusterIPPoolGroupKey: "dev",
+		ipam.DatacenterKey:         "dc2",
+		ipam.VCenterServerKey:      "vcenter-b",
+		ipam.ResourcePoolKey:       "/dc2/host/cluster/Resources/rp",
+		ipam.FailureDomainKey:      "zone-b",
+	}, labels)
+	assert.Len(t, poolMatchLabels, 1)
+}
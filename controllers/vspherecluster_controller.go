@@ -19,16 +19,23 @@ package controllers
 import (
 	"context"
 	"fmt"
+	"strconv"
 	"time"
 
 	"github.com/go-logr/logr"
 	"github.com/pkg/errors"
 	"github.com/spectrocloud/cluster-api-provider-vsphere-static-ip/pkg/ipam"
-	"github.com/spectrocloud/cluster-api-provider-vsphere-static-ip/pkg/ipam/factory"
+	"github.com/spectrocloud/cluster-api-provider-vsphere-static-ip/pkg/kubevip"
 	"github.com/spectrocloud/cluster-api-provider-vsphere-static-ip/pkg/util"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
 	"k8s.io/apimachinery/pkg/runtime"
-	infrav1 "sigs.k8s.io/cluster-api-provider-vsphere/api/v1alpha4"
-	capi "sigs.k8s.io/cluster-api/api/v1alpha4"
+	"k8s.io/apimachinery/pkg/types"
+	infrav1alpha3 "sigs.k8s.io/cluster-api-provider-vsphere/api/v1alpha3"
+	infrav1 "sigs.k8s.io/cluster-api-provider-vsphere/api/v1beta1"
+	capi "sigs.k8s.io/cluster-api/api/v1beta1"
+	bootstrapv1 "sigs.k8s.io/cluster-api/bootstrap/kubeadm/api/v1beta1"
+	kubeadmcontrolplane "sigs.k8s.io/cluster-api/controlplane/kubeadm/api/v1beta1"
 	clusterutilv1 "sigs.k8s.io/cluster-api/util"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
@@ -39,10 +46,13 @@ type VSphereClusterReconciler struct {
 	client.Client
 	Log    logr.Logger
 	Scheme *runtime.Scheme
+	// IPAM allocates the static IPs, it is shared by the reconcilers for the allocations from an IPPool to be serialized
+	IPAM ipam.IPAddressManager
 }
 
 // +kubebuilder:rbac:groups=infrastructure.cluster.x-k8s.io,resources=vsphereclusters,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups=infrastructure.cluster.x-k8s.io,resources=vsphereclusters/status,verbs=get;update;patch
+// +kubebuilder:rbac:groups=controlplane.cluster.x-k8s.io,resources=kubeadmcontrolplanes,verbs=get;list;watch;update;patch
 
 func (r *VSphereClusterReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
 	log := r.Log.WithValues("vspherecluster", req.NamespacedName)
@@ -89,19 +99,28 @@ func (r *VSphereClusterReconciler) reconcileVSphereClusterControlPlaneEndpoint(c
 
 	if len(vSphereCluster.Spec.ControlPlaneEndpoint.Host) > 0 {
 		log.V(0).Info("control plane endpoint is already allocated for the VSphereCluster", "vSphereCluster", vSphereCluster.Name)
-		return &ctrl.Result{}, nil
+		return r.reconcileKubeadmControlPlane(cluster, vSphereCluster)
 	}
 
-	newIpamFunc, ok := factory.IpamFactory[ipam.IpamTypeMetal3io]
-	if !ok {
-		log.V(0).Info("ipam type not supported")
+	//the control plane endpoint is set by capv from the HAProxyLoadBalancer address
+	hasLB, err := r.hasHAProxyLoadBalancer(cluster)
+	if err != nil {
+		return &ctrl.Result{}, err
+	}
+	if hasLB {
+		log.V(0).Info("control plane endpoint is provided by the HAProxyLoadBalancer, skipping allocation")
 		return &ctrl.Result{}, nil
 	}
 
 	dataPatch := client.MergeFrom(vSphereCluster.DeepCopy())
-	ipamFunc := newIpamFunc(r.Client, log)
-
-	ipPool, err := ipamFunc.GetAvailableIPPool(vSphereCluster.Labels, cluster.ObjectMeta)
+	//the StaticIPPolicy selecting the control plane of the Cluster takes precedence over the IPPool labels of the
+	//VSphereCluster
+	poolMatchLabels, selection, err := getVIPIPPoolSelection(r.Client, r.IPAM.GetOptions().GlobalIPPoolNamespace, cluster.ObjectMeta,
+		machineRoleControlPlane, vSphereCluster.Labels, ipam.SelectionOptions{})
+	if err != nil {
+		return &ctrl.Result{}, err
+	}
+	ipPool, err := r.IPAM.GetAvailableIPPool(poolMatchLabels, cluster.ObjectMeta, selection)
 	if err != nil {
 		log.Error(err, "failed to get an available IPPool")
 		return &ctrl.Result{}, nil
@@ -111,14 +130,14 @@ func (r *VSphereClusterReconciler) reconcileVSphereClusterControlPlaneEndpoint(c
 		return &ctrl.Result{}, nil
 	}
 
-	ipName := vSphereCluster.Name
-	ip, err := ipamFunc.GetIP(ipName, ipPool)
+	ipName := util.GetClaimOwnerName(vSphereCluster, ipPool.GetNamespace())
+	ip, err := r.IPAM.GetIP(ipName, ipPool)
 	if err != nil {
 		return &ctrl.Result{}, errors.Wrapf(err, "failed to get allocated IP address for VSphereCluster %s", vSphereCluster.Name)
 	}
 
 	if ip == nil {
-		if _, err := ipamFunc.AllocateIP(ipName, ipPool, vSphereCluster); err != nil {
+		if _, err := r.IPAM.AllocateIP(ipName, ipPool, vSphereCluster, nil); err != nil {
 			return &ctrl.Result{}, errors.Wrapf(err, "failed to allocate IP address for VSphereCluster %s", vSphereCluster.Name)
 		}
 
@@ -140,9 +159,159 @@ func (r *VSphereClusterReconciler) reconcileVSphereClusterControlPlaneEndpoint(c
 
 	log.V(0).Info("successfully reconciled control plane endpoint for VSphereCluster")
 
+	return r.reconcileKubeadmControlPlane(cluster, vSphereCluster)
+}
+
+func (r *VSphereClusterReconciler) hasHAProxyLoadBalancer(cluster *capi.Cluster) (bool, error) {
+	lbs := &infrav1alpha3.HAProxyLoadBalancerList{}
+	if err := r.List(context.TODO(), lbs, client.InNamespace(cluster.Namespace),
+		client.MatchingLabels{capi.ClusterLabelName: cluster.Name}); err != nil {
+		//the HAProxyLoadBalancer CRD is deprecated and might not be installed
+		if meta.IsNoMatchError(err) {
+			return false, nil
+		}
+		return false, errors.Wrapf(err, "failed to list HAProxyLoadBalancers for cluster %s", cluster.Name)
+	}
+
+	return len(lbs.Items) > 0, nil
+}
+
+// reconcileKubeadmControlPlane configures the KubeadmControlPlane with the control plane endpoint of the VSphereCluster,
+// if enabled with the kube-vip or inject-control-plane-endpoint annotations on the VSphereCluster
+func (r *VSphereClusterReconciler) reconcileKubeadmControlPlane(cluster *capi.Cluster, vSphereCluster *infrav1.VSphereCluster) (*ctrl.Result, error) {
+	annotations := vSphereCluster.GetAnnotations()
+	kubeVip, _ := strconv.ParseBool(annotations[ipam.KubeVipKey])
+	injectEndpoint, _ := strconv.ParseBool(annotations[ipam.InjectControlPlaneEndpointKey])
+	if !kubeVip && !injectEndpoint {
+		return &ctrl.Result{}, nil
+	}
+
+	log := r.Log.WithValues("vsphereCluster", vSphereCluster.Name, "namespace", vSphereCluster.Namespace)
+
+	kcp, err := r.getKubeadmControlPlane(cluster)
+	if err != nil {
+		return &ctrl.Result{}, err
+	}
+	if kcp == nil {
+		log.V(0).Info("waiting for KubeadmControlPlane to be available")
+		return &ctrl.Result{}, nil
+	}
+
+	//a change of the KubeadmControlPlane spec rolls out the control plane machines, so it is only configured before the
+	//first one is created
+	hasMachines, err := r.hasControlPlaneMachines(cluster)
+	if err != nil {
+		return &ctrl.Result{}, err
+	}
+	if hasMachines {
+		log.V(0).Info("control plane machines already exist, skipping KubeadmControlPlane configuration", "kubeadmControlPlane", kcp.Name)
+		return &ctrl.Result{}, nil
+	}
+
+	vip := vSphereCluster.Spec.ControlPlaneEndpoint.Host
+	dataPatch := client.MergeFrom(kcp.DeepCopy())
+	updated := false
+
+	if kubeVip && !hasFile(kcp.Spec.KubeadmConfigSpec.Files, kubevip.ManifestPath) {
+		manifest, err := kubevip.RenderManifest(kubevip.Config{
+			VIP:       vip,
+			Interface: annotations[ipam.KubeVipInterfaceKey],
+			Image:     annotations[ipam.KubeVipImageKey],
+		})
+		if err != nil {
+			return &ctrl.Result{}, err
+		}
+
+		kcp.Spec.KubeadmConfigSpec.Files = append(kcp.Spec.KubeadmConfigSpec.Files, bootstrapv1.File{
+			Path:    kubevip.ManifestPath,
+			Owner:   "root:root",
+			Content: manifest,
+		})
+		updated = true
+	}
+
+	if injectEndpoint && util.InjectControlPlaneEndpoint(&kcp.Spec.KubeadmConfigSpec, vip) {
+		updated = true
+	}
+
+	if updated {
+		if err := r.Patch(context.TODO(), kcp, dataPatch); err != nil {
+			return &ctrl.Result{}, errors.Wrapf(err, "failed to patch KubeadmControlPlane %s", kcp.Name)
+		}
+		log.V(0).Info("configured control plane endpoint in KubeadmControlPlane", "kubeadmControlPlane", kcp.Name)
+	}
+
+	if injectEndpoint {
+		if err := r.setKubeadmControlPlaneEndpoint(log, kcp, vSphereCluster.Spec.ControlPlaneEndpoint); err != nil {
+			return &ctrl.Result{}, err
+		}
+	}
+
 	return &ctrl.Result{}, nil
 }
 
+// setKubeadmControlPlaneEndpoint sets the control plane endpoint of the ClusterConfiguration of the KubeadmControlPlane
+// to the VIP. It is patched on its own, as the KubeadmControlPlane webhook rejects its change once the
+// KubeadmControlPlane is created, in which case it is left to capi, which sets it from the Cluster in the KubeadmConfigs
+// of the machines.
+func (r *VSphereClusterReconciler) setKubeadmControlPlaneEndpoint(log logr.Logger, kcp *kubeadmcontrolplane.KubeadmControlPlane,
+	endpoint infrav1.APIEndpoint) error {
+	dataPatch := client.MergeFrom(kcp.DeepCopy())
+	if !util.SetControlPlaneEndpoint(&kcp.Spec.KubeadmConfigSpec, endpoint.Host, endpoint.Port) {
+		return nil
+	}
+
+	if err := r.Patch(context.TODO(), kcp, dataPatch); err != nil {
+		if apierrors.IsInvalid(err) {
+			log.V(0).Info("control plane endpoint can not be changed in KubeadmControlPlane, it is set from the Cluster",
+				"kubeadmControlPlane", kcp.Name)
+			return nil
+		}
+		return errors.Wrapf(err, "failed to patch the control plane endpoint of KubeadmControlPlane %s", kcp.Name)
+	}
+
+	log.V(0).Info("set control plane endpoint in KubeadmControlPlane", "kubeadmControlPlane", kcp.Name)
+	return nil
+}
+
+// hasControlPlaneMachines checks if the control plane machines of the cluster are created
+func (r *VSphereClusterReconciler) hasControlPlaneMachines(cluster *capi.Cluster) (bool, error) {
+	machines := &capi.MachineList{}
+	if err := r.List(context.TODO(), machines, client.InNamespace(cluster.Namespace),
+		client.MatchingLabels{capi.ClusterLabelName: cluster.Name}, client.HasLabels{capi.MachineControlPlaneLabelName}); err != nil {
+		return false, errors.Wrapf(err, "failed to list the control plane machines of cluster %s", cluster.Name)
+	}
+
+	return len(machines.Items) > 0, nil
+}
+
+func hasFile(files []bootstrapv1.File, path string) bool {
+	for _, f := range files {
+		if f.Path == path {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *VSphereClusterReconciler) getKubeadmControlPlane(cluster *capi.Cluster) (*kubeadmcontrolplane.KubeadmControlPlane, error) {
+	ref := cluster.Spec.ControlPlaneRef
+	if ref == nil || ref.Kind != "KubeadmControlPlane" {
+		return nil, nil
+	}
+
+	kcp := &kubeadmcontrolplane.KubeadmControlPlane{}
+	key := types.NamespacedName{Namespace: cluster.Namespace, Name: ref.Name}
+	if err := r.Get(context.TODO(), key, kcp); err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, errors.Wrapf(err, "failed to get KubeadmControlPlane %s", ref.Name)
+	}
+
+	return kcp, nil
+}
+
 func (r *VSphereClusterReconciler) SetupWithManager(mgr ctrl.Manager) error {
 	return ctrl.NewControllerManagedBy(mgr).
 		For(&infrav1.VSphereCluster{}).
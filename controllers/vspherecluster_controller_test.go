@@ -0,0 +1,243 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	ipamv1 "github.com/metal3-io/ip-address-manager/api/v1alpha1"
+	staticipv1 "github.com/spectrocloud/cluster-api-provider-vsphere-static-ip/api/v1alpha1"
+	"github.com/spectrocloud/cluster-api-provider-vsphere-static-ip/pkg/ipam"
+	"github.com/spectrocloud/cluster-api-provider-vsphere-static-ip/pkg/ipam/metal3io"
+	"github.com/spectrocloud/cluster-api-provider-vsphere-static-ip/pkg/kubevip"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	infrav1alpha3 "sigs.k8s.io/cluster-api-provider-vsphere/api/v1alpha3"
+	infrav1 "sigs.k8s.io/cluster-api-provider-vsphere/api/v1beta1"
+	capi "sigs.k8s.io/cluster-api/api/v1beta1"
+	bootstrapv1 "sigs.k8s.io/cluster-api/bootstrap/kubeadm/api/v1beta1"
+	kubeadmcontrolplane "sigs.k8s.io/cluster-api/controlplane/kubeadm/api/v1beta1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+func TestReconcileKubeadmControlPlaneInjectEndpoint(t *testing.T) {
+	s := newTestScheme(t)
+
+	cluster := &capi.Cluster{
+		ObjectMeta: metav1.ObjectMeta{Name: "cluster", Namespace: "default"},
+		Spec:       capi.ClusterSpec{ControlPlaneRef: &corev1.ObjectReference{Kind: "KubeadmControlPlane", Name: "kcp"}},
+	}
+	vSphereCluster := &infrav1.VSphereCluster{
+		ObjectMeta: metav1.ObjectMeta{Name: "cluster", Namespace: "default",
+			Annotations: map[string]string{ipam.InjectControlPlaneEndpointKey: "true"}},
+		Spec: infrav1.VSphereClusterSpec{ControlPlaneEndpoint: infrav1.APIEndpoint{Host: "10.10.100.22", Port: 6443}},
+	}
+	kcp := &kubeadmcontrolplane.KubeadmControlPlane{ObjectMeta: metav1.ObjectMeta{Name: "kcp", Namespace: "default"}}
+	kcp.Spec.KubeadmConfigSpec.Files = []bootstrapv1.File{{Path: "/etc/vip", Content: "address: {{ .VIP }}"}}
+	cli := fake.NewClientBuilder().WithScheme(s).WithObjects(cluster, vSphereCluster, kcp).Build()
+	r := &VSphereClusterReconciler{Client: cli, Log: log.NullLogger{}, IPAM: metal3io.NewIpam(cli, cli, log.NullLogger{}, ipam.Options{})}
+
+	//the VIP is added to the certSANs and the files, and is the control plane endpoint
+	_, err := r.reconcileVSphereClusterControlPlaneEndpoint(cluster, vSphereCluster)
+	assert.NoError(t, err)
+	assert.NoError(t, cli.Get(context.Background(), client.ObjectKeyFromObject(kcp), kcp))
+	assert.Equal(t, []string{"10.10.100.22"}, kcp.Spec.KubeadmConfigSpec.ClusterConfiguration.APIServer.CertSANs)
+	assert.Equal(t, "10.10.100.22:6443", kcp.Spec.KubeadmConfigSpec.ClusterConfiguration.ControlPlaneEndpoint)
+	assert.Equal(t, "address: 10.10.100.22", kcp.Spec.KubeadmConfigSpec.Files[0].Content)
+
+	//the KubeadmControlPlane is no longer changed once its machines are created, not to roll them out
+	kcp.Spec.KubeadmConfigSpec.Files = append(kcp.Spec.KubeadmConfigSpec.Files, bootstrapv1.File{Path: "/etc/other", Content: "{{ .VIP }}"})
+	assert.NoError(t, cli.Update(context.Background(), kcp))
+	machine := &capi.Machine{ObjectMeta: metav1.ObjectMeta{Name: "cp-0", Namespace: "default",
+		Labels: map[string]string{capi.ClusterLabelName: "cluster", capi.MachineControlPlaneLabelName: ""}}}
+	assert.NoError(t, cli.Create(context.Background(), machine))
+	_, err = r.reconcileVSphereClusterControlPlaneEndpoint(cluster, vSphereCluster)
+	assert.NoError(t, err)
+	assert.NoError(t, cli.Get(context.Background(), client.ObjectKeyFromObject(kcp), kcp))
+	assert.Equal(t, "{{ .VIP }}", kcp.Spec.KubeadmConfigSpec.Files[1].Content)
+}
+
+// endpointWebhookClient rejects the change of the control plane endpoint of a KubeadmControlPlane, as its webhook does
+type endpointWebhookClient struct {
+	client.Client
+}
+
+func (c endpointWebhookClient) Patch(ctx context.Context, obj client.Object, patch client.Patch, opts ...client.PatchOption) error {
+	if kcp, ok := obj.(*kubeadmcontrolplane.KubeadmControlPlane); ok {
+		current := &kubeadmcontrolplane.KubeadmControlPlane{}
+		if err := c.Get(ctx, client.ObjectKeyFromObject(kcp), current); err != nil {
+			return err
+		}
+		endpoint := func(kcp *kubeadmcontrolplane.KubeadmControlPlane) string {
+			if kcp.Spec.KubeadmConfigSpec.ClusterConfiguration == nil {
+				return ""
+			}
+			return kcp.Spec.KubeadmConfigSpec.ClusterConfiguration.ControlPlaneEndpoint
+		}
+		if endpoint(kcp) != endpoint(current) {
+			return apierrors.NewInvalid(kubeadmcontrolplane.GroupVersion.WithKind("KubeadmControlPlane").GroupKind(), kcp.Name,
+				field.ErrorList{field.Forbidden(field.NewPath("spec", "kubeadmConfigSpec", "clusterConfiguration", "controlPlaneEndpoint"), "cannot be modified")})
+		}
+	}
+	return c.Client.Patch(ctx, obj, patch, opts...)
+}
+
+func TestReconcileKubeadmControlPlaneEndpointRejected(t *testing.T) {
+	s := newTestScheme(t)
+
+	cluster := &capi.Cluster{
+		ObjectMeta: metav1.ObjectMeta{Name: "cluster", Namespace: "default"},
+		Spec:       capi.ClusterSpec{ControlPlaneRef: &corev1.ObjectReference{Kind: "KubeadmControlPlane", Name: "kcp"}},
+	}
+	vSphereCluster := &infrav1.VSphereCluster{
+		ObjectMeta: metav1.ObjectMeta{Name: "cluster", Namespace: "default",
+			Annotations: map[string]string{ipam.InjectControlPlaneEndpointKey: "true"}},
+		Spec: infrav1.VSphereClusterSpec{ControlPlaneEndpoint: infrav1.APIEndpoint{Host: "10.10.100.22", Port: 6443}},
+	}
+	kcp := &kubeadmcontrolplane.KubeadmControlPlane{ObjectMeta: metav1.ObjectMeta{Name: "kcp", Namespace: "default"}}
+	cli := endpointWebhookClient{fake.NewClientBuilder().WithScheme(s).WithObjects(cluster, vSphereCluster, kcp).Build()}
+	r := &VSphereClusterReconciler{Client: cli, Log: log.NullLogger{}, IPAM: metal3io.NewIpam(cli, cli, log.NullLogger{}, ipam.Options{})}
+
+	//the control plane endpoint rejected by the webhook is left to capi, the certSANs are kept
+	_, err := r.reconcileVSphereClusterControlPlaneEndpoint(cluster, vSphereCluster)
+	assert.NoError(t, err)
+	assert.NoError(t, cli.Get(context.Background(), client.ObjectKeyFromObject(kcp), kcp))
+	assert.Equal(t, []string{"10.10.100.22"}, kcp.Spec.KubeadmConfigSpec.ClusterConfiguration.APIServer.CertSANs)
+	assert.Empty(t, kcp.Spec.KubeadmConfigSpec.ClusterConfiguration.ControlPlaneEndpoint)
+}
+
+func TestReconcileVSphereClusterKubeVip(t *testing.T) {
+	s := newTestScheme(t)
+	assert.NoError(t, ipamv1.AddToScheme(s))
+	assert.NoError(t, infrav1alpha3.AddToScheme(s))
+
+	ctx := context.Background()
+	start, end, gateway := ipamv1.IPAddressStr("10.10.100.20"), ipamv1.IPAddressStr("10.10.100.30"), ipamv1.IPAddressStr("10.10.100.1")
+	pool := &ipamv1.IPPool{
+		ObjectMeta: metav1.ObjectMeta{Name: "pool1", Namespace: "default"},
+		Spec:       ipamv1.IPPoolSpec{Pools: []ipamv1.Pool{{Start: &start, End: &end}}, Prefix: 24},
+	}
+	newCluster := func(name string) (*capi.Cluster, *infrav1.VSphereCluster, *kubeadmcontrolplane.KubeadmControlPlane) {
+		cluster := &capi.Cluster{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", UID: types.UID("uid-" + name)},
+			Spec:       capi.ClusterSpec{ControlPlaneRef: &corev1.ObjectReference{Kind: "KubeadmControlPlane", Name: name}},
+		}
+		vSphereCluster := &infrav1.VSphereCluster{
+			TypeMeta: metav1.TypeMeta{Kind: "VSphereCluster", APIVersion: infrav1.GroupVersion.String()},
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", UID: types.UID("uid-vsphere-" + name),
+				Labels:      map[string]string{ipam.ClusterIPPoolNameKey: "pool1"},
+				Annotations: map[string]string{ipam.KubeVipKey: "true"},
+				OwnerReferences: []metav1.OwnerReference{{APIVersion: capi.GroupVersion.String(), Kind: "Cluster", Name: name,
+					UID: cluster.UID}}},
+		}
+		kcp := &kubeadmcontrolplane.KubeadmControlPlane{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"}}
+		return cluster, vSphereCluster, kcp
+	}
+	cluster, vSphereCluster, kcp := newCluster("cluster")
+	lbCluster, lbVSphereCluster, lbKCP := newCluster("lb-cluster")
+	lb := &infrav1alpha3.HAProxyLoadBalancer{ObjectMeta: metav1.ObjectMeta{Name: "lb", Namespace: "default",
+		Labels: map[string]string{capi.ClusterLabelName: "lb-cluster"}}}
+
+	cli := fake.NewClientBuilder().WithScheme(s).WithObjects(pool, cluster, vSphereCluster, kcp,
+		lbCluster, lbVSphereCluster, lbKCP, lb).Build()
+	r := &VSphereClusterReconciler{Client: cli, Log: log.NullLogger{}, Scheme: s, IPAM: metal3io.NewIpam(cli, cli, log.NullLogger{}, ipam.Options{})}
+	reconcile := func(name string) ctrl.Result {
+		res, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKey{Namespace: "default", Name: name}})
+		assert.NoError(t, err)
+		return res
+	}
+	claims := func() []ipamv1.IPClaim {
+		ipClaims := &ipamv1.IPClaimList{}
+		assert.NoError(t, cli.List(ctx, ipClaims))
+		return ipClaims.Items
+	}
+
+	//the control plane endpoint of the cluster with a HAProxyLoadBalancer is set by capv
+	assert.Zero(t, reconcile("lb-cluster"))
+	assert.Empty(t, claims())
+	assert.NoError(t, cli.Get(ctx, client.ObjectKeyFromObject(lbKCP), lbKCP))
+	assert.Empty(t, lbKCP.Spec.KubeadmConfigSpec.Files)
+
+	//the control plane endpoint is claimed, and waited for
+	assert.NotZero(t, reconcile("cluster"))
+	ipClaims := claims()
+	assert.Len(t, ipClaims, 1)
+	//the claim is released with the VSphereCluster, by the garbage collector
+	assert.Equal(t, vSphereCluster.UID, ipClaims[0].OwnerReferences[0].UID)
+
+	ic := &ipClaims[0]
+	ic.Status.Address = &corev1.ObjectReference{Name: "ip-cluster", Namespace: "default"}
+	assert.NoError(t, cli.Update(ctx, ic))
+	assert.NoError(t, cli.Create(ctx, &ipamv1.IPAddress{
+		ObjectMeta: metav1.ObjectMeta{Name: "ip-cluster", Namespace: "default"},
+		Spec:       ipamv1.IPAddressSpec{Address: "10.10.100.20", Prefix: 24, Gateway: &gateway},
+	}))
+
+	//the allocated address is the control plane endpoint, and the kube-vip manifest with the VIP is added to the
+	//KubeadmControlPlane
+	assert.Zero(t, reconcile("cluster"))
+	assert.NoError(t, cli.Get(ctx, client.ObjectKeyFromObject(vSphereCluster), vSphereCluster))
+	assert.Equal(t, "10.10.100.20", vSphereCluster.Spec.ControlPlaneEndpoint.Host)
+	assert.NoError(t, cli.Get(ctx, client.ObjectKeyFromObject(kcp), kcp))
+	assert.Len(t, kcp.Spec.KubeadmConfigSpec.Files, 1)
+	assert.Equal(t, kubevip.ManifestPath, kcp.Spec.KubeadmConfigSpec.Files[0].Path)
+	assert.Contains(t, kcp.Spec.KubeadmConfigSpec.Files[0].Content, "10.10.100.20")
+
+	//the manifest is added once
+	assert.Zero(t, reconcile("cluster"))
+	assert.NoError(t, cli.Get(ctx, client.ObjectKeyFromObject(kcp), kcp))
+	assert.Len(t, kcp.Spec.KubeadmConfigSpec.Files, 1)
+}
+
+func TestReconcileVSphereClusterStaticIPPolicy(t *testing.T) {
+	s := newTestScheme(t)
+	assert.NoError(t, ipamv1.AddToScheme(s))
+	assert.NoError(t, infrav1alpha3.AddToScheme(s))
+
+	ctx := context.Background()
+	newPool := func(name, start, end string) *ipamv1.IPPool {
+		startAddress, endAddress := ipamv1.IPAddressStr(start), ipamv1.IPAddressStr(end)
+		return &ipamv1.IPPool{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+			Spec:       ipamv1.IPPoolSpec{Pools: []ipamv1.Pool{{Start: &startAddress, End: &endAddress}}, Prefix: 24},
+		}
+	}
+	cluster := &capi.Cluster{
+		ObjectMeta: metav1.ObjectMeta{Name: "cluster", Namespace: "default", UID: "uid-cluster",
+			Labels: map[string]string{"env": "prod"}},
+		Spec: capi.ClusterSpec{ControlPlaneRef: &corev1.ObjectReference{Kind: "KubeadmControlPlane", Name: "cluster"}},
+	}
+	vSphereCluster := &infrav1.VSphereCluster{
+		TypeMeta: metav1.TypeMeta{Kind: "VSphereCluster", APIVersion: infrav1.GroupVersion.String()},
+		ObjectMeta: metav1.ObjectMeta{Name: "cluster", Namespace: "default", UID: "uid-vsphere-cluster",
+			Labels: map[string]string{ipam.ClusterIPPoolNameKey: "pool1"},
+			OwnerReferences: []metav1.OwnerReference{{APIVersion: capi.GroupVersion.String(), Kind: "Cluster", Name: "cluster",
+				UID: cluster.UID}}},
+	}
+	//the policy sends the control plane, and its endpoint, to another IPPool than the one of the VSphereCluster labels
+	policy := &staticipv1.StaticIPPolicy{
+		ObjectMeta: metav1.ObjectMeta{Name: "prod", Namespace: "default"},
+		Spec: staticipv1.StaticIPPolicySpec{
+			ClusterSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"env": "prod"}},
+			PoolSelectors:   []staticipv1.PoolSelector{{Name: "pool2"}},
+			ControlPlane:    &staticipv1.RolePolicy{PoolSelectors: []staticipv1.PoolSelector{{Name: "pool3"}}},
+		},
+	}
+	cli := fake.NewClientBuilder().WithScheme(s).WithObjects(newPool("pool1", "10.10.100.20", "10.10.100.30"),
+		newPool("pool2", "10.10.101.20", "10.10.101.30"), newPool("pool3", "10.10.102.20", "10.10.102.30"),
+		cluster, vSphereCluster, policy).Build()
+	r := &VSphereClusterReconciler{Client: cli, Log: log.NullLogger{}, Scheme: s, IPAM: metal3io.NewIpam(cli, cli, log.NullLogger{}, ipam.Options{})}
+
+	_, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(vSphereCluster)})
+	assert.NoError(t, err)
+	ipClaims := &ipamv1.IPClaimList{}
+	assert.NoError(t, cli.List(ctx, ipClaims))
+	assert.Len(t, ipClaims.Items, 1)
+	assert.Equal(t, "pool3", ipClaims.Items[0].Spec.Pool.Name)
+}
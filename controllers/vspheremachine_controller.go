@@ -19,18 +19,22 @@ package controllers
 import (
 	"context"
 	"fmt"
-	"time"
 
 	"github.com/go-logr/logr"
 	"github.com/pkg/errors"
 	"github.com/spectrocloud/cluster-api-provider-vsphere-static-ip/pkg/ipam"
-	"github.com/spectrocloud/cluster-api-provider-vsphere-static-ip/pkg/ipam/factory"
 	_ "github.com/spectrocloud/cluster-api-provider-vsphere-static-ip/pkg/ipam/metal3io"
+	"github.com/spectrocloud/cluster-api-provider-vsphere-static-ip/pkg/ipam/prober"
 	"github.com/spectrocloud/cluster-api-provider-vsphere-static-ip/pkg/util"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/types"
-	infrav1 "sigs.k8s.io/cluster-api-provider-vsphere/api/v1alpha4"
-	capi "sigs.k8s.io/cluster-api/api/v1alpha4"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/client-go/tools/record"
+	infrav1 "sigs.k8s.io/cluster-api-provider-vsphere/api/v1beta1"
+	capi "sigs.k8s.io/cluster-api/api/v1beta1"
+	kubeadmcontrolplane "sigs.k8s.io/cluster-api/controlplane/kubeadm/api/v1beta1"
 	clusterutilv1 "sigs.k8s.io/cluster-api/util"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
@@ -41,14 +45,25 @@ type VSphereMachineReconciler struct {
 	client.Client
 	Log    logr.Logger
 	Scheme *runtime.Scheme
+	// IPAM allocates the static IPs, it is shared by the reconcilers for the allocations from an IPPool to be serialized
+	IPAM     ipam.IPAddressManager
+	Prober   prober.AddressProber
+	Recorder record.EventRecorder
+	// AddressesFromPoolsKind is the kind of the pools of the capi ipam contract referenced in the 'addressesFromPools'
+	// of the VSphereMachines migrated to capv, the migration is disabled if not set
+	AddressesFromPoolsKind schema.GroupKind
 }
 
 // +kubebuilder:rbac:groups=controlplane.cluster.x-k8s.io,resources=kubeadmcontrolplanes,verbs=get;list;watch
 // +kubebuilder:rbac:groups=infrastructure.cluster.x-k8s.io,resources=vspheremachinetemplates,verbs=get;list;watch
+// +kubebuilder:rbac:groups=apiextensions.k8s.io,resources=customresourcedefinitions,verbs=get
+// +kubebuilder:rbac:groups=infrastructure.cluster.x-k8s.io,resources=vspheredeploymentzones;vspherefailuredomains,verbs=get;list;watch
 // +kubebuilder:rbac:groups=infrastructure.cluster.x-k8s.io,resources=vspheremachines,verbs=get;list;watch;update;patch
 // +kubebuilder:rbac:groups=infrastructure.cluster.x-k8s.io,resources=vspheremachines/status,verbs=get;update;patch
 // +kubebuilder:rbac:groups=cluster.x-k8s.io,resources=machines;machines/status,verbs=get;list;watch
+// +kubebuilder:rbac:groups=cluster.x-k8s.io,resources=machinedeployments,verbs=get;list;watch
 // +kubebuilder:rbac:groups="",resources=events,verbs=get;list;watch;create;update;patch
+// +kubebuilder:rbac:groups="",resources=configmaps;namespaces,verbs=get;list;watch
 // +kubebuilder:rbac:groups=cluster.x-k8s.io,resources=clusters;clusters/status,verbs=get;list;watch
 // +kubebuilder:rbac:groups=ipam.metal3.io,resources=ippools,verbs=get;list;watch;update;patch
 // +kubebuilder:rbac:groups=ipam.metal3.io,resources=ippools/status,verbs=get;update;patch
@@ -91,7 +106,7 @@ func (r *VSphereMachineReconciler) Reconcile(ctx context.Context, req ctrl.Reque
 		return ctrl.Result{}, nil
 	}
 
-	res, err = r.reconcileVSphereMachineIPAddress(cluster, vsphereMachine)
+	res, err = r.reconcileVSphereMachineIPAddress(cluster, machine, vsphereMachine)
 	if err != nil {
 		log.Error(err, "failed to reconcile VSphereMachine IP")
 	}
@@ -103,7 +118,7 @@ func (r *VSphereMachineReconciler) Reconcile(ctx context.Context, req ctrl.Reque
 	return *res, err
 }
 
-func (r *VSphereMachineReconciler) reconcileVSphereMachineIPAddress(cluster *capi.Cluster, vSphereMachine *infrav1.VSphereMachine) (*ctrl.Result, error) {
+func (r *VSphereMachineReconciler) reconcileVSphereMachineIPAddress(cluster *capi.Cluster, machine *capi.Machine, vSphereMachine *infrav1.VSphereMachine) (*ctrl.Result, error) {
 	if vSphereMachine == nil {
 		r.Log.V(0).Info("invalid VSphereMachine, skipping reconcile IPAddress")
 		return &ctrl.Result{}, nil
@@ -122,26 +137,61 @@ func (r *VSphereMachineReconciler) reconcileVSphereMachineIPAddress(cluster *cap
 		return &ctrl.Result{}, nil
 	}
 
-	dataPatch := client.MergeFrom(vSphereMachine.DeepCopy())
-	newIpamFunc, ok := factory.IpamFactory[ipam.IpamTypeMetal3io]
-	if !ok {
-		log.V(0).Info("ipam type not supported")
-		return &ctrl.Result{}, nil
+	//the devices referencing pools in 'addressesFromPools' are assigned by capv, the unstructured VSphereMachine
+	//is used to detect and keep these fields unknown to the vendored capv api
+	rawVSphereMachine, err := getUnstructuredObject(r.Client, vSphereMachine)
+	if err != nil {
+		return &ctrl.Result{}, errors.Wrapf(err, "failed to get VSphereMachine %s", vSphereMachine.Name)
+	}
+	delegated, err := getAddressesFromPoolsDevices(rawVSphereMachine)
+	if err != nil {
+		return &ctrl.Result{}, err
 	}
 
-	ipamFunc := newIpamFunc(r.Client, log)
-
-	for i := range devices {
-		if util.IsDeviceIPAllocationDHCP(devices[i]) || len(devices[i].IPAddrs) > 0 {
-			continue
-		}
+	if isNetworkDevicesIPAllocated(devices, delegated) {
+		log.V(0).Info("IP address is already allocated for VSphereMachine")
+		return &ctrl.Result{}, nil
+	}
 
-		poolMatchLabels, err := r.getIPPoolMatchLabels(r.Client, vSphereMachine)
-		if err != nil {
+	dataPatch := client.MergeFrom(rawVSphereMachine.DeepCopy())
+	//the StaticIPPolicy selecting the machine takes precedence over the IPPool labels
+	vSphereMachineTemplate, err := getVSphereMachineTemplate(r.Client, vSphereMachine)
+	if err != nil {
+		return &ctrl.Result{}, err
+	}
+	role := getMachineRole(machine)
+	policySelection, err := getStaticIPPolicySelection(r.Client, r.IPAM.GetOptions().GlobalIPPoolNamespace, cluster.ObjectMeta, vSphereMachineTemplate, role)
+	if err != nil {
+		return &ctrl.Result{}, err
+	}
+	poolMatchLabels := map[string]string{}
+	var selection ipam.SelectionOptions
+	if policySelection != nil {
+		selection = *policySelection
+	} else {
+		if poolMatchLabels, selection, err = r.getIPPoolMatchLabels(r.Client, cluster, machine, vSphereMachine); err != nil {
 			log.Error(err, "failed to get IPPool match labels")
 			return &ctrl.Result{}, nil
 		}
-		ipPool, err := ipamFunc.GetAvailableIPPool(poolMatchLabels, cluster.ObjectMeta)
+		//the IPPool selector of the role of the machine, set on the Cluster, restricts the IPPools of the labels
+		poolMatchLabels = withRoleIPPoolSelector(poolMatchLabels, cluster, role)
+	}
+
+	//the IPPools are matched with the placement of the machine as well
+	poolMatchLabels, err = withTopology(r.Client, poolMatchLabels, vSphereMachine.Spec.VirtualMachineCloneSpec, getFailureDomain(machine, vSphereMachine))
+	if err != nil {
+		return &ctrl.Result{}, err
+	}
+
+	migrate := vSphereMachine.GetAnnotations()[ipam.AddressesFromPoolsKey] == "true"
+	if migrate && r.AddressesFromPoolsKind.Empty() {
+		log.V(0).Info("addressesFromPools is disabled, assigning the static IPs instead")
+		migrate = false
+	}
+
+	if migrate {
+		//reference the pool of the selected IPPool in the devices, for capv to claim the IP addresses
+		ipPool, err := r.IPAM.GetAvailableIPPool(poolMatchLabels, cluster.ObjectMeta, selection)
 		if err != nil {
 			log.Error(err, "failed to get an available IPPool")
 			return &ctrl.Result{}, nil
@@ -151,73 +201,170 @@ func (r *VSphereMachineReconciler) reconcileVSphereMachineIPAddress(cluster *cap
 			return &ctrl.Result{}, nil
 		}
 
-		ipName := util.GetFormattedClaimName(vSphereMachine.Name, i)
-		ip, err := ipamFunc.GetIP(ipName, ipPool)
+		if err := setAddressesFromPools(rawVSphereMachine, devices, delegated, ipPool, r.AddressesFromPoolsKind); err != nil {
+			return &ctrl.Result{}, err
+		}
+	} else {
+		opts, err := r.getNetworkDeviceOptions(r.Client, vSphereMachine, delegated)
 		if err != nil {
-			return &ctrl.Result{}, errors.Wrapf(err, "failed to get allocated IP address for VSphereMachine %s", vSphereMachine.Name)
+			log.Error(err, "failed to get the network device options")
+			return &ctrl.Result{}, nil
 		}
 
-		if ip == nil {
-			if _, err := ipamFunc.AllocateIP(ipName, ipPool, vSphereMachine); err != nil {
-				return &ctrl.Result{}, errors.Wrapf(err, "failed to allocate IP address for VSphereMachine: %s", vSphereMachine.Name)
-			}
+		res, err := reconcileNetworkDevicesIPAddress(r.IPAM, log, poolMatchLabels, selection, cluster.ObjectMeta, vSphereMachine, devices, opts)
+		if res, err := reconcileIPAllocationConditions(r.Client, r.Recorder, vSphereMachine, res, err); res != nil || err != nil {
+			return res, err
+		}
+
+		if err := mergeNetworkDevices(rawVSphereMachine, devices, delegated); err != nil {
+			return &ctrl.Result{}, err
+		}
+	}
+
+	if err := r.Patch(context.TODO(), rawVSphereMachine, dataPatch); err != nil {
+		return &ctrl.Result{}, errors.Wrapf(err, "failed to patch VSphereMachine %s", vSphereMachine.Name)
+	}
+
+	log.V(0).Info("successfully reconciled IP address for VSphereMachine")
 
-			log.V(0).Info("waiting for IP address to be available for the VSphereMachine")
-			return &ctrl.Result{RequeueAfter: 30 * time.Second}, nil
+	return &ctrl.Result{}, nil
+}
+
+// getNetworkDeviceOptions gets the options to assign the network devices, set in the annotations of the VSphereMachine
+// or of the VSphereMachineTemplate it is cloned from
+func (r *VSphereMachineReconciler) getNetworkDeviceOptions(cli client.Client, vSphereMachine *infrav1.VSphereMachine,
+	skipDevices sets.Int) (networkDeviceOptions, error) {
+	opts := networkDeviceOptions{skipDevices: skipDevices, prober: r.Prober}
+	annotations := vSphereMachine.GetAnnotations()
+
+	if vmTemplateName, ok := vSphereMachine.GetAnnotations()[capi.TemplateClonedFromNameAnnotation]; ok {
+		vsphereMachineTemplate := &infrav1.VSphereMachineTemplate{}
+		key := types.NamespacedName{Namespace: vSphereMachine.Namespace, Name: vmTemplateName}
+		if err := cli.Get(context.Background(), key, vsphereMachineTemplate); util.IgnoreNotFound(err) != nil {
+			return opts, fmt.Errorf("failed to get VSphereMachineTemplate %s", vmTemplateName)
 		}
 
-		if err := util.ValidateIP(ip); err != nil {
-			return &ctrl.Result{}, errors.Wrapf(err, "invalid IP address retrieved for VSphereMachine: %s", vSphereMachine.Name)
+		//the annotations of the VSphereMachine take precedence
+		annotations = map[string]string{}
+		for k, v := range vsphereMachineTemplate.GetAnnotations() {
+			annotations[k] = v
 		}
+		for k, v := range vSphereMachine.GetAnnotations() {
+			annotations[k] = v
+		}
+	}
 
-		log.V(0).Info("static IP selected for VSphereMachine", "IPAddressName", ip.GetName())
+	addressCounts, err := util.GetDeviceAddressCounts(annotations, len(vSphereMachine.Spec.Network.Devices))
+	if err != nil {
+		return opts, err
+	}
+	opts.addressCounts = addressCounts
+	opts.dnsMergePolicy = ipam.DNSMergePolicy(annotations[ipam.DNSMergePolicyKey])
 
-		//capv expects static-ip in the CIDR format
-		ipCidr := fmt.Sprintf("%s/%d", util.GetAddress(ip), util.GetMask(ip))
-		log.V(0).Info("assigning IP address to VSphereMachine", "IPAddress", util.GetAddress(ip))
+	return opts, nil
+}
 
-		devices[i].IPAddrs = []string{ipCidr}
-		gateway := util.GetGateway(ip)
-		//TODO: handle ipv6
-		//gateway4 is required if DHCP4 is disabled, gateway6 is required if DHCP6 is disabled
-		devices[i].Gateway4 = gateway
+// getIPPoolMatchLabels gets the IPPool match labels, and the selection options, for the VSphereMachine from the first of
+// these objects with the IPPool labels, or the IPPool selector annotation, set in the order of precedence:
+//  1. the VSphereMachine
+//  2. the VSphereMachineTemplate, set in the 'cloned-from-name' annotation of the VSphereMachine
+//  3. the owning MachineDeployment or KubeadmControlPlane of the machine
+//  4. the Cluster, also if it has the IPPool selector of the role of the machine
+func (r *VSphereMachineReconciler) getIPPoolMatchLabels(cli client.Client, cluster *capi.Cluster, machine *capi.Machine,
+	vSphereMachine *infrav1.VSphereMachine) (map[string]string, ipam.SelectionOptions, error) {
+	if labels := util.GetIPPoolMatchLabels(vSphereMachine); util.HasIPPoolMatchLabels(labels) {
+		return labels, util.GetIPPoolSelectionOptions(vSphereMachine), nil
+	}
 
-		//if configured, the values of nameservers and searchDomains from the IPPool
-		//will override the default values set from the VSphereMachineTemplate
-		nameservers := util.GetDNSServers(ipPool)
-		if len(nameservers) > 0 {
-			devices[i].Nameservers = nameservers
+	if vmTemplateName, ok := vSphereMachine.GetAnnotations()[capi.TemplateClonedFromNameAnnotation]; ok {
+		vsphereMachineTemplate := &infrav1.VSphereMachineTemplate{}
+		key := types.NamespacedName{Namespace: vSphereMachine.Namespace, Name: vmTemplateName}
+		if err := cli.Get(context.Background(), key, vsphereMachineTemplate); util.IgnoreNotFound(err) != nil {
+			return nil, ipam.SelectionOptions{}, fmt.Errorf("failed to get VSphereMachineTemplate %s", vmTemplateName)
 		}
-		searchDomains := util.GetSearchDomains(ipPool)
-		if len(searchDomains) > 0 {
-			devices[i].SearchDomains = searchDomains
+		if labels := util.GetIPPoolMatchLabels(vsphereMachineTemplate); util.HasIPPoolMatchLabels(labels) {
+			return labels, util.GetIPPoolSelectionOptions(vsphereMachineTemplate), nil
 		}
 	}
 
-	if err := r.Patch(context.TODO(), vSphereMachine, dataPatch); err != nil {
-		return &ctrl.Result{}, errors.Wrapf(err, "failed to patch VSphereMachine %s", vSphereMachine.Name)
+	owner, err := r.getMachineOwner(cli, machine)
+	if err != nil {
+		return nil, ipam.SelectionOptions{}, err
+	}
+	if owner != nil {
+		if labels := util.GetIPPoolMatchLabels(owner); util.HasIPPoolMatchLabels(labels) {
+			return labels, util.GetIPPoolSelectionOptions(owner), nil
+		}
 	}
 
-	log.V(0).Info("successfully reconciled IP address for VSphereMachine")
+	//the IPPool selector of the role of the machine, set on the Cluster, is enough to select the IPPools of a template
+	//shared by the roles
+	if labels := util.GetIPPoolMatchLabels(cluster); util.HasIPPoolMatchLabels(labels) || getRoleIPPoolSelector(cluster, getMachineRole(machine)) != "" {
+		return labels, util.GetIPPoolSelectionOptions(cluster), nil
+	}
 
-	return &ctrl.Result{}, nil
+	return nil, ipam.SelectionOptions{}, fmt.Errorf("no IPPool match labels found for VSphereMachine %s", vSphereMachine.Name)
 }
 
-func (r *VSphereMachineReconciler) getIPPoolMatchLabels(cli client.Client, vSphereMachine *infrav1.VSphereMachine) (map[string]string, error) {
-
-	//match labels for the IPPool are retrieved from the VSphereMachineTemplate
+// getVSphereMachineTemplate gets the VSphereMachineTemplate the VSphereMachine is cloned from, nil if none
+func getVSphereMachineTemplate(cli client.Client, vSphereMachine *infrav1.VSphereMachine) (*infrav1.VSphereMachineTemplate, error) {
 	vmTemplateName, ok := vSphereMachine.GetAnnotations()[capi.TemplateClonedFromNameAnnotation]
 	if !ok {
-		return nil, fmt.Errorf("VSphereMachine %s has no value set in the 'cloned-from-name' annotation", vSphereMachine.Name)
+		return nil, nil
 	}
 
 	vsphereMachineTemplate := &infrav1.VSphereMachineTemplate{}
 	key := types.NamespacedName{Namespace: vSphereMachine.Namespace, Name: vmTemplateName}
 	if err := cli.Get(context.Background(), key, vsphereMachineTemplate); err != nil {
-		return nil, fmt.Errorf("failed to get VSphereMachineTemplate %s", vmTemplateName)
+		if apierrors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, errors.Wrapf(err, "failed to get VSphereMachineTemplate %s", vmTemplateName)
+	}
+
+	return vsphereMachineTemplate, nil
+}
+
+// getFailureDomain gets the failure domain of the machine, set by capi, or on the VSphereMachine
+func getFailureDomain(machine *capi.Machine, vSphereMachine *infrav1.VSphereMachine) string {
+	if machine != nil && machine.Spec.FailureDomain != nil {
+		return *machine.Spec.FailureDomain
+	}
+	if vSphereMachine.Spec.FailureDomain != nil {
+		return *vSphereMachine.Spec.FailureDomain
+	}
+	return ""
+}
+
+// getMachineOwner gets the MachineDeployment or the KubeadmControlPlane managing the machine, if any
+func (r *VSphereMachineReconciler) getMachineOwner(cli client.Client, machine *capi.Machine) (client.Object, error) {
+	var owner client.Object
+	var key types.NamespacedName
+	if name, ok := machine.GetLabels()[capi.MachineDeploymentLabelName]; ok {
+		owner = &capi.MachineDeployment{}
+		key = types.NamespacedName{Namespace: machine.Namespace, Name: name}
+	} else {
+		for _, ref := range machine.GetOwnerReferences() {
+			if ref.Kind == "KubeadmControlPlane" {
+				owner = &kubeadmcontrolplane.KubeadmControlPlane{}
+				key = types.NamespacedName{Namespace: machine.Namespace, Name: ref.Name}
+				break
+			}
+		}
+	}
+
+	if owner == nil {
+		return nil, nil
+	}
+
+	if err := cli.Get(context.Background(), key, owner); err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, errors.Wrapf(err, "failed to get owner %s of machine %s", key.Name, machine.Name)
 	}
 
-	return vsphereMachineTemplate.GetLabels(), nil
+	return owner, nil
 }
 
 func (r *VSphereMachineReconciler) SetupWithManager(mgr ctrl.Manager) error {
@@ -0,0 +1,199 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	ipamv1 "github.com/metal3-io/ip-address-manager/api/v1alpha1"
+	staticipv1 "github.com/spectrocloud/cluster-api-provider-vsphere-static-ip/api/v1alpha1"
+	"github.com/spectrocloud/cluster-api-provider-vsphere-static-ip/pkg/ipam"
+	"github.com/spectrocloud/cluster-api-provider-vsphere-static-ip/pkg/ipam/metal3io"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
+	infrav1alpha4 "sigs.k8s.io/cluster-api-provider-vsphere/api/v1alpha4"
+	infrav1 "sigs.k8s.io/cluster-api-provider-vsphere/api/v1beta1"
+	capiv1alpha4 "sigs.k8s.io/cluster-api/api/v1alpha4"
+	capi "sigs.k8s.io/cluster-api/api/v1beta1"
+	kubeadmcontrolplane "sigs.k8s.io/cluster-api/controlplane/kubeadm/api/v1beta1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+func newTestScheme(t *testing.T) *runtime.Scheme {
+	s := runtime.NewScheme()
+	assert.NoError(t, capi.AddToScheme(s))
+	assert.NoError(t, infrav1.AddToScheme(s))
+	assert.NoError(t, kubeadmcontrolplane.AddToScheme(s))
+	assert.NoError(t, staticipv1.AddToScheme(s))
+	return s
+}
+
+func TestGetIPPoolMatchLabels(t *testing.T) {
+	poolLabels := func(name string) map[string]string {
+		return map[string]string{ipam.ClusterIPPoolNameKey: name}
+	}
+	objectMeta := func(name string, labels map[string]string) metav1.ObjectMeta {
+		return metav1.ObjectMeta{Name: name, Namespace: "default", Labels: labels}
+	}
+
+	template := &infrav1.VSphereMachineTemplate{ObjectMeta: objectMeta("template", poolLabels("template-pool"))}
+	unlabelledTemplate := &infrav1.VSphereMachineTemplate{ObjectMeta: objectMeta("unlabelled-template", nil)}
+	md := &capi.MachineDeployment{ObjectMeta: objectMeta("md", poolLabels("md-pool"))}
+	kcp := &kubeadmcontrolplane.KubeadmControlPlane{ObjectMeta: objectMeta("kcp", poolLabels("kcp-pool"))}
+
+	workerMachine := &capi.Machine{ObjectMeta: objectMeta("worker", map[string]string{capi.MachineDeploymentLabelName: "md"})}
+	cpMachine := &capi.Machine{ObjectMeta: objectMeta("cp", nil)}
+	cpMachine.OwnerReferences = []metav1.OwnerReference{{Kind: "KubeadmControlPlane", Name: "kcp"}}
+	orphanMachine := &capi.Machine{ObjectMeta: objectMeta("orphan", nil)}
+	orphanCPMachine := &capi.Machine{ObjectMeta: objectMeta("orphan-cp", map[string]string{capi.MachineControlPlaneLabelName: ""})}
+
+	tests := []struct {
+		name           string
+		vSphereMachine *infrav1.VSphereMachine
+		machine        *capi.Machine
+		cluster        *capi.Cluster
+		expectedPool   string
+		expectErr      bool
+	}{
+		{
+			name:           "labels on the VSphereMachine take precedence",
+			vSphereMachine: &infrav1.VSphereMachine{ObjectMeta: objectMeta("vm", poolLabels("vm-pool"))},
+			machine:        workerMachine,
+			cluster:        &capi.Cluster{ObjectMeta: objectMeta("cluster", poolLabels("cluster-pool"))},
+			expectedPool:   "vm-pool",
+		},
+		{
+			name: "labels on the cloned-from template",
+			vSphereMachine: &infrav1.VSphereMachine{ObjectMeta: metav1.ObjectMeta{Name: "vm", Namespace: "default",
+				Annotations: map[string]string{capi.TemplateClonedFromNameAnnotation: "template"}}},
+			machine:      workerMachine,
+			cluster:      &capi.Cluster{ObjectMeta: objectMeta("cluster", poolLabels("cluster-pool"))},
+			expectedPool: "template-pool",
+		},
+		{
+			name: "labels on the MachineDeployment, if the template has no IPPool labels",
+			vSphereMachine: &infrav1.VSphereMachine{ObjectMeta: metav1.ObjectMeta{Name: "vm", Namespace: "default",
+				Annotations: map[string]string{capi.TemplateClonedFromNameAnnotation: "unlabelled-template"}}},
+			machine:      workerMachine,
+			cluster:      &capi.Cluster{ObjectMeta: objectMeta("cluster", poolLabels("cluster-pool"))},
+			expectedPool: "md-pool",
+		},
+		{
+			name: "labels on the KubeadmControlPlane, if the template does not exist",
+			vSphereMachine: &infrav1.VSphereMachine{ObjectMeta: metav1.ObjectMeta{Name: "vm", Namespace: "default",
+				Annotations: map[string]string{capi.TemplateClonedFromNameAnnotation: "missing"}}},
+			machine:      cpMachine,
+			cluster:      &capi.Cluster{ObjectMeta: objectMeta("cluster", poolLabels("cluster-pool"))},
+			expectedPool: "kcp-pool",
+		},
+		{
+			name:           "labels on the Cluster",
+			vSphereMachine: &infrav1.VSphereMachine{ObjectMeta: objectMeta("vm", nil)},
+			machine:        orphanMachine,
+			cluster:        &capi.Cluster{ObjectMeta: objectMeta("cluster", poolLabels("cluster-pool"))},
+			expectedPool:   "cluster-pool",
+		},
+		{
+			name:           "IPPool selector of the machine role on the Cluster",
+			vSphereMachine: &infrav1.VSphereMachine{ObjectMeta: objectMeta("vm", nil)},
+			machine:        orphanCPMachine,
+			cluster: &capi.Cluster{ObjectMeta: metav1.ObjectMeta{Name: "cluster", Namespace: "default",
+				Annotations: map[string]string{ipam.ControlPlaneIPPoolSelectorKey: "tier=control-plane"}}},
+			expectedPool: "",
+		},
+		{
+			name:           "no IPPool labels",
+			vSphereMachine: &infrav1.VSphereMachine{ObjectMeta: objectMeta("vm", nil)},
+			machine:        orphanMachine,
+			cluster:        &capi.Cluster{ObjectMeta: objectMeta("cluster", nil)},
+			expectErr:      true,
+		},
+		{
+			name:           "no IPPool labels, and the IPPool selector of the other role on the Cluster",
+			vSphereMachine: &infrav1.VSphereMachine{ObjectMeta: objectMeta("vm", nil)},
+			machine:        orphanMachine,
+			cluster: &capi.Cluster{ObjectMeta: metav1.ObjectMeta{Name: "cluster", Namespace: "default",
+				Annotations: map[string]string{ipam.ControlPlaneIPPoolSelectorKey: "tier=control-plane"}}},
+			expectErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			objs := []client.Object{template, unlabelledTemplate, md, kcp}
+			cli := fake.NewClientBuilder().WithScheme(newTestScheme(t)).WithObjects(objs...).Build()
+			r := &VSphereMachineReconciler{Client: cli, Log: log.NullLogger{}}
+
+			labels, _, err := r.getIPPoolMatchLabels(cli, tt.cluster, tt.machine, tt.vSphereMachine)
+			if tt.expectErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expectedPool, labels[ipam.ClusterIPPoolNameKey])
+		})
+	}
+}
+
+func TestReconcileVSphereMachineV1alpha4(t *testing.T) {
+	s := newTestScheme(t)
+	assert.NoError(t, ipamv1.AddToScheme(s))
+
+	ctx := context.Background()
+	gateway := ipamv1.IPAddressStr("10.10.100.1")
+	pool := &ipamv1.IPPool{ObjectMeta: metav1.ObjectMeta{Name: "pool1", Namespace: "default"}}
+
+	//the objects created with the v1alpha4 apis are served as v1beta1, converted by the capi and capv conversion
+	//webhooks, while their owner references keep the v1alpha4 api version
+	oldCluster := &capiv1alpha4.Cluster{ObjectMeta: metav1.ObjectMeta{Name: "cluster", Namespace: "default", UID: "cluster-uid"}}
+	oldMachine := &capiv1alpha4.Machine{ObjectMeta: metav1.ObjectMeta{Name: "machine", Namespace: "default", UID: "machine-uid",
+		Labels: map[string]string{capiv1alpha4.ClusterLabelName: "cluster"}}}
+	oldMachine.Spec.ClusterName = "cluster"
+	oldTemplate := &infrav1alpha4.VSphereMachineTemplate{ObjectMeta: metav1.ObjectMeta{Name: "template", Namespace: "default",
+		Labels: map[string]string{ipam.ClusterIPPoolNameKey: "pool1"}}}
+	oldTemplate.Spec.Template.Spec.Network.Devices = []infrav1alpha4.NetworkDeviceSpec{{NetworkName: "vm-network"}}
+	oldVSphereMachine := &infrav1alpha4.VSphereMachine{ObjectMeta: metav1.ObjectMeta{Name: "vm", Namespace: "default", UID: "vm-uid",
+		Annotations: map[string]string{capiv1alpha4.TemplateClonedFromNameAnnotation: "template"},
+		OwnerReferences: []metav1.OwnerReference{{APIVersion: capiv1alpha4.GroupVersion.String(), Kind: "Machine",
+			Name: "machine", UID: "machine-uid"}}}}
+	oldVSphereMachine.Spec.Network.Devices = []infrav1alpha4.NetworkDeviceSpec{{NetworkName: "vm-network"}}
+
+	cluster, machine := &capi.Cluster{}, &capi.Machine{}
+	template, vSphereMachine := &infrav1.VSphereMachineTemplate{}, &infrav1.VSphereMachine{}
+	assert.NoError(t, oldCluster.ConvertTo(cluster))
+	assert.NoError(t, oldMachine.ConvertTo(machine))
+	assert.NoError(t, oldTemplate.ConvertTo(template))
+	assert.NoError(t, oldVSphereMachine.ConvertTo(vSphereMachine))
+
+	cli := fake.NewClientBuilder().WithScheme(s).WithObjects(pool, cluster, machine, template, vSphereMachine).Build()
+	r := &VSphereMachineReconciler{Client: cli, Log: log.NullLogger{}, Scheme: s, IPAM: metal3io.NewIpam(cli, cli, log.NullLogger{}, ipam.Options{}), Recorder: record.NewFakeRecorder(10)}
+	req := ctrl.Request{NamespacedName: client.ObjectKey{Namespace: "default", Name: "vm"}}
+
+	res, err := r.Reconcile(ctx, req)
+	assert.NoError(t, err)
+	assert.NotZero(t, res.RequeueAfter)
+
+	ic := &ipamv1.IPClaim{}
+	assert.NoError(t, cli.Get(ctx, client.ObjectKey{Namespace: "default", Name: "vm-0"}, ic))
+	ic.Status.Address = &corev1.ObjectReference{Name: "ip-vm-0", Namespace: "default"}
+	assert.NoError(t, cli.Update(ctx, ic))
+	assert.NoError(t, cli.Create(ctx, &ipamv1.IPAddress{
+		ObjectMeta: metav1.ObjectMeta{Name: "ip-vm-0", Namespace: "default"},
+		Spec:       ipamv1.IPAddressSpec{Address: "10.10.100.20", Prefix: 24, Gateway: &gateway},
+	}))
+
+	res, err = r.Reconcile(ctx, req)
+	assert.NoError(t, err)
+	assert.Zero(t, res)
+
+	//the assigned address is served back with the v1alpha4 api
+	assert.NoError(t, cli.Get(ctx, req.NamespacedName, vSphereMachine))
+	assert.NoError(t, oldVSphereMachine.ConvertFrom(vSphereMachine))
+	assert.Equal(t, []string{"10.10.100.20/24"}, oldVSphereMachine.Spec.Network.Devices[0].IPAddrs)
+	assert.Equal(t, "10.10.100.1", oldVSphereMachine.Spec.Network.Devices[0].Gateway4)
+}
@@ -0,0 +1,155 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	"github.com/go-logr/logr"
+	"github.com/pkg/errors"
+	"github.com/spectrocloud/cluster-api-provider-vsphere-static-ip/pkg/ipam"
+	"github.com/spectrocloud/cluster-api-provider-vsphere-static-ip/pkg/ipam/prober"
+	"github.com/spectrocloud/cluster-api-provider-vsphere-static-ip/pkg/util"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
+	infrav1 "sigs.k8s.io/cluster-api-provider-vsphere/api/v1beta1"
+	capi "sigs.k8s.io/cluster-api/api/v1beta1"
+	clusterutilv1 "sigs.k8s.io/cluster-api/util"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// VSphereVMReconciler reconciles a standalone VSphereVM object, which is not owned by a controller
+type VSphereVMReconciler struct {
+	client.Client
+	Log    logr.Logger
+	Scheme *runtime.Scheme
+	// IPAM allocates the static IPs, it is shared by the reconcilers for the allocations from an IPPool to be serialized
+	IPAM     ipam.IPAddressManager
+	Prober   prober.AddressProber
+	Recorder record.EventRecorder
+}
+
+// +kubebuilder:rbac:groups=infrastructure.cluster.x-k8s.io,resources=vspherevms,verbs=get;list;watch;update;patch
+// +kubebuilder:rbac:groups=infrastructure.cluster.x-k8s.io,resources=vspherevms/status,verbs=get;update;patch
+
+func (r *VSphereVMReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	log := r.Log.WithValues("vspherevm", req.NamespacedName)
+	var res *ctrl.Result
+	var err error
+
+	vSphereVM := &infrav1.VSphereVM{}
+	if err := r.Get(ctx, req.NamespacedName, vSphereVM); err != nil {
+		return ctrl.Result{}, util.IgnoreNotFound(err)
+	}
+
+	//handle the case where gvk is empty
+	if vSphereVM.GroupVersionKind().Empty() {
+		log.V(0).Info("setting the missing gvk for VSphereVM")
+		vSphereVM.Kind = "VSphereVM"
+		vSphereVM.APIVersion = infrav1.GroupVersion.String()
+	}
+
+	//the VSphereVMs created by a controller, for eg., for a VSphereMachine or a HAProxyLoadBalancer, get their network
+	//devices from their owner, which is reconciled instead
+	if metav1.GetControllerOf(vSphereVM) != nil {
+		return ctrl.Result{}, nil
+	}
+
+	//the capi cluster is optional for the standalone VSphereVMs, the IPPool is then selected in the VSphereVM namespace
+	clusterMeta := metav1.ObjectMeta{Namespace: vSphereVM.Namespace}
+	if _, ok := vSphereVM.GetLabels()[capi.ClusterLabelName]; ok {
+		cluster, err := clusterutilv1.GetClusterFromMetadata(ctx, r.Client, vSphereVM.ObjectMeta)
+		if err != nil {
+			log.V(0).Info("cluster does not exist for VSphereVM")
+			return ctrl.Result{}, nil
+		}
+		clusterMeta = cluster.ObjectMeta
+	}
+
+	res, err = r.reconcileVSphereVMIPAddress(clusterMeta, vSphereVM)
+	if err != nil {
+		log.Error(err, "failed to reconcile VSphereVM IP")
+	}
+
+	if res == nil {
+		res = &ctrl.Result{}
+	}
+
+	return *res, err
+}
+
+func (r *VSphereVMReconciler) reconcileVSphereVMIPAddress(clusterMeta metav1.ObjectMeta, vSphereVM *infrav1.VSphereVM) (*ctrl.Result, error) {
+	log := r.Log.WithValues("vSphereVM", vSphereVM.Name, "namespace", vSphereVM.Namespace)
+	devices := vSphereVM.Spec.VirtualMachineCloneSpec.Network.Devices
+	log.V(0).Info("reconcile IP address for VSphereVM")
+	if len(devices) == 0 {
+		log.V(0).Info("no network device found for VSphereVM")
+		return &ctrl.Result{}, nil
+	}
+
+	if util.IsMachineIPAllocationDHCP(devices) {
+		log.V(0).Info("VSphereVM has allocation type DHCP")
+		return &ctrl.Result{}, nil
+	}
+
+	if util.IsMachineIPAllocated(devices) {
+		log.V(0).Info("IP address is already allocated for VSphereVM")
+		return &ctrl.Result{}, nil
+	}
+
+	dataPatch := client.MergeFrom(vSphereVM.DeepCopy())
+	//the nameservers and search domains merge policy of the IPPool can be overridden on the VSphereVM
+	opts := networkDeviceOptions{dnsMergePolicy: ipam.DNSMergePolicy(vSphereVM.GetAnnotations()[ipam.DNSMergePolicyKey]), prober: r.Prober}
+
+	//match labels for the IPPool are retrieved from the StaticIPPolicy selecting the VSphereVM, or from the VSphereVM,
+	//along with its placement
+	policySelection, err := getStaticIPPolicySelection(r.Client, r.IPAM.GetOptions().GlobalIPPoolNamespace, clusterMeta, nil, machineRoleNone)
+	if err != nil {
+		return &ctrl.Result{}, err
+	}
+	poolMatchLabels, selection := map[string]string{}, util.GetIPPoolSelectionOptions(vSphereVM)
+	if policySelection != nil {
+		selection = *policySelection
+	} else {
+		poolMatchLabels = util.GetIPPoolMatchLabels(vSphereVM)
+	}
+	poolMatchLabels, err = withTopology(r.Client, poolMatchLabels, vSphereVM.Spec.VirtualMachineCloneSpec, "")
+	if err != nil {
+		return &ctrl.Result{}, err
+	}
+
+	res, err := reconcileNetworkDevicesIPAddress(r.IPAM, log, poolMatchLabels, selection, clusterMeta, vSphereVM, devices, opts)
+	if res, err := reconcileIPAllocationConditions(r.Client, r.Recorder, vSphereVM, res, err); res != nil || err != nil {
+		return res, err
+	}
+
+	if err := r.Patch(context.TODO(), vSphereVM, dataPatch); err != nil {
+		return &ctrl.Result{}, errors.Wrapf(err, "failed to patch VSphereVM %s", vSphereVM.Name)
+	}
+
+	log.V(0).Info("successfully reconciled IP address for VSphereVM")
+
+	return &ctrl.Result{}, nil
+}
+
+func (r *VSphereVMReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&infrav1.VSphereVM{}).
+		Complete(r)
+}
@@ -0,0 +1,93 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	ipamv1 "github.com/metal3-io/ip-address-manager/api/v1alpha1"
+	"github.com/spectrocloud/cluster-api-provider-vsphere-static-ip/pkg/ipam"
+	"github.com/spectrocloud/cluster-api-provider-vsphere-static-ip/pkg/ipam/metal3io"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	infrav1 "sigs.k8s.io/cluster-api-provider-vsphere/api/v1beta1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+func TestReconcileVSphereVM(t *testing.T) {
+	s := newTestScheme(t)
+	assert.NoError(t, ipamv1.AddToScheme(s))
+
+	ctx := context.Background()
+	newVSphereVM := func(name string, owners ...metav1.OwnerReference) *infrav1.VSphereVM {
+		vm := &infrav1.VSphereVM{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", UID: types.UID("uid-" + name),
+			Labels: map[string]string{ipam.ClusterIPPoolNameKey: "pool1"}, OwnerReferences: owners}}
+		vm.Spec.Network.Devices = []infrav1.NetworkDeviceSpec{{NetworkName: "vm-network"}}
+		return vm
+	}
+	isController := true
+	controllerOwner := func(kind string) metav1.OwnerReference {
+		return metav1.OwnerReference{Kind: kind, APIVersion: infrav1.GroupVersion.String(), Name: "owner", UID: "owner-uid",
+			Controller: &isController}
+	}
+	start, end, gateway := ipamv1.IPAddressStr("10.10.100.20"), ipamv1.IPAddressStr("10.10.100.30"), ipamv1.IPAddressStr("10.10.100.1")
+	pool := &ipamv1.IPPool{
+		ObjectMeta: metav1.ObjectMeta{Name: "pool1", Namespace: "default"},
+		Spec:       ipamv1.IPPoolSpec{Pools: []ipamv1.Pool{{Start: &start, End: &end}}, Prefix: 24},
+	}
+
+	cli := fake.NewClientBuilder().WithScheme(s).WithObjects(pool,
+		newVSphereVM("standalone"),
+		//an owner which is not a controller does not provide the network devices
+		newVSphereVM("referenced", metav1.OwnerReference{Kind: "ConfigMap", APIVersion: "v1", Name: "cm", UID: "cm-uid"}),
+		newVSphereVM("machine-vm", controllerOwner("VSphereMachine")),
+		newVSphereVM("haproxy-vm", controllerOwner("HAProxyLoadBalancer")),
+	).Build()
+	r := &VSphereVMReconciler{Client: cli, Log: log.NullLogger{}, Scheme: s, IPAM: metal3io.NewIpam(cli, cli, log.NullLogger{}, ipam.Options{}), Recorder: record.NewFakeRecorder(10)}
+
+	reconcile := func(name string) ctrl.Result {
+		res, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKey{Namespace: "default", Name: name}})
+		assert.NoError(t, err)
+		return res
+	}
+	claims := func() []string {
+		ipClaims := &ipamv1.IPClaimList{}
+		assert.NoError(t, cli.List(ctx, ipClaims))
+		names := []string{}
+		for _, ic := range ipClaims.Items {
+			names = append(names, ic.Name)
+		}
+		return names
+	}
+
+	//the VSphereVMs with a controller owner are reconciled by their owner
+	assert.Zero(t, reconcile("machine-vm"))
+	assert.Zero(t, reconcile("haproxy-vm"))
+	assert.Empty(t, claims())
+
+	//the standalone VSphereVMs wait for their addresses to be allocated
+	assert.NotZero(t, reconcile("standalone"))
+	assert.NotZero(t, reconcile("referenced"))
+	assert.ElementsMatch(t, []string{"standalone-0", "referenced-0"}, claims())
+
+	//the allocated address is assigned to the network device
+	ic := &ipamv1.IPClaim{}
+	assert.NoError(t, cli.Get(ctx, client.ObjectKey{Namespace: "default", Name: "standalone-0"}, ic))
+	ic.Status.Address = &corev1.ObjectReference{Name: "ip-standalone", Namespace: "default"}
+	assert.NoError(t, cli.Update(ctx, ic))
+	assert.NoError(t, cli.Create(ctx, &ipamv1.IPAddress{
+		ObjectMeta: metav1.ObjectMeta{Name: "ip-standalone", Namespace: "default"},
+		Spec:       ipamv1.IPAddressSpec{Address: "10.10.100.20", Prefix: 24, Gateway: &gateway},
+	}))
+	assert.Zero(t, reconcile("standalone"))
+
+	vm := &infrav1.VSphereVM{}
+	assert.NoError(t, cli.Get(ctx, client.ObjectKey{Namespace: "default", Name: "standalone"}, vm))
+	assert.Equal(t, []string{"10.10.100.20/24"}, vm.Spec.Network.Devices[0].IPAddrs)
+	assert.Equal(t, "10.10.100.1", vm.Spec.Network.Devices[0].Gateway4)
+}
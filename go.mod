@@ -8,22 +8,25 @@ require (
 	github.com/metal3-io/ip-address-manager v0.1.1
 	github.com/metal3-io/ip-address-manager/api v0.0.0
 	github.com/onsi/ginkgo v1.16.4
-	github.com/onsi/gomega v1.15.0
+	github.com/onsi/gomega v1.16.0
 	github.com/pkg/errors v0.9.1
+	github.com/prometheus/client_golang v1.11.0
 	github.com/stretchr/testify v1.7.0
+	golang.org/x/net v0.0.0-20211015210444-4f30a5c0130f
 	golang.org/x/tools v0.1.9 // indirect
 	k8s.io/api v0.22.2
 	k8s.io/apimachinery v0.22.2
 	k8s.io/client-go v0.22.2
 	k8s.io/klog v1.0.0
 	k8s.io/klog/v2 v2.9.0
-	sigs.k8s.io/cluster-api v0.4.3
-	sigs.k8s.io/cluster-api-provider-vsphere v0.8.1
-	sigs.k8s.io/controller-runtime v0.10.1
+	k8s.io/utils v0.0.0-20210930125809-cb0fa318a74b
+	sigs.k8s.io/cluster-api v1.0.5
+	sigs.k8s.io/cluster-api-provider-vsphere v1.0.2
+	sigs.k8s.io/controller-runtime v0.10.3
 )
 
 replace (
 	github.com/metal3-io/ip-address-manager/api => github.com/metal3-io/ip-address-manager/api v0.0.0-20210929111944-d66dc8cb0347
-	sigs.k8s.io/cluster-api => sigs.k8s.io/cluster-api v0.4.3
-	sigs.k8s.io/controller-runtime => sigs.k8s.io/controller-runtime v0.9.7
+	sigs.k8s.io/cluster-api => sigs.k8s.io/cluster-api v1.0.5
+	sigs.k8s.io/controller-runtime => sigs.k8s.io/controller-runtime v0.10.3
 )
@@ -17,20 +17,31 @@ limitations under the License.
 package main
 
 import (
+	"context"
 	"flag"
 	"os"
 	"time"
 
 	ipamv1 "github.com/metal3-io/ip-address-manager/api/v1alpha1"
+	"github.com/pkg/errors"
+	staticipv1 "github.com/spectrocloud/cluster-api-provider-vsphere-static-ip/api/v1alpha1"
 	"github.com/spectrocloud/cluster-api-provider-vsphere-static-ip/controllers"
+	"github.com/spectrocloud/cluster-api-provider-vsphere-static-ip/pkg/ipam"
+	"github.com/spectrocloud/cluster-api-provider-vsphere-static-ip/pkg/ipam/factory"
+	_ "github.com/spectrocloud/cluster-api-provider-vsphere-static-ip/pkg/ipam/metal3io"
+	"github.com/spectrocloud/cluster-api-provider-vsphere-static-ip/pkg/ipam/prober"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	_ "k8s.io/client-go/plugin/pkg/client/auth/gcp"
 	"k8s.io/klog/klogr"
-	infrav1 "sigs.k8s.io/cluster-api-provider-vsphere/api/v1alpha4"
-	capi "sigs.k8s.io/cluster-api/api/v1alpha4"
-	kubeadmcontrolplane "sigs.k8s.io/cluster-api/controlplane/kubeadm/api/v1alpha4"
+	infrav1alpha3 "sigs.k8s.io/cluster-api-provider-vsphere/api/v1alpha3"
+	infrav1 "sigs.k8s.io/cluster-api-provider-vsphere/api/v1beta1"
+	capi "sigs.k8s.io/cluster-api/api/v1beta1"
+	"sigs.k8s.io/cluster-api/controllers/remote"
+	kubeadmcontrolplane "sigs.k8s.io/cluster-api/controlplane/kubeadm/api/v1beta1"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
 	// +kubebuilder:scaffold:imports
 )
 
@@ -44,9 +55,11 @@ func init() {
 
 	_ = ipamv1.AddToScheme(scheme)
 	_ = infrav1.AddToScheme(scheme)
+	_ = infrav1alpha3.AddToScheme(scheme)
 	_ = capi.AddToScheme(scheme)
 	_ = capi.AddToScheme(scheme)
 	_ = kubeadmcontrolplane.AddToScheme(scheme)
+	_ = staticipv1.AddToScheme(scheme)
 
 	// +kubebuilder:scaffold:scheme
 }
@@ -58,6 +71,15 @@ func main() {
 		metricsAddr             string
 		enableLeaderElection    bool
 		maxConcurrentReconciles int
+		enableServiceLBIPAM     bool
+		serviceLBClass          string
+		enableHAProxyLB         bool
+		enableVSphereVMIPAM     bool
+		addressProber           string
+		addressProbeTimeout     time.Duration
+		globalIPPoolNamespace   string
+		enableCapacityPlan      bool
+		addressesFromPoolsKind  string
 	)
 
 	flag.StringVar(&watchNamespace, "namespace", "", "Namespace that the controller watches. If not specified, will watch over all namespaces.")
@@ -65,6 +87,15 @@ func main() {
 	flag.StringVar(&metricsAddr, "metrics-addr", ":8080", "The address the metric endpoint binds to.")
 	flag.BoolVar(&enableLeaderElection, "enable-leader-election", false, "Enable leader election for controller manager. Enabling this will ensure there is only one active controller manager.")
 	flag.IntVar(&maxConcurrentReconciles, "max-concurrency", 2, "MaxConcurrentReconciles is the maximum number of concurrent Reconciles which can be run")
+	flag.BoolVar(&enableHAProxyLB, "enable-haproxy-lb", false, "Enable allocation of static IPs for the HAProxyLoadBalancer VMs. Requires the HAProxyLoadBalancer CRD.")
+	flag.BoolVar(&enableVSphereVMIPAM, "enable-vspherevm-ipam", false, "Enable allocation of static IPs for the standalone VSphereVMs, which are not owned by a controller.")
+	flag.BoolVar(&enableServiceLBIPAM, "enable-service-lb-ipam", false, "Enable allocation of static IPs for the LoadBalancer Services in the workload clusters.")
+	flag.StringVar(&serviceLBClass, "service-lb-class", "", "The loadBalancerClass of the LoadBalancer Services handled besides the ones without a class. If not specified, only the Services without a loadBalancerClass are handled.")
+	flag.StringVar(&addressProber, "address-prober", "", "Probe the static IPs before they are assigned, and quarantine the ones already in use. One of 'icmp' or 'arp', 'arp' only probes the addresses on the subnets of the pod's own interfaces. If not specified, the IPs are not probed.")
+	flag.DurationVar(&addressProbeTimeout, "address-probe-timeout", prober.DefaultTimeout, "The time to wait for a reply when probing a static IP (e.g. 1s)")
+	flag.StringVar(&globalIPPoolNamespace, "global-ip-pool-namespace", "", "Namespace of the IPPools available to the clusters of all the namespaces, selected when no IPPool matches in the namespace of the cluster. If not specified, there are no global IPPools.")
+	flag.StringVar(&addressesFromPoolsKind, "addresses-from-pools-kind", "", "Kind of the pools of the CAPI IPAM contract, as <kind>.<group> (e.g. InClusterIPPool.ipam.cluster.x-k8s.io), referenced in the 'addressesFromPools' of the VSphereMachines migrated to CAPV. Requires a CAPV version with 'addressesFromPools'. If not specified, the migration is disabled.")
+	flag.BoolVar(&enableCapacityPlan, "enable-capacity-plan", false, "Serve the capacity plan of the IPPools for the manifests of a cluster posted to "+controllers.CapacityPlanPath+" on the metrics endpoint.")
 	flag.Parse()
 
 	//ctrl.SetLogger(zap.New(zap.UseDevMode(true)))
@@ -89,10 +120,46 @@ func main() {
 		os.Exit(1)
 	}
 
+	//the IPAM is shared by the reconcilers, for the allocations from an IPPool to be serialized, and counts the IPClaims
+	//for the quotas of the IPPools without the cache, which lags behind the allocations
+	newIpamFunc, ok := factory.IpamFactory[ipam.IpamTypeMetal3io]
+	if !ok {
+		setupLog.Error(errors.Errorf("ipam type %s not supported", ipam.IpamTypeMetal3io), "unable to create ipam")
+		os.Exit(1)
+	}
+	ipamFunc := newIpamFunc(mgr.GetClient(), mgr.GetAPIReader(), ctrl.Log.WithName("ipam"), ipam.Options{GlobalIPPoolNamespace: globalIPPoolNamespace})
+
+	ipProber, err := prober.NewAddressProber(prober.ProberType(addressProber), addressProbeTimeout)
+	if err != nil {
+		setupLog.Error(err, "unable to create address prober")
+		os.Exit(1)
+	}
+
+	//the pools are referenced in 'addressesFromPools' only if the installed capv has the field
+	poolKind := schema.ParseGroupKind(addressesFromPoolsKind)
+	if addressesFromPoolsKind != "" {
+		if poolKind.Group == "" {
+			setupLog.Error(errors.Errorf("invalid pool kind %q", addressesFromPoolsKind), "unable to enable addressesFromPools")
+			os.Exit(1)
+		}
+		supported, err := controllers.SupportsAddressesFromPools(context.Background(), mgr.GetAPIReader())
+		if err == nil && !supported {
+			err = errors.New("the VSphereMachine CRD has no addressesFromPools")
+		}
+		if err != nil {
+			setupLog.Error(err, "unable to enable addressesFromPools")
+			os.Exit(1)
+		}
+	}
+
 	if err = (&controllers.VSphereMachineReconciler{
-		Client: mgr.GetClient(),
-		Log:    ctrl.Log.WithName("controllers").WithName("VSphereMachine"),
-		Scheme: mgr.GetScheme(),
+		Client:                 mgr.GetClient(),
+		Log:                    ctrl.Log.WithName("controllers").WithName("VSphereMachine"),
+		Scheme:                 mgr.GetScheme(),
+		IPAM:                   ipamFunc,
+		Prober:                 ipProber,
+		Recorder:               mgr.GetEventRecorderFor("vspheremachine-controller"),
+		AddressesFromPoolsKind: poolKind,
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "VSphereMachine")
 		os.Exit(1)
@@ -101,10 +168,82 @@ func main() {
 		Client: mgr.GetClient(),
 		Log:    ctrl.Log.WithName("controllers").WithName("VSphereCluster"),
 		Scheme: mgr.GetScheme(),
+		IPAM:   ipamFunc,
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "VSphereCluster")
 		os.Exit(1)
 	}
+	if err = (&controllers.IPClaimReconciler{
+		Client:    mgr.GetClient(),
+		Log:       ctrl.Log.WithName("controllers").WithName("IPClaim"),
+		Scheme:    mgr.GetScheme(),
+		APIReader: mgr.GetAPIReader(),
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "IPClaim")
+		os.Exit(1)
+	}
+	if err = (&controllers.IPPoolReconciler{
+		Client:   mgr.GetClient(),
+		Log:      ctrl.Log.WithName("controllers").WithName("IPPool"),
+		Scheme:   mgr.GetScheme(),
+		Recorder: mgr.GetEventRecorderFor("ippool-controller"),
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "IPPool")
+		os.Exit(1)
+	}
+	if err = (&controllers.MachineDeploymentReconciler{
+		Client:   mgr.GetClient(),
+		Log:      ctrl.Log.WithName("controllers").WithName("MachineDeployment"),
+		Scheme:   mgr.GetScheme(),
+		IPAM:     ipamFunc,
+		Recorder: mgr.GetEventRecorderFor("machinedeployment-controller"),
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "MachineDeployment")
+		os.Exit(1)
+	}
+	if enableHAProxyLB {
+		if err = (&controllers.HAProxyLoadBalancerReconciler{
+			Client:   mgr.GetClient(),
+			Log:      ctrl.Log.WithName("controllers").WithName("HAProxyLoadBalancer"),
+			Scheme:   mgr.GetScheme(),
+			IPAM:     ipamFunc,
+			Prober:   ipProber,
+			Recorder: mgr.GetEventRecorderFor("haproxyloadbalancer-controller"),
+		}).SetupWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create controller", "controller", "HAProxyLoadBalancer")
+			os.Exit(1)
+		}
+	}
+	if enableVSphereVMIPAM {
+		if err = (&controllers.VSphereVMReconciler{
+			Client:   mgr.GetClient(),
+			Log:      ctrl.Log.WithName("controllers").WithName("VSphereVM"),
+			Scheme:   mgr.GetScheme(),
+			IPAM:     ipamFunc,
+			Prober:   ipProber,
+			Recorder: mgr.GetEventRecorderFor("vspherevm-controller"),
+		}).SetupWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create controller", "controller", "VSphereVM")
+			os.Exit(1)
+		}
+	}
+	if enableServiceLBIPAM {
+		if err = setupServiceLoadBalancerReconciler(mgr, ipamFunc, serviceLBClass); err != nil {
+			setupLog.Error(err, "unable to create controller", "controller", "ServiceLoadBalancer")
+			os.Exit(1)
+		}
+	}
+	if enableCapacityPlan {
+		if err = mgr.AddMetricsExtraHandler(controllers.CapacityPlanPath, &controllers.CapacityPlanHandler{
+			Client: mgr.GetClient(),
+			Log:    ctrl.Log.WithName("controllers").WithName("CapacityPlan"),
+			Scheme: mgr.GetScheme(),
+			IPAM:   ipamFunc,
+		}); err != nil {
+			setupLog.Error(err, "unable to add handler", "handler", "CapacityPlan")
+			os.Exit(1)
+		}
+	}
 	// +kubebuilder:scaffold:builder
 
 	setupLog.Info("starting manager")
@@ -113,3 +252,28 @@ func main() {
 		os.Exit(1)
 	}
 }
+
+func setupServiceLoadBalancerReconciler(mgr ctrl.Manager, ipamFunc ipam.IPAddressManager, loadBalancerClass string) error {
+	log := ctrl.Log.WithName("remote").WithName("ClusterCacheTracker")
+	tracker, err := remote.NewClusterCacheTracker(mgr, remote.ClusterCacheTrackerOptions{Log: log})
+	if err != nil {
+		return err
+	}
+
+	if err := (&remote.ClusterCacheReconciler{
+		Client:  mgr.GetClient(),
+		Log:     ctrl.Log.WithName("remote").WithName("ClusterCacheReconciler"),
+		Tracker: tracker,
+	}).SetupWithManager(context.Background(), mgr, controller.Options{}); err != nil {
+		return err
+	}
+
+	return (&controllers.ServiceLoadBalancerReconciler{
+		Client:            mgr.GetClient(),
+		Log:               ctrl.Log.WithName("controllers").WithName("ServiceLoadBalancer"),
+		Scheme:            mgr.GetScheme(),
+		IPAM:              ipamFunc,
+		Tracker:           tracker,
+		LoadBalancerClass: loadBalancerClass,
+	}).SetupWithManager(mgr)
+}
@@ -10,15 +10,33 @@ type IPAddressManager interface {
 	// gets the allocated static ip by name
 	GetIP(name string, pool IPPool) (IPAddress, error)
 
-	// creates/requests a new static ip for the resource, if it does not exist
+	// creates/requests a new static ip for the resource, if it does not exist, labelled with the claim labels
 	// source ip pool is fetched using optional poolSelector, default is using poolKey
-	AllocateIP(name string, pool IPPool, ownerObj runtime.Object) (IPAddress, error)
+	AllocateIP(name string, pool IPPool, ownerObj runtime.Object, claimLabels map[string]string) (IPAddress, error)
 
 	// releases static ip back to the ip pool
 	DeallocateIP(name string, pool IPPool, ownerObj runtime.Object) error
 
-	// gets an available ip pool in the cluster namespace
-	GetAvailableIPPool(poolMatchLabels map[string]string, clusterMeta metav1.ObjectMeta) (IPPool, error)
+	// releases the static ip and reserves its address in the ip pool, so that it is not reused
+	QuarantineIP(name string, pool IPPool, reason string) error
+
+	// gets the address of the static ip which was probed before it was first assigned, if any
+	GetProbedAddress(name string, pool IPPool) (string, error)
+
+	// records the address of the static ip as probed, so that it is not probed again
+	SetProbedAddress(name string, pool IPPool, address string) error
+
+	// gets the names of the static ips allocated from the ip pool for the resource, with the claim labels
+	GetOwnedIPNames(pool IPPool, ownerObj runtime.Object, claimLabels map[string]string) ([]string, error)
+
+	// gets the ip pools the static ips of the resource, with the claim labels, are allocated from
+	GetOwnedIPPools(ownerObj runtime.Object, claimLabels map[string]string) ([]IPPool, error)
+
+	// gets an available ip pool in the cluster namespace, selected with the match labels and the selection options
+	GetAvailableIPPool(poolMatchLabels map[string]string, clusterMeta metav1.ObjectMeta, opts SelectionOptions) (IPPool, error)
+
+	// gets the options the ipam is created with
+	GetOptions() Options
 }
 
 type IPAddress interface {
@@ -58,6 +76,18 @@ type IPPool interface {
 	GetDNSServers() ([]IPAddressStr, error)
 	GetSearchDomains() ([]string, error)
 	GetNamePrefix() (string, error)
+
+	// gets the static routes of the network devices using the ip pool
+	GetRoutes() ([]Route, error)
+
+	// gets the mtu of the network devices using the ip pool, if set
+	GetMTU() (*int64, error)
+
+	// gets the policy to merge the nameservers and search domains with the ones of the network devices, if set
+	GetDNSMergePolicy() (DNSMergePolicy, error)
+
+	// gets the number of addresses of the ip pool which are neither allocated nor reserved, counted up to a maximum
+	GetFreeAddressCount() (int, error)
 }
 
 type Pool interface {
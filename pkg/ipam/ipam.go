@@ -1,7 +1,11 @@
 package ipam
 
 import (
+	"fmt"
+
 	"github.com/go-logr/logr"
+	"github.com/pkg/errors"
+	staticipv1 "github.com/spectrocloud/cluster-api-provider-vsphere-static-ip/api/v1alpha1"
 	"k8s.io/apimachinery/pkg/types"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 )
@@ -14,21 +18,239 @@ const (
 	ClusterIPPoolGroupKey     = "cluster.x-k8s.io/ip-pool-group"
 	ClusterIPPoolNamespaceKey = "cluster.x-k8s.io/ip-pool-namespace"
 
+	// annotation with the label selector of the ip-pools, either in the label selector string format, for eg.,
+	// 'group=prod,tier notin (legacy)', or as a json metav1.LabelSelector with 'matchLabels' and 'matchExpressions'
+	IPPoolSelectorKey = "cluster.x-k8s.io/ip-pool-selector"
+
+	// annotations on the Cluster with the ip-pool selectors of its control plane machines, and of its worker machines,
+	// in the format of the ip-pool selector. The selector of the role of the machine is set in the match labels with
+	// the role ip-pool selector key, in place of the ip-pool name, labels and selector of the machine.
+	ControlPlaneIPPoolSelectorKey = "cluster.x-k8s.io/control-plane-ip-pool-selector"
+	WorkerIPPoolSelectorKey       = "cluster.x-k8s.io/worker-ip-pool-selector"
+	RoleIPPoolSelectorKey         = "cluster.x-k8s.io/role-ip-pool-selector"
+
 	// comma-separated list of search domains
 	SearchDomainsKey = "cluster.x-k8s.io/dns-search-domains"
+
+	// labels on the Cluster to select the ip-pool for the workload cluster LoadBalancer Services
+	LoadBalancerIPPoolNameKey  = "cluster.x-k8s.io/lb-ip-pool-name"
+	LoadBalancerIPPoolGroupKey = "cluster.x-k8s.io/lb-ip-pool-group"
+
+	// annotations on the VSphereCluster to render the kube-vip static pod manifest in the KubeadmControlPlane
+	KubeVipKey          = "cluster.x-k8s.io/kube-vip"
+	KubeVipInterfaceKey = "cluster.x-k8s.io/kube-vip-interface"
+	KubeVipImageKey     = "cluster.x-k8s.io/kube-vip-image"
+
+	// annotation on the VSphereCluster to inject the allocated VIP into the KubeadmControlPlane configuration
+	InjectControlPlaneEndpointKey = "cluster.x-k8s.io/inject-control-plane-endpoint"
+
+	// annotation on the VSphereMachine to reference the selected ip-pool in the capv 'addressesFromPools' of the
+	// network devices, instead of assigning the static ips
+	AddressesFromPoolsKey = "cluster.x-k8s.io/addresses-from-pools"
+
+	// comma-separated number of ip addresses to allocate for each network device, or a single number for all devices
+	AddressesPerDeviceKey = "cluster.x-k8s.io/addresses-per-device"
+
+	// annotations on the ip-pool to configure the network devices, the routes are a json list of
+	// {"to": "<cidr>", "via": "<gateway>", "metric": <metric>}
+	RoutesKey = "cluster.x-k8s.io/routes"
+	MTUKey    = "cluster.x-k8s.io/mtu"
+
+	// annotation on the ip-pool, or on the VSphereMachineTemplate, to select how the nameservers and search domains
+	// of the ip-pool are merged with the ones of the network device. The template annotation takes precedence.
+	DNSMergePolicyKey = "cluster.x-k8s.io/dns-merge-policy"
+
+	// annotation on the ip-pool with the json map of the quarantined addresses, which are not reused
+	QuarantinedAddressesKey = "cluster.x-k8s.io/quarantined-addresses"
+
+	// annotation on the ip-pool with the duration, for eg., '10m', the released addresses are quarantined for before
+	// being reused
+	QuarantinePeriodKey = "cluster.x-k8s.io/quarantine-period"
+
+	// annotation on the ip-pool with the comma-separated addresses, CIDRs, or '<start>-<end>' ranges which are never
+	// allocated, for eg., the addresses of the network appliances inside a range
+	ExcludedAddressesKey = "cluster.x-k8s.io/excluded-addresses"
+
+	// annotation on the ip-claim with the allocated address, to quarantine it once the ip-claim is released
+	IPClaimAddressKey = "cluster.x-k8s.io/ip-address"
+
+	// annotation on the ip-claim with the address probed before it was first assigned, so that it is not probed again
+	IPClaimProbedAddressKey = "cluster.x-k8s.io/probed-address"
+
+	// annotations on the ip-pool with the maximum number of addresses allocated from it for each consuming namespace,
+	// and for each Cluster
+	NamespaceQuotaKey = "cluster.x-k8s.io/namespace-quota"
+	ClusterQuotaKey   = "cluster.x-k8s.io/cluster-quota"
+
+	// label on the ip-claim with the namespace of its owner, along with the cluster-name label, to count the addresses
+	// consumed from the ip-pool
+	ClusterNamespaceKey = "cluster.x-k8s.io/cluster-namespace"
+
+	// label on the ConfigMaps in the ip-pool namespace with the policy of the access to the ip-pools from the other
+	// namespaces. The data of the policy is set with the access policy keys.
+	AccessPolicyKey = "cluster.x-k8s.io/ip-pool-access-policy"
+
+	// comma-separated namespaces allowed to use the ip-pools, and label selectors of the allowed namespaces and of the
+	// ip-pools the policy applies to, all the ip-pools of the namespace by default
+	AccessPolicyAllowedNamespacesKey = "allowedNamespaces"
+	AccessPolicyNamespaceSelectorKey = "namespaceSelector"
+	AccessPolicyIPPoolSelectorKey    = "ipPoolSelector"
+
+	// annotation on the ip-claim with the json reference to its owner in another namespace, which can not be set as an
+	// owner reference of the ip-claim
+	IPClaimOwnerKey = "cluster.x-k8s.io/ip-claim-owner"
+
+	// annotations on the ip-pool with the comma-separated topology values it serves, matched with the placement of the
+	// machines. The ip-pools without a topology annotation are available to all the placements.
+	DatacenterKey    = "cluster.x-k8s.io/datacenter"
+	VCenterServerKey = "cluster.x-k8s.io/vcenter-server"
+	ResourcePoolKey  = "cluster.x-k8s.io/resource-pool"
+	FailureDomainKey = "cluster.x-k8s.io/failure-domain"
+
+	// annotation along with the ip-pool labels, with the strategy to select an ip-pool among the ones matching them
+	IPPoolStrategyKey = "cluster.x-k8s.io/ip-pool-strategy"
+
+	// annotation on the MachineDeployment to reserve a block of addresses in its ip-pool, sized for its replicas and its
+	// maximum surge, for the addresses of its new machines to be allocated from the block
+	ReserveIPBlockKey = "cluster.x-k8s.io/reserve-ip-block"
+
+	// label on the ip-claim with the name of the MachineDeployment whose block of addresses the address is taken from
+	IPBlockKey = "cluster.x-k8s.io/ip-block"
+
+	// label on the ip-claim of the address of a LoadBalancer Service of the workload cluster, to tell it apart from the
+	// other ip-claims owned by the cluster
+	ServiceLoadBalancerKey = "cluster.x-k8s.io/service-load-balancer"
+
+	// finalizer on the ip-claim to quarantine its address before the ip-claim is removed
+	QuarantineFinalizer = "static-ip.cluster.x-k8s.io/quarantine"
+
+	// finalizer on the ip-claim to return its address to the block of its MachineDeployment before the ip-claim is
+	// removed
+	IPBlockFinalizer = "static-ip.cluster.x-k8s.io/ip-block"
 )
 
+// IPPoolMatchLabelKeys are the labels, and the selector annotation, used to select the ip-pool
+var IPPoolMatchLabelKeys = []string{ClusterIPPoolNameKey, ClusterIPPoolGroupKey, ClusterNetworkNameKey, IPPoolSelectorKey}
+
+// TopologyKeys are the ip-pool annotations matched with the placement of the machines, set in the match labels
+var TopologyKeys = []string{DatacenterKey, VCenterServerKey, ResourcePoolKey, FailureDomainKey}
+
 // ObjectKey identifies a Kubernetes Object.
 type ObjectKey = types.NamespacedName
 
-// function to create a new IPAM
-type NewIpamFunc func(cli client.Client, log logr.Logger) IPAddressManager
+// Options are the options the IPAM is created with
+type Options struct {
+	// GlobalIPPoolNamespace is the namespace of the ip-pools available to the clusters of all the namespaces, which are
+	// selected when no ip-pool matches in the namespace of the cluster. There are no global ip-pools if not set.
+	GlobalIPPoolNamespace string
+}
+
+// function to create a new IPAM, the reader reads the objects the cache may lag behind on, for eg., the ip-claims just
+// created, from the api server
+type NewIpamFunc func(cli client.Client, reader client.Reader, log logr.Logger, opts Options) IPAddressManager
 
 type IpamType string
 
+// DNSMergePolicy is the policy to merge the nameservers and search domains of the ip-pool and the network device
+type DNSMergePolicy string
+
+const (
+	// the ip-pool values, if set, override the network device values
+	DNSMergePolicyPool DNSMergePolicy = "pool"
+	// the network device values, if set, override the ip-pool values
+	DNSMergePolicyTemplate DNSMergePolicy = "template"
+	// the union of the values, with the ip-pool values first
+	DNSMergePolicyUnionPoolFirst DNSMergePolicy = "union-pool-first"
+	// the union of the values, with the network device values first
+	DNSMergePolicyUnionTemplateFirst DNSMergePolicy = "union-template-first"
+)
+
 const (
 	IpamTypeMetal3io IpamType = "metal3io"
 )
 
 type IPAddressStr string
 type IPSubnetStr string
+
+// Route is a static route of the network devices using the ip-pool
+type Route struct {
+	To     string `json:"to"`
+	Via    string `json:"via"`
+	Metric int32  `json:"metric,omitempty"`
+}
+
+// SelectionOptions are the options to select the ip-pool, along with the ip-pool match labels
+type SelectionOptions struct {
+	// PoolSelectors are the ordered ip-pool selectors of the StaticIPPolicy of the consumer, which take precedence over
+	// the ip-pool match labels. The ip-pools of a selector are used once the ones of the previous selectors are full.
+	PoolSelectors []staticipv1.PoolSelector
+
+	// Strategy selects an ip-pool among the ones matching a selector, the first one with a free address by default
+	Strategy staticipv1.SelectionStrategy
+
+	// Owner is the owner of the ip-claims, if any. The ip-pool it already claimed from, then the one with the block of
+	// its MachineDeployment, keep being selected, and the Spread strategy spreads the addresses of its group of machines.
+	Owner client.Object
+}
+
+// QuotaScope is the consumer the quota of the ip-pool applies to
+type QuotaScope string
+
+const (
+	QuotaScopeNamespace QuotaScope = "namespace"
+	QuotaScopeCluster   QuotaScope = "cluster"
+)
+
+// QuotaExceededError is returned when allocating an address exceeds the quota of the ip-pool
+type QuotaExceededError struct {
+	Pool     string
+	Scope    QuotaScope
+	Consumer string
+	Quota    int
+}
+
+func (e *QuotaExceededError) Error() string {
+	return fmt.Sprintf("%s %s exceeds its quota of %d addresses in ip-pool %s", e.Scope, e.Consumer, e.Quota, e.Pool)
+}
+
+// IsQuotaExceeded checks if the error is caused by an exceeded quota
+func IsQuotaExceeded(err error) bool {
+	var quotaErr *QuotaExceededError
+	return errors.As(err, &quotaErr)
+}
+
+// AccessDeniedError is returned when the namespace of the cluster is not allowed to use the ip-pools of another
+// namespace by its access policies
+type AccessDeniedError struct {
+	PoolNamespace string
+	Consumer      string
+}
+
+func (e *AccessDeniedError) Error() string {
+	return fmt.Sprintf("namespace %s is not allowed to use the ip-pools of namespace %s", e.Consumer, e.PoolNamespace)
+}
+
+// IsAccessDenied checks if the error is caused by a denied access to the ip-pools
+func IsAccessDenied(err error) bool {
+	var accessErr *AccessDeniedError
+	return errors.As(err, &accessErr)
+}
+
+// IPBlockExhaustedError is returned when the ip-pool has not enough free addresses to reserve the block of addresses of a
+// MachineDeployment
+type IPBlockExhaustedError struct {
+	Pool     string
+	Owner    string
+	Size     int
+	Reserved int
+}
+
+func (e *IPBlockExhaustedError) Error() string {
+	return fmt.Sprintf("only %d of the %d addresses of the block of %s are reserved in ip-pool %s", e.Reserved, e.Size, e.Owner, e.Pool)
+}
+
+// IsIPBlockExhausted checks if the error is caused by an ip-pool without enough free addresses for a block
+func IsIPBlockExhausted(err error) bool {
+	var blockErr *IPBlockExhaustedError
+	return errors.As(err, &blockErr)
+}
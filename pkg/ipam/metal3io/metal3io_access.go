@@ -0,0 +1,100 @@
+package metal3io
+
+import (
+	"context"
+	"strings"
+
+	ipamv1 "github.com/metal3-io/ip-address-manager/api/v1alpha1"
+	"github.com/pkg/errors"
+	"github.com/spectrocloud/cluster-api-provider-vsphere-static-ip/pkg/ipam"
+	"github.com/spectrocloud/cluster-api-provider-vsphere-static-ip/pkg/util"
+	corev1 "k8s.io/api/core/v1"
+	k8slabels "k8s.io/apimachinery/pkg/labels"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// accessPolicy is the access to the ip-pools of a namespace from the other namespaces
+type accessPolicy struct {
+	allowedNamespaces []string
+	namespaceSelector k8slabels.Selector
+	ipPoolSelector    k8slabels.Selector
+}
+
+// filterAccessibleIPPools filters the IPPools the consumer namespace is allowed to use. The IPPools in the consumer
+// namespace, and in the namespaces without access policies, are accessible.
+func filterAccessibleIPPools(cli client.Client, poolNamespace, consumer string, ipPools []ipamv1.IPPool) ([]ipamv1.IPPool, error) {
+	if poolNamespace == consumer || len(ipPools) == 0 {
+		return ipPools, nil
+	}
+
+	policies, err := getAccessPolicies(cli, poolNamespace)
+	if err != nil || len(policies) == 0 {
+		return ipPools, err
+	}
+
+	consumerLabels, err := util.GetNamespaceLabels(cli, consumer)
+	if err != nil {
+		return nil, err
+	}
+
+	accessible := []ipamv1.IPPool{}
+	for _, p := range ipPools {
+		for _, policy := range policies {
+			if policy.allows(p, consumer, consumerLabels) {
+				accessible = append(accessible, p)
+				break
+			}
+		}
+	}
+	if len(accessible) == 0 {
+		return nil, &ipam.AccessDeniedError{PoolNamespace: poolNamespace, Consumer: consumer}
+	}
+
+	return accessible, nil
+}
+
+func (p accessPolicy) allows(ipPool ipamv1.IPPool, consumer string, consumerLabels k8slabels.Set) bool {
+	if p.ipPoolSelector != nil && !p.ipPoolSelector.Matches(k8slabels.Set(ipPool.Labels)) {
+		return false
+	}
+	for _, ns := range p.allowedNamespaces {
+		if ns == consumer || ns == "*" {
+			return true
+		}
+	}
+
+	return p.namespaceSelector != nil && p.namespaceSelector.Matches(consumerLabels)
+}
+
+// getAccessPolicies gets the access policies of the namespace, from the labelled ConfigMaps
+func getAccessPolicies(cli client.Client, namespace string) ([]accessPolicy, error) {
+	configMaps := &corev1.ConfigMapList{}
+	if err := cli.List(context.Background(), configMaps, client.InNamespace(namespace), client.HasLabels{ipam.AccessPolicyKey}); err != nil {
+		return nil, errors.Wrapf(err, "failed to list the IPPool access policies in namespace %s", namespace)
+	}
+
+	policies := []accessPolicy{}
+	for _, cm := range configMaps.Items {
+		policy := accessPolicy{}
+		for _, ns := range strings.Split(cm.Data[ipam.AccessPolicyAllowedNamespacesKey], ",") {
+			if ns = strings.TrimSpace(ns); ns != "" {
+				policy.allowedNamespaces = append(policy.allowedNamespaces, ns)
+			}
+		}
+
+		var err error
+		if v := cm.Data[ipam.AccessPolicyNamespaceSelectorKey]; v != "" {
+			if policy.namespaceSelector, err = k8slabels.Parse(v); err != nil {
+				return nil, errors.Wrapf(err, "invalid %s in IPPool access policy %s/%s", ipam.AccessPolicyNamespaceSelectorKey, namespace, cm.Name)
+			}
+		}
+		if v := cm.Data[ipam.AccessPolicyIPPoolSelectorKey]; v != "" {
+			if policy.ipPoolSelector, err = k8slabels.Parse(v); err != nil {
+				return nil, errors.Wrapf(err, "invalid %s in IPPool access policy %s/%s", ipam.AccessPolicyIPPoolSelectorKey, namespace, cm.Name)
+			}
+		}
+		policies = append(policies, policy)
+	}
+
+	return policies, nil
+}
@@ -0,0 +1,337 @@
+package metal3io
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	ipamv1 "github.com/metal3-io/ip-address-manager/api/v1alpha1"
+	"github.com/pkg/errors"
+	"github.com/spectrocloud/cluster-api-provider-vsphere-static-ip/pkg/ipam"
+	"github.com/spectrocloud/cluster-api-provider-vsphere-static-ip/pkg/metrics"
+	"github.com/spectrocloud/cluster-api-provider-vsphere-static-ip/pkg/util"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	capi "sigs.k8s.io/cluster-api/api/v1beta1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// ipBlockPreAllocationPrefix prefixes the pre-allocations reserving the block of addresses of a MachineDeployment, along
+// with its namespace and name. The '/' separator is neither valid in the IPClaim names, so the addresses are not
+// allocated by metal3io, nor in the namespaces and names, so the blocks are not confused with each other.
+const ipBlockPreAllocationPrefix = "ipblock/"
+
+// ReserveIPBlock reserves the block of addresses of the MachineDeployment in the IPPool, for the addresses allocated to
+// its machines, and the reserved ones, to add up to the size. The reservations beyond the size are released, as well as
+// the reservations of the block in the other IPPools of the cluster. The IPBlockExhaustedError is returned if the
+// IPPool has not enough free addresses for the block.
+func ReserveIPBlock(cli client.Client, ipPool *ipamv1.IPPool, block types.NamespacedName, size int, clusterMeta metav1.ObjectMeta,
+	globalNamespace string) error {
+	if err := ReleaseIPBlock(cli, block, clusterMeta, globalNamespace, ipPool); err != nil {
+		return err
+	}
+
+	allocated, err := countIPBlockClaims(cli, block, clusterMeta, globalNamespace)
+	if err != nil {
+		return err
+	}
+
+	//the reservations are patched with an optimistic lock, as the machines take their addresses from the block
+	dataPatch := client.MergeFromWithOptions(ipPool.DeepCopy(), client.MergeFromWithOptimisticLock{})
+
+	//the addresses excluded, or quarantined, since they were reserved are dropped from the block
+	reservations := []string{}
+	reserved := map[ipamv1.IPAddressStr]bool{}
+	for _, address := range ipPool.Status.Allocations {
+		reserved[address] = true
+	}
+	for name, address := range ipPool.Spec.PreAllocations {
+		if !strings.HasPrefix(name, getIPBlockPrefix(block)) {
+			reserved[address] = true
+		}
+	}
+	changed := false
+	for _, name := range getIPBlockReservations(*ipPool, block) {
+		if reserved[ipPool.Spec.PreAllocations[name]] {
+			delete(ipPool.Spec.PreAllocations, name)
+			changed = true
+			continue
+		}
+		reservations = append(reservations, name)
+	}
+
+	missing := size - allocated - len(reservations)
+	for ; missing < 0 && len(reservations) > 0; missing++ {
+		delete(ipPool.Spec.PreAllocations, reservations[len(reservations)-1])
+		reservations = reservations[:len(reservations)-1]
+		changed = true
+	}
+	if missing > 0 {
+		for _, address := range getFreeAddresses(*ipPool, missing) {
+			if ipPool.Spec.PreAllocations == nil {
+				ipPool.Spec.PreAllocations = map[string]ipamv1.IPAddressStr{}
+			}
+			ipPool.Spec.PreAllocations[getIPBlockPreAllocationName(block, string(address))] = address
+			missing--
+			changed = true
+		}
+	}
+
+	if changed {
+		if err := cli.Patch(context.Background(), ipPool, dataPatch); err != nil {
+			return errors.Wrapf(err, "failed to reserve the block of addresses of %s in IPPool %s", block, ipPool.Name)
+		}
+	}
+
+	blockLabels := []string{ipPool.Namespace, ipPool.Name, block.Namespace, block.Name}
+	metrics.IPBlockSize.WithLabelValues(blockLabels...).Set(float64(size))
+	metrics.IPBlockReserved.WithLabelValues(blockLabels...).Set(float64(size - missing))
+
+	if missing > 0 {
+		return &ipam.IPBlockExhaustedError{Pool: ipPool.Name, Owner: block.String(), Size: size, Reserved: size - missing}
+	}
+
+	return nil
+}
+
+// ReleaseIPBlock releases the reservations of the block of addresses of the MachineDeployment in the IPPools of the
+// cluster, except in the given IPPool, if any
+func ReleaseIPBlock(cli client.Client, block types.NamespacedName, clusterMeta metav1.ObjectMeta, globalNamespace string, except *ipamv1.IPPool) error {
+	for _, namespace := range getIPPoolNamespaces(clusterMeta, globalNamespace) {
+		ipPools := &ipamv1.IPPoolList{}
+		if err := cli.List(context.Background(), ipPools, client.InNamespace(namespace)); err != nil {
+			return errors.Wrapf(err, "failed to list IPPools in namespace %s", namespace)
+		}
+
+		for i := range ipPools.Items {
+			ipPool := &ipPools.Items[i]
+			if except != nil && ipPool.Namespace == except.Namespace && ipPool.Name == except.Name {
+				continue
+			}
+			if err := releaseIPBlockReservations(cli, ipPool, map[types.NamespacedName]bool{block: true}); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// ReleaseOrphanedIPBlocks releases the reservations of the blocks of addresses of the deleted MachineDeployments in the
+// IPPool
+func ReleaseOrphanedIPBlocks(cli client.Client, ipPool *ipamv1.IPPool) error {
+	orphaned := map[types.NamespacedName]bool{}
+	for name := range ipPool.Spec.PreAllocations {
+		block, ok := parseIPBlockPreAllocationName(name)
+		if !ok {
+			continue
+		}
+		if _, checked := orphaned[block]; checked {
+			continue
+		}
+
+		err := cli.Get(context.Background(), block, &capi.MachineDeployment{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			return errors.Wrapf(err, "failed to get MachineDeployment %s", block)
+		}
+		orphaned[block] = apierrors.IsNotFound(err)
+	}
+
+	for block, ok := range orphaned {
+		if !ok {
+			delete(orphaned, block)
+		}
+	}
+	if len(orphaned) == 0 {
+		return nil
+	}
+
+	return releaseIPBlockReservations(cli, ipPool, orphaned)
+}
+
+// ReturnIPBlockAddress returns the address pre-allocated for the released IPClaim to the block of its MachineDeployment.
+// The address quarantined by the IPPool is dropped from the block instead, for the block to be refilled with a free one.
+func ReturnIPBlockAddress(cli client.Client, poolKey types.NamespacedName, ipClaim *ipamv1.IPClaim) error {
+	ipPool := &ipamv1.IPPool{}
+	if err := cli.Get(context.Background(), poolKey, ipPool); err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil
+		}
+		return errors.Wrapf(err, "failed to get IPPool %s", poolKey.Name)
+	}
+
+	address, ok := ipPool.Spec.PreAllocations[ipClaim.Name]
+	if !ok {
+		return nil
+	}
+
+	period, err := GetQuarantinePeriod(ipPool)
+	if err != nil {
+		return err
+	}
+	quarantined, err := getQuarantinedAddresses(ipPool)
+	if err != nil {
+		return err
+	}
+
+	dataPatch := client.MergeFromWithOptions(ipPool.DeepCopy(), client.MergeFromWithOptimisticLock{})
+	delete(ipPool.Spec.PreAllocations, ipClaim.Name)
+	if _, ok := quarantined[string(address)]; !ok && period == 0 && ipClaim.Labels[ipam.IPBlockKey] != "" {
+		block := types.NamespacedName{Namespace: ipClaim.Labels[ipam.ClusterNamespaceKey], Name: ipClaim.Labels[ipam.IPBlockKey]}
+		ipPool.Spec.PreAllocations[getIPBlockPreAllocationName(block, string(address))] = address
+	}
+
+	if err := cli.Patch(context.Background(), ipPool, dataPatch); err != nil {
+		return errors.Wrapf(err, "failed to return address %s of IPClaim %s to its block in IPPool %s", address, ipClaim.Name, ipPool.Name)
+	}
+
+	return nil
+}
+
+// takeIPBlockAddress pre-allocates an address reserved in the block of the MachineDeployment of the consumer for the
+// IPClaim, for metal3io to allocate it right away. False is returned if the block has no reserved address left, or the
+// IPClaim already has a pre-allocated address.
+func takeIPBlockAddress(cli client.Client, ipPool *ipamv1.IPPool, claimName string, consumerLabels map[string]string) (bool, error) {
+	name := consumerLabels[capi.MachineDeploymentLabelName]
+	if name == "" {
+		return false, nil
+	}
+	if _, ok := ipPool.Spec.PreAllocations[claimName]; ok {
+		return false, nil
+	}
+
+	block := types.NamespacedName{Namespace: consumerLabels[ipam.ClusterNamespaceKey], Name: name}
+	reservations := getIPBlockReservations(*ipPool, block)
+	if len(reservations) == 0 {
+		return false, nil
+	}
+
+	//the optimistic lock keeps the machines from taking the same address
+	dataPatch := client.MergeFromWithOptions(ipPool.DeepCopy(), client.MergeFromWithOptimisticLock{})
+	address := ipPool.Spec.PreAllocations[reservations[0]]
+	delete(ipPool.Spec.PreAllocations, reservations[0])
+	ipPool.Spec.PreAllocations[claimName] = address
+
+	if err := cli.Patch(context.Background(), ipPool, dataPatch); err != nil {
+		return false, errors.Wrapf(err, "failed to take address %s of the block of %s in IPPool %s", address, block, ipPool.Name)
+	}
+
+	return true, nil
+}
+
+// getIPBlockIPPool gets the candidate IPPool with an address reserved in the block of the MachineDeployment of the owner
+// of the IPClaims, if any
+func getIPBlockIPPool(candidates []ipamv1.IPPool, owner client.Object) (*ipamv1.IPPool, error) {
+	name := util.GetIPClaimOwnerGroupLabels(owner)[capi.MachineDeploymentLabelName]
+	if name == "" {
+		return nil, nil
+	}
+
+	block := types.NamespacedName{Namespace: owner.GetNamespace(), Name: name}
+	for i := range candidates {
+		if len(getIPBlockReservations(candidates[i], block)) > 0 {
+			return &candidates[i], nil
+		}
+	}
+
+	return nil, nil
+}
+
+// countIPBlockClaims counts the IPClaims of the machines of the MachineDeployment in the IPPool namespaces of the
+// cluster, whether their addresses are taken from the block or not
+func countIPBlockClaims(cli client.Client, block types.NamespacedName, clusterMeta metav1.ObjectMeta, globalNamespace string) (int, error) {
+	count := 0
+	for _, namespace := range getIPPoolNamespaces(clusterMeta, globalNamespace) {
+		ipClaims := &ipamv1.IPClaimList{}
+		matchLabels := client.MatchingLabels{ipam.ClusterNamespaceKey: block.Namespace, capi.MachineDeploymentLabelName: block.Name}
+		if err := cli.List(context.Background(), ipClaims, client.InNamespace(namespace), matchLabels); err != nil {
+			return 0, errors.Wrapf(err, "failed to list IPClaims in namespace %s", namespace)
+		}
+		for _, ic := range ipClaims.Items {
+			if ic.DeletionTimestamp.IsZero() {
+				count++
+			}
+		}
+	}
+
+	return count, nil
+}
+
+// releaseIPBlockReservations removes the reservations of the blocks from the pre-allocations of the IPPool
+func releaseIPBlockReservations(cli client.Client, ipPool *ipamv1.IPPool, blocks map[types.NamespacedName]bool) error {
+	dataPatch := client.MergeFromWithOptions(ipPool.DeepCopy(), client.MergeFromWithOptimisticLock{})
+	changed := false
+	for name := range ipPool.Spec.PreAllocations {
+		if block, ok := parseIPBlockPreAllocationName(name); ok && blocks[block] {
+			delete(ipPool.Spec.PreAllocations, name)
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+
+	if err := cli.Patch(context.Background(), ipPool, dataPatch); err != nil {
+		return errors.Wrapf(err, "failed to release the blocks of addresses in IPPool %s", ipPool.Name)
+	}
+
+	return nil
+}
+
+// getIPBlockReservations gets the sorted names of the pre-allocations of the block in the IPPool
+func getIPBlockReservations(ipPool ipamv1.IPPool, block types.NamespacedName) []string {
+	names := []string{}
+	for name := range ipPool.Spec.PreAllocations {
+		if strings.HasPrefix(name, getIPBlockPrefix(block)) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// getFreeAddresses gets up to count addresses of the IPPool which are neither allocated nor pre-allocated
+func getFreeAddresses(ipPool ipamv1.IPPool, count int) []ipamv1.IPAddressStr {
+	reserved := getReservedAddresses(ipPool)
+
+	free := []ipamv1.IPAddressStr{}
+	for _, p := range ipPool.Spec.Pools {
+		for index := 0; len(free) < count; index++ {
+			address, err := ipamv1.GetIPAddress(p, index)
+			if err != nil {
+				break
+			}
+			if !reserved[address] {
+				free = append(free, address)
+				reserved[address] = true
+			}
+		}
+	}
+
+	return free
+}
+
+func getIPBlockPrefix(block types.NamespacedName) string {
+	return fmt.Sprintf("%s%s/%s/", ipBlockPreAllocationPrefix, block.Namespace, block.Name)
+}
+
+func getIPBlockPreAllocationName(block types.NamespacedName, address string) string {
+	return getIPBlockPrefix(block) + address
+}
+
+// parseIPBlockPreAllocationName gets the MachineDeployment of the block pre-allocation, false if not a block one
+func parseIPBlockPreAllocationName(name string) (types.NamespacedName, bool) {
+	if !strings.HasPrefix(name, ipBlockPreAllocationPrefix) {
+		return types.NamespacedName{}, false
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(name, ipBlockPreAllocationPrefix), "/", 3)
+	if len(parts) != 3 {
+		return types.NamespacedName{}, false
+	}
+
+	return types.NamespacedName{Namespace: parts[0], Name: parts[1]}, true
+}
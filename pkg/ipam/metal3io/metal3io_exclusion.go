@@ -0,0 +1,82 @@
+package metal3io
+
+import (
+	"sort"
+	"strings"
+
+	ipamv1 "github.com/metal3-io/ip-address-manager/api/v1alpha1"
+	"github.com/pkg/errors"
+	"github.com/spectrocloud/cluster-api-provider-vsphere-static-ip/pkg/ipam"
+	"github.com/spectrocloud/cluster-api-provider-vsphere-static-ip/pkg/util"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// exclusionPreAllocationPrefix prefixes the pre-allocations reserving the excluded addresses in the IPPool
+const exclusionPreAllocationPrefix = "exclusion-"
+
+// SyncExcludedAddresses reserves the excluded addresses of the IPPool in its pre-allocations, and removes the
+// reservations of the addresses no longer excluded. The excluded addresses already allocated to an IPClaim are not
+// reserved, and are returned as conflicts, for eg. "10.10.100.20 (vm-0)", while the other ones are.
+func SyncExcludedAddresses(cli client.Client, ipPool *ipamv1.IPPool) ([]string, error) {
+	excluded, err := util.GetExcludedAddresses(ipPool.Annotations[ipam.ExcludedAddressesKey])
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid %s in IPPool %s", ipam.ExcludedAddressesKey, ipPool.Name)
+	}
+
+	var conflicts []string
+	err = patchIPPool(cli, ipPool, func(ipPool *ipamv1.IPPool) (bool, error) {
+		allocated := getAllocatedAddresses(ipPool)
+		conflicts = nil
+		desired := map[string]ipamv1.IPAddressStr{}
+		for _, address := range excluded {
+			if claim, ok := allocated[address]; ok {
+				conflicts = append(conflicts, address+" ("+claim+")")
+				continue
+			}
+			desired[getExclusionPreAllocationName(address)] = ipamv1.IPAddressStr(address)
+		}
+		sort.Strings(conflicts)
+
+		changed := false
+		for name := range ipPool.Spec.PreAllocations {
+			if _, ok := desired[name]; strings.HasPrefix(name, exclusionPreAllocationPrefix) && !ok {
+				delete(ipPool.Spec.PreAllocations, name)
+				changed = true
+			}
+		}
+		for name, address := range desired {
+			if ipPool.Spec.PreAllocations[name] == address {
+				continue
+			}
+			if ipPool.Spec.PreAllocations == nil {
+				ipPool.Spec.PreAllocations = map[string]ipamv1.IPAddressStr{}
+			}
+			ipPool.Spec.PreAllocations[name] = address
+			changed = true
+		}
+		return changed, nil
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to reserve excluded addresses in IPPool %s", ipPool.Name)
+	}
+
+	return conflicts, nil
+}
+
+// getAllocatedAddresses gets the addresses of the IPPool allocated to an IPClaim, with the name of the IPClaim
+func getAllocatedAddresses(ipPool *ipamv1.IPPool) map[string]string {
+	allocated := map[string]string{}
+	for claim, address := range ipPool.Status.Allocations {
+		if strings.HasPrefix(claim, exclusionPreAllocationPrefix) || strings.HasPrefix(claim, quarantinePreAllocationPrefix) {
+			continue
+		}
+		allocated[string(address)] = claim
+	}
+
+	return allocated
+}
+
+// getExclusionPreAllocationName gets the pre-allocation name of the excluded address
+func getExclusionPreAllocationName(address string) string {
+	return exclusionPreAllocationPrefix + strings.NewReplacer(".", "-", ":", "-").Replace(address)
+}
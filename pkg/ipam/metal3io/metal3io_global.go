@@ -0,0 +1,168 @@
+package metal3io
+
+import (
+	"context"
+	"encoding/json"
+
+	ipamv1 "github.com/metal3-io/ip-address-manager/api/v1alpha1"
+	"github.com/pkg/errors"
+	"github.com/spectrocloud/cluster-api-provider-vsphere-static-ip/pkg/ipam"
+	"github.com/spectrocloud/cluster-api-provider-vsphere-static-ip/pkg/util"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// getIPPoolByName gets the IPPool of the namespace, or the IPPool of the global namespace, if set, if it does not exist in
+// the namespace. The IPPool is restricted by the access policies of its namespace, as for the IPPools selected by labels.
+func getIPPoolByName(cli client.Client, name, namespace, globalNamespace, consumer string) (*ipamv1.IPPool, error) {
+	ipPool := &ipamv1.IPPool{}
+	err := cli.Get(context.Background(), types.NamespacedName{Namespace: namespace, Name: name}, ipPool)
+	if apierrors.IsNotFound(err) && globalNamespace != "" && globalNamespace != namespace {
+		err = cli.Get(context.Background(), types.NamespacedName{Namespace: globalNamespace, Name: name}, ipPool)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get IPPool %s", name)
+	}
+
+	if _, err := filterAccessibleIPPools(cli, ipPool.Namespace, consumer, []ipamv1.IPPool{*ipPool}); err != nil {
+		return nil, err
+	}
+
+	return ipPool, nil
+}
+
+// selectIPPool selects an IPPool with a free address, matching the labels and the topology, in the IPPool namespace of
+// the cluster first, and then in the global namespace, with the selection options. The first matching IPPool is selected
+// if none has a free address.
+func (m Metal3IPAM) selectIPPool(matchLabels, poolMatchLabels map[string]string, opts ipam.SelectionOptions,
+	clusterMeta metav1.ObjectMeta) (*ipamv1.IPPool, error) {
+	//the ip-pool selector, and the one of the role of the machine, if set, restrict the ip-pools matching the labels
+	selector := labels.SelectorFromSet(matchLabels)
+	for _, key := range []string{ipam.IPPoolSelectorKey, ipam.RoleIPPoolSelectorKey} {
+		v := poolMatchLabels[key]
+		if v == "" {
+			continue
+		}
+		poolSelector, err := util.ParseIPPoolSelector(v)
+		if err != nil {
+			return nil, err
+		}
+		requirements, _ := poolSelector.Requirements()
+		selector = selector.Add(requirements...)
+	}
+
+	candidates, err := listIPPools(m.Client, selector, poolMatchLabels, clusterMeta, m.opts.GlobalIPPoolNamespace)
+	if err != nil || len(candidates) == 0 {
+		return nil, err
+	}
+
+	//the ip-pool of the addresses already allocated to the owner keeps being selected
+	ipPool, err := getOwnerIPPool(m.Client, candidates, opts.Owner)
+	if err != nil || ipPool != nil {
+		return ipPool, err
+	}
+
+	//then the ip-pool with the addresses reserved for the MachineDeployment of the owner
+	ipPool, err = getIPBlockIPPool(candidates, opts.Owner)
+	if err != nil || ipPool != nil {
+		return ipPool, err
+	}
+
+	return pickIPPool(m.reader, candidates, opts, clusterMeta)
+}
+
+// listIPPools lists the IPPools matching the selector and the topology, in the IPPool namespace of the cluster first, and
+// then in the global namespace. The access error is returned if no IPPool is accessible.
+func listIPPools(cli client.Client, selector labels.Selector, poolMatchLabels map[string]string, clusterMeta metav1.ObjectMeta,
+	globalNamespace string) ([]ipamv1.IPPool, error) {
+	candidates := []ipamv1.IPPool{}
+	var accessErr error
+	for _, namespace := range getIPPoolNamespaces(clusterMeta, globalNamespace) {
+		ipPools := &ipamv1.IPPoolList{}
+		if err := cli.List(context.Background(), ipPools, client.InNamespace(namespace), client.MatchingLabelsSelector{Selector: selector}); err != nil {
+			return nil, util.IgnoreNotFound(err)
+		}
+
+		//the ip-pools of another namespace are restricted by the access policies of the namespace
+		items, err := filterAccessibleIPPools(cli, namespace, clusterMeta.Namespace, ipPools.Items)
+		if ipam.IsAccessDenied(err) {
+			if accessErr == nil {
+				accessErr = err
+			}
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		//the ip-pools of the placement of the machine are selected first
+		candidates = append(candidates, filterTopologyIPPools(items, poolMatchLabels)...)
+	}
+
+	if len(candidates) == 0 {
+		return nil, accessErr
+	}
+
+	return candidates, nil
+}
+
+// getIPPoolNamespaces gets the IPPool namespace of the cluster, and the global namespace, if set, in the order of selection
+func getIPPoolNamespaces(clusterMeta metav1.ObjectMeta, globalNamespace string) []string {
+	namespaces := []string{getIPPoolNamespace(clusterMeta)}
+	if globalNamespace != "" && globalNamespace != namespaces[0] {
+		namespaces = append(namespaces, globalNamespace)
+	}
+
+	return namespaces
+}
+
+// setIPClaimOwner references the owner of the IPClaim in another namespace
+func setIPClaimOwner(ic *ipamv1.IPClaim, ownerRef v1.ObjectReference) error {
+	ref, err := json.Marshal(ownerRef)
+	if err != nil {
+		return errors.Wrapf(err, "failed to reference the owner of IPClaim %s", ic.Name)
+	}
+
+	annotations := ic.GetAnnotations()
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	annotations[ipam.IPClaimOwnerKey] = string(ref)
+	ic.SetAnnotations(annotations)
+	return nil
+}
+
+// GetIPClaimOwner gets the owner of the IPClaim in another namespace, nil if not set
+func GetIPClaimOwner(ic *ipamv1.IPClaim) (*v1.ObjectReference, error) {
+	v := ic.GetAnnotations()[ipam.IPClaimOwnerKey]
+	if v == "" {
+		return nil, nil
+	}
+
+	ownerRef := &v1.ObjectReference{}
+	if err := json.Unmarshal([]byte(v), ownerRef); err != nil {
+		return nil, errors.Wrapf(err, "invalid %s in IPClaim %s", ipam.IPClaimOwnerKey, ic.Name)
+	}
+
+	return ownerRef, nil
+}
+
+// isIPClaimOwnedBy checks if the IPClaim is owned by the object, in the same or in another namespace
+// hasClaimLabels checks if the IPClaim has the claim labels, all the IPClaims have the empty claim labels
+func hasClaimLabels(ic ipamv1.IPClaim, claimLabels map[string]string) bool {
+	return labels.SelectorFromSet(claimLabels).Matches(labels.Set(ic.Labels))
+}
+
+func isIPClaimOwnedBy(ic ipamv1.IPClaim, o v1.ObjectReference) bool {
+	for _, ref := range ic.GetOwnerReferences() {
+		if ref.UID == o.UID && ref.Kind == o.Kind && ref.Name == o.Name {
+			return true
+		}
+	}
+
+	ownerRef, err := GetIPClaimOwner(&ic)
+	return err == nil && ownerRef != nil && ownerRef.UID == o.UID && ownerRef.Kind == o.Kind && ownerRef.Name == o.Name
+}
@@ -13,23 +13,37 @@ import (
 	v1 "k8s.io/api/core/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
+	capi "sigs.k8s.io/cluster-api/api/v1beta1"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
 type Metal3IPAM struct {
 	client.Client
-	log logr.Logger
+	// reader counts the IPClaims from the api server, as an IPClaim created moments earlier, for eg., for another network
+	// device of the same machine, is not yet in the cache of the client
+	reader client.Reader
+	locks  *poolLocks
+	opts   ipam.Options
+	log    logr.Logger
 }
 
-func NewIpam(cli client.Client, log logr.Logger) ipam.IPAddressManager {
+func NewIpam(cli client.Client, reader client.Reader, log logr.Logger, opts ipam.Options) ipam.IPAddressManager {
 	return &Metal3IPAM{
 		Client: cli,
+		reader: reader,
+		locks:  &poolLocks{},
+		opts:   opts,
 		log:    log,
 	}
 }
 
+func (m Metal3IPAM) GetOptions() ipam.Options {
+	return m.opts
+}
+
 func (m Metal3IPAM) GetIP(ipName string, pool ipam.IPPool) (ipam.IPAddress, error) {
 	m.log.V(0).Info(fmt.Sprintf("get IPAddress %s", ipName))
 
@@ -41,7 +55,7 @@ func (m Metal3IPAM) GetIP(ipName string, pool ipam.IPPool) (ipam.IPAddress, erro
 	return ip, nil
 }
 
-func (m Metal3IPAM) AllocateIP(ipName string, pool ipam.IPPool, ownerObj runtime.Object) (ipam.IPAddress, error) {
+func (m Metal3IPAM) AllocateIP(ipName string, pool ipam.IPPool, ownerObj runtime.Object, claimLabels map[string]string) (ipam.IPAddress, error) {
 	o := util.GetObjRef(ownerObj)
 	m.log.V(0).Info(fmt.Sprintf("allocate IP %s", ipName))
 
@@ -52,32 +66,153 @@ func (m Metal3IPAM) AllocateIP(ipName string, pool ipam.IPPool, ownerObj runtime
 		return nil, err
 	}
 
-	//if IPClaim exists, the corresponding IPAddress is expected to be generated
+	//if IPClaim exists, the corresponding IPAddress is expected to be generated, the claim labels are added to the
+	//IPClaims created before them
 	if ic != nil {
 		m.log.V(0).Info(fmt.Sprintf("IPClaim %s already exists, skipping creation", ipName))
+		if hasClaimLabels(*ic, claimLabels) {
+			return nil, nil
+		}
+		dataPatch := client.MergeFrom(ic.DeepCopy())
+		ic.Labels = labels.Merge(ic.Labels, claimLabels)
+		if err := m.Patch(context.Background(), ic, dataPatch); err != nil {
+			return nil, errors.Wrapf(err, "failed to patch IPClaim %s", ipName)
+		}
 		return nil, nil
 	}
 
 	//create a new ip claim
-	if err = createIPClaim(m.Client, pool, ipName, o, m.log); err != nil {
+	consumerLabels := labels.Merge(getConsumerLabels(ownerObj), claimLabels)
+	if err = m.createIPClaim(pool, ipName, o, consumerLabels); err != nil {
 		return nil, err
 	}
 
 	return nil, nil
 }
 
-func (m Metal3IPAM) DeallocateIP(name string, pool ipam.IPPool, ownerObj runtime.Object) error {
+func (m Metal3IPAM) DeallocateIP(ipName string, pool ipam.IPPool, ownerObj runtime.Object) error {
+	m.log.V(0).Info(fmt.Sprintf("deallocate IP %s", ipName))
+
+	ic, err := getIPClaim(m.Client, pool, ipName)
+	if err != nil {
+		m.log.V(0).Info(fmt.Sprintf("failed to get IPClaim %s", ipName))
+		return err
+	}
+
+	//the IPAddress is released by the metal3io ipam, once the IPClaim is deleted
+	if ic == nil {
+		m.log.V(0).Info(fmt.Sprintf("IPClaim %s does not exist, skipping deletion", ipName))
+		return nil
+	}
+
+	if err := m.Delete(context.Background(), ic); err != nil {
+		return errors.Wrapf(err, "failed to delete IPClaim %s", ipName)
+	}
+
 	return nil
 }
 
-func (m Metal3IPAM) GetAvailableIPPool(poolMatchLabels map[string]string, clusterMeta metav1.ObjectMeta) (ipam.IPPool, error) {
-	ipPool := ipamv1.IPPool{}
+func (m Metal3IPAM) GetProbedAddress(ipName string, pool ipam.IPPool) (string, error) {
+	ic, err := getIPClaim(m.Client, pool, ipName)
+	if err != nil || ic == nil {
+		return "", err
+	}
+
+	return ic.Annotations[ipam.IPClaimProbedAddressKey], nil
+}
+
+func (m Metal3IPAM) SetProbedAddress(ipName string, pool ipam.IPPool, address string) error {
+	ic, err := getIPClaim(m.Client, pool, ipName)
+	if err != nil {
+		return err
+	}
+	if ic == nil {
+		return errors.Errorf("IPClaim %s does not exist", ipName)
+	}
+
+	dataPatch := client.MergeFrom(ic.DeepCopy())
+	if ic.Annotations == nil {
+		ic.Annotations = map[string]string{}
+	}
+	ic.Annotations[ipam.IPClaimProbedAddressKey] = address
+	if err := m.Patch(context.Background(), ic, dataPatch); err != nil {
+		return errors.Wrapf(err, "failed to patch IPClaim %s", ipName)
+	}
+
+	return nil
+}
+
+func (m Metal3IPAM) GetOwnedIPNames(pool ipam.IPPool, ownerObj runtime.Object, claimLabels map[string]string) ([]string, error) {
+	o := util.GetObjRef(ownerObj)
+
+	ipClaims := &ipamv1.IPClaimList{}
+	if err := m.List(context.Background(), ipClaims, client.InNamespace(pool.GetNamespace())); err != nil {
+		return nil, errors.Wrapf(err, "failed to list IPClaims in namespace %s", pool.GetNamespace())
+	}
+
+	ipNames := []string{}
+	for _, ic := range ipClaims.Items {
+		if ic.Spec.Pool.Name != pool.GetName() {
+			continue
+		}
+		if isIPClaimOwnedBy(ic, o) && hasClaimLabels(ic, claimLabels) {
+			ipNames = append(ipNames, ic.Name)
+		}
+	}
+
+	return ipNames, nil
+}
+
+func (m Metal3IPAM) GetOwnedIPPools(ownerObj runtime.Object, claimLabels map[string]string) ([]ipam.IPPool, error) {
+	o := util.GetObjRef(ownerObj)
+
+	//the claims are in the namespaces of their ip-pools, which are not only the namespace of the owner
+	ipClaims := &ipamv1.IPClaimList{}
+	if err := m.List(context.Background(), ipClaims); err != nil {
+		return nil, errors.Wrap(err, "failed to list IPClaims")
+	}
 
-	//if the specific ip-pool name is provided use that to get the ip-pool
-	if v, ok := poolMatchLabels[ipam.ClusterIPPoolNameKey]; ok && v != "" {
-		key := types.NamespacedName{Namespace: clusterMeta.Namespace, Name: v}
-		if err := m.Get(context.Background(), key, &ipPool); err != nil {
-			return nil, errors.Wrapf(err, "failed to get IPPool %s", v)
+	pools := []ipam.IPPool{}
+	poolKeys := map[types.NamespacedName]bool{}
+	for _, ic := range ipClaims.Items {
+		poolKey := types.NamespacedName{Namespace: ic.Namespace, Name: ic.Spec.Pool.Name}
+		if poolKeys[poolKey] || !isIPClaimOwnedBy(ic, o) || !hasClaimLabels(ic, claimLabels) {
+			continue
+		}
+		poolKeys[poolKey] = true
+
+		ipPool := &ipamv1.IPPool{}
+		if err := m.Get(context.Background(), poolKey, ipPool); err != nil {
+			if !apierrors.IsNotFound(err) {
+				return nil, errors.Wrapf(err, "failed to get IPPool %s", poolKey)
+			}
+			//the claims of a deleted ip-pool are still released
+			ipPool.ObjectMeta = metav1.ObjectMeta{Namespace: poolKey.Namespace, Name: poolKey.Name}
+		}
+		pools = append(pools, convertToMetal3ioIPPool(*ipPool, nil))
+	}
+
+	return pools, nil
+}
+
+func (m Metal3IPAM) GetAvailableIPPool(poolMatchLabels map[string]string, clusterMeta metav1.ObjectMeta,
+	opts ipam.SelectionOptions) (ipam.IPPool, error) {
+	var ipPool *ipamv1.IPPool
+	var err error
+
+	//the ip-pool selectors of the StaticIPPolicy take precedence over the ip-pool labels
+	if len(opts.PoolSelectors) > 0 {
+		if ipPool, err = m.selectPolicyIPPool(poolMatchLabels, opts, clusterMeta); err != nil {
+			return nil, err
+		}
+		if ipPool == nil {
+			m.log.V(0).Info("failed to get an IPPool matching the StaticIPPolicy")
+			return nil, nil
+		}
+	} else if v, ok := poolMatchLabels[ipam.ClusterIPPoolNameKey]; ok && v != "" {
+		//if the specific ip-pool name is provided use that to get the ip-pool
+		if ipPool, err = getIPPoolByName(m.Client, v, clusterMeta.Namespace, m.opts.GlobalIPPoolNamespace, clusterMeta.Namespace); err != nil {
+			return nil, err
 		}
 	} else {
 		//use labels 'ip-pool-group' & 'network-name' to select the ip-pool
@@ -89,22 +224,13 @@ func (m Metal3IPAM) GetAvailableIPPool(poolMatchLabels map[string]string, cluste
 			matchLabels[ipam.ClusterNetworkNameKey] = v
 		}
 
-		ipPools := &ipamv1.IPPoolList{}
-		if err := m.List(
-			context.Background(),
-			ipPools,
-			client.InNamespace(getIPPoolNamespace(clusterMeta)),
-			client.MatchingLabels(matchLabels)); err != nil {
-			return nil, util.IgnoreNotFound(err)
+		if ipPool, err = m.selectIPPool(matchLabels, poolMatchLabels, opts, clusterMeta); err != nil {
+			return nil, err
 		}
-
-		if len(ipPools.Items) == 0 {
+		if ipPool == nil {
 			m.log.V(0).Info("failed to get a matching IPPool")
 			return nil, nil
 		}
-
-		//TODO: handle selection based on ip address availability
-		ipPool = ipPools.Items[0]
 	}
 
 	//TODO: refactor searchDomains, once its added in metal3io
@@ -113,9 +239,43 @@ func (m Metal3IPAM) GetAvailableIPPool(poolMatchLabels map[string]string, cluste
 		searchDomains = strings.Split(ipPool.Annotations[ipam.SearchDomainsKey], ",")
 	}
 
-	m.log.V(0).Info(fmt.Sprintf("IPPool %s is available", ipPool.Name))
+	m.log.V(0).Info(fmt.Sprintf("IPPool %s/%s is available", ipPool.Namespace, ipPool.Name))
 
-	return convertToMetal3ioIPPool(ipPool, searchDomains), nil
+	return convertToMetal3ioIPPool(*ipPool, searchDomains), nil
+}
+
+// hasFreeAddress checks if the IPPool has an address which is neither allocated nor pre-allocated, such as the
+// quarantined addresses
+func hasFreeAddress(ipPool ipamv1.IPPool) bool {
+	reserved := getReservedAddresses(ipPool)
+
+	//a range with more addresses than the reserved ones has a free address
+	for _, p := range ipPool.Spec.Pools {
+		for index := 0; index <= len(reserved); index++ {
+			address, err := ipamv1.GetIPAddress(p, index)
+			if err != nil {
+				break
+			}
+			if !reserved[address] {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// getReservedAddresses gets the addresses of the IPPool which are either allocated or pre-allocated
+func getReservedAddresses(ipPool ipamv1.IPPool) map[ipamv1.IPAddressStr]bool {
+	reserved := map[ipamv1.IPAddressStr]bool{}
+	for _, address := range ipPool.Status.Allocations {
+		reserved[address] = true
+	}
+	for _, address := range ipPool.Spec.PreAllocations {
+		reserved[address] = true
+	}
+
+	return reserved
 }
 
 func getIPPoolNamespace(meta metav1.ObjectMeta) string {
@@ -134,7 +294,8 @@ func getIPAddress(cli client.Client, pool ipam.IPPool, ipName string, log logr.L
 		return nil, err
 	}
 
-	if ic == nil || ic.Status.Address == nil {
+	//an IPClaim being deleted, for eg., when its address is quarantined, is replaced by a new one once deleted
+	if ic == nil || ic.Status.Address == nil || !ic.DeletionTimestamp.IsZero() {
 		log.V(0).Info(fmt.Sprintf("waiting for IPClaim %s", ipName))
 		return nil, nil
 	}
@@ -163,47 +324,83 @@ func getIPClaim(cli client.Client, pool ipam.IPPool, claimName string) (*ipamv1.
 	return ic, nil
 }
 
-func createIPClaim(cli client.Client, pool ipam.IPPool, claimName string, ownerRef v1.ObjectReference, log logr.Logger) error {
+func (m Metal3IPAM) createIPClaim(pool ipam.IPPool, claimName string, ownerRef v1.ObjectReference, consumerLabels map[string]string) error {
 	//set owner name as the claim name
-	log.V(0).Info(fmt.Sprintf("create IPClaim %s", claimName))
+	m.log.V(0).Info(fmt.Sprintf("create IPClaim %s", claimName))
 	ipPool := &ipamv1.IPPool{}
 	poolKey := types.NamespacedName{Namespace: pool.GetNamespace(), Name: pool.GetName()}
-	if err := cli.Get(context.Background(), poolKey, ipPool); err != nil {
-		log.V(0).Info(fmt.Sprintf("failed to get IPPool %s", pool.GetName()))
+	if err := m.Client.Get(context.Background(), poolKey, ipPool); err != nil {
+		m.log.V(0).Info(fmt.Sprintf("failed to get IPPool %s", pool.GetName()))
 		return util.IgnoreNotFound(err)
 	}
 
+	//the quotas of the IPPool are enforced before the IPClaim is created, the IPPool is locked until then
+	defer m.locks.lock(poolKey)()
+	if err := checkQuota(m.reader, ipPool, consumerLabels); err != nil {
+		return err
+	}
+
+	//an address reserved in the block of the MachineDeployment of the consumer is taken, and returned to the block by
+	//the finalizer once the IPClaim is released
+	fromBlock, err := takeIPBlockAddress(m.Client, ipPool, claimName, consumerLabels)
+	if err != nil {
+		return err
+	}
+	labels := map[string]string{}
+	for k, v := range consumerLabels {
+		labels[k] = v
+	}
+	finalizers := []string{}
+	if fromBlock {
+		labels[ipam.IPBlockKey] = consumerLabels[capi.MachineDeploymentLabelName]
+		finalizers = append(finalizers, ipam.IPBlockFinalizer)
+		m.log.V(0).Info(fmt.Sprintf("allocating address of IPClaim %s from the block of its MachineDeployment", claimName))
+	}
+
 	ipclaim := &ipamv1.IPClaim{
 		TypeMeta: metav1.TypeMeta{
 			Kind:       "IPClaim",
 			APIVersion: ipamv1.GroupVersion.String(),
 		},
 		ObjectMeta: metav1.ObjectMeta{
-			Name:      claimName,
-			Namespace: pool.GetNamespace(),
+			Name:       claimName,
+			Namespace:  pool.GetNamespace(),
+			Labels:     labels,
+			Finalizers: finalizers,
 		},
 		Spec: ipamv1.IPClaimSpec{
 			Pool: util.GetObjRef(ipPool),
 		},
 	}
 
-	//set owner ref
+	//set owner ref, the owner in another namespace is referenced in an annotation, as the IPClaim would otherwise be
+	//garbage collected
 	if len(ownerRef.APIVersion) > 0 && len(ownerRef.Kind) > 0 {
-		ref := metav1.OwnerReference{
-			APIVersion: ownerRef.APIVersion,
-			Kind:       ownerRef.Kind,
-			Name:       ownerRef.Name,
-			UID:        ownerRef.UID,
+		if ownerRef.Namespace == "" || ownerRef.Namespace == pool.GetNamespace() {
+			ref := metav1.OwnerReference{
+				APIVersion: ownerRef.APIVersion,
+				Kind:       ownerRef.Kind,
+				Name:       ownerRef.Name,
+				UID:        ownerRef.UID,
+			}
+			ipclaim.SetOwnerReferences([]metav1.OwnerReference{ref})
+		} else if err := setIPClaimOwner(ipclaim, ownerRef); err != nil {
+			return err
 		}
-		ipclaim.SetOwnerReferences([]metav1.OwnerReference{ref})
 	}
 
-	if err := cli.Create(context.Background(), ipclaim); err != nil {
+	if err := m.Client.Create(context.Background(), ipclaim); err != nil {
+		//the address taken from the block is returned, if not used by the IPClaim
+		if fromBlock {
+			if err := ReturnIPBlockAddress(m.Client, poolKey, ipclaim); err != nil {
+				m.log.Error(err, "failed to return the address of the block")
+			}
+		}
 		if !apierrors.IsAlreadyExists(err) {
 			return errors.Wrapf(err, "failed to create IPClaim %s", claimName)
 		}
 	}
 
-	log.V(0).Info(fmt.Sprintf("created IPClaim %s, waiting for IPAddress to be available", claimName))
+	m.log.V(0).Info(fmt.Sprintf("created IPClaim %s, waiting for IPAddress to be available", claimName))
 	return nil
 }
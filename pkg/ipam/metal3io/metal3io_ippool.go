@@ -1,7 +1,11 @@
 package metal3io
 
 import (
+	"encoding/json"
+	"strconv"
+
 	ipamv1 "github.com/metal3-io/ip-address-manager/api/v1alpha1"
+	"github.com/pkg/errors"
 	"github.com/spectrocloud/cluster-api-provider-vsphere-static-ip/pkg/ipam"
 )
 
@@ -71,10 +75,43 @@ func (m Metal3IPPool) GetNamePrefix() (string, error) {
 	return m.IPPool.Spec.NamePrefix, nil
 }
 
+func (m Metal3IPPool) GetRoutes() ([]ipam.Route, error) {
+	routes := []ipam.Route{}
+	if v := m.Annotations[ipam.RoutesKey]; v != "" {
+		if err := json.Unmarshal([]byte(v), &routes); err != nil {
+			return nil, errors.Wrapf(err, "invalid %s in IPPool %s", ipam.RoutesKey, m.Name)
+		}
+	}
+
+	return routes, nil
+}
+
+func (m Metal3IPPool) GetMTU() (*int64, error) {
+	v := m.Annotations[ipam.MTUKey]
+	if v == "" {
+		return nil, nil
+	}
+
+	mtu, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || mtu <= 0 {
+		return nil, errors.Errorf("invalid %s %q in IPPool %s", ipam.MTUKey, v, m.Name)
+	}
+
+	return &mtu, nil
+}
+
+func (m Metal3IPPool) GetDNSMergePolicy() (ipam.DNSMergePolicy, error) {
+	return ipam.DNSMergePolicy(m.Annotations[ipam.DNSMergePolicyKey]), nil
+}
+
 func (m Metal3IPPool) GetSearchDomains() ([]string, error) {
 	return m.SearchDomains, nil
 }
 
+func (m Metal3IPPool) GetFreeAddressCount() (int, error) {
+	return countFreeAddresses(m.IPPool), nil
+}
+
 type Metal3Pool struct {
 	ipamv1.Pool
 }
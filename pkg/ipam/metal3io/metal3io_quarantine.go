@@ -0,0 +1,215 @@
+package metal3io
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	ipamv1 "github.com/metal3-io/ip-address-manager/api/v1alpha1"
+	"github.com/pkg/errors"
+	"github.com/spectrocloud/cluster-api-provider-vsphere-static-ip/pkg/ipam"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// quarantinePreAllocationPrefix prefixes the pre-allocations reserving the quarantined addresses in the IPPool. No
+// IPClaim is created with these names, so the addresses are not allocated by metal3io.
+const quarantinePreAllocationPrefix = "quarantine-"
+
+type quarantinedAddress struct {
+	Reason string      `json:"reason"`
+	Since  metav1.Time `json:"since"`
+	// Until is the end of the quarantine period of a released address, the address in use is quarantined indefinitely
+	Until *metav1.Time `json:"until,omitempty"`
+}
+
+func (m Metal3IPAM) QuarantineIP(ipName string, pool ipam.IPPool, reason string) error {
+	m.log.V(0).Info(fmt.Sprintf("quarantine IP %s", ipName), "reason", reason)
+
+	ic, err := getIPClaim(m.Client, pool, ipName)
+	if err != nil {
+		m.log.V(0).Info(fmt.Sprintf("failed to get IPClaim %s", ipName))
+		return err
+	}
+	if ic == nil {
+		m.log.V(0).Info(fmt.Sprintf("IPClaim %s does not exist, skipping quarantine", ipName))
+		return nil
+	}
+
+	if ic.Status.Address != nil {
+		ip := &ipamv1.IPAddress{}
+		ipKey := types.NamespacedName{Namespace: pool.GetNamespace(), Name: ic.Status.Address.Name}
+		if err := m.Get(context.Background(), ipKey, ip); err != nil {
+			return errors.Wrapf(err, "failed to get IPAddress %s", ic.Status.Address.Name)
+		}
+
+		poolKey := types.NamespacedName{Namespace: pool.GetNamespace(), Name: pool.GetName()}
+		if err := reserveAddress(m.Client, poolKey, string(ip.Spec.Address), reason, nil); err != nil {
+			return err
+		}
+	}
+
+	//the IPClaim is deleted once the address is reserved, for a new address to be allocated
+	if err := m.Delete(context.Background(), ic); err != nil {
+		return errors.Wrapf(err, "failed to delete IPClaim %s", ipName)
+	}
+
+	return nil
+}
+
+// QuarantineReleasedAddress quarantines the address released by an IPClaim for the quarantine period of the IPPool.
+// An address already quarantined, for eg., when it was found in use, is kept as is.
+func QuarantineReleasedAddress(cli client.Client, ipPool *ipamv1.IPPool, address, reason string) error {
+	period, err := GetQuarantinePeriod(ipPool)
+	if err != nil || period == 0 {
+		return err
+	}
+
+	until := metav1.NewTime(time.Now().Add(period))
+	return reserveAddress(cli, client.ObjectKeyFromObject(ipPool), address, reason, &until)
+}
+
+// SyncQuarantinedAddresses removes the addresses, whose quarantine period is over, from the IPPool, and restores the
+// pre-allocations of the other quarantined addresses removed from the spec, for eg., by a GitOps tool applying the
+// IPPool again. The time until the next quarantine period is over is returned, or zero if no released address is
+// quarantined.
+func SyncQuarantinedAddresses(cli client.Client, ipPool *ipamv1.IPPool) (time.Duration, error) {
+	var next time.Duration
+	err := patchIPPool(cli, ipPool, func(ipPool *ipamv1.IPPool) (bool, error) {
+		quarantined, err := getQuarantinedAddresses(ipPool)
+		if err != nil {
+			return false, err
+		}
+
+		now := time.Now()
+		next = 0
+		expired, restored := false, false
+		allocated := getAllocatedAddresses(ipPool)
+		for address, q := range quarantined {
+			if q.Until != nil {
+				remaining := q.Until.Sub(now)
+				if remaining <= 0 {
+					delete(quarantined, address)
+					delete(ipPool.Spec.PreAllocations, getQuarantinePreAllocationName(address))
+					expired = true
+					continue
+				}
+				if next == 0 || remaining < next {
+					next = remaining
+				}
+			}
+
+			//the address allocated to an IPClaim meanwhile is reserved again once released
+			name := getQuarantinePreAllocationName(address)
+			if _, ok := ipPool.Spec.PreAllocations[name]; ok {
+				continue
+			}
+			if _, ok := allocated[address]; ok {
+				continue
+			}
+			if ipPool.Spec.PreAllocations == nil {
+				ipPool.Spec.PreAllocations = map[string]ipamv1.IPAddressStr{}
+			}
+			ipPool.Spec.PreAllocations[name] = ipamv1.IPAddressStr(address)
+			restored = true
+		}
+		if !expired {
+			return restored, nil
+		}
+
+		return true, setQuarantinedAddresses(ipPool, quarantined)
+	})
+	if err != nil {
+		return 0, errors.Wrapf(err, "failed to sync quarantined addresses in IPPool %s", ipPool.Name)
+	}
+
+	return next, nil
+}
+
+// GetQuarantinePeriod gets the quarantine period of the addresses released in the IPPool, zero if not set
+func GetQuarantinePeriod(ipPool *ipamv1.IPPool) (time.Duration, error) {
+	v := ipPool.Annotations[ipam.QuarantinePeriodKey]
+	if v == "" {
+		return 0, nil
+	}
+
+	period, err := time.ParseDuration(v)
+	if err != nil || period < 0 {
+		return 0, errors.Errorf("invalid %s %q in IPPool %s", ipam.QuarantinePeriodKey, v, ipPool.Name)
+	}
+
+	return period, nil
+}
+
+// reserveAddress pre-allocates the address in the IPPool and records it in the quarantined addresses, until the given
+// time or indefinitely if not set. An address quarantined already is kept as is by a quarantine period.
+func reserveAddress(cli client.Client, poolKey types.NamespacedName, address, reason string, until *metav1.Time) error {
+	ipPool := &ipamv1.IPPool{}
+	if err := cli.Get(context.Background(), poolKey, ipPool); err != nil {
+		return errors.Wrapf(err, "failed to get IPPool %s", poolKey.Name)
+	}
+
+	err := patchIPPool(cli, ipPool, func(ipPool *ipamv1.IPPool) (bool, error) {
+		quarantined, err := getQuarantinedAddresses(ipPool)
+		if err != nil {
+			return false, err
+		}
+		if _, ok := quarantined[address]; ok && until != nil {
+			return false, nil
+		}
+		quarantined[address] = quarantinedAddress{Reason: reason, Since: metav1.Now(), Until: until}
+		if err := setQuarantinedAddresses(ipPool, quarantined); err != nil {
+			return false, err
+		}
+
+		if ipPool.Spec.PreAllocations == nil {
+			ipPool.Spec.PreAllocations = map[string]ipamv1.IPAddressStr{}
+		}
+		ipPool.Spec.PreAllocations[getQuarantinePreAllocationName(address)] = ipamv1.IPAddressStr(address)
+		return true, nil
+	})
+	if err != nil {
+		return errors.Wrapf(err, "failed to quarantine address %s in IPPool %s", address, poolKey.Name)
+	}
+
+	return nil
+}
+
+func getQuarantinedAddresses(ipPool *ipamv1.IPPool) (map[string]quarantinedAddress, error) {
+	quarantined := map[string]quarantinedAddress{}
+	if v := ipPool.Annotations[ipam.QuarantinedAddressesKey]; v != "" {
+		if err := json.Unmarshal([]byte(v), &quarantined); err != nil {
+			return nil, errors.Wrapf(err, "invalid %s in IPPool %s", ipam.QuarantinedAddressesKey, ipPool.Name)
+		}
+	}
+
+	return quarantined, nil
+}
+
+func setQuarantinedAddresses(ipPool *ipamv1.IPPool, quarantined map[string]quarantinedAddress) error {
+	annotations := ipPool.GetAnnotations()
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+
+	if len(quarantined) == 0 {
+		delete(annotations, ipam.QuarantinedAddressesKey)
+	} else {
+		v, err := json.Marshal(quarantined)
+		if err != nil {
+			return errors.Wrapf(err, "failed to set %s in IPPool %s", ipam.QuarantinedAddressesKey, ipPool.Name)
+		}
+		annotations[ipam.QuarantinedAddressesKey] = string(v)
+	}
+
+	ipPool.SetAnnotations(annotations)
+	return nil
+}
+
+// getQuarantinePreAllocationName gets the pre-allocation name of the address, which is a valid IPClaim name
+func getQuarantinePreAllocationName(address string) string {
+	return quarantinePreAllocationPrefix + strings.NewReplacer(".", "-", ":", "-").Replace(address)
+}
@@ -0,0 +1,122 @@
+package metal3io
+
+import (
+	"context"
+	"strconv"
+	"sync"
+
+	ipamv1 "github.com/metal3-io/ip-address-manager/api/v1alpha1"
+	"github.com/pkg/errors"
+	"github.com/spectrocloud/cluster-api-provider-vsphere-static-ip/pkg/ipam"
+	"github.com/spectrocloud/cluster-api-provider-vsphere-static-ip/pkg/metrics"
+	"github.com/spectrocloud/cluster-api-provider-vsphere-static-ip/pkg/util"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	capi "sigs.k8s.io/cluster-api/api/v1beta1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// poolLocks serializes the allocations from each IPPool, so that concurrent allocations do not count the same IPClaims.
+// The locks only serialize the allocations of the IPAM instance within one replica of the controller, the allocations of
+// another replica, for eg., while the leader election hands over, are not serialized with them.
+type poolLocks struct {
+	locks sync.Map
+}
+
+// lock locks the allocations from the IPPool, and returns the function to unlock them
+func (l *poolLocks) lock(poolKey types.NamespacedName) func() {
+	v, _ := l.locks.LoadOrStore(poolKey, &sync.Mutex{})
+	m := v.(*sync.Mutex)
+	m.Lock()
+	return m.Unlock
+}
+
+// getConsumerLabels gets the labels of the IPClaim identifying the namespace, the Cluster, and the MachineDeployment or
+// the control plane, of its owner
+func getConsumerLabels(ownerObj runtime.Object) map[string]string {
+	m, err := meta.Accessor(ownerObj)
+	if err != nil {
+		return nil
+	}
+
+	labels := map[string]string{ipam.ClusterNamespaceKey: m.GetNamespace()}
+	if ownerObj.GetObjectKind().GroupVersionKind().Kind == "Cluster" {
+		labels[ipam.ClusterNameKey] = m.GetName()
+	} else if v := m.GetLabels()[capi.ClusterLabelName]; v != "" {
+		labels[ipam.ClusterNameKey] = v
+	}
+	//the MachineDeployment, or the control plane, of the owner, to spread its addresses across the ip-pools
+	for k, v := range util.GetMachineGroupLabels(m.GetLabels()) {
+		labels[k] = v
+	}
+
+	return labels
+}
+
+// checkQuota checks a new address can be allocated from the IPPool to the consumer, within the namespace and the
+// Cluster quotas of the IPPool. The IPClaims are counted with the reader, the cache may miss the IPClaims just created.
+func checkQuota(reader client.Reader, ipPool *ipamv1.IPPool, consumerLabels map[string]string) error {
+	scopes := []struct {
+		scope ipam.QuotaScope
+		key   string
+		label string
+	}{
+		{ipam.QuotaScopeNamespace, ipam.NamespaceQuotaKey, ipam.ClusterNamespaceKey},
+		{ipam.QuotaScopeCluster, ipam.ClusterQuotaKey, ipam.ClusterNameKey},
+	}
+
+	for _, s := range scopes {
+		v := ipPool.Annotations[s.key]
+		if v == "" {
+			continue
+		}
+		quota, err := strconv.Atoi(v)
+		if err != nil || quota < 0 {
+			return errors.Errorf("invalid %s %q in IPPool %s", s.key, v, ipPool.Name)
+		}
+
+		consumer, ok := consumerLabels[s.label]
+		if !ok {
+			continue
+		}
+
+		//the cluster quota applies to the Cluster within its namespace
+		matchLabels := client.MatchingLabels{ipam.ClusterNamespaceKey: consumerLabels[ipam.ClusterNamespaceKey], s.label: consumer}
+		if s.scope == ipam.QuotaScopeCluster {
+			consumer = consumerLabels[ipam.ClusterNamespaceKey] + "/" + consumer
+		}
+
+		used, err := countPoolClaims(reader, ipPool, matchLabels)
+		if err != nil {
+			return err
+		}
+
+		poolLabels := []string{ipPool.Namespace, ipPool.Name, string(s.scope), consumer}
+		metrics.QuotaUsage.WithLabelValues(poolLabels...).Set(float64(used))
+		metrics.QuotaLimit.WithLabelValues(poolLabels...).Set(float64(quota))
+		if used >= quota {
+			metrics.QuotaExceededTotal.WithLabelValues(poolLabels...).Inc()
+			return &ipam.QuotaExceededError{Pool: ipPool.Name, Scope: s.scope, Consumer: consumer, Quota: quota}
+		}
+	}
+
+	return nil
+}
+
+// countPoolClaims counts the IPClaims of the IPPool with the labels, the IPClaims being deleted are not counted
+func countPoolClaims(cli client.Reader, ipPool *ipamv1.IPPool, matchLabels client.MatchingLabels) (int, error) {
+	ipClaims := &ipamv1.IPClaimList{}
+	if err := cli.List(context.Background(), ipClaims, client.InNamespace(ipPool.Namespace), matchLabels); err != nil {
+		return 0, errors.Wrapf(err, "failed to list IPClaims in namespace %s", ipPool.Namespace)
+	}
+
+	count := 0
+	for _, ic := range ipClaims.Items {
+		if ic.Spec.Pool.Name == ipPool.Name && ic.DeletionTimestamp.IsZero() {
+			count++
+		}
+	}
+
+	return count, nil
+}
@@ -0,0 +1,219 @@
+package metal3io
+
+import (
+	"context"
+
+	ipamv1 "github.com/metal3-io/ip-address-manager/api/v1alpha1"
+	"github.com/pkg/errors"
+	staticipv1 "github.com/spectrocloud/cluster-api-provider-vsphere-static-ip/api/v1alpha1"
+	"github.com/spectrocloud/cluster-api-provider-vsphere-static-ip/pkg/ipam"
+	"github.com/spectrocloud/cluster-api-provider-vsphere-static-ip/pkg/util"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// maxCountedAddresses is the maximum number of free addresses counted in an IPPool, the IPPools with more free
+// addresses are considered equal
+const maxCountedAddresses = 65536
+
+// selectPolicyIPPool selects an IPPool with the ordered selectors of the StaticIPPolicy, set in the selection options.
+// The IPPools of a selector are used once the IPPools of the previous selectors have no free address.
+func (m Metal3IPAM) selectPolicyIPPool(poolMatchLabels map[string]string, opts ipam.SelectionOptions, clusterMeta metav1.ObjectMeta) (*ipamv1.IPPool, error) {
+	tiers := [][]ipamv1.IPPool{}
+	all := []ipamv1.IPPool{}
+	var accessErr error
+	for _, ps := range opts.PoolSelectors {
+		candidates, err := getSelectorIPPools(m.Client, ps, poolMatchLabels, clusterMeta, m.opts.GlobalIPPoolNamespace)
+		if ipam.IsAccessDenied(err) {
+			if accessErr == nil {
+				accessErr = err
+			}
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(candidates) > 0 {
+			tiers = append(tiers, candidates)
+			all = append(all, candidates...)
+		}
+	}
+
+	if len(tiers) == 0 {
+		return nil, accessErr
+	}
+
+	//the ip-pool of the addresses already allocated to the owner keeps being selected, whichever its selector
+	ipPool, err := getOwnerIPPool(m.Client, all, opts.Owner)
+	if err != nil || ipPool != nil {
+		return ipPool, err
+	}
+	if ipPool, err = getIPBlockIPPool(all, opts.Owner); err != nil || ipPool != nil {
+		return ipPool, err
+	}
+
+	for _, candidates := range tiers {
+		ipPool, err := pickIPPool(m.reader, candidates, opts, clusterMeta)
+		if err != nil {
+			return nil, err
+		}
+		if hasFreeAddress(*ipPool) {
+			return ipPool, nil
+		}
+	}
+
+	return &tiers[0][0], nil
+}
+
+// getSelectorIPPools gets the IPPools of the pool selector, by name, or matching its labels and the topology, in the
+// IPPool namespace of the cluster and in the global namespace
+func getSelectorIPPools(cli client.Client, ps staticipv1.PoolSelector, poolMatchLabels map[string]string, clusterMeta metav1.ObjectMeta,
+	globalNamespace string) ([]ipamv1.IPPool, error) {
+	if ps.Name != "" {
+		ipPool, err := getIPPoolByName(cli, ps.Name, getIPPoolNamespace(clusterMeta), globalNamespace, clusterMeta.Namespace)
+		if apierrors.IsNotFound(errors.Cause(err)) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		return []ipamv1.IPPool{*ipPool}, nil
+	}
+
+	if ps.Selector == nil {
+		return nil, nil
+	}
+	selector, err := metav1.LabelSelectorAsSelector(ps.Selector)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid pool selector")
+	}
+
+	return listIPPools(cli, selector, poolMatchLabels, clusterMeta, globalNamespace)
+}
+
+// pickIPPool picks an IPPool with a free address among the candidates, with the strategy. The first candidate is picked
+// if none has a free address.
+func pickIPPool(reader client.Reader, candidates []ipamv1.IPPool, opts ipam.SelectionOptions, clusterMeta metav1.ObjectMeta) (*ipamv1.IPPool, error) {
+	//the allocated, pre-allocated and quarantined addresses are skipped
+	free := []ipamv1.IPPool{}
+	for _, p := range candidates {
+		if hasFreeAddress(p) {
+			free = append(free, p)
+		}
+	}
+	if len(free) == 0 {
+		return &candidates[0], nil
+	}
+
+	switch opts.Strategy {
+	case "", staticipv1.FirstFitStrategy:
+		return &free[0], nil
+	case staticipv1.MostFreeStrategy:
+		selected, most := 0, 0
+		for i := range free {
+			if count := countFreeAddresses(free[i]); count > most {
+				selected, most = i, count
+			}
+		}
+		return &free[selected], nil
+	case staticipv1.RoundRobinStrategy:
+		counts, err := countClusterClaims(reader, free, clusterMeta, nil)
+		if err != nil {
+			return nil, err
+		}
+		//the ip-pools take turns with each address allocated to the cluster
+		total := 0
+		for i := range counts {
+			total += counts[i]
+		}
+		return &free[total%len(free)], nil
+	case staticipv1.SpreadStrategy:
+		//the addresses of the MachineDeployment, or of the control plane, of the owner are spread, the first of the
+		//least used ip-pools is picked
+		counts, err := countClusterClaims(reader, free, clusterMeta, util.GetIPClaimOwnerGroupLabels(opts.Owner))
+		if err != nil {
+			return nil, err
+		}
+		selected := 0
+		for i := range counts {
+			if counts[i] < counts[selected] {
+				selected = i
+			}
+		}
+		return &free[selected], nil
+	default:
+		return nil, errors.Errorf("invalid ip-pool selection strategy %q", opts.Strategy)
+	}
+}
+
+// countFreeAddresses counts the addresses of the IPPool which are neither allocated nor pre-allocated, up to
+// maxCountedAddresses
+func countFreeAddresses(ipPool ipamv1.IPPool) int {
+	reserved := getReservedAddresses(ipPool)
+
+	count := 0
+	for _, p := range ipPool.Spec.Pools {
+		for index := 0; count < maxCountedAddresses; index++ {
+			address, err := ipamv1.GetIPAddress(p, index)
+			if err != nil {
+				break
+			}
+			if !reserved[address] {
+				count++
+			}
+		}
+	}
+
+	return count
+}
+
+// countClusterClaims counts the IPClaims of the cluster in each of the IPPools, restricted to the IPClaims with the
+// group labels, if any. The IPClaims are counted with the reader, the cache may miss the IPClaims just created.
+func countClusterClaims(reader client.Reader, ipPools []ipamv1.IPPool, clusterMeta metav1.ObjectMeta, groupLabels map[string]string) ([]int, error) {
+	matchLabels := client.MatchingLabels{ipam.ClusterNamespaceKey: clusterMeta.Namespace}
+	if clusterMeta.Name != "" {
+		matchLabels[ipam.ClusterNameKey] = clusterMeta.Name
+	}
+	for k, v := range groupLabels {
+		matchLabels[k] = v
+	}
+
+	counts := make([]int, len(ipPools))
+	for i := range ipPools {
+		count, err := countPoolClaims(reader, &ipPools[i], matchLabels)
+		if err != nil {
+			return nil, err
+		}
+		counts[i] = count
+	}
+
+	return counts, nil
+}
+
+// getOwnerIPPool gets the candidate IPPool with an IPClaim of the owner, if any
+func getOwnerIPPool(cli client.Client, candidates []ipamv1.IPPool, owner client.Object) (*ipamv1.IPPool, error) {
+	if owner == nil {
+		return nil, nil
+	}
+	ownerRef := util.GetObjRef(owner)
+
+	ipClaims := map[string][]ipamv1.IPClaim{}
+	for i, p := range candidates {
+		if _, ok := ipClaims[p.Namespace]; !ok {
+			list := &ipamv1.IPClaimList{}
+			if err := cli.List(context.Background(), list, client.InNamespace(p.Namespace)); err != nil {
+				return nil, errors.Wrapf(err, "failed to list IPClaims in namespace %s", p.Namespace)
+			}
+			ipClaims[p.Namespace] = list.Items
+		}
+
+		for _, ic := range ipClaims[p.Namespace] {
+			if ic.Spec.Pool.Name == p.Name && ic.DeletionTimestamp.IsZero() && isIPClaimOwnedBy(ic, ownerRef) {
+				return &candidates[i], nil
+			}
+		}
+	}
+
+	return nil, nil
+}
@@ -1,10 +1,25 @@
 package metal3io
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
 	"testing"
+	"time"
 
 	ipamv1 "github.com/metal3-io/ip-address-manager/api/v1alpha1"
+	staticipv1 "github.com/spectrocloud/cluster-api-provider-vsphere-static-ip/api/v1alpha1"
+	"github.com/spectrocloud/cluster-api-provider-vsphere-static-ip/pkg/ipam"
 	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	capi "sigs.k8s.io/cluster-api/api/v1beta1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/log"
 )
 
 func TestConvertToIpamAddressStr(t *testing.T) {
@@ -12,3 +27,901 @@ func TestConvertToIpamAddressStr(t *testing.T) {
 	res := convertToIpamAddressStr(&mIP)
 	assert.NotEmpty(t, res)
 }
+
+func TestGetOwnedIPNamesAndDeallocateIP(t *testing.T) {
+	s := runtime.NewScheme()
+	assert.NoError(t, ipamv1.AddToScheme(s))
+	assert.NoError(t, capi.AddToScheme(s))
+
+	pool := ipamv1.IPPool{ObjectMeta: metav1.ObjectMeta{Name: "pool1", Namespace: "default"}}
+	cluster := &capi.Cluster{
+		TypeMeta:   metav1.TypeMeta{Kind: "Cluster", APIVersion: capi.GroupVersion.String()},
+		ObjectMeta: metav1.ObjectMeta{Name: "cluster1", Namespace: "default", UID: types.UID("cluster1-uid")},
+	}
+	owner := metav1.OwnerReference{Kind: "Cluster", APIVersion: capi.GroupVersion.String(), Name: "cluster1", UID: "cluster1-uid"}
+	newClaim := func(name, poolName string, owners ...metav1.OwnerReference) *ipamv1.IPClaim {
+		return &ipamv1.IPClaim{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", OwnerReferences: owners},
+			Spec:       ipamv1.IPClaimSpec{Pool: corev1.ObjectReference{Name: poolName, Namespace: "default"}},
+		}
+	}
+
+	cli := fake.NewClientBuilder().WithScheme(s).WithObjects(
+		&pool,
+		newClaim("owned", "pool1", owner),
+		newClaim("other-pool", "pool2", owner),
+		newClaim("not-owned", "pool1"),
+	).Build()
+	m := NewIpam(cli, cli, log.NullLogger{}, ipam.Options{})
+	ipPool := NewIPPool(pool, nil)
+
+	names, err := m.GetOwnedIPNames(ipPool, cluster, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"owned"}, names)
+
+	//only the claims with the claim labels are selected, the labels are added to the existing claims once allocated
+	claimLabels := map[string]string{ipam.ServiceLoadBalancerKey: "true"}
+	names, err = m.GetOwnedIPNames(ipPool, cluster, claimLabels)
+	assert.NoError(t, err)
+	assert.Empty(t, names)
+	_, err = m.AllocateIP("owned", ipPool, cluster, claimLabels)
+	assert.NoError(t, err)
+	names, err = m.GetOwnedIPNames(ipPool, cluster, claimLabels)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"owned"}, names)
+
+	assert.NoError(t, m.DeallocateIP("owned", ipPool, cluster))
+	err = cli.Get(context.Background(), client.ObjectKey{Namespace: "default", Name: "owned"}, &ipamv1.IPClaim{})
+	assert.True(t, apierrors.IsNotFound(err))
+
+	//deallocating a missing claim is a no-op
+	assert.NoError(t, m.DeallocateIP("owned", ipPool, cluster))
+}
+
+func TestGetRoutesAndMTU(t *testing.T) {
+	pool := NewIPPool(ipamv1.IPPool{ObjectMeta: metav1.ObjectMeta{Name: "pool1", Annotations: map[string]string{
+		ipam.RoutesKey: `[{"to": "10.20.0.0/16", "via": "10.10.100.254", "metric": 100}]`,
+		ipam.MTUKey:    "9000",
+	}}}, nil)
+	routes, err := pool.GetRoutes()
+	assert.NoError(t, err)
+	assert.Equal(t, []ipam.Route{{To: "10.20.0.0/16", Via: "10.10.100.254", Metric: 100}}, routes)
+	mtu, err := pool.GetMTU()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(9000), *mtu)
+
+	//routes and mtu are optional
+	pool = NewIPPool(ipamv1.IPPool{ObjectMeta: metav1.ObjectMeta{Name: "pool1"}}, nil)
+	routes, err = pool.GetRoutes()
+	assert.NoError(t, err)
+	assert.Empty(t, routes)
+	mtu, err = pool.GetMTU()
+	assert.NoError(t, err)
+	assert.Nil(t, mtu)
+
+	pool = NewIPPool(ipamv1.IPPool{ObjectMeta: metav1.ObjectMeta{Name: "pool1", Annotations: map[string]string{
+		ipam.RoutesKey: "10.20.0.0/16 via 10.10.100.254",
+		ipam.MTUKey:    "jumbo",
+	}}}, nil)
+	_, err = pool.GetRoutes()
+	assert.Error(t, err)
+	_, err = pool.GetMTU()
+	assert.Error(t, err)
+}
+
+func TestQuarantineIP(t *testing.T) {
+	s := runtime.NewScheme()
+	assert.NoError(t, ipamv1.AddToScheme(s))
+
+	pool := &ipamv1.IPPool{ObjectMeta: metav1.ObjectMeta{Name: "pool1", Namespace: "default"}}
+	claim := &ipamv1.IPClaim{
+		ObjectMeta: metav1.ObjectMeta{Name: "vm-0", Namespace: "default"},
+		Spec:       ipamv1.IPClaimSpec{Pool: corev1.ObjectReference{Name: "pool1", Namespace: "default"}},
+		Status:     ipamv1.IPClaimStatus{Address: &corev1.ObjectReference{Name: "pool1-vm-0", Namespace: "default"}},
+	}
+	address := &ipamv1.IPAddress{
+		ObjectMeta: metav1.ObjectMeta{Name: "pool1-vm-0", Namespace: "default"},
+		Spec:       ipamv1.IPAddressSpec{Address: "10.10.100.20"},
+	}
+
+	cli := fake.NewClientBuilder().WithScheme(s).WithObjects(pool, claim, address).Build()
+	m := NewIpam(cli, cli, log.NullLogger{}, ipam.Options{})
+	assert.NoError(t, m.QuarantineIP("vm-0", NewIPPool(*pool, nil), "in use"))
+
+	err := cli.Get(context.Background(), client.ObjectKey{Namespace: "default", Name: "vm-0"}, &ipamv1.IPClaim{})
+	assert.True(t, apierrors.IsNotFound(err))
+
+	updatedPool := &ipamv1.IPPool{}
+	assert.NoError(t, cli.Get(context.Background(), client.ObjectKey{Namespace: "default", Name: "pool1"}, updatedPool))
+	assert.Equal(t, ipamv1.IPAddressStr("10.10.100.20"), updatedPool.Spec.PreAllocations["quarantine-10-10-100-20"])
+	quarantined, err := getQuarantinedAddresses(updatedPool)
+	assert.NoError(t, err)
+	assert.Equal(t, "in use", quarantined["10.10.100.20"].Reason)
+
+	//quarantining a missing claim is a no-op
+	assert.NoError(t, m.QuarantineIP("vm-0", NewIPPool(*updatedPool, nil), "in use"))
+}
+
+func TestQuarantinePeriod(t *testing.T) {
+	s := runtime.NewScheme()
+	assert.NoError(t, ipamv1.AddToScheme(s))
+
+	pool := &ipamv1.IPPool{ObjectMeta: metav1.ObjectMeta{
+		Name:        "pool1",
+		Namespace:   "default",
+		Annotations: map[string]string{ipam.QuarantinePeriodKey: "10m"},
+	}}
+	cli := fake.NewClientBuilder().WithScheme(s).WithObjects(pool).Build()
+
+	period, err := GetQuarantinePeriod(pool)
+	assert.NoError(t, err)
+	assert.Equal(t, 10*time.Minute, period)
+
+	assert.NoError(t, QuarantineReleasedAddress(cli, pool, "10.10.100.20", "released"))
+	updatedPool := &ipamv1.IPPool{}
+	assert.NoError(t, cli.Get(context.Background(), client.ObjectKeyFromObject(pool), updatedPool))
+	assert.Equal(t, ipamv1.IPAddressStr("10.10.100.20"), updatedPool.Spec.PreAllocations["quarantine-10-10-100-20"])
+
+	//the address is kept in quarantine until the period is over
+	next, err := SyncQuarantinedAddresses(cli, updatedPool)
+	assert.NoError(t, err)
+	assert.True(t, next > 0 && next <= 10*time.Minute)
+	assert.Contains(t, updatedPool.Spec.PreAllocations, "quarantine-10-10-100-20")
+
+	quarantined, err := getQuarantinedAddresses(updatedPool)
+	assert.NoError(t, err)
+	expired := metav1.NewTime(time.Now().Add(-time.Minute))
+	quarantined["10.10.100.20"] = quarantinedAddress{Reason: "released", Until: &expired}
+	//an address in use is quarantined indefinitely
+	quarantined["10.10.100.21"] = quarantinedAddress{Reason: "in use"}
+	assert.NoError(t, setQuarantinedAddresses(updatedPool, quarantined))
+	updatedPool.Spec.PreAllocations["quarantine-10-10-100-21"] = "10.10.100.21"
+	assert.NoError(t, cli.Update(context.Background(), updatedPool))
+
+	next, err = SyncQuarantinedAddresses(cli, updatedPool)
+	assert.NoError(t, err)
+	assert.Zero(t, next)
+	assert.NoError(t, cli.Get(context.Background(), client.ObjectKeyFromObject(pool), updatedPool))
+	assert.NotContains(t, updatedPool.Spec.PreAllocations, "quarantine-10-10-100-20")
+	assert.Contains(t, updatedPool.Spec.PreAllocations, "quarantine-10-10-100-21")
+
+	//the address quarantined indefinitely is not released after a period
+	assert.NoError(t, QuarantineReleasedAddress(cli, updatedPool, "10.10.100.21", "released"))
+	quarantined, err = getQuarantinedAddresses(updatedPool)
+	assert.NoError(t, err)
+	assert.Nil(t, quarantined["10.10.100.21"].Until)
+
+	pool.Annotations[ipam.QuarantinePeriodKey] = "soon"
+	_, err = GetQuarantinePeriod(pool)
+	assert.Error(t, err)
+}
+
+func TestQuarantineConcurrentUpdates(t *testing.T) {
+	s := runtime.NewScheme()
+	assert.NoError(t, ipamv1.AddToScheme(s))
+
+	pool := &ipamv1.IPPool{ObjectMeta: metav1.ObjectMeta{
+		Name:        "pool1",
+		Namespace:   "default",
+		Annotations: map[string]string{ipam.QuarantinePeriodKey: "10m"},
+	}}
+	cli := fake.NewClientBuilder().WithScheme(s).WithObjects(pool).Build()
+	assert.NoError(t, cli.Get(context.Background(), client.ObjectKeyFromObject(pool), pool))
+	quarantined := map[string]quarantinedAddress{"10.10.100.20": {Reason: "released", Until: &metav1.Time{Time: time.Now().Add(-time.Minute)}}}
+	assert.NoError(t, setQuarantinedAddresses(pool, quarantined))
+	pool.Spec.PreAllocations = map[string]ipamv1.IPAddressStr{"quarantine-10-10-100-20": "10.10.100.20"}
+	assert.NoError(t, cli.Update(context.Background(), pool))
+
+	//another address is quarantined after the IPPool is read by the IPPool reconciler
+	stale := pool.DeepCopy()
+	assert.NoError(t, QuarantineReleasedAddress(cli, pool, "10.10.100.21", "released"))
+
+	//the expired address is released without losing the address quarantined meanwhile
+	next, err := SyncQuarantinedAddresses(cli, stale)
+	assert.NoError(t, err)
+	assert.NotZero(t, next)
+	updatedPool := &ipamv1.IPPool{}
+	assert.NoError(t, cli.Get(context.Background(), client.ObjectKeyFromObject(pool), updatedPool))
+	assert.Equal(t, map[string]ipamv1.IPAddressStr{"quarantine-10-10-100-21": "10.10.100.21"}, updatedPool.Spec.PreAllocations)
+	quarantined, err = getQuarantinedAddresses(updatedPool)
+	assert.NoError(t, err)
+	assert.Len(t, quarantined, 1)
+	assert.Contains(t, quarantined, "10.10.100.21")
+}
+
+func TestSyncQuarantinedAddressesRestoresPreAllocations(t *testing.T) {
+	s := runtime.NewScheme()
+	assert.NoError(t, ipamv1.AddToScheme(s))
+
+	//the IPPool was applied again without the pre-allocations of the controller, the annotations are kept
+	until := metav1.NewTime(time.Now().Add(10 * time.Minute))
+	pool := &ipamv1.IPPool{ObjectMeta: metav1.ObjectMeta{
+		Name:        "pool1",
+		Namespace:   "default",
+		Annotations: map[string]string{ipam.ExcludedAddressesKey: "10.10.100.30"},
+	}}
+	assert.NoError(t, setQuarantinedAddresses(pool, map[string]quarantinedAddress{
+		"10.10.100.20": {Reason: "in use"},
+		"10.10.100.21": {Reason: "released", Until: &until},
+		"10.10.100.22": {Reason: "in use"},
+	}))
+	pool.Spec.PreAllocations = map[string]ipamv1.IPAddressStr{"gateway": "10.10.100.1"}
+	//the address was allocated by metal3io before it is reserved again
+	pool.Status.Allocations = map[string]ipamv1.IPAddressStr{"vm-0": "10.10.100.22"}
+	cli := fake.NewClientBuilder().WithScheme(s).WithObjects(pool).Build()
+
+	_, err := SyncExcludedAddresses(cli, pool)
+	assert.NoError(t, err)
+	next, err := SyncQuarantinedAddresses(cli, pool)
+	assert.NoError(t, err)
+	assert.True(t, next > 0 && next <= 10*time.Minute)
+
+	updatedPool := &ipamv1.IPPool{}
+	assert.NoError(t, cli.Get(context.Background(), client.ObjectKeyFromObject(pool), updatedPool))
+	assert.Equal(t, map[string]ipamv1.IPAddressStr{
+		"gateway":                 "10.10.100.1",
+		"exclusion-10-10-100-30":  "10.10.100.30",
+		"quarantine-10-10-100-20": "10.10.100.20",
+		"quarantine-10-10-100-21": "10.10.100.21",
+	}, updatedPool.Spec.PreAllocations)
+	quarantined, err := getQuarantinedAddresses(updatedPool)
+	assert.NoError(t, err)
+	assert.Len(t, quarantined, 3)
+}
+
+func TestGetAvailableIPPoolSkipsExhaustedPools(t *testing.T) {
+	s := runtime.NewScheme()
+	assert.NoError(t, ipamv1.AddToScheme(s))
+
+	start, end := ipamv1.IPAddressStr("10.10.100.20"), ipamv1.IPAddressStr("10.10.100.21")
+	newPool := func(name string) *ipamv1.IPPool {
+		return &ipamv1.IPPool{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", Labels: map[string]string{ipam.ClusterIPPoolGroupKey: "dev"}},
+			Spec:       ipamv1.IPPoolSpec{Pools: []ipamv1.Pool{{Start: &start, End: &end}}},
+		}
+	}
+	//the addresses of the first pool are allocated and quarantined
+	exhausted := newPool("pool1")
+	exhausted.Spec.PreAllocations = map[string]ipamv1.IPAddressStr{"quarantine-10-10-100-21": end}
+	exhausted.Status.Allocations = map[string]ipamv1.IPAddressStr{"vm-0": start}
+
+	cli := fake.NewClientBuilder().WithScheme(s).WithObjects(exhausted, newPool("pool2")).Build()
+	m := NewIpam(cli, cli, log.NullLogger{}, ipam.Options{})
+	ipPool, err := m.GetAvailableIPPool(map[string]string{ipam.ClusterIPPoolGroupKey: "dev"}, metav1.ObjectMeta{Namespace: "default"}, ipam.SelectionOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, "pool2", ipPool.GetName())
+}
+
+func TestSyncExcludedAddresses(t *testing.T) {
+	s := runtime.NewScheme()
+	assert.NoError(t, ipamv1.AddToScheme(s))
+
+	pool := &ipamv1.IPPool{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "pool1",
+			Namespace:   "default",
+			Annotations: map[string]string{ipam.ExcludedAddressesKey: "10.10.100.20-10.10.100.21, 10.10.100.30"},
+		},
+		Spec: ipamv1.IPPoolSpec{PreAllocations: map[string]ipamv1.IPAddressStr{
+			"exclusion-10-10-100-40":  "10.10.100.40",
+			"quarantine-10-10-100-50": "10.10.100.50",
+		}},
+		Status: ipamv1.IPPoolStatus{Allocations: map[string]ipamv1.IPAddressStr{"vm-0": "10.10.100.22"}},
+	}
+	cli := fake.NewClientBuilder().WithScheme(s).WithObjects(pool).Build()
+
+	conflicts, err := SyncExcludedAddresses(cli, pool)
+	assert.NoError(t, err)
+	assert.Empty(t, conflicts)
+	updatedPool := &ipamv1.IPPool{}
+	assert.NoError(t, cli.Get(context.Background(), client.ObjectKeyFromObject(pool), updatedPool))
+	assert.Equal(t, map[string]ipamv1.IPAddressStr{
+		"exclusion-10-10-100-20":  "10.10.100.20",
+		"exclusion-10-10-100-21":  "10.10.100.21",
+		"exclusion-10-10-100-30":  "10.10.100.30",
+		"quarantine-10-10-100-50": "10.10.100.50",
+	}, updatedPool.Spec.PreAllocations)
+
+	//the allocated address is reported, and the other addresses are reserved
+	updatedPool.Annotations[ipam.ExcludedAddressesKey] = "10.10.100.20-10.10.100.22"
+	assert.NoError(t, cli.Update(context.Background(), updatedPool))
+	conflicts, err = SyncExcludedAddresses(cli, updatedPool)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"10.10.100.22 (vm-0)"}, conflicts)
+	assert.NoError(t, cli.Get(context.Background(), client.ObjectKeyFromObject(pool), updatedPool))
+	assert.Equal(t, map[string]ipamv1.IPAddressStr{
+		"exclusion-10-10-100-20":  "10.10.100.20",
+		"exclusion-10-10-100-21":  "10.10.100.21",
+		"quarantine-10-10-100-50": "10.10.100.50",
+	}, updatedPool.Spec.PreAllocations)
+
+	//the address is reserved once released, without losing an address quarantined meanwhile
+	updatedPool.Status.Allocations = nil
+	assert.NoError(t, cli.Update(context.Background(), updatedPool))
+	stale := updatedPool.DeepCopy()
+	assert.NoError(t, reserveAddress(cli, client.ObjectKeyFromObject(pool), "10.10.100.60", "in use", nil))
+	conflicts, err = SyncExcludedAddresses(cli, stale)
+	assert.NoError(t, err)
+	assert.Empty(t, conflicts)
+	assert.NoError(t, cli.Get(context.Background(), client.ObjectKeyFromObject(pool), updatedPool))
+	assert.Contains(t, updatedPool.Spec.PreAllocations, "exclusion-10-10-100-22")
+	assert.Contains(t, updatedPool.Spec.PreAllocations, "quarantine-10-10-100-60")
+	assert.Contains(t, updatedPool.Annotations[ipam.QuarantinedAddressesKey], "10.10.100.60")
+}
+
+func TestAllocateIPQuota(t *testing.T) {
+	s := runtime.NewScheme()
+	assert.NoError(t, ipamv1.AddToScheme(s))
+
+	pool := &ipamv1.IPPool{ObjectMeta: metav1.ObjectMeta{
+		Name:        "pool1",
+		Namespace:   "pools",
+		Annotations: map[string]string{ipam.NamespaceQuotaKey: "2", ipam.ClusterQuotaKey: "1"},
+	}}
+	cli := fake.NewClientBuilder().WithScheme(s).WithObjects(pool).Build()
+	m := NewIpam(cli, cli, log.NullLogger{}, ipam.Options{})
+	ipPool := NewIPPool(*pool, nil)
+
+	newOwner := func(name, cluster string) *capi.Machine {
+		return &capi.Machine{
+			TypeMeta: metav1.TypeMeta{Kind: "Machine", APIVersion: capi.GroupVersion.String()},
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "tenant1", UID: types.UID(name),
+				Labels: map[string]string{capi.ClusterLabelName: cluster}},
+		}
+	}
+
+	_, err := m.AllocateIP("m1-0", ipPool, newOwner("m1", "cluster1"), nil)
+	assert.NoError(t, err)
+	ic := &ipamv1.IPClaim{}
+	assert.NoError(t, cli.Get(context.Background(), client.ObjectKey{Namespace: "pools", Name: "m1-0"}, ic))
+	assert.Equal(t, map[string]string{ipam.ClusterNamespaceKey: "tenant1", ipam.ClusterNameKey: "cluster1"}, ic.Labels)
+
+	//the cluster quota is exceeded
+	_, err = m.AllocateIP("m2-0", ipPool, newOwner("m2", "cluster1"), nil)
+	assert.True(t, ipam.IsQuotaExceeded(err))
+
+	_, err = m.AllocateIP("m3-0", ipPool, newOwner("m3", "cluster2"), nil)
+	assert.NoError(t, err)
+
+	//the namespace quota is exceeded
+	_, err = m.AllocateIP("m4-0", ipPool, newOwner("m4", "cluster3"), nil)
+	assert.True(t, ipam.IsQuotaExceeded(err))
+	assert.EqualError(t, err, "namespace tenant1 exceeds its quota of 2 addresses in ip-pool pool1")
+	err = cli.Get(context.Background(), client.ObjectKey{Namespace: "pools", Name: "m4-0"}, &ipamv1.IPClaim{})
+	assert.True(t, apierrors.IsNotFound(err))
+}
+
+// staleClaimsClient is a client with a cache which has not yet seen the IPClaims
+type staleClaimsClient struct {
+	client.Client
+}
+
+func (c staleClaimsClient) List(ctx context.Context, list client.ObjectList, opts ...client.ListOption) error {
+	if _, ok := list.(*ipamv1.IPClaimList); ok {
+		return nil
+	}
+	return c.Client.List(ctx, list, opts...)
+}
+
+func TestAllocateIPQuotaUncached(t *testing.T) {
+	s := runtime.NewScheme()
+	assert.NoError(t, ipamv1.AddToScheme(s))
+
+	pool := &ipamv1.IPPool{ObjectMeta: metav1.ObjectMeta{
+		Name:        "pool1",
+		Namespace:   "pools",
+		Annotations: map[string]string{ipam.ClusterQuotaKey: "2"},
+	}}
+	cli := fake.NewClientBuilder().WithScheme(s).WithObjects(pool).Build()
+	m := NewIpam(staleClaimsClient{cli}, cli, log.NullLogger{}, ipam.Options{})
+	ipPool := NewIPPool(*pool, nil)
+
+	owner := &capi.Machine{
+		TypeMeta: metav1.TypeMeta{Kind: "Machine", APIVersion: capi.GroupVersion.String()},
+		ObjectMeta: metav1.ObjectMeta{Name: "m1", Namespace: "tenant1", UID: "m1",
+			Labels: map[string]string{capi.ClusterLabelName: "cluster1"}},
+	}
+
+	//the IPClaims of the network devices of a machine, allocated concurrently, are counted although not yet cached
+	errs := make(chan error, 4)
+	for i := 0; i < 4; i++ {
+		go func(i int) {
+			_, err := m.AllocateIP(fmt.Sprintf("m1-%d", i), ipPool, owner, nil)
+			errs <- err
+		}(i)
+	}
+	exceeded := 0
+	for i := 0; i < 4; i++ {
+		if err := <-errs; err != nil {
+			assert.True(t, ipam.IsQuotaExceeded(err))
+			exceeded++
+		}
+	}
+	assert.Equal(t, 2, exceeded)
+
+	ipClaims := &ipamv1.IPClaimList{}
+	assert.NoError(t, cli.List(context.Background(), ipClaims))
+	assert.Len(t, ipClaims.Items, 2)
+}
+
+func TestGetAvailableIPPoolAccessPolicy(t *testing.T) {
+	s := runtime.NewScheme()
+	assert.NoError(t, ipamv1.AddToScheme(s))
+	assert.NoError(t, corev1.AddToScheme(s))
+
+	newPool := func(name, tier string) *ipamv1.IPPool {
+		return &ipamv1.IPPool{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "pools",
+			Labels: map[string]string{ipam.ClusterIPPoolGroupKey: "dev", "tier": tier}}}
+	}
+	policy := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "access", Namespace: "pools", Labels: map[string]string{ipam.AccessPolicyKey: ""}},
+		Data: map[string]string{
+			ipam.AccessPolicyAllowedNamespacesKey: "tenant1",
+			ipam.AccessPolicyNamespaceSelectorKey: "team=platform",
+			ipam.AccessPolicyIPPoolSelectorKey:    "tier=shared",
+		},
+	}
+	platform := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "tenant2", Labels: map[string]string{"team": "platform"}}}
+
+	cli := fake.NewClientBuilder().WithScheme(s).WithObjects(newPool("pool1", "reserved"), newPool("pool2", "shared"), policy, platform).Build()
+	m := NewIpam(cli, cli, log.NullLogger{}, ipam.Options{})
+	poolMatchLabels := map[string]string{ipam.ClusterIPPoolGroupKey: "dev"}
+	clusterMeta := func(namespace string) metav1.ObjectMeta {
+		return metav1.ObjectMeta{Namespace: namespace, Annotations: map[string]string{ipam.ClusterIPPoolNamespaceKey: "pools"}}
+	}
+
+	//the namespaces allowed by name or by labels only get the ip-pools selected by the policy
+	for _, namespace := range []string{"tenant1", "tenant2"} {
+		ipPool, err := m.GetAvailableIPPool(poolMatchLabels, clusterMeta(namespace), ipam.SelectionOptions{})
+		assert.NoError(t, err)
+		assert.Equal(t, "pool2", ipPool.GetName())
+	}
+
+	_, err := m.GetAvailableIPPool(poolMatchLabels, clusterMeta("tenant3"), ipam.SelectionOptions{})
+	assert.True(t, ipam.IsAccessDenied(err))
+
+	//the ip-pools selected by name by a StaticIPPolicy are restricted as well
+	byName := ipam.SelectionOptions{PoolSelectors: []staticipv1.PoolSelector{{Name: "pool1"}}}
+	_, err = m.GetAvailableIPPool(map[string]string{}, clusterMeta("tenant1"), byName)
+	assert.True(t, ipam.IsAccessDenied(err))
+	byName.PoolSelectors = append(byName.PoolSelectors, staticipv1.PoolSelector{Name: "pool2"})
+	ipPool, err := m.GetAvailableIPPool(map[string]string{}, clusterMeta("tenant1"), byName)
+	assert.NoError(t, err)
+	assert.Equal(t, "pool2", ipPool.GetName())
+
+	//the ip-pools of the namespace of the cluster are not restricted
+	ipPool, err = m.GetAvailableIPPool(poolMatchLabels, metav1.ObjectMeta{Namespace: "pools"}, ipam.SelectionOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, "pool1", ipPool.GetName())
+}
+
+func TestGlobalIPPools(t *testing.T) {
+	s := runtime.NewScheme()
+	assert.NoError(t, ipamv1.AddToScheme(s))
+	assert.NoError(t, corev1.AddToScheme(s))
+	assert.NoError(t, capi.AddToScheme(s))
+
+	newPool := func(name, namespace string) *ipamv1.IPPool {
+		return &ipamv1.IPPool{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace,
+			Labels: map[string]string{ipam.ClusterIPPoolGroupKey: "dev"}}}
+	}
+	cli := fake.NewClientBuilder().WithScheme(s).WithObjects(newPool("local", "tenant1"), newPool("shared", "global")).Build()
+	m := NewIpam(cli, cli, log.NullLogger{}, ipam.Options{GlobalIPPoolNamespace: "global"})
+
+	//the ip-pool of the namespace is selected first
+	ipPool, err := m.GetAvailableIPPool(map[string]string{ipam.ClusterIPPoolGroupKey: "dev"}, metav1.ObjectMeta{Namespace: "tenant1"}, ipam.SelectionOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, "tenant1", ipPool.GetNamespace())
+
+	ipPool, err = m.GetAvailableIPPool(map[string]string{ipam.ClusterIPPoolGroupKey: "dev"}, metav1.ObjectMeta{Namespace: "tenant2"}, ipam.SelectionOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, "global", ipPool.GetNamespace())
+
+	ipPool, err = m.GetAvailableIPPool(map[string]string{ipam.ClusterIPPoolNameKey: "shared"}, metav1.ObjectMeta{Namespace: "tenant1"}, ipam.SelectionOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, "global", ipPool.GetNamespace())
+
+	//the global ip-pool selected by name is restricted by the access policies of the global namespace
+	policy := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "access", Namespace: "global", Labels: map[string]string{ipam.AccessPolicyKey: ""}},
+		Data:       map[string]string{ipam.AccessPolicyAllowedNamespacesKey: "tenant2"},
+	}
+	assert.NoError(t, cli.Create(context.Background(), policy))
+	_, err = m.GetAvailableIPPool(map[string]string{ipam.ClusterIPPoolNameKey: "shared"}, metav1.ObjectMeta{Namespace: "tenant1"}, ipam.SelectionOptions{})
+	assert.True(t, ipam.IsAccessDenied(err))
+	ipPool, err = m.GetAvailableIPPool(map[string]string{ipam.ClusterIPPoolNameKey: "shared"}, metav1.ObjectMeta{Namespace: "tenant2"}, ipam.SelectionOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, "global", ipPool.GetNamespace())
+
+	//the owner in another namespace is referenced in an annotation
+	owner := &capi.Machine{
+		TypeMeta:   metav1.TypeMeta{Kind: "Machine", APIVersion: capi.GroupVersion.String()},
+		ObjectMeta: metav1.ObjectMeta{Name: "m1", Namespace: "tenant2", UID: "m1-uid"},
+	}
+	_, err = m.AllocateIP("tenant2.m1-0", ipPool, owner, nil)
+	assert.NoError(t, err)
+	ic := &ipamv1.IPClaim{}
+	assert.NoError(t, cli.Get(context.Background(), client.ObjectKey{Namespace: "global", Name: "tenant2.m1-0"}, ic))
+	assert.Empty(t, ic.OwnerReferences)
+	ownerRef, err := GetIPClaimOwner(ic)
+	assert.NoError(t, err)
+	assert.Equal(t, types.UID("m1-uid"), ownerRef.UID)
+
+	ipNames, err := m.GetOwnedIPNames(ipPool, owner, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"tenant2.m1-0"}, ipNames)
+}
+
+func TestGetAvailableIPPoolTopology(t *testing.T) {
+	s := runtime.NewScheme()
+	assert.NoError(t, ipamv1.AddToScheme(s))
+
+	newPool := func(name string, annotations map[string]string) *ipamv1.IPPool {
+		return &ipamv1.IPPool{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", Annotations: annotations,
+			Labels: map[string]string{ipam.ClusterIPPoolGroupKey: "dev"}}}
+	}
+	cli := fake.NewClientBuilder().WithScheme(s).WithObjects(
+		newPool("any", nil),
+		newPool("zone-a", map[string]string{ipam.FailureDomainKey: "zone-a", ipam.DatacenterKey: "dc1"}),
+		newPool("zone-b", map[string]string{ipam.FailureDomainKey: "zone-b, zone-c", ipam.DatacenterKey: "dc1"}),
+	).Build()
+	m := NewIpam(cli, cli, log.NullLogger{}, ipam.Options{})
+
+	tests := []struct {
+		topology map[string]string
+		expected string
+	}{
+		{topology: map[string]string{ipam.FailureDomainKey: "zone-a", ipam.DatacenterKey: "dc1"}, expected: "zone-a"},
+		{topology: map[string]string{ipam.FailureDomainKey: "zone-c"}, expected: "zone-b"},
+		{topology: map[string]string{ipam.FailureDomainKey: "zone-d", ipam.DatacenterKey: "dc1"}, expected: "any"},
+		{topology: map[string]string{ipam.DatacenterKey: "dc2"}, expected: "any"},
+	}
+	for _, tt := range tests {
+		poolMatchLabels := map[string]string{ipam.ClusterIPPoolGroupKey: "dev"}
+		for k, v := range tt.topology {
+			poolMatchLabels[k] = v
+		}
+		ipPool, err := m.GetAvailableIPPool(poolMatchLabels, metav1.ObjectMeta{Namespace: "default"}, ipam.SelectionOptions{})
+		assert.NoError(t, err)
+		assert.Equal(t, tt.expected, ipPool.GetName(), tt.topology)
+	}
+}
+
+func TestGetAvailableIPPoolSelector(t *testing.T) {
+	s := runtime.NewScheme()
+	assert.NoError(t, ipamv1.AddToScheme(s))
+
+	newPool := func(name string, labels map[string]string) *ipamv1.IPPool {
+		return &ipamv1.IPPool{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", Labels: labels}}
+	}
+	cli := fake.NewClientBuilder().WithScheme(s).WithObjects(
+		newPool("legacy", map[string]string{ipam.ClusterIPPoolGroupKey: "prod", "tier": "legacy"}),
+		newPool("prod", map[string]string{ipam.ClusterIPPoolGroupKey: "prod", "tier": "frontend"}),
+		newPool("dev", map[string]string{ipam.ClusterIPPoolGroupKey: "dev", "tier": "frontend"}),
+	).Build()
+	m := NewIpam(cli, cli, log.NullLogger{}, ipam.Options{})
+
+	tests := []struct {
+		poolMatchLabels map[string]string
+		expected        string
+		expectedErr     bool
+	}{
+		{poolMatchLabels: map[string]string{ipam.IPPoolSelectorKey: ipam.ClusterIPPoolGroupKey + "=prod,tier notin (legacy)"}, expected: "prod"},
+		{poolMatchLabels: map[string]string{ipam.ClusterIPPoolGroupKey: "dev", ipam.IPPoolSelectorKey: "tier"}, expected: "dev"},
+		{poolMatchLabels: map[string]string{ipam.IPPoolSelectorKey: `{"matchLabels":{"` + ipam.ClusterIPPoolGroupKey + `":"prod"},"matchExpressions":[{"key":"tier","operator":"In","values":["legacy"]}]}`}, expected: "legacy"},
+		{poolMatchLabels: map[string]string{ipam.IPPoolSelectorKey: "!tier"}, expected: ""},
+		{poolMatchLabels: map[string]string{ipam.ClusterIPPoolGroupKey: "prod", ipam.RoleIPPoolSelectorKey: "tier=legacy"}, expected: "legacy"},
+		{poolMatchLabels: map[string]string{ipam.IPPoolSelectorKey: "tier", ipam.RoleIPPoolSelectorKey: ipam.ClusterIPPoolGroupKey + "=dev"}, expected: "dev"},
+		{poolMatchLabels: map[string]string{ipam.IPPoolSelectorKey: `{"matchExpressions":[{"key":"tier","operator":"Unknown"}]}`}, expectedErr: true},
+	}
+	for _, tt := range tests {
+		ipPool, err := m.GetAvailableIPPool(tt.poolMatchLabels, metav1.ObjectMeta{Namespace: "default"}, ipam.SelectionOptions{})
+		if tt.expectedErr {
+			assert.Error(t, err, tt.poolMatchLabels)
+			continue
+		}
+		assert.NoError(t, err)
+		if tt.expected == "" {
+			assert.Nil(t, ipPool, tt.poolMatchLabels)
+			continue
+		}
+		assert.Equal(t, tt.expected, ipPool.GetName(), tt.poolMatchLabels)
+	}
+}
+
+func TestGetAvailableIPPoolPolicy(t *testing.T) {
+	s := runtime.NewScheme()
+	assert.NoError(t, ipamv1.AddToScheme(s))
+
+	newPool := func(name, tier string, size int) *ipamv1.IPPool {
+		start := ipamv1.IPAddressStr(fmt.Sprintf("10.10.%d.1", size))
+		end := ipamv1.IPAddressStr(fmt.Sprintf("10.10.%d.%d", size, size))
+		return &ipamv1.IPPool{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", Labels: map[string]string{"tier": tier}},
+			Spec:       ipamv1.IPPoolSpec{Pools: []ipamv1.Pool{{Start: &start, End: &end}}},
+		}
+	}
+	newClaim := func(name, pool string) *ipamv1.IPClaim {
+		return &ipamv1.IPClaim{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default",
+				Labels: map[string]string{ipam.ClusterNamespaceKey: "default", ipam.ClusterNameKey: "cluster1"}},
+			Spec: ipamv1.IPClaimSpec{Pool: corev1.ObjectReference{Name: pool}},
+		}
+	}
+	//the first pool of the primary tier is exhausted
+	exhausted := newPool("a", "primary", 1)
+	exhausted.Status.Allocations = map[string]ipamv1.IPAddressStr{"other": *exhausted.Spec.Pools[0].Start}
+	owned := newClaim("vm-0", "c")
+	owned.OwnerReferences = []metav1.OwnerReference{{Kind: "Machine", Name: "vm", UID: "uid"}}
+	cli := fake.NewClientBuilder().WithScheme(s).WithObjects(
+		exhausted, newPool("b", "primary", 2), newPool("c", "primary", 8), newPool("d", "secondary", 8),
+		newClaim("b-0", "b"), owned,
+	).Build()
+	m := NewIpam(cli, cli, log.NullLogger{}, ipam.Options{})
+	clusterMeta := metav1.ObjectMeta{Name: "cluster1", Namespace: "default"}
+	owner := &capi.Machine{
+		TypeMeta:   metav1.TypeMeta{Kind: "Machine", APIVersion: capi.GroupVersion.String()},
+		ObjectMeta: metav1.ObjectMeta{Name: "vm", Namespace: "default", UID: "uid"},
+	}
+
+	tests := []struct {
+		selectors string
+		strategy  staticipv1.SelectionStrategy
+		owned     bool
+		expected  string
+	}{
+		{selectors: `[{"selector":{"matchLabels":{"tier":"primary"}}}]`, expected: "b"},
+		{selectors: `[{"selector":{"matchLabels":{"tier":"primary"}}}]`, strategy: staticipv1.MostFreeStrategy, expected: "c"},
+		{selectors: `[{"selector":{"matchLabels":{"tier":"primary"}}}]`, strategy: staticipv1.SpreadStrategy, expected: "b"},
+		{selectors: `[{"selector":{"matchLabels":{"tier":"primary"}}}]`, strategy: staticipv1.RoundRobinStrategy, expected: "b"},
+		{selectors: `[{"name":"a"},{"name":"missing"},{"name":"d"}]`, expected: "d"},
+		{selectors: `[{"name":"d"}]`, owned: true, expected: "d"},
+		{selectors: `[{"name":"b"},{"name":"c"}]`, owned: true, expected: "c"},
+		{selectors: `[{"selector":{"matchLabels":{"tier":"missing"}}}]`, expected: ""},
+	}
+	for _, tt := range tests {
+		selection := ipam.SelectionOptions{Strategy: tt.strategy}
+		assert.NoError(t, json.Unmarshal([]byte(tt.selectors), &selection.PoolSelectors))
+		if tt.owned {
+			selection.Owner = owner
+		}
+		ipPool, err := m.GetAvailableIPPool(map[string]string{}, clusterMeta, selection)
+		assert.NoError(t, err, tt.selectors)
+		if tt.expected == "" {
+			assert.Nil(t, ipPool, tt.selectors)
+			continue
+		}
+		assert.Equal(t, tt.expected, ipPool.GetName(), tt.selectors, tt.strategy)
+	}
+
+	_, err := m.GetAvailableIPPool(map[string]string{}, clusterMeta, ipam.SelectionOptions{
+		PoolSelectors: []staticipv1.PoolSelector{{Name: "b"}}, Strategy: "Unknown"})
+	assert.Error(t, err)
+}
+
+func TestGetAvailableIPPoolSpread(t *testing.T) {
+	s := runtime.NewScheme()
+	assert.NoError(t, ipamv1.AddToScheme(s))
+	assert.NoError(t, capi.AddToScheme(s))
+
+	start, end := ipamv1.IPAddressStr("10.10.100.20"), ipamv1.IPAddressStr("10.10.100.29")
+	newPool := func(name string) *ipamv1.IPPool {
+		return &ipamv1.IPPool{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", Labels: map[string]string{ipam.ClusterIPPoolGroupKey: "dev"}},
+			Spec:       ipamv1.IPPoolSpec{Pools: []ipamv1.Pool{{Start: &start, End: &end}}},
+		}
+	}
+	newClaim := func(name, pool string, groupLabels map[string]string) *ipamv1.IPClaim {
+		labels := map[string]string{ipam.ClusterNamespaceKey: "default", ipam.ClusterNameKey: "cluster1"}
+		for k, v := range groupLabels {
+			labels[k] = v
+		}
+		return &ipamv1.IPClaim{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", Labels: labels},
+			Spec:       ipamv1.IPClaimSpec{Pool: corev1.ObjectReference{Name: pool}},
+		}
+	}
+	md1 := map[string]string{capi.MachineDeploymentLabelName: "md1"}
+	md2 := map[string]string{capi.MachineDeploymentLabelName: "md2"}
+	controlPlane := map[string]string{capi.MachineControlPlaneLabelName: ""}
+	cli := fake.NewClientBuilder().WithScheme(s).WithObjects(
+		newPool("pool1"), newPool("pool2"), newPool("pool3"),
+		newClaim("md1-a", "pool1", md1), newClaim("md1-b", "pool2", md1),
+		newClaim("md2-a", "pool3", md2), newClaim("md2-b", "pool3", md2), newClaim("md2-c", "pool1", md2),
+		newClaim("cp-a", "pool1", controlPlane),
+	).Build()
+	//the IPClaims are counted from the api reader, the cache may not have seen the IPClaims just created
+	m := NewIpam(staleClaimsClient{cli}, cli, log.NullLogger{}, ipam.Options{})
+	clusterMeta := metav1.ObjectMeta{Name: "cluster1", Namespace: "default"}
+
+	tests := []struct {
+		groupLabels map[string]string
+		expected    string
+	}{
+		{groupLabels: md1, expected: "pool3"},
+		{groupLabels: md2, expected: "pool2"},
+		{groupLabels: controlPlane, expected: "pool2"},
+		{groupLabels: map[string]string{capi.MachineDeploymentLabelName: "md3"}, expected: "pool1"},
+		//the machines without a group are spread across the ip-pools for the cluster
+		{groupLabels: nil, expected: "pool2"},
+	}
+	for _, tt := range tests {
+		//the addresses are spread for the group of machines of the owner
+		selection := ipam.SelectionOptions{Strategy: staticipv1.SpreadStrategy,
+			Owner: &capi.Machine{ObjectMeta: metav1.ObjectMeta{Name: "machine", Namespace: "default", Labels: tt.groupLabels}}}
+		ipPool, err := m.GetAvailableIPPool(map[string]string{ipam.ClusterIPPoolGroupKey: "dev"}, clusterMeta, selection)
+		assert.NoError(t, err)
+		assert.Equal(t, tt.expected, ipPool.GetName(), tt.groupLabels)
+	}
+
+	//the IPClaims are labeled with the MachineDeployment of their owner
+	owner := &capi.Machine{
+		TypeMeta:   metav1.TypeMeta{Kind: "Machine", APIVersion: capi.GroupVersion.String()},
+		ObjectMeta: metav1.ObjectMeta{Name: "machine", Namespace: "default", Labels: map[string]string{capi.ClusterLabelName: "cluster1", capi.MachineDeploymentLabelName: "md1"}},
+	}
+	ipPool, err := m.GetAvailableIPPool(map[string]string{ipam.ClusterIPPoolNameKey: "pool3"}, clusterMeta, ipam.SelectionOptions{})
+	assert.NoError(t, err)
+	_, err = m.AllocateIP("machine-0", ipPool, owner, nil)
+	assert.NoError(t, err)
+	ic := &ipamv1.IPClaim{}
+	assert.NoError(t, cli.Get(context.Background(), types.NamespacedName{Namespace: "default", Name: "machine-0"}, ic))
+	assert.Equal(t, "md1", ic.Labels[capi.MachineDeploymentLabelName])
+}
+
+func TestReserveIPBlock(t *testing.T) {
+	s := runtime.NewScheme()
+	assert.NoError(t, ipamv1.AddToScheme(s))
+	assert.NoError(t, capi.AddToScheme(s))
+
+	start, end := ipamv1.IPAddressStr("10.10.100.20"), ipamv1.IPAddressStr("10.10.100.25")
+	pool1 := &ipamv1.IPPool{
+		ObjectMeta: metav1.ObjectMeta{Name: "pool1", Namespace: "default", Labels: map[string]string{ipam.ClusterIPPoolGroupKey: "dev"}},
+		Spec: ipamv1.IPPoolSpec{
+			Pools:          []ipamv1.Pool{{Start: &start, End: &end}},
+			PreAllocations: map[string]ipamv1.IPAddressStr{"exclusion-10.10.100.20": "10.10.100.20"},
+		},
+		Status: ipamv1.IPPoolStatus{Allocations: map[string]ipamv1.IPAddressStr{"other-0": "10.10.100.21"}},
+	}
+	pool2 := &ipamv1.IPPool{
+		ObjectMeta: metav1.ObjectMeta{Name: "pool2", Namespace: "default"},
+		Spec: ipamv1.IPPoolSpec{
+			Pools:          []ipamv1.Pool{{Start: &start, End: &end}},
+			PreAllocations: map[string]ipamv1.IPAddressStr{"ipblock/default/md1/10.10.100.20": "10.10.100.20"},
+		},
+	}
+	md := &capi.MachineDeployment{ObjectMeta: metav1.ObjectMeta{Name: "md1", Namespace: "default"}}
+	cli := fake.NewClientBuilder().WithScheme(s).WithObjects(pool1, pool2, md).Build()
+	clusterMeta := metav1.ObjectMeta{Name: "cluster1", Namespace: "default"}
+	block := client.ObjectKeyFromObject(md)
+	poolKey := client.ObjectKeyFromObject(pool1)
+
+	//the free addresses are reserved, and the block is released in the other ip-pools
+	assert.NoError(t, cli.Get(context.Background(), poolKey, pool1))
+	assert.NoError(t, ReserveIPBlock(cli, pool1, block, 3, clusterMeta, ""))
+	assert.NoError(t, cli.Get(context.Background(), poolKey, pool1))
+	assert.Equal(t, []string{"ipblock/default/md1/10.10.100.22", "ipblock/default/md1/10.10.100.23", "ipblock/default/md1/10.10.100.24"},
+		getIPBlockReservations(*pool1, block))
+	assert.NoError(t, cli.Get(context.Background(), client.ObjectKeyFromObject(pool2), pool2))
+	assert.Empty(t, pool2.Spec.PreAllocations)
+
+	//a machine of the MachineDeployment takes a reserved address, which metal3io allocates to its IPClaim
+	owner := &capi.Machine{
+		TypeMeta:   metav1.TypeMeta{Kind: "Machine", APIVersion: capi.GroupVersion.String()},
+		ObjectMeta: metav1.ObjectMeta{Name: "machine", Namespace: "default", Labels: map[string]string{capi.ClusterLabelName: "cluster1", capi.MachineDeploymentLabelName: "md1"}},
+	}
+	m := NewIpam(cli, cli, log.NullLogger{}, ipam.Options{})
+	ipPool, err := m.GetAvailableIPPool(map[string]string{ipam.ClusterIPPoolNameKey: "pool1"}, clusterMeta, ipam.SelectionOptions{})
+	assert.NoError(t, err)
+	_, err = m.AllocateIP("machine-0", ipPool, owner, nil)
+	assert.NoError(t, err)
+	ic := &ipamv1.IPClaim{}
+	assert.NoError(t, cli.Get(context.Background(), types.NamespacedName{Namespace: "default", Name: "machine-0"}, ic))
+	assert.Equal(t, "md1", ic.Labels[ipam.IPBlockKey])
+	assert.Contains(t, ic.Finalizers, ipam.IPBlockFinalizer)
+	assert.NoError(t, cli.Get(context.Background(), poolKey, pool1))
+	assert.Equal(t, ipamv1.IPAddressStr("10.10.100.22"), pool1.Spec.PreAllocations["machine-0"])
+	assert.Len(t, getIPBlockReservations(*pool1, block), 2)
+
+	//the block is shrunk to the size, along with the addresses allocated to the machines
+	assert.NoError(t, ReserveIPBlock(cli, pool1, block, 2, clusterMeta, ""))
+	assert.NoError(t, cli.Get(context.Background(), poolKey, pool1))
+	assert.Equal(t, []string{"ipblock/default/md1/10.10.100.23"}, getIPBlockReservations(*pool1, block))
+
+	//the ip-pool has not enough free addresses to grow the block
+	err = ReserveIPBlock(cli, pool1, block, 5, clusterMeta, "")
+	assert.True(t, ipam.IsIPBlockExhausted(err), err)
+	assert.NoError(t, cli.Get(context.Background(), poolKey, pool1))
+	assert.Len(t, getIPBlockReservations(*pool1, block), 3)
+
+	//the address is returned to the block once the IPClaim is released
+	assert.NoError(t, ReturnIPBlockAddress(cli, poolKey, ic))
+	assert.NoError(t, cli.Get(context.Background(), poolKey, pool1))
+	assert.NotContains(t, pool1.Spec.PreAllocations, "machine-0")
+	assert.Contains(t, pool1.Spec.PreAllocations, "ipblock/default/md1/10.10.100.22")
+
+	//the block of the deleted MachineDeployment is released
+	assert.NoError(t, ReleaseOrphanedIPBlocks(cli, pool1))
+	assert.Len(t, getIPBlockReservations(*pool1, block), 4)
+	assert.NoError(t, cli.Delete(context.Background(), md))
+	assert.NoError(t, ReleaseOrphanedIPBlocks(cli, pool1))
+	assert.NoError(t, cli.Get(context.Background(), poolKey, pool1))
+	assert.Equal(t, map[string]ipamv1.IPAddressStr{"exclusion-10.10.100.20": "10.10.100.20"}, pool1.Spec.PreAllocations)
+}
+
+func TestGetAvailableIPPoolIPBlock(t *testing.T) {
+	s := runtime.NewScheme()
+	assert.NoError(t, ipamv1.AddToScheme(s))
+	assert.NoError(t, capi.AddToScheme(s))
+
+	start, end := ipamv1.IPAddressStr("10.10.100.20"), ipamv1.IPAddressStr("10.10.100.21")
+	newPool := func(name string, preAllocations map[string]ipamv1.IPAddressStr) *ipamv1.IPPool {
+		return &ipamv1.IPPool{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", Labels: map[string]string{ipam.ClusterIPPoolGroupKey: "dev"}},
+			Spec:       ipamv1.IPPoolSpec{Pools: []ipamv1.Pool{{Start: &start, End: &end}}, PreAllocations: preAllocations},
+		}
+	}
+	//the block of md1 reserves all the addresses of pool2
+	cli := fake.NewClientBuilder().WithScheme(s).WithObjects(
+		newPool("pool1", nil),
+		newPool("pool2", map[string]ipamv1.IPAddressStr{"ipblock/default/md1/10.10.100.20": "10.10.100.20", "ipblock/default/md1/10.10.100.21": "10.10.100.21"}),
+	).Build()
+	m := NewIpam(cli, cli, log.NullLogger{}, ipam.Options{})
+	clusterMeta := metav1.ObjectMeta{Name: "cluster1", Namespace: "default"}
+
+	tests := []struct {
+		md        string
+		namespace string
+		expected  string
+	}{
+		{md: "md1", namespace: "default", expected: "pool2"},
+		{md: "md2", namespace: "default", expected: "pool1"},
+		{md: "md1", namespace: "other", expected: "pool1"},
+	}
+	for _, tt := range tests {
+		owner := &capi.Machine{ObjectMeta: metav1.ObjectMeta{Name: "vm", Namespace: tt.namespace,
+			Labels: map[string]string{capi.MachineDeploymentLabelName: tt.md}}}
+		ipPool, err := m.GetAvailableIPPool(map[string]string{ipam.ClusterIPPoolGroupKey: "dev"}, clusterMeta, ipam.SelectionOptions{Owner: owner})
+		assert.NoError(t, err)
+		assert.Equal(t, tt.expected, ipPool.GetName(), tt)
+	}
+}
+
+func TestPlanCapacity(t *testing.T) {
+	s := runtime.NewScheme()
+	assert.NoError(t, ipamv1.AddToScheme(s))
+
+	newPool := func(name, group string, end ipamv1.IPAddressStr) *ipamv1.IPPool {
+		start := ipamv1.IPAddressStr("10.10.100.20")
+		return &ipamv1.IPPool{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", Labels: map[string]string{ipam.ClusterIPPoolGroupKey: group}},
+			Spec:       ipamv1.IPPoolSpec{Pools: []ipamv1.Pool{{Start: &start, End: &end}}},
+		}
+	}
+	//one of the addresses of the control plane pool is allocated
+	controlPlane := newPool("control-plane", "cp", "10.10.100.23")
+	controlPlane.Status.Allocations = map[string]ipamv1.IPAddressStr{"vm-0": "10.10.100.20"}
+	cli := fake.NewClientBuilder().WithScheme(s).WithObjects(controlPlane, newPool("workers", "workers", "10.10.100.24")).Build()
+	m := NewIpam(cli, cli, log.NullLogger{}, ipam.Options{})
+
+	demands := []ipam.AddressDemand{
+		{Consumer: "VSphereCluster cluster", Addresses: 1, PoolMatchLabels: map[string]string{ipam.ClusterIPPoolGroupKey: "cp"}},
+		{Consumer: "KubeadmControlPlane cluster", Addresses: 4, PoolMatchLabels: map[string]string{ipam.ClusterIPPoolGroupKey: "cp"}},
+		{Consumer: "MachineDeployment md-0", Addresses: 5, PoolMatchLabels: map[string]string{ipam.ClusterIPPoolGroupKey: "workers"}},
+		{Consumer: "MachineDeployment md-1", Addresses: 2, PoolMatchLabels: map[string]string{ipam.ClusterIPPoolGroupKey: "storage"}},
+		{Consumer: "MachineDeployment md-2", Addresses: 0, PoolMatchLabels: map[string]string{ipam.ClusterIPPoolGroupKey: "storage"}},
+	}
+	plan, err := ipam.PlanCapacity(m, demands, metav1.ObjectMeta{Namespace: "default"})
+	assert.NoError(t, err)
+	assert.False(t, plan.Fits)
+	assert.Equal(t, []ipam.PoolCapacity{
+		{Namespace: "default", Name: "control-plane", Demand: 5, Free: 3, Fits: false, Consumers: []string{"VSphereCluster cluster", "KubeadmControlPlane cluster"}},
+		{Namespace: "default", Name: "workers", Demand: 5, Free: 5, Fits: true, Consumers: []string{"MachineDeployment md-0"}},
+	}, plan.Pools)
+	assert.Len(t, plan.Unresolved, 1)
+	assert.Equal(t, "MachineDeployment md-1", plan.Unresolved[0].Consumer)
+
+	//nothing is allocated by the plan
+	claims := &ipamv1.IPClaimList{}
+	assert.NoError(t, cli.List(context.Background(), claims))
+	assert.Empty(t, claims.Items)
+}
@@ -0,0 +1,63 @@
+package metal3io
+
+import (
+	"sort"
+	"strings"
+
+	ipamv1 "github.com/metal3-io/ip-address-manager/api/v1alpha1"
+	"github.com/spectrocloud/cluster-api-provider-vsphere-static-ip/pkg/ipam"
+)
+
+// filterTopologyIPPools filters the IPPools serving the topology of the machine, set in the match labels. The IPPools
+// matching more topology values are sorted first, so the machines draw from the IPPools of their placement.
+func filterTopologyIPPools(ipPools []ipamv1.IPPool, poolMatchLabels map[string]string) []ipamv1.IPPool {
+	matching := []ipamv1.IPPool{}
+	matches := map[string]int{}
+	for _, p := range ipPools {
+		count, ok := matchTopology(p, poolMatchLabels)
+		if !ok {
+			continue
+		}
+		matching = append(matching, p)
+		matches[p.Name] = count
+	}
+
+	sort.SliceStable(matching, func(i, j int) bool {
+		return matches[matching[i].Name] > matches[matching[j].Name]
+	})
+
+	return matching
+}
+
+// matchTopology counts the topology values of the machine served by the IPPool, the IPPool does not match if one of its
+// topology annotations does not include the value of the machine
+func matchTopology(ipPool ipamv1.IPPool, poolMatchLabels map[string]string) (int, bool) {
+	count := 0
+	for _, key := range ipam.TopologyKeys {
+		v := ipPool.Annotations[key]
+		if v == "" {
+			continue
+		}
+
+		value, ok := poolMatchLabels[key]
+		if !ok || value == "" {
+			continue
+		}
+		if !containsValue(v, value) {
+			return 0, false
+		}
+		count++
+	}
+
+	return count, true
+}
+
+func containsValue(values, value string) bool {
+	for _, v := range strings.Split(values, ",") {
+		if strings.TrimSpace(v) == value {
+			return true
+		}
+	}
+
+	return false
+}
@@ -1,10 +1,36 @@
 package metal3io
 
 import (
+	"context"
+
 	ipamv1 "github.com/metal3-io/ip-address-manager/api/v1alpha1"
 	"github.com/spectrocloud/cluster-api-provider-vsphere-static-ip/pkg/ipam"
+	"k8s.io/client-go/util/retry"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
+// patchIPPool updates the IPPool and patches it with an optimistic lock, as its pre-allocations and annotations are
+// written concurrently by the reconcilers. On a conflict, the IPPool is read again and updated from scratch. The update
+// returns false when there is nothing to patch.
+func patchIPPool(cli client.Client, ipPool *ipamv1.IPPool, update func(*ipamv1.IPPool) (bool, error)) error {
+	refresh := false
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		if refresh {
+			if err := cli.Get(context.Background(), client.ObjectKeyFromObject(ipPool), ipPool); err != nil {
+				return err
+			}
+		}
+		refresh = true
+
+		dataPatch := client.MergeFromWithOptions(ipPool.DeepCopy(), client.MergeFromWithOptimisticLock{})
+		changed, err := update(ipPool)
+		if err != nil || !changed {
+			return err
+		}
+		return cli.Patch(context.Background(), ipPool, dataPatch)
+	})
+}
+
 func convertToMetal3ioIP(mIP ipamv1.IPAddress, searchDomains []string) ipam.IPAddress {
 	return NewIP(mIP, searchDomains)
 }
@@ -0,0 +1,90 @@
+package ipam
+
+import (
+	"github.com/pkg/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// AddressDemand is the number of addresses needed by a consumer, a group of machines or a control plane endpoint, with
+// the match labels and the selection options of the ip-pool they are allocated from
+type AddressDemand struct {
+	Consumer        string
+	Addresses       int
+	PoolMatchLabels map[string]string
+	Selection       SelectionOptions
+}
+
+// PoolCapacity is the demand for the addresses of an ip-pool, against its free addresses
+type PoolCapacity struct {
+	Namespace string   `json:"namespace"`
+	Name      string   `json:"name"`
+	Demand    int      `json:"demand"`
+	Free      int      `json:"free"`
+	Fits      bool     `json:"fits"`
+	Consumers []string `json:"consumers"`
+}
+
+// UnresolvedDemand is a consumer for which no ip-pool is available
+type UnresolvedDemand struct {
+	Consumer  string `json:"consumer"`
+	Addresses int    `json:"addresses"`
+	Reason    string `json:"reason"`
+}
+
+// CapacityPlan is the demand for the addresses of each of the ip-pools selected for a set of consumers. It fits when
+// every consumer has an ip-pool and every ip-pool has enough free addresses.
+type CapacityPlan struct {
+	Fits       bool               `json:"fits"`
+	Pools      []PoolCapacity     `json:"pools"`
+	Unresolved []UnresolvedDemand `json:"unresolved,omitempty"`
+}
+
+// PlanCapacity selects the ip-pool of each demand as for its allocation, and sums the demands of each ip-pool against
+// its free addresses. No address is allocated, so the ip-pool selected for a consumer stands for all of its addresses.
+func PlanCapacity(m IPAddressManager, demands []AddressDemand, clusterMeta metav1.ObjectMeta) (*CapacityPlan, error) {
+	plan := &CapacityPlan{Fits: true, Pools: []PoolCapacity{}}
+	indexes := map[string]int{}
+
+	for _, demand := range demands {
+		if demand.Addresses == 0 {
+			continue
+		}
+
+		pool, err := m.GetAvailableIPPool(demand.PoolMatchLabels, clusterMeta, demand.Selection)
+		if err != nil && !IsAccessDenied(err) {
+			return nil, errors.Wrapf(err, "failed to get an available ip-pool for %s", demand.Consumer)
+		}
+		if pool == nil {
+			reason := "no matching ip-pool with free addresses"
+			if err != nil {
+				reason = err.Error()
+			}
+			plan.Unresolved = append(plan.Unresolved, UnresolvedDemand{Consumer: demand.Consumer, Addresses: demand.Addresses, Reason: reason})
+			plan.Fits = false
+			continue
+		}
+
+		key := pool.GetNamespace() + "/" + pool.GetName()
+		index, ok := indexes[key]
+		if !ok {
+			free, err := pool.GetFreeAddressCount()
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed to count the free addresses of ip-pool %s", pool.GetName())
+			}
+			plan.Pools = append(plan.Pools, PoolCapacity{Namespace: pool.GetNamespace(), Name: pool.GetName(), Free: free})
+			index = len(plan.Pools) - 1
+			indexes[key] = index
+		}
+		plan.Pools[index].Demand += demand.Addresses
+		plan.Pools[index].Consumers = append(plan.Pools[index].Consumers, demand.Consumer)
+	}
+
+	for i := range plan.Pools {
+		plan.Pools[i].Fits = plan.Pools[i].Demand <= plan.Pools[i].Free
+		if !plan.Pools[i].Fits {
+			plan.Fits = false
+		}
+	}
+
+	return plan, nil
+}
@@ -0,0 +1,81 @@
+package prober
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	defaultARPTable = "/proc/net/arp"
+
+	// ATF_COM, the flag of the completed entries in the arp table
+	arpFlagComplete = 0x2
+
+	arpPollInterval = 100 * time.Millisecond
+)
+
+// ARPProber probes the ipv4 address by resolving it in the arp table of the linux kernel. Only the addresses on the
+// subnets the controller is attached to can be probed.
+type ARPProber struct {
+	Timeout time.Duration
+
+	// ARPTable is the path of the kernel arp table
+	ARPTable string
+}
+
+func (p *ARPProber) Probe(ctx context.Context, address string) (bool, error) {
+	ip := net.ParseIP(address)
+	if ip == nil || ip.To4() == nil {
+		return false, fmt.Errorf("invalid IPv4 address %q", address)
+	}
+
+	//sending a datagram to the discard port of the address makes the kernel resolve it, the arp table is checked
+	//even if it can not be sent, as the address may already be resolved
+	if conn, err := net.Dial("udp4", net.JoinHostPort(address, "9")); err == nil {
+		_, _ = conn.Write([]byte{0})
+		conn.Close()
+	}
+
+	deadline := probeDeadline(ctx, p.Timeout)
+	for {
+		table, err := ioutil.ReadFile(p.ARPTable)
+		if err != nil {
+			return false, fmt.Errorf("failed to read arp table: %v", err)
+		}
+		if hasARPEntry(string(table), ip) {
+			return true, nil
+		}
+
+		if time.Now().Add(arpPollInterval).After(deadline) {
+			return false, nil
+		}
+		time.Sleep(arpPollInterval)
+	}
+}
+
+// hasARPEntry checks if the arp table has a completed entry for the ip address, the format of the table is
+//
+//	IP address       HW type     Flags       HW address            Mask     Device
+//	10.10.100.20     0x1         0x2         00:50:56:aa:bb:cc     *        eth0
+func hasARPEntry(table string, ip net.IP) bool {
+	for _, line := range strings.Split(table, "\n")[1:] {
+		fields := strings.Fields(line)
+		if len(fields) < 4 || !net.ParseIP(fields[0]).Equal(ip) {
+			continue
+		}
+
+		var flags int
+		if _, err := fmt.Sscanf(fields[2], "0x%x", &flags); err != nil {
+			continue
+		}
+		if flags&arpFlagComplete != 0 && fields[3] != "00:00:00:00:00:00" {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,34 @@
+package prober
+
+import (
+	"context"
+	"sync"
+)
+
+// FakeProber is an AddressProber for the tests, which reports the InUse addresses as in use
+type FakeProber struct {
+	InUse map[string]bool
+	Err   error
+
+	mu     sync.Mutex
+	probed []string
+}
+
+func (p *FakeProber) Probe(ctx context.Context, address string) (bool, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.probed = append(p.probed, address)
+	if p.Err != nil {
+		return false, p.Err
+	}
+	return p.InUse[address], nil
+}
+
+// Probed gets the probed addresses, in order
+func (p *FakeProber) Probed() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return append([]string{}, p.probed...)
+}
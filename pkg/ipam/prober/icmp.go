@@ -0,0 +1,80 @@
+package prober
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+const (
+	protocolICMP     = 1
+	protocolICMPIPv6 = 58
+)
+
+// ICMPProber probes the ip address with an ICMP echo request. The unprivileged ICMP datagram sockets are used, which
+// requires the group of the controller to be in the 'net.ipv4.ping_group_range' sysctl.
+type ICMPProber struct {
+	Timeout time.Duration
+}
+
+func (p *ICMPProber) Probe(ctx context.Context, address string) (bool, error) {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return false, fmt.Errorf("invalid IP address %q", address)
+	}
+
+	network, protocol := "udp4", protocolICMP
+	var echoType, replyType icmp.Type = ipv4.ICMPTypeEcho, ipv4.ICMPTypeEchoReply
+	if ip.To4() == nil {
+		network, protocol = "udp6", protocolICMPIPv6
+		echoType, replyType = ipv6.ICMPTypeEchoRequest, ipv6.ICMPTypeEchoReply
+	}
+
+	conn, err := icmp.ListenPacket(network, "")
+	if err != nil {
+		return false, fmt.Errorf("failed to open ICMP socket: %v", err)
+	}
+	defer conn.Close()
+
+	msg := icmp.Message{
+		Type: echoType,
+		Body: &icmp.Echo{ID: os.Getpid() & 0xffff, Seq: 1, Data: []byte("static-ip-probe")},
+	}
+	b, err := msg.Marshal(nil)
+	if err != nil {
+		return false, err
+	}
+	if _, err := conn.WriteTo(b, &net.UDPAddr{IP: ip}); err != nil {
+		return false, fmt.Errorf("failed to send ICMP echo to %s: %v", address, err)
+	}
+
+	if err := conn.SetReadDeadline(probeDeadline(ctx, p.Timeout)); err != nil {
+		return false, err
+	}
+
+	buf := make([]byte, 1500)
+	for {
+		n, peer, err := conn.ReadFrom(buf)
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				//no reply, the address is considered free
+				return false, nil
+			}
+			return false, err
+		}
+
+		reply, err := icmp.ParseMessage(protocol, buf[:n])
+		if err != nil || reply.Type != replyType {
+			continue
+		}
+		if udpAddr, ok := peer.(*net.UDPAddr); ok && udpAddr.IP.Equal(ip) {
+			return true, nil
+		}
+	}
+}
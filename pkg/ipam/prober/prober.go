@@ -0,0 +1,50 @@
+package prober
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// AddressProber checks if an ip address is already in use on the network, before it is assigned
+type AddressProber interface {
+	// probes the ip address, returns true if the address is in use
+	Probe(ctx context.Context, address string) (bool, error)
+}
+
+type ProberType string
+
+const (
+	ProberTypeNone ProberType = ""
+	ProberTypeICMP ProberType = "icmp"
+	ProberTypeARP  ProberType = "arp"
+
+	DefaultTimeout = time.Second
+)
+
+// NewAddressProber creates the address prober of the type, nil is returned if no prober type is set
+func NewAddressProber(proberType ProberType, timeout time.Duration) (AddressProber, error) {
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+
+	switch proberType {
+	case ProberTypeNone:
+		return nil, nil
+	case ProberTypeICMP:
+		return &ICMPProber{Timeout: timeout}, nil
+	case ProberTypeARP:
+		return &ARPProber{Timeout: timeout, ARPTable: defaultARPTable}, nil
+	default:
+		return nil, fmt.Errorf("unsupported address prober type %q", proberType)
+	}
+}
+
+// probeDeadline gets the deadline of the probe, the context deadline if earlier than the timeout
+func probeDeadline(ctx context.Context, timeout time.Duration) time.Time {
+	deadline := time.Now().Add(timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		return d
+	}
+	return deadline
+}
@@ -0,0 +1,69 @@
+package prober
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const arpTable = `IP address       HW type     Flags       HW address            Mask     Device
+10.10.100.20     0x1         0x2         00:50:56:aa:bb:cc     *        eth0
+10.10.100.21     0x1         0x0         00:00:00:00:00:00     *        eth0
+`
+
+func TestNewAddressProber(t *testing.T) {
+	p, err := NewAddressProber(ProberTypeNone, 0)
+	assert.NoError(t, err)
+	assert.Nil(t, p)
+
+	p, err = NewAddressProber(ProberTypeICMP, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, DefaultTimeout, p.(*ICMPProber).Timeout)
+
+	p, err = NewAddressProber(ProberTypeARP, 2*time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, 2*time.Second, p.(*ARPProber).Timeout)
+
+	_, err = NewAddressProber("tcp", 0)
+	assert.Error(t, err)
+}
+
+func TestHasARPEntry(t *testing.T) {
+	assert.True(t, hasARPEntry(arpTable, net.ParseIP("10.10.100.20")))
+	//incomplete entry, the address did not answer
+	assert.False(t, hasARPEntry(arpTable, net.ParseIP("10.10.100.21")))
+	assert.False(t, hasARPEntry(arpTable, net.ParseIP("10.10.100.22")))
+}
+
+func TestARPProber(t *testing.T) {
+	table := filepath.Join(t.TempDir(), "arp")
+	assert.NoError(t, ioutil.WriteFile(table, []byte(arpTable), 0600))
+	p := &ARPProber{Timeout: 200 * time.Millisecond, ARPTable: table}
+
+	inUse, err := p.Probe(context.Background(), "10.10.100.20")
+	assert.NoError(t, err)
+	assert.True(t, inUse)
+
+	inUse, err = p.Probe(context.Background(), "10.10.100.21")
+	assert.NoError(t, err)
+	assert.False(t, inUse)
+
+	_, err = p.Probe(context.Background(), "fd00::1")
+	assert.Error(t, err)
+}
+
+func TestFakeProber(t *testing.T) {
+	p := &FakeProber{InUse: map[string]bool{"10.10.100.20": true}}
+	inUse, err := p.Probe(context.Background(), "10.10.100.20")
+	assert.NoError(t, err)
+	assert.True(t, inUse)
+	inUse, err = p.Probe(context.Background(), "10.10.100.21")
+	assert.NoError(t, err)
+	assert.False(t, inUse)
+	assert.Equal(t, []string{"10.10.100.20", "10.10.100.21"}, p.Probed())
+}
@@ -0,0 +1,92 @@
+package kubevip
+
+import (
+	"bytes"
+	"text/template"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// ManifestPath is the path of the kube-vip static pod manifest on the control plane nodes
+	ManifestPath = "/etc/kubernetes/manifests/kube-vip.yaml"
+
+	DefaultImage     = "ghcr.io/kube-vip/kube-vip:v0.3.8"
+	DefaultInterface = "eth0"
+)
+
+var manifestTemplate = template.Must(template.New("kube-vip").Parse(`apiVersion: v1
+kind: Pod
+metadata:
+  name: kube-vip
+  namespace: kube-system
+spec:
+  containers:
+  - name: kube-vip
+    image: {{ .Image }}
+    imagePullPolicy: IfNotPresent
+    args:
+    - manager
+    env:
+    - name: cp_enable
+      value: "true"
+    - name: vip_arp
+      value: "true"
+    - name: vip_leaderelection
+      value: "true"
+    - name: vip_address
+      value: {{ .VIP }}
+    - name: vip_interface
+      value: {{ .Interface }}
+    - name: vip_leaseduration
+      value: "15"
+    - name: vip_renewdeadline
+      value: "10"
+    - name: vip_retryperiod
+      value: "2"
+    securityContext:
+      capabilities:
+        add:
+        - NET_ADMIN
+        - NET_RAW
+    volumeMounts:
+    - mountPath: /etc/kubernetes/admin.conf
+      name: kubeconfig
+  hostNetwork: true
+  hostAliases:
+  - hostnames:
+    - kubernetes
+    ip: 127.0.0.1
+  volumes:
+  - hostPath:
+      path: /etc/kubernetes/admin.conf
+      type: FileOrCreate
+    name: kubeconfig
+`))
+
+// Config holds the values rendered in the kube-vip static pod manifest
+type Config struct {
+	VIP       string
+	Interface string
+	Image     string
+}
+
+// RenderManifest renders the kube-vip static pod manifest for the control plane VIP
+func RenderManifest(config Config) (string, error) {
+	if config.VIP == "" {
+		return "", errors.New("VIP is required to render the kube-vip manifest")
+	}
+	if config.Interface == "" {
+		config.Interface = DefaultInterface
+	}
+	if config.Image == "" {
+		config.Image = DefaultImage
+	}
+
+	var buf bytes.Buffer
+	if err := manifestTemplate.Execute(&buf, config); err != nil {
+		return "", errors.Wrap(err, "failed to render the kube-vip manifest")
+	}
+
+	return buf.String(), nil
+}
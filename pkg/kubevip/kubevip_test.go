@@ -0,0 +1,18 @@
+package kubevip
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRenderManifest(t *testing.T) {
+	manifest, err := RenderManifest(Config{VIP: "10.10.100.22"})
+	assert.NoError(t, err)
+	assert.Contains(t, manifest, "value: 10.10.100.22")
+	assert.Contains(t, manifest, "value: "+DefaultInterface)
+	assert.Contains(t, manifest, "image: "+DefaultImage)
+
+	_, err = RenderManifest(Config{})
+	assert.Error(t, err)
+}
@@ -0,0 +1,43 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+var (
+	// QuotaUsage is the number of addresses allocated from an ip-pool to a consumer with a quota
+	QuotaUsage = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "capv_static_ip_quota_usage",
+		Help: "Number of addresses allocated from the ip-pool to the consumer with a quota",
+	}, []string{"pool_namespace", "pool", "scope", "consumer"})
+
+	// QuotaLimit is the quota of a consumer of an ip-pool
+	QuotaLimit = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "capv_static_ip_quota_limit",
+		Help: "Maximum number of addresses allocated from the ip-pool to the consumer",
+	}, []string{"pool_namespace", "pool", "scope", "consumer"})
+
+	// QuotaExceededTotal is the number of allocations rejected for exceeding a quota
+	QuotaExceededTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "capv_static_ip_quota_exceeded_total",
+		Help: "Number of address allocations rejected for exceeding the quota of the ip-pool",
+	}, []string{"pool_namespace", "pool", "scope", "consumer"})
+
+	// IPBlockSize is the number of addresses of the block of a MachineDeployment, for its replicas and its maximum surge
+	IPBlockSize = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "capv_static_ip_block_size",
+		Help: "Number of addresses of the block of the MachineDeployment in the ip-pool",
+	}, []string{"pool_namespace", "pool", "namespace", "machine_deployment"})
+
+	// IPBlockReserved is the number of addresses of the block of a MachineDeployment, either allocated or reserved
+	IPBlockReserved = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "capv_static_ip_block_reserved",
+		Help: "Number of addresses of the block of the MachineDeployment allocated or reserved in the ip-pool",
+	}, []string{"pool_namespace", "pool", "namespace", "machine_deployment"})
+)
+
+func init() {
+	//the metrics are served by the controller manager
+	metrics.Registry.MustRegister(QuotaUsage, QuotaLimit, QuotaExceededTotal, IPBlockSize, IPBlockReserved)
+}
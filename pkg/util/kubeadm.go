@@ -0,0 +1,67 @@
+package util
+
+import (
+	"net"
+	"regexp"
+	"strconv"
+
+	bootstrapv1 "sigs.k8s.io/cluster-api/bootstrap/kubeadm/api/v1beta1"
+)
+
+// matches the '{{ .VIP }}' placeholders in the KubeadmConfigSpec files
+var vipPlaceholder = regexp.MustCompile(`{{\s*\.VIP\s*}}`)
+
+// InjectControlPlaneEndpoint adds the VIP to the API server certSANs of the ClusterConfiguration, and replaces the VIP
+// placeholders in the files. The control plane endpoint itself is set with SetControlPlaneEndpoint, as the
+// KubeadmControlPlane webhook may reject its change. Returns true if the spec is updated.
+func InjectControlPlaneEndpoint(spec *bootstrapv1.KubeadmConfigSpec, vip string) bool {
+	if vip == "" {
+		return false
+	}
+
+	updated := false
+	if spec.ClusterConfiguration == nil || !containsString(spec.ClusterConfiguration.APIServer.CertSANs, vip) {
+		if spec.ClusterConfiguration == nil {
+			spec.ClusterConfiguration = &bootstrapv1.ClusterConfiguration{}
+		}
+		spec.ClusterConfiguration.APIServer.CertSANs = append(spec.ClusterConfiguration.APIServer.CertSANs, vip)
+		updated = true
+	}
+
+	for i := range spec.Files {
+		content := vipPlaceholder.ReplaceAllLiteralString(spec.Files[i].Content, vip)
+		if content != spec.Files[i].Content {
+			spec.Files[i].Content = content
+			updated = true
+		}
+	}
+
+	return updated
+}
+
+// SetControlPlaneEndpoint sets the control plane endpoint of the ClusterConfiguration to the VIP, with the port if set,
+// unless it is set already. Returns true if the spec is updated.
+func SetControlPlaneEndpoint(spec *bootstrapv1.KubeadmConfigSpec, vip string, port int32) bool {
+	if vip == "" || (spec.ClusterConfiguration != nil && spec.ClusterConfiguration.ControlPlaneEndpoint != "") {
+		return false
+	}
+
+	endpoint := vip
+	if port != 0 {
+		endpoint = net.JoinHostPort(vip, strconv.Itoa(int(port)))
+	}
+	if spec.ClusterConfiguration == nil {
+		spec.ClusterConfiguration = &bootstrapv1.ClusterConfiguration{}
+	}
+	spec.ClusterConfiguration.ControlPlaneEndpoint = endpoint
+	return true
+}
+
+func containsString(arr []string, s string) bool {
+	for _, a := range arr {
+		if a == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,51 @@
+package util
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	bootstrapv1 "sigs.k8s.io/cluster-api/bootstrap/kubeadm/api/v1beta1"
+)
+
+func TestInjectControlPlaneEndpoint(t *testing.T) {
+	spec := &bootstrapv1.KubeadmConfigSpec{
+		Files: []bootstrapv1.File{
+			{Path: "/etc/vip", Content: "address: {{ .VIP }}, {{.VIP}}"},
+			{Path: "/etc/other", Content: "no placeholder"},
+		},
+	}
+
+	assert.True(t, InjectControlPlaneEndpoint(spec, "10.10.100.22"))
+	assert.Empty(t, spec.ClusterConfiguration.ControlPlaneEndpoint)
+	assert.Equal(t, []string{"10.10.100.22"}, spec.ClusterConfiguration.APIServer.CertSANs)
+	assert.Equal(t, "address: 10.10.100.22, 10.10.100.22", spec.Files[0].Content)
+	assert.Equal(t, "no placeholder", spec.Files[1].Content)
+
+	//a second injection is a no-op
+	assert.False(t, InjectControlPlaneEndpoint(spec, "10.10.100.22"))
+
+	//the existing certSANs are kept
+	spec = &bootstrapv1.KubeadmConfigSpec{
+		ClusterConfiguration: &bootstrapv1.ClusterConfiguration{APIServer: bootstrapv1.APIServer{CertSANs: []string{"cp.example.com"}}},
+	}
+	assert.True(t, InjectControlPlaneEndpoint(spec, "10.10.100.22"))
+	assert.Equal(t, []string{"cp.example.com", "10.10.100.22"}, spec.ClusterConfiguration.APIServer.CertSANs)
+}
+
+func TestSetControlPlaneEndpoint(t *testing.T) {
+	spec := &bootstrapv1.KubeadmConfigSpec{}
+	assert.True(t, SetControlPlaneEndpoint(spec, "10.10.100.22", 6443))
+	assert.Equal(t, "10.10.100.22:6443", spec.ClusterConfiguration.ControlPlaneEndpoint)
+
+	//the endpoint set already is kept
+	assert.False(t, SetControlPlaneEndpoint(spec, "10.10.100.23", 6443))
+	assert.Equal(t, "10.10.100.22:6443", spec.ClusterConfiguration.ControlPlaneEndpoint)
+
+	//the port of kubeadm is used without a port
+	spec = &bootstrapv1.KubeadmConfigSpec{}
+	assert.True(t, SetControlPlaneEndpoint(spec, "fd00::22", 0))
+	assert.Equal(t, "fd00::22", spec.ClusterConfiguration.ControlPlaneEndpoint)
+	spec = &bootstrapv1.KubeadmConfigSpec{}
+	assert.True(t, SetControlPlaneEndpoint(spec, "fd00::22", 6443))
+	assert.Equal(t, "[fd00::22]:6443", spec.ClusterConfiguration.ControlPlaneEndpoint)
+}
@@ -1,14 +1,30 @@
 package util
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"net"
+	"strconv"
+	"strings"
 
+	"github.com/pkg/errors"
+	staticipv1 "github.com/spectrocloud/cluster-api-provider-vsphere-static-ip/api/v1alpha1"
 	"github.com/spectrocloud/cluster-api-provider-vsphere-static-ip/pkg/ipam"
 	corev1 "k8s.io/api/core/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8slabels "k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
-	infrav1 "sigs.k8s.io/cluster-api-provider-vsphere/api/v1alpha4"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation"
+	infrav1 "sigs.k8s.io/cluster-api-provider-vsphere/api/v1beta1"
+	capi "sigs.k8s.io/cluster-api/api/v1beta1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
 func IsMachineIPAllocationDHCP(devices []infrav1.NetworkDeviceSpec) bool {
@@ -22,6 +38,16 @@ func IsMachineIPAllocationDHCP(devices []infrav1.NetworkDeviceSpec) bool {
 	return isDHCP
 }
 
+func IsMachineIPAllocated(devices []infrav1.NetworkDeviceSpec) bool {
+	for _, dev := range devices {
+		if !IsDeviceIPAllocationDHCP(dev) && len(dev.IPAddrs) == 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
 func IsDeviceIPAllocationDHCP(device infrav1.NetworkDeviceSpec) bool {
 	if device.DHCP4 || device.DHCP6 {
 		return true
@@ -88,6 +114,295 @@ func GetSearchDomains(pool ipam.IPPool) []string {
 	return searchDomains
 }
 
+// GetMatchingPool gets the range of the ip pool the address falls in, if any
+func GetMatchingPool(ipPool ipam.IPPool, address string) ipam.Pool {
+	ip := net.ParseIP(address)
+	pools, err := ipPool.GetPools()
+	if ip == nil || err != nil {
+		return nil
+	}
+
+	for _, p := range pools {
+		start, end, subnet := "", "", ""
+		if s, err := p.GetStart(); err == nil && s != nil {
+			start = string(*s)
+		}
+		if e, err := p.GetEnd(); err == nil && e != nil {
+			end = string(*e)
+		}
+		if s, err := p.GetSubnet(); err == nil && s != nil {
+			subnet = string(*s)
+		}
+		if start == "" && end == "" && subnet == "" {
+			continue
+		}
+
+		if start != "" && compareIP(ip, net.ParseIP(start)) < 0 {
+			continue
+		}
+		if end != "" && compareIP(ip, net.ParseIP(end)) > 0 {
+			continue
+		}
+		if subnet != "" {
+			if _, n, err := net.ParseCIDR(subnet); err != nil || !n.Contains(ip) {
+				continue
+			}
+		}
+
+		return p
+	}
+
+	return nil
+}
+
+// GetIPConfig gets the mask, gateway and nameservers of the ip address. The values set in the range of the ip pool the
+// address falls in take precedence over the values of the ip address, and the nameservers of the ip pool.
+func GetIPConfig(ipPool ipam.IPPool, ip ipam.IPAddress) (int, string, []string) {
+	mask, gateway, nameservers := GetMask(ip), GetGateway(ip), GetDNSServers(ipPool)
+
+	p := GetMatchingPool(ipPool, GetAddress(ip))
+	if p == nil {
+		return mask, gateway, nameservers
+	}
+
+	if prefix, err := p.GetPrefix(); err == nil && prefix > 0 {
+		mask = prefix
+	}
+	if g, err := p.GetGateway(); err == nil && g != nil && *g != "" {
+		gateway = string(*g)
+	}
+	if dnsArr, err := p.GetDNSServers(); err == nil && len(dnsArr) > 0 {
+		nameservers = []string{}
+		for _, d := range dnsArr {
+			nameservers = append(nameservers, string(d))
+		}
+	}
+
+	return mask, gateway, nameservers
+}
+
+// compareIP compares the ip addresses, nil addresses are lower than any address
+func compareIP(a, b net.IP) int {
+	return bytes.Compare(a.To16(), b.To16())
+}
+
+// MaxExcludedAddresses limits the number of addresses the exclusions of an ip pool expand to
+const MaxExcludedAddresses = 4096
+
+// GetExcludedAddresses expands the comma-separated exclusions of an ip pool, set as addresses, CIDRs, or ranges in the
+// '<start>-<end>' format, to the list of excluded addresses
+func GetExcludedAddresses(value string) ([]string, error) {
+	addresses := []string{}
+	for _, exclusion := range strings.Split(value, ",") {
+		exclusion = strings.TrimSpace(exclusion)
+		if exclusion == "" {
+			continue
+		}
+
+		var start, end net.IP
+		switch {
+		case strings.Contains(exclusion, "/"):
+			ip, ipNet, err := net.ParseCIDR(exclusion)
+			if err != nil {
+				return nil, fmt.Errorf("invalid excluded CIDR %q", exclusion)
+			}
+			start, end = ip.Mask(ipNet.Mask), lastIP(ipNet)
+		case strings.Contains(exclusion, "-"):
+			r := strings.SplitN(exclusion, "-", 2)
+			start, end = net.ParseIP(strings.TrimSpace(r[0])), net.ParseIP(strings.TrimSpace(r[1]))
+			if start == nil || end == nil || (start.To4() == nil) != (end.To4() == nil) || compareIP(start, end) > 0 {
+				return nil, fmt.Errorf("invalid excluded range %q", exclusion)
+			}
+		default:
+			start = net.ParseIP(exclusion)
+			if start == nil {
+				return nil, fmt.Errorf("invalid excluded address %q", exclusion)
+			}
+			end = start
+		}
+
+		for ip := start; compareIP(ip, end) <= 0; ip = nextIP(ip) {
+			if len(addresses) == MaxExcludedAddresses {
+				return nil, fmt.Errorf("exclusions %q cover more than %d addresses", value, MaxExcludedAddresses)
+			}
+			addresses = append(addresses, ip.String())
+			if ip.Equal(end) {
+				break
+			}
+		}
+	}
+
+	return addresses, nil
+}
+
+// lastIP gets the last address of the network
+func lastIP(ipNet *net.IPNet) net.IP {
+	ip := make(net.IP, len(ipNet.IP))
+	for i := range ipNet.IP {
+		ip[i] = ipNet.IP[i] | ^ipNet.Mask[i]
+	}
+	return ip
+}
+
+// nextIP gets the address following the ip address
+func nextIP(ip net.IP) net.IP {
+	next := make(net.IP, len(ip))
+	copy(next, ip)
+	for i := len(next) - 1; i >= 0; i-- {
+		next[i]++
+		if next[i] != 0 {
+			break
+		}
+	}
+	return next
+}
+
+// GetRoutes converts the ip pool routes to the network device routes
+func GetRoutes(routes []ipam.Route) []infrav1.NetworkRouteSpec {
+	deviceRoutes := []infrav1.NetworkRouteSpec{}
+	for _, r := range routes {
+		deviceRoutes = append(deviceRoutes, infrav1.NetworkRouteSpec{To: r.To, Via: r.Via, Metric: r.Metric})
+	}
+	return deviceRoutes
+}
+
+// ValidateRoutes validates that the gateways of the routes are reachable on the subnet of the ip address in CIDR format
+func ValidateRoutes(ipCidr string, routes []infrav1.NetworkRouteSpec) error {
+	_, subnet, err := net.ParseCIDR(ipCidr)
+	if err != nil {
+		return fmt.Errorf("invalid IP address %q", ipCidr)
+	}
+
+	for _, r := range routes {
+		if _, _, err := net.ParseCIDR(r.To); err != nil && net.ParseIP(r.To) == nil {
+			return fmt.Errorf("invalid destination %q in route", r.To)
+		}
+		via := net.ParseIP(r.Via)
+		if via == nil {
+			return fmt.Errorf("invalid gateway %q in route to %s", r.Via, r.To)
+		}
+		if !subnet.Contains(via) {
+			return fmt.Errorf("gateway %s of route to %s is not reachable on subnet %s", r.Via, r.To, subnet)
+		}
+	}
+
+	return nil
+}
+
+// MergeDNSValues merges the nameservers or search domains of the ip pool and the network device, with the merge policy
+// defaulting to the ip pool values overriding the network device values
+func MergeDNSValues(policy ipam.DNSMergePolicy, poolValues, deviceValues []string) ([]string, error) {
+	switch policy {
+	case "", ipam.DNSMergePolicyPool:
+		if len(poolValues) > 0 {
+			return poolValues, nil
+		}
+		return deviceValues, nil
+	case ipam.DNSMergePolicyTemplate:
+		if len(deviceValues) > 0 {
+			return deviceValues, nil
+		}
+		return poolValues, nil
+	case ipam.DNSMergePolicyUnionPoolFirst:
+		return union(poolValues, deviceValues), nil
+	case ipam.DNSMergePolicyUnionTemplateFirst:
+		return union(deviceValues, poolValues), nil
+	default:
+		return nil, fmt.Errorf("invalid %s %q", ipam.DNSMergePolicyKey, policy)
+	}
+}
+
+func union(first, second []string) []string {
+	//nil when both are empty, so the unset device values are left unchanged
+	var values []string
+	seen := map[string]bool{}
+	for _, v := range append(append([]string{}, first...), second...) {
+		if !seen[v] {
+			seen[v] = true
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+// GetIPPoolMatchLabels gets the labels of the object used to select the ip-pool, along with its ip-pool selector
+// annotation, if set
+func GetIPPoolMatchLabels(obj metav1.Object) map[string]string {
+	labels := map[string]string{}
+	for k, v := range obj.GetLabels() {
+		labels[k] = v
+	}
+	if v := obj.GetAnnotations()[ipam.IPPoolSelectorKey]; v != "" {
+		labels[ipam.IPPoolSelectorKey] = v
+	}
+
+	return labels
+}
+
+// GetIPPoolSelectionOptions gets the options to select the ip-pool among the ones matching the labels of the object,
+// with its strategy annotation, if set
+func GetIPPoolSelectionOptions(obj metav1.Object) ipam.SelectionOptions {
+	return ipam.SelectionOptions{Strategy: staticipv1.SelectionStrategy(obj.GetAnnotations()[ipam.IPPoolStrategyKey])}
+}
+
+// GetMachineGroupLabels gets the labels of the machine identifying its MachineDeployment, or the control plane, which
+// the addresses are spread for
+func GetMachineGroupLabels(labels map[string]string) map[string]string {
+	if v, ok := labels[capi.MachineDeploymentLabelName]; ok && v != "" {
+		return map[string]string{capi.MachineDeploymentLabelName: v}
+	}
+	if _, ok := labels[capi.MachineControlPlaneLabelName]; ok {
+		return map[string]string{capi.MachineControlPlaneLabelName: ""}
+	}
+
+	return map[string]string{}
+}
+
+// GetIPClaimOwnerGroupLabels gets the labels identifying the MachineDeployment, or the control plane, of the owner of
+// the IPClaims, which is either a MachineDeployment or one of its machines
+func GetIPClaimOwnerGroupLabels(owner client.Object) map[string]string {
+	if md, ok := owner.(*capi.MachineDeployment); ok {
+		return map[string]string{capi.MachineDeploymentLabelName: md.Name}
+	}
+	if owner == nil {
+		return map[string]string{}
+	}
+
+	return GetMachineGroupLabels(owner.GetLabels())
+}
+
+// ParseIPPoolSelector parses the ip-pool selector, set in the label selector string format, or as a json
+// metav1.LabelSelector
+func ParseIPPoolSelector(value string) (k8slabels.Selector, error) {
+	if !strings.HasPrefix(strings.TrimSpace(value), "{") {
+		selector, err := k8slabels.Parse(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s %q: %v", ipam.IPPoolSelectorKey, value, err)
+		}
+		return selector, nil
+	}
+
+	labelSelector := &metav1.LabelSelector{}
+	if err := json.Unmarshal([]byte(value), labelSelector); err != nil {
+		return nil, fmt.Errorf("invalid %s %q: %v", ipam.IPPoolSelectorKey, value, err)
+	}
+	selector, err := metav1.LabelSelectorAsSelector(labelSelector)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s %q: %v", ipam.IPPoolSelectorKey, value, err)
+	}
+
+	return selector, nil
+}
+
+func HasIPPoolMatchLabels(labels map[string]string) bool {
+	for _, k := range ipam.IPPoolMatchLabelKeys {
+		if v, ok := labels[k]; ok && v != "" {
+			return true
+		}
+	}
+	return false
+}
+
 func IgnoreNotFound(err error) error {
 	if apierrors.IsNotFound(err) {
 		return nil
@@ -95,6 +410,16 @@ func IgnoreNotFound(err error) error {
 	return err
 }
 
+// GetNamespaceLabels gets the labels of the namespace, none if the namespace does not exist
+func GetNamespaceLabels(cli client.Reader, namespace string) (k8slabels.Set, error) {
+	ns := &corev1.Namespace{}
+	if err := cli.Get(context.Background(), types.NamespacedName{Name: namespace}, ns); IgnoreNotFound(err) != nil {
+		return nil, errors.Wrapf(err, "failed to get namespace %s", namespace)
+	}
+
+	return k8slabels.Set(ns.Labels), nil
+}
+
 func GetObjRef(obj runtime.Object) corev1.ObjectReference {
 	m, err := meta.Accessor(obj)
 	if err != nil {
@@ -114,3 +439,98 @@ func GetObjRef(obj runtime.Object) corev1.ObjectReference {
 func GetFormattedClaimName(ownerName string, deviceCount int) string {
 	return fmt.Sprintf("%s-%d", ownerName, deviceCount)
 }
+
+// GetClaimOwnerName gets the owner name used in the claim names, prefixed with the owner namespace when the ip pool is
+// in another namespace, for eg., a global ip pool, to keep the claim names of the namespaces unique
+func GetClaimOwnerName(owner metav1.Object, poolNamespace string) string {
+	if owner.GetNamespace() == "" || owner.GetNamespace() == poolNamespace {
+		return owner.GetName()
+	}
+	return fmt.Sprintf("%s.%s", owner.GetNamespace(), owner.GetName())
+}
+
+// GetFormattedDeviceClaimName gets the claim name of an address of the network device. The first address keeps the
+// device claim name, the '.' separator keeps the names of the additional addresses unique
+func GetFormattedDeviceClaimName(ownerName string, deviceCount, addressCount int) string {
+	if addressCount == 0 {
+		return GetFormattedClaimName(ownerName, deviceCount)
+	}
+	return fmt.Sprintf("%s.%d", GetFormattedClaimName(ownerName, deviceCount), addressCount)
+}
+
+// GetDeviceAddressCounts parses the comma-separated number of addresses per network device, set in the
+// 'addresses-per-device' annotation. A single value applies to all the network devices.
+func GetDeviceAddressCounts(annotations map[string]string, deviceCount int) ([]int, error) {
+	counts := make([]int, deviceCount)
+	for i := range counts {
+		counts[i] = 1
+	}
+
+	v, ok := annotations[ipam.AddressesPerDeviceKey]
+	if !ok || v == "" {
+		return counts, nil
+	}
+
+	values := strings.Split(v, ",")
+	if len(values) != 1 && len(values) != deviceCount {
+		return nil, fmt.Errorf("invalid %s %q, expected 1 or %d values", ipam.AddressesPerDeviceKey, v, deviceCount)
+	}
+
+	for i := range counts {
+		value := values[0]
+		if len(values) > 1 {
+			value = values[i]
+		}
+		count, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil || count < 1 {
+			return nil, fmt.Errorf("invalid %s %q, the number of addresses must be a positive integer", ipam.AddressesPerDeviceKey, v)
+		}
+		counts[i] = count
+	}
+
+	return counts, nil
+}
+
+// GetFormattedServiceClaimName gets the claim name of the LoadBalancer Service of a workload cluster. The names alone
+// are ambiguous once joined, for eg., cluster 'a' with namespace 'b-c' and cluster 'a-b' with namespace 'c', so a hash
+// of the cluster namespace, name and uid, and of the service namespace and name keeps the claim names unique. The ip
+// pool name is hashed too, so that the claim of a newly selected ip pool does not reuse the one of the previous pool.
+// The cluster and service names prefix is truncated for the claim name to be a valid object name, the hash keeps it
+// unique.
+func GetFormattedServiceClaimName(cluster metav1.Object, poolName, serviceNamespace, serviceName string) string {
+	sum := sha256.Sum256([]byte(strings.Join([]string{cluster.GetNamespace(), cluster.GetName(), string(cluster.GetUID()),
+		poolName, serviceNamespace, serviceName}, "/")))
+	hash := hex.EncodeToString(sum[:])[:10]
+
+	prefix := cluster.GetName() + "-" + serviceName
+	if maxLen := validation.DNS1123SubdomainMaxLength - len(hash) - 1; len(prefix) > maxLen {
+		//the truncated prefix must end with an alphanumeric character, as the names it is cut from
+		prefix = strings.TrimRight(prefix[:maxLen], "-.")
+	}
+	return fmt.Sprintf("%s-%s", prefix, hash)
+}
+
+func GetLoadBalancerIPPoolMatchLabels(clusterLabels map[string]string) map[string]string {
+	poolMatchLabels := map[string]string{}
+	if v, ok := clusterLabels[ipam.LoadBalancerIPPoolNameKey]; ok && v != "" {
+		poolMatchLabels[ipam.ClusterIPPoolNameKey] = v
+	}
+	if v, ok := clusterLabels[ipam.LoadBalancerIPPoolGroupKey]; ok && v != "" {
+		poolMatchLabels[ipam.ClusterIPPoolGroupKey] = v
+	}
+	return poolMatchLabels
+}
+
+func HasLoadBalancerIngressIP(svc *corev1.Service, ipAddr string) bool {
+	ingress := svc.Status.LoadBalancer.Ingress
+	return len(ingress) == 1 && ingress[0].IP == ipAddr
+}
+
+func IsOwnedByKind(meta metav1.ObjectMeta, kind string) bool {
+	for _, ref := range meta.GetOwnerReferences() {
+		if ref.Kind == kind {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,206 @@
+package util
+
+import (
+	"strings"
+	"testing"
+
+	staticipv1 "github.com/spectrocloud/cluster-api-provider-vsphere-static-ip/api/v1alpha1"
+	"github.com/spectrocloud/cluster-api-provider-vsphere-static-ip/pkg/ipam"
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	capi "sigs.k8s.io/cluster-api/api/v1beta1"
+)
+
+func TestGetDeviceAddressCounts(t *testing.T) {
+	tests := []struct {
+		name        string
+		annotation  *string
+		deviceCount int
+		expected    []int
+		expectErr   bool
+	}{
+		{name: "defaults to one address per device", deviceCount: 2, expected: []int{1, 1}},
+		{name: "single value applies to all devices", annotation: strPtr("2"), deviceCount: 2, expected: []int{2, 2}},
+		{name: "value per device", annotation: strPtr("2, 1"), deviceCount: 2, expected: []int{2, 1}},
+		{name: "mismatched number of values", annotation: strPtr("2,1,3"), deviceCount: 2, expectErr: true},
+		{name: "zero addresses", annotation: strPtr("0"), deviceCount: 1, expectErr: true},
+		{name: "not a number", annotation: strPtr("two"), deviceCount: 1, expectErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			annotations := map[string]string{}
+			if tt.annotation != nil {
+				annotations[ipam.AddressesPerDeviceKey] = *tt.annotation
+			}
+
+			counts, err := GetDeviceAddressCounts(annotations, tt.deviceCount)
+			if tt.expectErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, counts)
+		})
+	}
+}
+
+func TestGetFormattedDeviceClaimName(t *testing.T) {
+	assert.Equal(t, "vm-0", GetFormattedDeviceClaimName("vm", 0, 0))
+	assert.Equal(t, "vm-0.1", GetFormattedDeviceClaimName("vm", 0, 1))
+	assert.NotEqual(t, GetFormattedDeviceClaimName("vm", 0, 1), GetFormattedDeviceClaimName("vm-0", 1, 0))
+}
+
+func strPtr(s string) *string {
+	return &s
+}
+
+func TestValidateRoutes(t *testing.T) {
+	routes := GetRoutes([]ipam.Route{{To: "10.20.0.0/16", Via: "10.10.100.254", Metric: 100}})
+	assert.Equal(t, int32(100), routes[0].Metric)
+	assert.NoError(t, ValidateRoutes("10.10.100.20/24", routes))
+
+	//the gateway is not on the subnet of the device
+	assert.Error(t, ValidateRoutes("10.10.101.20/24", routes))
+
+	assert.Error(t, ValidateRoutes("10.10.100.20/24", GetRoutes([]ipam.Route{{To: "10.20.0.0/16", Via: "gateway"}})))
+	assert.Error(t, ValidateRoutes("10.10.100.20/24", GetRoutes([]ipam.Route{{To: "subnet", Via: "10.10.100.254"}})))
+}
+
+func TestMergeDNSValues(t *testing.T) {
+	pool := []string{"8.8.8.8", "1.1.1.1"}
+	template := []string{"1.2.3.4", "8.8.8.8"}
+
+	tests := []struct {
+		name         string
+		policy       ipam.DNSMergePolicy
+		poolValues   []string
+		deviceValues []string
+		expected     []string
+		expectErr    bool
+	}{
+		{name: "defaults to pool overrides template", poolValues: pool, deviceValues: template, expected: pool},
+		{name: "pool overrides template", policy: ipam.DNSMergePolicyPool, poolValues: pool, deviceValues: template, expected: pool},
+		{name: "pool without values keeps template", policy: ipam.DNSMergePolicyPool, deviceValues: template, expected: template},
+		{name: "template overrides pool", policy: ipam.DNSMergePolicyTemplate, poolValues: pool, deviceValues: template, expected: template},
+		{name: "template without values uses pool", policy: ipam.DNSMergePolicyTemplate, poolValues: pool, expected: pool},
+		{name: "union with pool first", policy: ipam.DNSMergePolicyUnionPoolFirst, poolValues: pool, deviceValues: template,
+			expected: []string{"8.8.8.8", "1.1.1.1", "1.2.3.4"}},
+		{name: "union with template first", policy: ipam.DNSMergePolicyUnionTemplateFirst, poolValues: pool, deviceValues: template,
+			expected: []string{"1.2.3.4", "8.8.8.8", "1.1.1.1"}},
+		{name: "union without values", policy: ipam.DNSMergePolicyUnionPoolFirst},
+		{name: "union without values keeps the empty template", policy: ipam.DNSMergePolicyUnionTemplateFirst, deviceValues: []string{}},
+		{name: "invalid policy", policy: "merge", poolValues: pool, deviceValues: template, expectErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			values, err := MergeDNSValues(tt.policy, tt.poolValues, tt.deviceValues)
+			if tt.expectErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, values)
+		})
+	}
+}
+
+func TestGetExcludedAddresses(t *testing.T) {
+	addresses, err := GetExcludedAddresses("10.10.100.1, 10.10.100.8/30,10.10.100.254-10.10.101.1")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"10.10.100.1", "10.10.100.8", "10.10.100.9", "10.10.100.10", "10.10.100.11",
+		"10.10.100.254", "10.10.100.255", "10.10.101.0", "10.10.101.1"}, addresses)
+
+	addresses, err = GetExcludedAddresses("fd00::fffe-fd00::1:0")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"fd00::fffe", "fd00::ffff", "fd00::1:0"}, addresses)
+
+	addresses, err = GetExcludedAddresses("")
+	assert.NoError(t, err)
+	assert.Empty(t, addresses)
+
+	for _, v := range []string{"10.10.100.300", "10.10.100.0/33", "10.10.100.20-10.10.100.10", "10.10.100.1-fd00::1", "10.0.0.0/8"} {
+		_, err := GetExcludedAddresses(v)
+		assert.Error(t, err, v)
+	}
+}
+
+func TestGetClaimOwnerName(t *testing.T) {
+	owner := &metav1.ObjectMeta{Name: "vm", Namespace: "tenant1"}
+	assert.Equal(t, "vm", GetClaimOwnerName(owner, "tenant1"))
+	assert.Equal(t, "tenant1.vm", GetClaimOwnerName(owner, "global"))
+	assert.Equal(t, "tenant1.vm-0.1", GetFormattedDeviceClaimName(GetClaimOwnerName(owner, "global"), 0, 1))
+}
+
+func TestGetFormattedServiceClaimName(t *testing.T) {
+	clusterA := &metav1.ObjectMeta{Name: "a", Namespace: "b-c", UID: "uid-a"}
+	clusterAB := &metav1.ObjectMeta{Name: "a-b", Namespace: "c", UID: "uid-ab"}
+	name := GetFormattedServiceClaimName(clusterA, "pool1", "default", "web")
+	assert.Regexp(t, "^a-web-[0-9a-f]{10}$", name)
+	assert.Equal(t, name, GetFormattedServiceClaimName(clusterA, "pool1", "default", "web"))
+
+	//the joined names of the clusters and services are ambiguous, the claim names are not
+	assert.NotEqual(t, GetFormattedServiceClaimName(clusterA, "pool1", "c", "svc"), GetFormattedServiceClaimName(clusterAB, "pool1", "c", "svc"))
+	assert.NotEqual(t, GetFormattedServiceClaimName(clusterA, "pool1", "x-y", "z"), GetFormattedServiceClaimName(clusterA, "pool1", "x", "y-z"))
+
+	//a cluster recreated with the same name gets new claims
+	recreated := clusterA.DeepCopy()
+	recreated.UID = "uid-a2"
+	assert.NotEqual(t, name, GetFormattedServiceClaimName(recreated, "pool1", "default", "web"))
+
+	//a newly selected ip pool gets new claims
+	assert.NotEqual(t, name, GetFormattedServiceClaimName(clusterA, "pool2", "default", "web"))
+
+	//the prefix of a long cluster name is truncated to a valid name, which stays unique
+	long := &metav1.ObjectMeta{Name: strings.Repeat("a", 241) + "." + strings.Repeat("b", 11), Namespace: "default", UID: "uid-long"}
+	name = GetFormattedServiceClaimName(long, "pool1", "default", "web")
+	assert.Empty(t, validation.IsDNS1123Subdomain(name))
+	assert.Regexp(t, "^a{241}-[0-9a-f]{10}$", name)
+	assert.NotEqual(t, name, GetFormattedServiceClaimName(long, "pool1", "default", "api"))
+}
+
+func TestGetIPPoolMatchLabels(t *testing.T) {
+	obj := &metav1.ObjectMeta{Labels: map[string]string{"app": "web"}}
+	assert.False(t, HasIPPoolMatchLabels(GetIPPoolMatchLabels(obj)))
+
+	obj.Annotations = map[string]string{ipam.IPPoolSelectorKey: "tier in (frontend)", ipam.IPPoolStrategyKey: "Spread"}
+	labels := GetIPPoolMatchLabels(obj)
+	assert.True(t, HasIPPoolMatchLabels(labels))
+	//the strategy is a selection option, not a match label
+	assert.NotContains(t, labels, ipam.IPPoolStrategyKey)
+	assert.Equal(t, staticipv1.SpreadStrategy, GetIPPoolSelectionOptions(obj).Strategy)
+	assert.Equal(t, "web", labels["app"])
+	assert.Equal(t, "tier in (frontend)", labels[ipam.IPPoolSelectorKey])
+	assert.Len(t, obj.Labels, 1)
+}
+
+func TestParseIPPoolSelector(t *testing.T) {
+	for _, v := range []string{"tier in (frontend),!legacy", `{"matchExpressions":[{"key":"tier","operator":"NotIn","values":["legacy"]}]}`} {
+		_, err := ParseIPPoolSelector(v)
+		assert.NoError(t, err, v)
+	}
+	for _, v := range []string{"tier in frontend", `{"matchExpressions":[{"key":"tier","operator":"In"}]}`, "{invalid"} {
+		_, err := ParseIPPoolSelector(v)
+		assert.Error(t, err, v)
+	}
+}
+
+func TestGetMachineGroupLabels(t *testing.T) {
+	assert.Equal(t, map[string]string{capi.MachineDeploymentLabelName: "md1"},
+		GetMachineGroupLabels(map[string]string{capi.ClusterLabelName: "cluster1", capi.MachineDeploymentLabelName: "md1"}))
+	assert.Equal(t, map[string]string{capi.MachineControlPlaneLabelName: ""},
+		GetMachineGroupLabels(map[string]string{capi.ClusterLabelName: "cluster1", capi.MachineControlPlaneLabelName: ""}))
+	assert.Empty(t, GetMachineGroupLabels(map[string]string{capi.ClusterLabelName: "cluster1"}))
+}
+
+func TestGetIPClaimOwnerGroupLabels(t *testing.T) {
+	md := &capi.MachineDeployment{ObjectMeta: metav1.ObjectMeta{Name: "md1", Namespace: "default"}}
+	assert.Equal(t, map[string]string{capi.MachineDeploymentLabelName: "md1"}, GetIPClaimOwnerGroupLabels(md))
+
+	machine := &capi.Machine{ObjectMeta: metav1.ObjectMeta{Name: "m1", Namespace: "default",
+		Labels: map[string]string{capi.MachineControlPlaneLabelName: ""}}}
+	assert.Equal(t, map[string]string{capi.MachineControlPlaneLabelName: ""}, GetIPClaimOwnerGroupLabels(machine))
+	assert.Empty(t, GetIPClaimOwnerGroupLabels(nil))
+}
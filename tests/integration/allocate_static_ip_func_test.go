@@ -6,21 +6,20 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 
 	ipamv1 "github.com/metal3-io/ip-address-manager/api/v1alpha1"
-	. "github.com/metal3-io/ip-address-manager/controllers"
 	"github.com/metal3-io/ip-address-manager/ipam"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 	. "github.com/spectrocloud/cluster-api-provider-vsphere-static-ip/controllers"
 	. "github.com/spectrocloud/cluster-api-provider-vsphere-static-ip/pkg/ipam"
+	"github.com/spectrocloud/cluster-api-provider-vsphere-static-ip/pkg/ipam/metal3io"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
-	capivsphere "sigs.k8s.io/cluster-api-provider-vsphere/api/v1alpha4"
-	infrav1 "sigs.k8s.io/cluster-api-provider-vsphere/api/v1alpha4"
-	capiv1alpha3 "sigs.k8s.io/cluster-api/api/v1alpha4"
-	kubeadmv3 "sigs.k8s.io/cluster-api/controlplane/kubeadm/api/v1alpha4"
+	capivsphere "sigs.k8s.io/cluster-api-provider-vsphere/api/v1beta1"
+	infrav1 "sigs.k8s.io/cluster-api-provider-vsphere/api/v1beta1"
+	capi "sigs.k8s.io/cluster-api/api/v1beta1"
+	kubeadmcontrolplane "sigs.k8s.io/cluster-api/controlplane/kubeadm/api/v1beta1"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
-	"sigs.k8s.io/controller-runtime/pkg/client/fake"
 )
 
 const (
@@ -36,25 +35,21 @@ func initVariables() {
 	err := os.Setenv("KUBECONFIG", "/tmp/kubeconfig-current")
 	Expect(err).To(Not(HaveOccurred()))
 
+	ipamFunc := metal3io.NewIpam(tm.GetClient(), tm.GetClient(), ctrl.Log.WithName("ipam"), Options{})
 	vSphereMachineReconciler = &VSphereMachineReconciler{
 		Client: tm.GetClient(),
 		Log:    ctrl.Log.WithName("controllers").WithName("VSphereMachine"),
+		IPAM:   ipamFunc,
 	}
 
 	vSphereClusterReconciler = &VSphereClusterReconciler{
 		Client: tm.GetClient(),
 		Log:    ctrl.Log.WithName("controllers").WithName("VSphereCluster"),
+		IPAM:   ipamFunc,
 	}
 
-	objects := []runtime.Object{}
-	objects = append(objects, tm.M3IpamIPPool)
-	objects = append(objects, tm.Cluster)
-	objects = append(objects, tm.Machine)
-	objects = append(objects, tm.KubeadmControlPlane)
-
-	ipamClient := fake.NewFakeClientWithScheme(setupScheme(), objects...)
-	m3ipamReconciler = &IPPoolReconciler{
-		Client:         ipamClient,
+	m3ipamReconciler = &M3IPPoolReconciler{
+		Client:         tm.GetClient(),
 		Log:            ctrl.Log.WithName("controllers").WithName("IPPool"),
 		ManagerFactory: ipam.NewManagerFactory(tm.GetClient()),
 	}
@@ -78,13 +73,13 @@ func initVariables() {
 
 func setupScheme() *runtime.Scheme {
 	s := runtime.NewScheme()
-	err := capiv1alpha3.AddToScheme(s)
+	err := capi.AddToScheme(s)
 	Expect(err).NotTo(HaveOccurred())
 	err = capivsphere.AddToScheme(s)
 	Expect(err).NotTo(HaveOccurred())
 	err = ipamv1.AddToScheme(s)
 	Expect(err).ToNot(HaveOccurred())
-	err = kubeadmv3.AddToScheme(s)
+	err = kubeadmcontrolplane.AddToScheme(s)
 	Expect(err).ToNot(HaveOccurred())
 
 	return s
@@ -343,10 +338,10 @@ func createNewVSphereMachine(name string, isMaster bool, template *infrav1.VSphe
 	}
 
 	//set 'clone-from-name' annotation, which is used to select the IPPool for the VM
-	vSphereMachine.SetAnnotations(map[string]string{capiv1alpha3.TemplateClonedFromNameAnnotation: template.Name})
+	vSphereMachine.SetAnnotations(map[string]string{capi.TemplateClonedFromNameAnnotation: template.Name})
 	vSphereMachine.SetOwnerReferences([]metav1.OwnerReference{
 		{
-			APIVersion: "cluster.x-k8s.io/v1alpha3",
+			APIVersion: capi.GroupVersion.String(),
 			Kind:       "Machine",
 			Name:       machine.Name,
 			UID:        machine.UID,
@@ -1,7 +1,6 @@
 package integration
 
 import (
-	. "github.com/metal3-io/ip-address-manager/controllers"
 	. "github.com/onsi/ginkgo"
 	. "github.com/spectrocloud/cluster-api-provider-vsphere-static-ip/controllers"
 	"k8s.io/klog/klogr"
@@ -12,7 +11,7 @@ import (
 var (
 	vSphereMachineReconciler *VSphereMachineReconciler
 	vSphereClusterReconciler *VSphereClusterReconciler
-	m3ipamReconciler         *IPPoolReconciler
+	m3ipamReconciler         *M3IPPoolReconciler
 	log                      = klogr.New().WithName("allocate-static-ip-test")
 	key                      client.ObjectKey
 	testClient               client.Client
@@ -0,0 +1,73 @@
+package integration
+
+import (
+	"context"
+
+	"github.com/go-logr/logr"
+	ipamv1 "github.com/metal3-io/ip-address-manager/api/v1alpha1"
+	"github.com/metal3-io/ip-address-manager/ipam"
+	"github.com/pkg/errors"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"sigs.k8s.io/cluster-api/util/patch"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// M3IPPoolReconciler runs the IPPool reconcile of the metal3 controller, allocating the IPAddresses of the IPClaims
+// with the metal3 IPPoolManager. The metal3 controllers package of the pinned release checks the paused Cluster with
+// the cluster-api v1alpha4 types, and does not build against v1beta1, so the Cluster of the IPPool is not checked.
+type M3IPPoolReconciler struct {
+	Client         client.Client
+	Log            logr.Logger
+	ManagerFactory ipam.ManagerFactory
+}
+
+func (r *M3IPPoolReconciler) Reconcile(ctx context.Context, req ctrl.Request) (_ ctrl.Result, rerr error) {
+	ipPool := &ipamv1.IPPool{}
+	if err := r.Client.Get(ctx, req.NamespacedName, ipPool); err != nil {
+		if apierrors.IsNotFound(err) {
+			return ctrl.Result{}, nil
+		}
+		return ctrl.Result{}, err
+	}
+
+	helper, err := patch.NewHelper(ipPool, r.Client)
+	if err != nil {
+		return ctrl.Result{}, errors.Wrap(err, "failed to init patch helper")
+	}
+	defer func() {
+		if err := helper.Patch(ctx, ipPool); err != nil && rerr == nil {
+			rerr = errors.Wrap(err, "failed to patch IPPool")
+		}
+	}()
+
+	ipPoolMgr, err := r.ManagerFactory.NewIPPoolManager(ipPool, r.Log.WithValues("ippool", req.NamespacedName))
+	if err != nil {
+		return ctrl.Result{}, errors.Wrap(err, "failed to create helper for managing the IP pool")
+	}
+
+	if !ipPool.DeletionTimestamp.IsZero() {
+		allocations, err := ipPoolMgr.UpdateAddresses(ctx)
+		if err != nil {
+			return checkRequeueError(err, "failed to delete the IPAddresses")
+		}
+		if allocations == 0 {
+			ipPoolMgr.UnsetFinalizer()
+		}
+		return ctrl.Result{}, nil
+	}
+
+	ipPoolMgr.SetFinalizer()
+	if _, err := ipPoolMgr.UpdateAddresses(ctx); err != nil {
+		return checkRequeueError(err, "failed to create the IPAddresses")
+	}
+
+	return ctrl.Result{}, nil
+}
+
+func checkRequeueError(err error, errMessage string) (ctrl.Result, error) {
+	if requeueErr, ok := errors.Cause(err).(ipam.HasRequeueAfterError); ok {
+		return ctrl.Result{Requeue: true, RequeueAfter: requeueErr.GetRequeueAfter()}, nil
+	}
+	return ctrl.Result{}, errors.Wrap(err, errMessage)
+}
@@ -10,9 +10,10 @@ import (
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
 	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
-	capivsphere "sigs.k8s.io/cluster-api-provider-vsphere/api/v1alpha4"
-	capiv1alpha4 "sigs.k8s.io/cluster-api/api/v1alpha4"
-	kubeadmv4 "sigs.k8s.io/cluster-api/controlplane/kubeadm/api/v1alpha4"
+	capivspherev1alpha3 "sigs.k8s.io/cluster-api-provider-vsphere/api/v1alpha3"
+	capivsphere "sigs.k8s.io/cluster-api-provider-vsphere/api/v1beta1"
+	capi "sigs.k8s.io/cluster-api/api/v1beta1"
+	kubeadmcontrolplane "sigs.k8s.io/cluster-api/controlplane/kubeadm/api/v1beta1"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/envtest"
 )
@@ -58,13 +59,15 @@ func (m *Manager) InitEnvironment(input InitEnvironmentInput) {
 	}
 
 	//+kubebuilder:scaffold:scheme
-	err := capiv1alpha4.AddToScheme(scheme.Scheme)
+	err := capi.AddToScheme(scheme.Scheme)
 	Expect(err).NotTo(HaveOccurred())
 	err = capivsphere.AddToScheme(scheme.Scheme)
 	Expect(err).NotTo(HaveOccurred())
+	err = capivspherev1alpha3.AddToScheme(scheme.Scheme)
+	Expect(err).NotTo(HaveOccurred())
 	err = ipam.AddToScheme(scheme.Scheme)
 	Expect(err).ToNot(HaveOccurred())
-	err = kubeadmv4.AddToScheme(scheme.Scheme)
+	err = kubeadmcontrolplane.AddToScheme(scheme.Scheme)
 	Expect(err).ToNot(HaveOccurred())
 
 	cfg, _ := testEnv.Start()